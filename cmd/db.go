@@ -7,17 +7,20 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/InfinityBotList/ibldev/internal/agents/dbstats"
+	"github.com/InfinityBotList/ibldev/internal/downloader"
+	"github.com/InfinityBotList/ibldev/internal/seeddata"
 	"github.com/infinitybotlist/eureka/crypto"
 	"github.com/infinitybotlist/iblfile"
-	"github.com/infinitybotlist/iblfile/encryptors/aes256"
 	"github.com/infinitybotlist/iblfile/encryptors/noencryption"
 	"github.com/infinitybotlist/iblfile/encryptors/pem"
 	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/spf13/cobra"
 )
 
@@ -33,6 +36,9 @@ type SeedMetadata struct {
 
 	// Restore table order
 	RestoreOrder []string `json:"r"`
+
+	// Format of the table data, one of pg/jsonl/csv. Empty (a2 seeds) means pg
+	DataFormat string `json:"f,omitempty"`
 }
 
 // Extensions needed. If a git repo is provided under the extensions key,
@@ -133,12 +139,7 @@ var newCmd = &cobra.Command{
 			})
 
 			// Create full backup of the database
-			var backupBuf = bytes.NewBuffer([]byte{})
-			backupCmd := exec.Command("pg_dump", "-Fc", "-d", dbName)
-			backupCmd.Env = os.Environ()
-			backupCmd.Stdout = backupBuf
-
-			err = backupCmd.Run()
+			backupBuf, stats, err := dumpWithStats(context.Background(), dbName, cmd.Flag("watermark-column").Value.String(), nil, "-Fc")
 
 			if err != nil {
 				fmt.Println("ERROR: Failed to create backup:", err)
@@ -147,6 +148,13 @@ var newCmd = &cobra.Command{
 
 			fmt.Println("NOTE: Created", backupBuf.Len(), "byte backup file")
 
+			err = writeStatsSection(file, stats)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to write stats to tar file:", err)
+				os.Exit(1)
+			}
+
 			err = file.WriteSection(backupBuf, "data")
 
 			if err != nil {
@@ -170,8 +178,9 @@ var newCmd = &cobra.Command{
 			}
 		case "seed":
 			dbName := cmd.Flag("db").Value.String()
+			fixturesDir := cmd.Flag("fixtures").Value.String()
 
-			if dbName == "" {
+			if dbName == "" && fixturesDir == "" {
 				fmt.Println("ERROR: You must specify a database to seed from!")
 				os.Exit(1)
 			}
@@ -179,10 +188,40 @@ var newCmd = &cobra.Command{
 			defaultDatabase := cmd.Flag("default-db").Value.String()
 
 			if defaultDatabase == "" {
+				if dbName == "" {
+					fmt.Println("ERROR: You must specify a default database with --default-db when building a seed from fixtures and migrations")
+					os.Exit(1)
+				}
+
 				fmt.Println("NOTE: No default database specified, will use database name as default")
 				defaultDatabase = dbName
 			}
 
+			sourceDatabase := dbName
+
+			// Tables of a fixtures seed come from the fixture files
+			var fixtureTables []string
+
+			if fixturesDir != "" {
+				if cmd.Flag("backup-tables").Value.String() != "" {
+					fmt.Println("ERROR: --backup-tables cannot be used with --fixtures")
+					os.Exit(1)
+				}
+
+				scratchName, tables, cleanup, err := buildFixturesDb(context.Background(), cmd, fixturesDir)
+
+				if err != nil {
+					fmt.Println("ERROR: Failed to build database from fixtures:", err)
+					os.Exit(1)
+				}
+
+				defer cleanup()
+
+				dbName = scratchName
+				fixtureTables = tables
+				sourceDatabase = "fixtures:" + fixturesDir
+			}
+
 			// Create a new file
 			file = iblfile.NewAutoEncryptedFile_FullFile(&noencryption.NoEncryptionSource{})
 
@@ -212,7 +251,9 @@ var newCmd = &cobra.Command{
 			var coreTables []string
 			backupTables := cmd.Flag("backup-tables").Value.String()
 
-			if backupTables != "" {
+			if fixtureTables != nil {
+				coreTables = fixtureTables
+			} else if backupTables != "" {
 				coreTables = strings.Split(backupTables, ",")
 
 				for i := range coreTables {
@@ -220,23 +261,53 @@ var newCmd = &cobra.Command{
 				}
 			}
 
+			dataFormat := cmd.Flag("data-format").Value.String()
+
+			if !slices.Contains(seeddata.Formats, dataFormat) {
+				fmt.Println("ERROR: Invalid data format:", dataFormat, "must be one of", strings.Join(seeddata.Formats, "/"))
+				os.Exit(1)
+			}
+
+			piiScanner := newPIIScanner(cmd)
+
+			stats := &dbstats.Manifest{
+				CollectedAt:     time.Now(),
+				WatermarkColumn: cmd.Flag("watermark-column").Value.String(),
+			}
+
 			for i, table := range coreTables {
 				fmt.Printf("Backing up table: [%d/%d] %s\n", i+1, len(coreTables), table)
 
 				// Create backup using pg_dump
-				var backupBuf = bytes.NewBuffer([]byte{})
-				backupCmd = exec.Command("pg_dump", "-Fc", "-d", dbName, "--data-only", "-t", table)
-
-				backupCmd.Env = os.Environ()
-				backupCmd.Stdout = backupBuf
-
-				err = backupCmd.Run()
+				backupBuf, tableStats, err := dumpWithStats(context.Background(), dbName, stats.WatermarkColumn, []string{table}, "-Fc", "--data-only", "-t", table)
 
 				if err != nil {
 					fmt.Println("ERROR: Failed to create backup:", err)
 					os.Exit(1)
 				}
 
+				stats.Merge(tableStats)
+
+				checkSectionForPII(piiScanner, "backup/"+table, backupBuf)
+
+				if seeddata.IsPlain(dataFormat) {
+					plainBuf, err := archiveToPlain(context.Background(), dbName, table, backupBuf, dataFormat)
+
+					if err != nil {
+						fmt.Println("ERROR: Failed to convert backup to", dataFormat+":", err)
+						os.Exit(1)
+					}
+
+					err = file.WriteSection(plainBuf, plainSeedSection(table))
+
+					if err != nil {
+						fmt.Println("ERROR: Failed to write table data to tar file:", err)
+						os.Exit(1)
+					}
+
+					continue
+				}
+
 				// Add to tar file
 				err = file.WriteSection(backupBuf, "backup/"+table)
 
@@ -246,14 +317,26 @@ var newCmd = &cobra.Command{
 				}
 			}
 
+			err = writeStatsSection(file, stats)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to write stats to tar file:", err)
+				os.Exit(1)
+			}
+
 			// Create seed meta file
 			seedMeta := SeedMetadata{
 				Nonce:           crypto.RandString(32),
 				DefaultDatabase: defaultDatabase,
-				SourceDatabase:  dbName,
+				SourceDatabase:  sourceDatabase,
 				RestoreOrder:    coreTables,
 			}
 
+			// Left unset for pg so the seed_meta of pg seeds stays readable by older versions
+			if seeddata.IsPlain(dataFormat) {
+				seedMeta.DataFormat = dataFormat
+			}
+
 			seedMetaBuf := bytes.NewBuffer([]byte{})
 			enc := json.NewEncoder(seedMetaBuf)
 			err = enc.Encode(seedMeta)
@@ -294,7 +377,11 @@ var newCmd = &cobra.Command{
 				os.Exit(1)
 			}
 
-			createSanitizedDb := func() (*bytes.Buffer, error) {
+			piiScanner := newPIIScanner(cmd)
+
+			watermarkColumn := cmd.Flag("watermark-column").Value.String()
+
+			createSanitizedDb := func() (*bytes.Buffer, *dbstats.Manifest, error) {
 				ctx := context.Background()
 
 				sanitizeCode := map[string]func(conn *pgx.Conn) error{
@@ -322,26 +409,21 @@ var newCmd = &cobra.Command{
 
 				fmt.Println("NOTE: Creating unsanitized database backup in memory")
 
-				var buf = bytes.NewBuffer([]byte{})
-				backupCmd := exec.Command("pg_dump", "-Fc", "-d", dbName)
-				backupCmd.Env = os.Environ()
-				backupCmd.Stdout = buf
-
-				err := backupCmd.Run()
+				buf, stats, err := dumpWithStats(ctx, dbName, watermarkColumn, nil, "-Fc")
 
 				if err != nil {
-					return nil, fmt.Errorf("failed to create db backup: %w", err)
+					return nil, nil, err
 				}
 
 				if buf.Len() == 0 {
-					return nil, fmt.Errorf("database backup is empty")
+					return nil, nil, fmt.Errorf("database backup is empty")
 				}
 
 				sanitizer, ok := sanitizeCode[dbName]
 
 				if !ok {
 					fmt.Println("WARNING: No sanitization task for database", dbName)
-					return buf, nil
+					return buf, stats, nil
 				}
 
 				// Make copy (__dbcopy) using created db backup on source server
@@ -352,7 +434,7 @@ var newCmd = &cobra.Command{
 				conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
 
 				if err != nil {
-					return nil, fmt.Errorf("failed to acquire database conn: %w", err)
+					return nil, nil, fmt.Errorf("failed to acquire database conn: %w", err)
 				}
 
 				sqlCmds := []string{
@@ -365,7 +447,7 @@ var newCmd = &cobra.Command{
 					_, err = conn.Exec(ctx, c)
 
 					if err != nil {
-						return nil, fmt.Errorf("failed to execute sql command: %w", err)
+						return nil, nil, fmt.Errorf("failed to execute sql command: %w", err)
 					}
 				}
 
@@ -378,7 +460,7 @@ var newCmd = &cobra.Command{
 				conn, err = pgx.Connect(ctx, "postgres:///"+copyDbName)
 
 				if err != nil {
-					return nil, fmt.Errorf("failed to acquire copy database conn: %w", err)
+					return nil, nil, fmt.Errorf("failed to acquire copy database conn: %w", err)
 				}
 
 				for _, ext := range extensions {
@@ -388,7 +470,7 @@ var newCmd = &cobra.Command{
 					_, err = conn.Exec(ctx, c)
 
 					if err != nil {
-						return nil, fmt.Errorf("failed to execute sql command: %w", err)
+						return nil, nil, fmt.Errorf("failed to execute sql command: %w", err)
 					}
 				}
 
@@ -407,7 +489,7 @@ var newCmd = &cobra.Command{
 				err = restoreCmd.Run()
 
 				if err != nil {
-					return nil, fmt.Errorf("failed to restore db backup: %w", err)
+					return nil, nil, fmt.Errorf("failed to restore db backup: %w", err)
 				}
 
 				defer func() {
@@ -450,13 +532,13 @@ var newCmd = &cobra.Command{
 				conn, err = pgx.Connect(ctx, "postgres:///"+copyDbName)
 
 				if err != nil {
-					return nil, fmt.Errorf("failed to acquire copy database conn: %w", err)
+					return nil, nil, fmt.Errorf("failed to acquire copy database conn: %w", err)
 				}
 
 				err = sanitizer(conn)
 
 				if err != nil {
-					return nil, fmt.Errorf("failed to sanitize database: %w", err)
+					return nil, nil, fmt.Errorf("failed to sanitize database: %w", err)
 				}
 
 				err = conn.Close(ctx)
@@ -467,22 +549,17 @@ var newCmd = &cobra.Command{
 
 				fmt.Println("NOTE: Creating sanitized database backup in memory")
 
-				var sanitizedBuf = bytes.NewBuffer([]byte{})
-				backupCmd = exec.Command("pg_dump", "-Fc", "-d", copyDbName)
-				backupCmd.Env = os.Environ()
-				backupCmd.Stdout = sanitizedBuf
-
-				err = backupCmd.Run()
+				sanitizedBuf, sanitizedStats, err := dumpWithStats(ctx, copyDbName, watermarkColumn, nil, "-Fc")
 
 				if err != nil {
-					return nil, fmt.Errorf("failed to create db backup: %w", err)
+					return nil, nil, err
 				}
 
 				if sanitizedBuf.Len() == 0 {
-					return nil, fmt.Errorf("sanitized database backup is empty")
+					return nil, nil, fmt.Errorf("sanitized database backup is empty")
 				}
 
-				return sanitizedBuf, nil
+				return sanitizedBuf, sanitizedStats, nil
 			}
 
 			pubKeyFile := cmd.Flag("pubkey").Value.String()
@@ -501,13 +578,22 @@ var newCmd = &cobra.Command{
 					PublicKey: pubKeyFileContents,
 				})
 
-				data, err := createSanitizedDb()
+				data, stats, err := createSanitizedDb()
 
 				if err != nil {
 					fmt.Println("ERROR: Failed to create sanitized database backup:", err)
 					os.Exit(1)
 				}
 
+				checkSectionForPII(piiScanner, "data", data)
+
+				err = writeStatsSection(file, stats)
+
+				if err != nil {
+					fmt.Println("ERROR: Failed to write stats to tar file:", err)
+					os.Exit(1)
+				}
+
 				file.WriteSection(data, "data")
 
 				if err != nil {
@@ -519,13 +605,22 @@ var newCmd = &cobra.Command{
 
 				file = iblfile.NewAutoEncryptedFile_FullFile(&noencryption.NoEncryptionSource{})
 
-				backupBuf, err := createSanitizedDb()
+				backupBuf, stats, err := createSanitizedDb()
 
 				if err != nil {
 					fmt.Println("ERROR: Failed to create sanitized database backup:", err)
 					os.Exit(1)
 				}
 
+				checkSectionForPII(piiScanner, "data", backupBuf)
+
+				err = writeStatsSection(file, stats)
+
+				if err != nil {
+					fmt.Println("ERROR: Failed to write stats to tar file:", err)
+					os.Exit(1)
+				}
+
 				err = file.WriteSection(backupBuf, "data")
 
 				if err != nil {
@@ -566,6 +661,10 @@ var newCmd = &cobra.Command{
 			FormatVersion: f.Version,
 		}
 
+		if fileType == "seed" {
+			metadata.FormatVersion = seedFormatVersion(f, cmd.Flag("data-format").Value.String())
+		}
+
 		enc := json.NewEncoder(mdBuf)
 
 		err = enc.Encode(metadata)
@@ -601,209 +700,141 @@ var newCmd = &cobra.Command{
 	},
 }
 
-var loadCmd = &cobra.Command{
-	Use:     "load FILENAME",
-	Example: "load <backup file>/<seed file>",
-	Short:   "Loads a file to the database. You must provide the path to a loadable db file. You can find a database seed for Infinity List on Popplio.",
-	Args:    cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		// Check args as to which file to use
-		filename := args[0]
+// Installs the extensions listed in the extensionsNeeded section of a file into dbName
+func tryHandlingExtensions(sections map[string]*bytes.Buffer, dbName string) error {
+	extSection, ok := sections["extensionsNeeded"]
 
-		// Open seed file
-		f, err := os.Open(filename)
+	if !ok {
+		// No extensions needed
+		fmt.Println("NOTE: No extensions needed")
+		return nil
+	}
 
-		if err != nil {
-			fmt.Println("ERROR: Failed to open seed file:", err)
-			os.Exit(1)
-		}
+	var extensions []Extension
 
-		defer f.Close()
+	err := json.NewDecoder(bytes.NewReader(extSection.Bytes())).Decode(&extensions)
 
-		fileType, err := iblfile.DeduceType(f, false)
+	if err != nil {
+		return fmt.Errorf("failed to decode extensions: %w", err)
+	}
 
-		if err != nil {
-			fmt.Println("ERROR: Failed to deduce file type:", err, ". Defaulting to NewAutoEncryptedFile_FullFile")
-		} else {
-			if fileType.Type != iblfile.DeducedTypeAutoEncryptedFile_FullFile {
-				fmt.Println("ERROR: Invalid file type:", fileType.Type.String(), ". Try using the `iblcli upgrade` command to upgrade the file")
-				os.Exit(1)
-			}
-		}
-
-		// Seek to first bit
-		_, err = f.Seek(0, 0)
+	conn, err := pgx.Connect(context.Background(), "postgres:///"+dbName)
 
-		if err != nil {
-			panic(err)
-		}
+	if err != nil {
+		return fmt.Errorf("failed to acquire database conn: %w", err)
+	}
 
-		// Load the file itself
-		var file *iblfile.AutoEncryptedFile_FullFile
+	defer conn.Close(context.Background())
 
-		block, err := iblfile.QuickBlockParser(f)
+	for _, ext := range extensions {
+		// Check if extension exists on postgres
+		_, err = conn.Exec(context.Background(), "CREATE EXTENSION IF NOT EXISTS \""+ext.Name+"\"")
 
-		if err != nil {
-			panic("error reading metadata: " + err.Error())
+		if err == nil {
+			continue
 		}
 
-		pemEnc := pem.PemEncryptedSource{}
-		aes256Enc := aes256.AES256Source{}
-		noencryptionEnc := noencryption.NoEncryptionSource{}
-		if string(block.Encryptor) == pemEnc.ID() {
-			privKeyFile := cmd.Flag("priv-key").Value.String()
-
-			if privKeyFile == "" {
-				fmt.Println("ERROR: You must specify a private key to decrypt the seed with!")
-				os.Exit(1)
+		if strings.Contains(err.Error(), "not available") {
+			if os.Getenv("SKIP_EXTENSION_INSTALL") == "true" {
+				return fmt.Errorf("extension %s cannot be loaded and SKIP_EXTENSION_INSTALL is set: %w", ext.Name, err)
 			}
 
-			privKeyFileContents, err := os.ReadFile(privKeyFile)
+			fmt.Println("WARNING: Extension", ext.Name, "cannot be loaded:", err)
 
-			if err != nil {
-				fmt.Println("ERROR: Failed to read private key file:", err)
-				os.Exit(1)
-			}
+			fmt.Println("Trying to install it from the git repo:", ext.GitUrl)
+
+			gitCmd := exec.Command("git", "clone", ext.GitUrl, ext.Name)
 
-			pemEnc.PrivateKey = privKeyFileContents
-			file, err = iblfile.OpenAutoEncryptedFile_FullFile(f, &pemEnc)
+			gitCmd.Stdout = os.Stdout
+			gitCmd.Stderr = os.Stderr
+			gitCmd.Env = os.Environ()
+
+			err = gitCmd.Run()
 
 			if err != nil {
-				fmt.Println("ERROR: Failed to open auto encrypted file:", err)
-				os.Exit(1)
+				return fmt.Errorf("failed to clone git repo: %w", err)
 			}
-		} else if string(block.Encryptor) == aes256Enc.ID() {
-			encKey := cmd.Flag("enc-key").Value.String()
 
-			if encKey == "" {
-				fmt.Println("ERROR: You must specify an encryption key to decrypt the seed with!")
-				os.Exit(1)
+			var cmds = [][]string{
+				{"gmake"},
+				{"gmake", "install"},
+				{"gmake", "installcheck"},
 			}
 
-			aes256Enc.EncryptionKey = encKey
-			file, err = iblfile.OpenAutoEncryptedFile_FullFile(f, &aes256Enc)
+			pwd, err := os.Getwd()
 
 			if err != nil {
-				fmt.Println("ERROR: Failed to open auto encrypted file:", err)
-				os.Exit(1)
+				return fmt.Errorf("failed to get pwd: %w", err)
 			}
-		} else if string(block.Encryptor) == noencryptionEnc.ID() {
-			file, err = iblfile.OpenAutoEncryptedFile_FullFile(f, &noencryption.NoEncryptionSource{})
 
-			if err != nil {
-				fmt.Println("ERROR: Failed to open auto encrypted file:", err)
-				os.Exit(1)
-			}
-		} else {
-			fmt.Println("ERROR: Invalid file type:", fileType.Type.String(), ". Try using the `iblcli upgrade` command to upgrade the file")
-			os.Exit(1)
-		}
+			for _, c := range cmds {
+				cmd := exec.Command(c[0], c[1:]...)
 
-		if err != nil {
-			fmt.Println("ERROR: Failed to open file:", err)
-			os.Exit(1)
-		}
+				cmd.Dir = pwd + "/" + ext.Name
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				cmd.Env = os.Environ()
 
-		sections, err := file.Sections()
+				err = cmd.Run()
 
-		if err != nil {
-			fmt.Println("ERROR: Failed to get sections:", err)
-			os.Exit(1)
+				if err != nil {
+					return fmt.Errorf("failed to execute command '%s': %w", c, err)
+				}
+			}
 		}
 
-		meta, err := iblfile.ParseMetadata(sections)
-
 		if err != nil {
-			fmt.Println("ERROR: Failed to parse metadata:", err)
-			os.Exit(1)
+			return fmt.Errorf("failed to create extension: %w", err)
 		}
+	}
 
-		tryHandlingExtensions := func(sections map[string]*bytes.Buffer, dbName string) error {
-			extSection, ok := sections["extensionsNeeded"]
-
-			if !ok {
-				// No extensions needed
-				fmt.Println("NOTE: No extensions needed")
-				return nil
-			}
-
-			var extensions []Extension
+	return nil
+}
 
-			err := json.NewDecoder(extSection).Decode(&extensions)
+var loadCmd = &cobra.Command{
+	Use:     "load FILENAME",
+	Example: "load <backup file>/<seed file>/<seed url>",
+	Short:   "Loads a file to the database. You must provide the path or URL to a loadable db file. You can find a database seed for Infinity List on Popplio.",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Check args as to which file to use
+		filename := args[0]
 
-			if err != nil {
-				return fmt.Errorf("failed to decode extensions: %w", err)
-			}
+		if downloader.IsURL(filename) {
+			fmt.Println("Downloading", filename)
 
-			conn, err := pgx.Connect(context.Background(), "postgres:///"+dbName)
+			path, err := downloader.DownloadFileCached(filename)
 
 			if err != nil {
-				return fmt.Errorf("failed to acquire database conn: %w", err)
+				fmt.Println("ERROR: Failed to download file:", err)
+				os.Exit(1)
 			}
 
-			for _, ext := range extensions {
-				// Check if extension exists on postgres
-				_, err = conn.Exec(context.Background(), "CREATE EXTENSION IF NOT EXISTS \""+ext.Name+"\"")
-
-				if err == nil {
-					continue
-				}
-
-				if strings.Contains(err.Error(), "not available") {
-					fmt.Println("ERROR: Extension", ext.Name, "cannot be loaded:", err)
-
-					if os.Getenv("SKIP_EXTENSION_INSTALL") == "true" {
-						os.Exit(1)
-					}
-
-					fmt.Println("Trying to install it from the git repo:", ext.GitUrl)
-
-					gitCmd := exec.Command("git", "clone", ext.GitUrl, ext.Name)
-
-					gitCmd.Stdout = os.Stdout
-					gitCmd.Stderr = os.Stderr
-					gitCmd.Env = os.Environ()
-
-					err = gitCmd.Run()
-
-					if err != nil {
-						return fmt.Errorf("failed to clone git repo: %w", err)
-					}
-
-					var cmds = [][]string{
-						{"gmake"},
-						{"gmake", "install"},
-						{"gmake", "installcheck"},
-					}
+			filename = path
+		}
 
-					pwd, err := os.Getwd()
+		// Open seed file
+		f, err := os.Open(filename)
 
-					if err != nil {
-						return fmt.Errorf("failed to get pwd: %w", err)
-					}
+		if err != nil {
+			fmt.Println("ERROR: Failed to open seed file:", err)
+			os.Exit(1)
+		}
 
-					for _, c := range cmds {
-						cmd := exec.Command(c[0], c[1:]...)
+		defer f.Close()
 
-						cmd.Dir = pwd + "/" + ext.Name
-						cmd.Stdout = os.Stdout
-						cmd.Stderr = os.Stderr
-						cmd.Env = os.Environ()
+		sections, meta, err := openDbFile(cmd, f)
 
-						err = cmd.Run()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
 
-						if err != nil {
-							return fmt.Errorf("failed to execute command '%s': %w", c, err)
-						}
-					}
-				}
+		ropts := selectiveRestoreOptsFromFlags(cmd)
 
-				if err != nil {
-					return fmt.Errorf("failed to create extension: %w", err)
-				}
-			}
-
-			return nil
+		if ropts.IsSet() && meta.Type != "db.backup" {
+			fmt.Println("ERROR: Selective restore is only supported for db.backup files")
+			os.Exit(1)
 		}
 
 		switch meta.Type {
@@ -829,6 +860,18 @@ var loadCmd = &cobra.Command{
 				os.Exit(1)
 			}
 
+			if ropts.IsSet() {
+				err = selectiveRestore(context.Background(), sections, data, dbName, ropts)
+
+				if err != nil {
+					fmt.Println("ERROR: Failed to restore database backup with error:", err)
+					os.Exit(1)
+				}
+
+				fmt.Println("NOTE: Selected objects restored successfully!")
+				return
+			}
+
 			// Restore dump
 			backupCmd := exec.Command("pg_restore", "-d", dbName)
 
@@ -844,6 +887,17 @@ var loadCmd = &cobra.Command{
 				os.Exit(1)
 			}
 
+			err = recordLoad(context.Background(), dbName, SeedInfo{
+				CreatedAt: meta.CreatedAt,
+				FileType:  meta.Type,
+			})
+
+			if err != nil {
+				fmt.Println("WARNING: Failed to record load info:", err)
+			}
+
+			checkLoadedStats(cmd, sections, dbName)
+
 			fmt.Println("NOTE: Backup restored successfully!")
 		case "db.seed":
 			dbName := cmd.Flag("db").Value.String()
@@ -910,14 +964,12 @@ var loadCmd = &cobra.Command{
 				if err != nil {
 					fmt.Println("ERROR: Failed to acquire iconn:", err, "Ignoring...")
 				} else {
-					var nonce string
-
-					err = iconn.QueryRow(ctx, "SELECT nonce FROM seed_info").Scan(&nonce)
+					info, err := latestSeedInfo(ctx, iconn)
 
 					if err != nil {
 						fmt.Println("ERROR: Failed to check seed_info table:", err, ". Ignoring...")
 					} else {
-						if nonce == smeta.Nonce {
+						if info.Nonce == smeta.Nonce {
 							fmt.Print("\n\nYou are on the latest seed already!")
 							os.Exit(0)
 						}
@@ -962,6 +1014,17 @@ var loadCmd = &cobra.Command{
 			for i, table := range smeta.RestoreOrder {
 				fmt.Printf("Restoring table: [%d/%d] %s\n", i+1, len(smeta.RestoreOrder), table)
 
+				if seeddata.IsPlain(smeta.DataFormat) {
+					err = restorePlainSeedTable(ctx, sections, smeta.DataFormat, dbName, table)
+
+					if err != nil {
+						fmt.Println("ERROR: Failed to restore table", table+":", err)
+						os.Exit(1)
+					}
+
+					continue
+				}
+
 				backupBuf, ok := sections["backup/"+table]
 
 				if !ok {
@@ -984,26 +1047,27 @@ var loadCmd = &cobra.Command{
 				}
 			}
 
-			conn, err = pgx.Connect(ctx, "postgres:///"+dbName)
-
-			if err != nil {
-				fmt.Println("ERROR: Failed to acquire database pool for newly created database:", err)
-				os.Exit(1)
+			info := SeedInfo{
+				Nonce:          smeta.Nonce,
+				CreatedAt:      meta.CreatedAt,
+				FileType:       meta.Type,
+				SourceDatabase: smeta.SourceDatabase,
 			}
 
-			_, err = conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS seed_info (nonce TEXT NOT NULL, created_at TIMESTAMPTZ NOT NULL)")
+			err = recordSeedInfo(ctx, dbName, info)
 
 			if err != nil {
-				fmt.Println("ERROR: Failed to create seed_info table:", err)
+				fmt.Println("ERROR: Failed to record seed info:", err)
 				os.Exit(1)
 			}
 
-			_, err = conn.Exec(ctx, "INSERT INTO seed_info (nonce, created_at) VALUES ($1, $2)", smeta.Nonce, meta.CreatedAt)
+			err = recordLoad(ctx, dbName, info)
 
 			if err != nil {
-				fmt.Println("ERROR: Failed to insert seed info:", err)
-				os.Exit(1)
+				fmt.Println("WARNING: Failed to record load info:", err)
 			}
+
+			checkLoadedStats(cmd, sections, dbName)
 		case "db.staging":
 			dbName := cmd.Flag("db").Value.String()
 
@@ -1088,6 +1152,110 @@ var loadCmd = &cobra.Command{
 				fmt.Println("ERROR: Failed to restore database backup to prodmarker with error:", err)
 				os.Exit(1)
 			}
+
+			// Recorded outside of the restored databases so a staging reset keeps it
+			err = recordLoad(ctx, dbName, SeedInfo{
+				CreatedAt: meta.CreatedAt,
+				FileType:  meta.Type,
+			})
+
+			if err != nil {
+				fmt.Println("WARNING: Failed to record load info:", err)
+			}
+
+			checkLoadedStats(cmd, sections, dbName)
+		case "db.snapshot":
+			dbName := cmd.Flag("db").Value.String()
+
+			var smeta SnapshotMetadata
+
+			snapshotMetaBuf, ok := sections["snapshot_meta"]
+
+			if !ok {
+				fmt.Println("ERROR: Snapshot file is corrupt [no snapshot meta]")
+				os.Exit(1)
+			}
+
+			err = json.NewDecoder(snapshotMetaBuf).Decode(&smeta)
+
+			if err != nil {
+				fmt.Println("ERROR: Snapshot file is corrupt [invalid snapshot meta]")
+				os.Exit(1)
+			}
+
+			if dbName == "" {
+				fmt.Println("NOTE: No database specified, restoring to", smeta.SourceDatabase)
+				dbName = smeta.SourceDatabase
+			}
+
+			data, ok := sections["data"]
+
+			if !ok {
+				fmt.Println("ERROR: Snapshot file is corrupt [no data]")
+				os.Exit(1)
+			}
+
+			ctx := context.Background()
+
+			conn, err := pgx.Connect(ctx, "postgres:///")
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to acquire database conn:", err)
+				os.Exit(1)
+			}
+
+			err = terminateConnections(ctx, conn, dbName)
+
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+
+			sqlCmds := []string{
+				"DROP DATABASE IF EXISTS " + dbName,
+				"CREATE DATABASE " + dbName,
+			}
+
+			for _, c := range sqlCmds {
+				fmt.Println("[psql, origDb] =>", c)
+				_, err = conn.Exec(ctx, c)
+
+				if err != nil {
+					fmt.Println("ERROR: Failed to execute sql command:", err)
+					os.Exit(1)
+				}
+			}
+
+			err = conn.Close(ctx)
+
+			if err != nil {
+				fmt.Println("WARNING: Failed to close conn:", err)
+			}
+
+			restoreCmd := exec.Command("pg_restore", "-d", dbName)
+			restoreCmd.Stdout = os.Stdout
+			restoreCmd.Stderr = os.Stderr
+			restoreCmd.Env = os.Environ()
+			restoreCmd.Stdin = data
+
+			err = restoreCmd.Run()
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to restore snapshot with error:", err)
+				os.Exit(1)
+			}
+
+			err = recordLoad(ctx, dbName, SeedInfo{
+				CreatedAt:      meta.CreatedAt,
+				FileType:       meta.Type,
+				SourceDatabase: smeta.SourceDatabase,
+			})
+
+			if err != nil {
+				fmt.Println("WARNING: Failed to record load info:", err)
+			}
+
+			fmt.Println("NOTE: Snapshot", smeta.Name, "(taken at commit "+smeta.GitCommit+") restored successfully!")
 		default:
 			fmt.Println("ERROR: Invalid type:", meta.Type)
 			os.Exit(1)
@@ -1098,19 +1266,30 @@ var loadCmd = &cobra.Command{
 var genCiSchemaCmd = &cobra.Command{
 	Use:   "gen-ci-schema <path>",
 	Short: "Generates a seed-ci.json file for use in CI",
-	Long:  "Generates a seed-ci.json file for use in CI",
-	Args:  cobra.ExactArgs(1),
+	Long: `Generates a seed-ci.json file for use in CI. This only reads from the database, use ` + "`db tag-tables`" + ` to add itag columns
+
+The output is an object with a version field (currently ` + strconv.Itoa(dbparser.CISchemaVersion) + `) describing the tables, keys, foreign keys, checks, indexes, views and enums of all schemas.
+Use --legacy to write the old format (a bare array of public schema columns) for consumers that have not been updated yet`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		// Generate schema for CI
 		ctx := context.Background()
-		pool, err := pgxpool.Connect(ctx, "postgres:///infinity")
+		conn, err := pgx.Connect(ctx, cmd.Flag("dsn").Value.String())
 
 		if err != nil {
-			fmt.Println("ERROR: Failed to get pool:", err)
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
 			os.Exit(1)
 		}
 
-		schema, err := dbparser.GetSchema(ctx, pool)
+		defer conn.Close(ctx)
+
+		var schema any
+
+		if legacy, _ := cmd.Flags().GetBool("legacy"); legacy {
+			schema, err = dbparser.GetSchema(ctx, conn)
+		} else {
+			schema, err = dbparser.GetCISchema(ctx, conn)
+		}
 
 		if err != nil {
 			fmt.Println("ERROR: Failed to get schema for CI etc.:", err)
@@ -1151,7 +1330,7 @@ func init() {
 		},
 		&iblfile.Format{
 			Format:  "seed",
-			Version: "a2",
+			Version: "a3",
 			GetExtended: func(sections map[string]*bytes.Buffer, meta *iblfile.Meta) (map[string]any, error) {
 				seedMetaBuf, ok := sections["seed_meta"]
 
@@ -1171,6 +1350,7 @@ func init() {
 					"Nonce":           smeta.Nonce,
 					"DefaultDatabase": smeta.DefaultDatabase,
 					"SourceDatabase":  smeta.SourceDatabase,
+					"DataFormat":      dataFormatOrDefault(smeta.DataFormat),
 				}, nil
 			},
 		},
@@ -1178,17 +1358,62 @@ func init() {
 			Format:  "staging",
 			Version: "a1",
 		},
+		&iblfile.Format{
+			Format:  "snapshot",
+			Version: "a1",
+			GetExtended: func(sections map[string]*bytes.Buffer, meta *iblfile.Meta) (map[string]any, error) {
+				snapshotMetaBuf, ok := sections["snapshot_meta"]
+
+				if !ok {
+					return nil, fmt.Errorf("no snapshot metadata found")
+				}
+
+				var smeta SnapshotMetadata
+
+				err := json.NewDecoder(bytes.NewReader(snapshotMetaBuf.Bytes())).Decode(&smeta)
+
+				if err != nil {
+					return nil, fmt.Errorf("snapshot metadata is invalid: %w", err)
+				}
+
+				return map[string]any{
+					"Name":           smeta.Name,
+					"SourceDatabase": smeta.SourceDatabase,
+					"GitCommit":      smeta.GitCommit,
+				}, nil
+			},
+		},
 	)
 
+	registerFormatDiffer("db.backup", diffArchiveSections)
+	registerFormatDiffer("db.seed", diffSeedFiles)
+	registerFormatDiffer("db.staging", diffArchiveSections)
+	registerFormatDiffer("db.snapshot", diffArchiveSections)
+
 	loadCmd.PersistentFlags().String("priv-key", "", "The private key to decrypt the backup with [backup only]")
-	loadCmd.PersistentFlags().String("db", "", "If type is backup, the database to restore the backup to (backup) or the database name to seed to (seed).")
+	loadCmd.PersistentFlags().String("db", "", "If type is backup, the database to restore the backup to (backup) or the database name to seed to (seed). Defaults to the source database for snapshots (snapshot).")
+
+	loadCmd.PersistentFlags().StringSlice("only-table", nil, "Only restore these tables (and their indexes, constraints etc.) from the backup. Format: table or schema.table [backup only]")
+	loadCmd.PersistentFlags().StringSlice("only-schema", nil, "Only restore these schemas from the backup [backup only]")
+	loadCmd.PersistentFlags().StringSlice("exclude-table", nil, "Do not restore these tables from the backup. Format: table or schema.table [backup only]")
+	loadCmd.PersistentFlags().String("into-schema", "", "Restore the selected objects into this side schema instead of their original schema for comparison [backup only]")
+	loadCmd.PersistentFlags().Bool("strict-stats", false, "Fail if the restored row counts/watermarks differ from the stats recorded when the file was created")
+	loadCmd.PersistentFlags().Bool("data-only", false, "Only restore the data of the selected objects [backup only]")
 
 	newCmd.PersistentFlags().String("pubkey", "", "The public key to encrypt the seed with")
 	newCmd.PersistentFlags().String("default-db", "", "If type is seed, the default database name to seed to.")
 	newCmd.PersistentFlags().String("db", "", "If type is backup, the database to backup to (backup) or the database name to seed from [seed only].")
+	newCmd.PersistentFlags().String("fixtures", "", "Build the seed from the YAML/JSON fixture files in this directory instead of the data in --db. The schema is taken from --db or --migrations [seed only]")
+	newCmd.PersistentFlags().String("migrations", "", "With --fixtures, apply the migrations in this directory to get the schema instead of copying it from --db [seed only]")
 	newCmd.PersistentFlags().String("backup-tables", "", "The tables to fully backup in the seed [seed only]")
+	newCmd.PersistentFlags().String("data-format", seeddata.FormatPg, "The format to store table data in. One of pg/jsonl/csv, jsonl and csv can be reviewed and diffed [seed only]")
+	newCmd.PersistentFlags().String("watermark-column", "created_at", "The column whose max value is recorded per table in the stats section [seed/backup/staging only]")
+	newCmd.PersistentFlags().Bool("skip-pii-scan", false, "Do not scan the dumped data for PII/secrets before writing the file [seed/staging only]")
 	newCmd.PersistentFlags().String("extensions", "", "The extensions required. Format: --extensions=NAME,GIT_URL|NAME2,GIT_URL2 [seed/backup/staging only]")
 
+	genCiSchemaCmd.Flags().String("dsn", "postgres:///infinity", "The database to read the schema of")
+	genCiSchemaCmd.Flags().Bool("legacy", false, "Write the legacy (unversioned) seed-ci.json format")
+
 	dbCmd.AddCommand(genCiSchemaCmd)
 	dbCmd.AddCommand(newCmd)
 	dbCmd.AddCommand(loadCmd)
@@ -0,0 +1,535 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/InfinityBotList/ibldev/internal/downloader"
+	"github.com/InfinityBotList/ibldev/internal/projectconfig"
+	"github.com/InfinityBotList/ibldev/internal/seeddata"
+	"github.com/infinitybotlist/eureka/crypto"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// The result of a restore drill, this is printed as JSON with --json
+type DrillResult struct {
+	File          string             `json:"file"`
+	FileType      string             `json:"file_type,omitempty"`
+	FileCreatedAt *time.Time         `json:"file_created_at,omitempty"`
+	Database      string             `json:"database"`
+	Success       bool               `json:"success"`
+	Error         string             `json:"error,omitempty"`
+	StartedAt     time.Time          `json:"started_at"`
+	DurationMs    int64              `json:"duration_ms"`
+	Steps         []DrillStep        `json:"steps"`
+	Stats         []DrillTableResult `json:"stats,omitempty"`
+	Checks        []DrillCheckResult `json:"checks,omitempty"`
+}
+
+// A timed step of a restore drill
+type DrillStep struct {
+	Name       string `json:"name"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// The stats comparison of a single table
+type DrillTableResult struct {
+	Table        string `json:"table"`
+	ExpectedRows int64  `json:"expected_rows"`
+	ActualRows   *int64 `json:"actual_rows"`
+	Status       string `json:"status"`
+}
+
+// The result of a check query
+type DrillCheckResult struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Runs fn as a timed step of the drill
+func (r *DrillResult) step(name string, fn func() error) error {
+	fmt.Println("== Drill:", name, "==")
+
+	start := time.Now()
+	err := fn()
+
+	s := DrillStep{
+		Name:       name,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	r.Steps = append(r.Steps, s)
+	return err
+}
+
+// Restores all data of a db file into dbName, which must be an empty database
+func restoreFileInto(ctx context.Context, sections map[string]*bytes.Buffer, meta *iblfile.Meta, dbName string) error {
+	restore := func(name string, data *bytes.Buffer) error {
+		restoreCmd := exec.CommandContext(ctx, "pg_restore", "--no-owner", "--no-privileges", "-d", dbName)
+		restoreCmd.Stdout = os.Stdout
+		restoreCmd.Stderr = os.Stderr
+		restoreCmd.Stdin = bytes.NewReader(data.Bytes())
+		restoreCmd.Env = os.Environ()
+
+		err := restoreCmd.Run()
+
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+
+		return nil
+	}
+
+	err := tryHandlingExtensions(sections, dbName)
+
+	if err != nil {
+		return fmt.Errorf("failed to handle extensions: %w", err)
+	}
+
+	switch meta.Type {
+	case "db.backup", "db.staging", "db.snapshot":
+		data, ok := sections["data"]
+
+		if !ok {
+			return fmt.Errorf("file is corrupt [no data]")
+		}
+
+		return restore("data", data)
+	case "db.seed":
+		var smeta SeedMetadata
+
+		seedMetaBuf, ok := sections["seed_meta"]
+
+		if !ok {
+			return fmt.Errorf("seed file is corrupt [no seed meta]")
+		}
+
+		err = json.NewDecoder(bytes.NewReader(seedMetaBuf.Bytes())).Decode(&smeta)
+
+		if err != nil {
+			return fmt.Errorf("seed file is corrupt [invalid seed meta]: %w", err)
+		}
+
+		schema, ok := sections["schema"]
+
+		if !ok {
+			return fmt.Errorf("seed file is corrupt [no schema]")
+		}
+
+		err = restore("schema", schema)
+
+		if err != nil {
+			return err
+		}
+
+		for _, table := range smeta.RestoreOrder {
+			if seeddata.IsPlain(smeta.DataFormat) {
+				err = restorePlainSeedTable(ctx, sections, smeta.DataFormat, dbName, table)
+
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			backupBuf, ok := sections["backup/"+table]
+
+			if !ok {
+				return fmt.Errorf("failed to find backup for table %s", table)
+			}
+
+			err = restore("table "+table, backupBuf)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("cannot restore file of type %s", meta.Type)
+	}
+}
+
+// Runs a check query, the first column of the first row is used as the value
+func runDrillCheck(ctx context.Context, conn *pgx.Conn, query, expect string) (string, error) {
+	rows, err := conn.Query(ctx, query)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer rows.Close()
+
+	var value string
+	var hasRow bool
+
+	if rows.Next() {
+		vals, err := rows.Values()
+
+		if err != nil {
+			return "", err
+		}
+
+		hasRow = true
+
+		if len(vals) > 0 {
+			value = fmt.Sprint(vals[0])
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if expect == "" {
+		return value, nil
+	}
+
+	if !hasRow {
+		return "", fmt.Errorf("query returned no rows, expected %s", expect)
+	}
+
+	if value != expect {
+		return value, fmt.Errorf("expected %s, got %s", expect, value)
+	}
+
+	return value, nil
+}
+
+// Runs a drill, a failure to drop the scratch database fails the drill too
+func runDrill(ctx context.Context, cmd *cobra.Command, result *DrillResult) (err error) {
+	filename := result.File
+
+	if downloader.IsURL(filename) {
+		err := result.step("download", func() error {
+			path, err := downloader.DownloadFileCached(filename)
+
+			if err != nil {
+				return fmt.Errorf("failed to download file: %w", err)
+			}
+
+			filename = path
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	var sections map[string]*bytes.Buffer
+	var meta *iblfile.Meta
+
+	err = result.step("open", func() error {
+		f, err := os.Open(filename)
+
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+
+		defer f.Close()
+
+		sections, _, err = openAutoEncryptedFullFile(cmd, f)
+
+		if err != nil {
+			return err
+		}
+
+		meta, err = parseDbMetadata(sections)
+
+		if err != nil {
+			return fmt.Errorf("failed to parse metadata: %w", err)
+		}
+
+		result.FileType = meta.Type
+		result.FileCreatedAt = &meta.CreatedAt
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	proj, err := projectconfig.LoadOptionalProjectConfig()
+
+	if err != nil {
+		return fmt.Errorf("failed to load project.yaml: %w", err)
+	}
+
+	err = result.step("create database", func() error {
+		conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+		if err != nil {
+			return fmt.Errorf("failed to acquire database conn: %w", err)
+		}
+
+		defer conn.Close(ctx)
+
+		c := "CREATE DATABASE " + pgx.Identifier{result.Database}.Sanitize()
+		fmt.Println("[psql, drillDb] =>", c)
+
+		_, err = conn.Exec(ctx, c)
+
+		if err != nil {
+			return fmt.Errorf("failed to create scratch database: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The context may already be cancelled here (Ctrl-C), so cleanup uses its own
+	defer func() {
+		cleanupErr := result.step("cleanup", func() error {
+			cctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			conn, err := pgx.Connect(cctx, "postgres:///postgres")
+
+			if err != nil {
+				fmt.Println("FATAL: Failed to drop scratch database '"+result.Database+"'! Please do so manually.\nError:", err)
+				return err
+			}
+
+			defer conn.Close(cctx)
+
+			err = terminateConnections(cctx, conn, result.Database)
+
+			if err == nil {
+				_, err = conn.Exec(cctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{result.Database}.Sanitize())
+			}
+
+			if err != nil {
+				fmt.Println("FATAL: Failed to drop scratch database '"+result.Database+"'! Please do so manually.\nError:", err)
+				return err
+			}
+
+			return nil
+		})
+
+		if cleanupErr == nil {
+			return
+		}
+
+		cleanupErr = fmt.Errorf("failed to drop scratch database %s: %w", result.Database, cleanupErr)
+
+		if err == nil {
+			err = cleanupErr
+		} else {
+			err = errors.New(err.Error() + "; " + cleanupErr.Error())
+		}
+	}()
+
+	err = result.step("restore", func() error {
+		return restoreFileInto(ctx, sections, meta, result.Database)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+
+	err = result.step("stats", func() error {
+		expected, comparisons, err := compareLoadedStats(ctx, sections, result.Database)
+
+		if err != nil {
+			return err
+		}
+
+		if expected == nil {
+			fmt.Println("NOTE: File has no stats section, skipping row count verification")
+			return nil
+		}
+
+		printStatsComparison(expected, comparisons)
+
+		var mismatches int
+		for _, c := range comparisons {
+			tr := DrillTableResult{
+				Table:        c.Expected.QualifiedName(),
+				ExpectedRows: c.Expected.Rows,
+				Status:       comparisonStatus(c),
+			}
+
+			if c.Actual != nil {
+				tr.ActualRows = &c.Actual.Rows
+			}
+
+			if !c.Ok() {
+				mismatches++
+			}
+
+			result.Stats = append(result.Stats, tr)
+		}
+
+		if mismatches > 0 {
+			return fmt.Errorf("%d tables do not match the stats recorded at backup time", mismatches)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	if proj != nil && proj.Drill != nil && len(proj.Drill.Checks) > 0 {
+		err = result.step("checks", func() error {
+			conn, err := pgx.Connect(ctx, "postgres:///"+result.Database)
+
+			if err != nil {
+				return fmt.Errorf("failed to acquire drill database conn: %w", err)
+			}
+
+			defer conn.Close(ctx)
+
+			var failed int
+			for _, check := range proj.Drill.Checks {
+				value, err := runDrillCheck(ctx, conn, check.Query, check.Expect)
+
+				cr := DrillCheckResult{
+					Name:  check.Name,
+					Ok:    err == nil,
+					Value: value,
+				}
+
+				if err != nil {
+					cr.Error = err.Error()
+					failed++
+					fmt.Println("FAIL:", check.Name, "=>", err)
+				} else {
+					fmt.Println("OK:", check.Name, "=>", value)
+				}
+
+				result.Checks = append(result.Checks, cr)
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", failed, len(proj.Drill.Checks))
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+var drillCmd = &cobra.Command{
+	Use:     "drill <file>",
+	Example: "drill <backup file>/<seed file>/<seed url>",
+	Short:   "Tests that a db file can be restored",
+	Long:    "Restores a db file into a throwaway database, compares the restored data against the stats recorded at backup time and runs the check queries in the drill section of project.yaml. The throwaway database is always dropped afterwards. Exits with a non-zero status if the drill fails",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jsonOut := cmd.Flag("json").Value.String() == "true"
+
+		// With --json, stdout is reserved for the result. Everything else (including
+		// pg_restore output) goes to stderr
+		stdout := os.Stdout
+
+		if jsonOut {
+			os.Stdout = os.Stderr
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		result := &DrillResult{
+			File:      args[0],
+			Database:  "ibl_drill_" + strings.ToLower(crypto.RandString(10)),
+			StartedAt: time.Now(),
+		}
+
+		err := runDrill(ctx, cmd, result)
+
+		if err == nil && ctx.Err() != nil {
+			err = fmt.Errorf("drill was interrupted")
+		}
+
+		result.DurationMs = time.Since(result.StartedAt).Milliseconds()
+		result.Success = err == nil
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		if jsonOut {
+			enc := json.NewEncoder(stdout)
+			enc.SetIndent("", "  ")
+
+			encErr := enc.Encode(result)
+
+			if encErr != nil {
+				fmt.Println("ERROR: Failed to encode result:", encErr)
+				os.Exit(1)
+			}
+		} else {
+			fmt.Println("\n== Drill Result ==")
+
+			for _, s := range result.Steps {
+				status := "ok"
+
+				if s.Error != "" {
+					status = "FAILED: " + s.Error
+				}
+
+				fmt.Printf("%s: %s (%s)\n", s.Name, status, time.Duration(s.DurationMs)*time.Millisecond)
+			}
+
+			fmt.Println("Total:", time.Duration(result.DurationMs)*time.Millisecond)
+
+			if result.Success {
+				fmt.Println("NOTE: Drill passed!")
+			} else {
+				fmt.Println("ERROR: Drill failed:", result.Error)
+			}
+		}
+
+		if !result.Success {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	drillCmd.Flags().String("priv-key", "", "The private key [pem] to decrypt the file with")
+	drillCmd.Flags().String("enc-key", "", "The encryption key [aes256] to decrypt the file with")
+	drillCmd.Flags().Bool("json", false, "Print the result as JSON on stdout (all other output goes to stderr)")
+
+	dbCmd.AddCommand(drillCmd)
+}
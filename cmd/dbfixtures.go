@@ -0,0 +1,397 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/InfinityBotList/ibldev/internal/fixtures"
+	"github.com/InfinityBotList/ibldev/internal/migrator"
+	"github.com/infinitybotlist/eureka/crypto"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Splits a fixture table name into its schema and name, tables without a schema are in public
+func splitTableName(table string) (string, string) {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return schema, name
+	}
+
+	return "public", table
+}
+
+// Returns the tables each table has foreign keys to, keyed by schema.table
+func foreignKeyDeps(ctx context.Context, conn *pgx.Conn) (map[string][]string, error) {
+	rows, err := conn.Query(ctx, `SELECT tn.nspname || '.' || t.relname, rn.nspname || '.' || r.relname FROM pg_constraint con
+JOIN pg_class t ON t.oid = con.conrelid
+JOIN pg_namespace tn ON tn.oid = t.relnamespace
+JOIN pg_class r ON r.oid = con.confrelid
+JOIN pg_namespace rn ON rn.oid = r.relnamespace
+WHERE con.contype = 'f'`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+
+	defer rows.Close()
+
+	deps := map[string][]string{}
+
+	for rows.Next() {
+		var table, ref string
+
+		err = rows.Scan(&table, &ref)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read foreign key: %w", err)
+		}
+
+		deps[table] = append(deps[table], ref)
+	}
+
+	return deps, rows.Err()
+}
+
+// Restores the schema of a live database into dbName
+func copySchema(srcDb, dbName string) error {
+	dumpCmd := exec.Command("pg_dump", "-Fc", "--schema-only", "--no-owner", "-d", srcDb)
+	dumpCmd.Env = os.Environ()
+	dumpCmd.Stderr = os.Stderr
+
+	schema, err := dumpCmd.Output()
+
+	if err != nil {
+		return fmt.Errorf("failed to dump schema of %s: %w", srcDb, err)
+	}
+
+	restoreCmd := exec.Command("pg_restore", "--no-owner", "--no-privileges", "-d", dbName)
+	restoreCmd.Stdin = bytes.NewReader(schema)
+	restoreCmd.Stdout = os.Stdout
+	restoreCmd.Stderr = os.Stderr
+	restoreCmd.Env = os.Environ()
+
+	return restoreCmd.Run()
+}
+
+// Applies all migrations in dir to dbName
+func applyMigrations(ctx context.Context, dir, dbName string) error {
+	migrations, err := migrator.Load(dir)
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	m, err := migrator.New(ctx, conn, migrations)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Up(ctx, 0)
+
+	if err != nil {
+		m.Close(ctx)
+		return err
+	}
+
+	return m.Close(ctx)
+}
+
+// Checks that every fixture table and column exists in the catalog
+func validateFixtures(set *fixtures.Set, cat *dbparser.Catalog) []error {
+	errs := set.Validate()
+
+	for _, t := range set.Tables {
+		schema, name := splitTableName(t)
+		table := cat.Table(schema, name)
+
+		if table == nil {
+			errs = append(errs, fmt.Errorf("table %s does not exist in the schema", t))
+			continue
+		}
+
+		for _, r := range set.Rows[t] {
+			for _, col := range r.Columns {
+				if table.Column(col) == nil {
+					errs = append(errs, fmt.Errorf("%s: column %s does not exist in %s", r.Pos(), col, t))
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// Inserts the fixture rows into conn, references are resolved using the values returned by each insert
+func insertFixtures(ctx context.Context, conn *pgx.Conn, set *fixtures.Set, cat *dbparser.Catalog, tables []string, rows map[string][]*fixtures.Row) error {
+	inserted := map[string]map[string]map[string]*string{}
+	pks := map[string][]string{}
+
+	for _, t := range tables {
+		schema, name := splitTableName(t)
+		table := cat.Table(schema, name)
+
+		_, pk, err := tableColumnInfo(ctx, conn, table.Ident())
+
+		if err != nil {
+			return err
+		}
+
+		pks[t] = pk
+		inserted[t] = map[string]map[string]*string{}
+
+		var returning []string
+
+		for _, c := range table.Columns {
+			returning = append(returning, pgx.Identifier{c.Name}.Sanitize()+"::text")
+		}
+
+		fmt.Printf("Inserting fixtures: %s [%d rows]\n", t, len(rows[t]))
+
+		for _, r := range rows[t] {
+			resolve := func(ref fixtures.Ref) (*string, error) {
+				values, ok := inserted[ref.Table][ref.Row]
+
+				if !ok {
+					return nil, fmt.Errorf("row %s.%s is not inserted yet", ref.Table, ref.Row)
+				}
+
+				column := ref.Column
+
+				if column == "" {
+					if len(pks[ref.Table]) != 1 {
+						return nil, fmt.Errorf("%s has no single column primary key, use !ref %s.%s.<column>", ref.Table, ref.Table, ref.Row)
+					}
+
+					column = pks[ref.Table][0]
+				}
+
+				v, ok := values[column]
+
+				if !ok {
+					return nil, fmt.Errorf("%s has no column %s", ref.Table, column)
+				}
+
+				return v, nil
+			}
+
+			var cols, placeholders []string
+			var args []any
+
+			for _, col := range r.Columns {
+				c := table.Column(col)
+
+				v, err := set.Render(r.Values[col], strings.HasSuffix(c.Type, "[]"), resolve)
+
+				if err != nil {
+					return fmt.Errorf("%s: column %s: %w", r.Pos(), col, err)
+				}
+
+				args = append(args, v)
+				cols = append(cols, pgx.Identifier{col}.Sanitize())
+				placeholders = append(placeholders, fmt.Sprintf("$%d::text::%s", len(args), c.Type))
+			}
+
+			sql := "INSERT INTO " + table.Ident() + " DEFAULT VALUES"
+
+			if len(cols) > 0 {
+				sql = "INSERT INTO " + table.Ident() + " (" + strings.Join(cols, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")"
+			}
+
+			values := make([]*string, len(returning))
+			dest := make([]any, len(returning))
+
+			for i := range values {
+				dest[i] = &values[i]
+			}
+
+			err = conn.QueryRow(ctx, sql+" RETURNING "+strings.Join(returning, ", "), args...).Scan(dest...)
+
+			if err != nil {
+				return fmt.Errorf("%s: %w", r.Pos(), err)
+			}
+
+			inserted[t][r.Key] = map[string]*string{}
+
+			for i, c := range table.Columns {
+				inserted[t][r.Key][c.Name] = values[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Builds a scratch database from fixtures for `db new seed --fixtures`
+//
+// The schema is taken from --db or applied from --migrations. Returns the scratch database,
+// the tables to back up in restore order and a function that drops the scratch database
+func buildFixturesDb(ctx context.Context, cmd *cobra.Command, dir string) (string, []string, func(), error) {
+	set, err := fixtures.Load(dir)
+
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	srcDb := cmd.Flag("db").Value.String()
+	migrationsDir := cmd.Flag("migrations").Value.String()
+
+	if (srcDb == "") == (migrationsDir == "") {
+		return "", nil, nil, fmt.Errorf("exactly one of --db or --migrations must be set to take the fixtures schema from")
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///")
+
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	scratchName := "ibl_fixtures_" + strings.ToLower(crypto.RandString(10))
+
+	c := "CREATE DATABASE " + pgx.Identifier{scratchName}.Sanitize()
+	fmt.Println("[psql, scratchDb] =>", c)
+
+	_, err = conn.Exec(ctx, c)
+
+	if err != nil {
+		conn.Close(ctx)
+		return "", nil, nil, fmt.Errorf("failed to create scratch database: %w", err)
+	}
+
+	cleanup := func() {
+		fmt.Println("CLEANUP: Dropping scratch database", scratchName)
+
+		_, err := conn.Exec(ctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{scratchName}.Sanitize())
+
+		if err != nil {
+			fmt.Println("FATAL: Failed to drop scratch database '"+scratchName+"'! Please do so manually.\nError:", err)
+		}
+
+		conn.Close(ctx)
+	}
+
+	tables, err := fillFixturesDb(ctx, set, scratchName, srcDb, migrationsDir)
+
+	if err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+
+	return scratchName, tables, cleanup, nil
+}
+
+func fillFixturesDb(ctx context.Context, set *fixtures.Set, scratchName, srcDb, migrationsDir string) ([]string, error) {
+	var err error
+
+	if srcDb != "" {
+		fmt.Println("Copying schema from", srcDb)
+		err = copySchema(srcDb, scratchName)
+	} else {
+		fmt.Println("Applying migrations from", migrationsDir)
+		err = applyMigrations(ctx, migrationsDir, scratchName)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fixtures schema: %w", err)
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///"+scratchName)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire scratch database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	cat, err := dbparser.GetCatalog(ctx, conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	errs := validateFixtures(set, cat)
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Println("ERROR:", err)
+		}
+
+		return nil, fmt.Errorf("%d fixture errors", len(errs))
+	}
+
+	fkDeps, err := foreignKeyDeps(ctx, conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Map the schema qualified names back to fixture table names
+	qualified := map[string]string{}
+
+	for _, t := range set.Tables {
+		schema, name := splitTableName(t)
+		qualified[schema+"."+name] = t
+	}
+
+	deps := map[string][]string{}
+
+	for table, refs := range fkDeps {
+		t, ok := qualified[table]
+
+		if !ok {
+			continue
+		}
+
+		for _, ref := range refs {
+			if dep, ok := qualified[ref]; ok {
+				deps[t] = append(deps[t], dep)
+			}
+		}
+	}
+
+	tables, rows, err := set.Order(deps)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := conn.Begin(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	err = insertFixtures(ctx, tx.Conn(), set, cat, tables, rows)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit fixtures: %w", err)
+	}
+
+	// Keep the migration history so loaded seeds are not migrated again
+	if migrationsDir != "" {
+		tables = append(tables, migrator.Table)
+	}
+
+	return tables, nil
+}
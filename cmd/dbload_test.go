@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/InfinityBotList/ibldev/internal/multipem"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/spf13/cobra"
+)
+
+// Writes a PKIX public key and PKCS8 private key pair into dir, returning their paths
+func testKeyFiles(t *testing.T, dir, name string) (pubPath string, privPath string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubPath, privPath = filepath.Join(dir, name+".pub"), filepath.Join(dir, name+".pem")
+
+	err = os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pubPath, privPath
+}
+
+// A command with the decryption flags of db load
+func testLoadFlags(privKey string) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.Flags().String("priv-key", privKey, "")
+	cmd.Flags().String("enc-key", "", "")
+	return cmd
+}
+
+// A backup re-encrypted to several recipients with `file reencrypt` must stay loadable by each of them
+func TestOpenDbFileMultiPem(t *testing.T) {
+	dir := t.TempDir()
+
+	alicePub, alicePriv := testKeyFiles(t, dir, "alice")
+	bobPub, bobPriv := testKeyFiles(t, dir, "bob")
+	_, evePriv := testKeyFiles(t, dir, "eve")
+
+	var publicKeys [][]byte
+
+	for _, path := range []string{alicePub, bobPub} {
+		key, err := os.ReadFile(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publicKeys = append(publicKeys, key)
+	}
+
+	file := iblfile.NewAutoEncryptedFile_FullFile(&multipem.MultiPemEncryptedSource{PublicKeys: publicKeys})
+
+	data := []byte("pg_dump archive")
+
+	err := file.WriteSection(bytes.NewBuffer(data), "data")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := json.Marshal(iblfile.Meta{
+		CreatedAt:     time.Now(),
+		Protocol:      iblfile.Protocol,
+		Type:          "db.backup",
+		FormatVersion: "a1",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = file.WriteSection(bytes.NewBuffer(meta), "meta")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "backup.iblcli-backup")
+	out, err := os.Create(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = file.WriteOutput(out)
+	out.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, privKey := range map[string]string{"alice": alicePriv, "bob": bobPriv} {
+		f, err := os.Open(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sections, meta, err := openDbFile(testLoadFlags(privKey), f)
+		f.Close()
+
+		if err != nil {
+			t.Errorf("openDbFile with %s's key failed: %v", name, err)
+			continue
+		}
+
+		if meta.Type != "db.backup" {
+			t.Errorf("openDbFile with %s's key: type = %s, want db.backup", name, meta.Type)
+		}
+
+		if got := sections["data"]; got == nil || !bytes.Equal(got.Bytes(), data) {
+			t.Errorf("openDbFile with %s's key: data section = %q, want %q", name, got, data)
+		}
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	_, _, err = openDbFile(testLoadFlags(evePriv), f)
+
+	if err == nil {
+		t.Error("openDbFile with a key that is not a recipient succeeded")
+	}
+}
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/InfinityBotList/ibldev/internal/migrator"
+	"github.com/InfinityBotList/ibldev/internal/projectconfig"
+	"github.com/InfinityBotList/ibldev/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Loads the migrations section of project.yaml, exiting if it is missing
+func migrationsConfig(cmd *cobra.Command) *types.Migrations {
+	proj, err := projectconfig.LoadProjectConfig()
+
+	if err != nil {
+		fmt.Println("\nERROR: Failed to load project.yaml:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("")
+
+	if proj.Migrations == nil {
+		fmt.Println("ERROR: project.yaml has no migrations section")
+		os.Exit(1)
+	}
+
+	cfg := *proj.Migrations
+
+	if db := cmd.Flag("db").Value.String(); db != "" {
+		cfg.Database = db
+	}
+
+	if cfg.Database == "" {
+		cfg.Database = "infinity"
+	}
+
+	return &cfg
+}
+
+// Opens a migrator for the configured database, the returned function must be called to release the migration lock
+func openMigrator(ctx context.Context, cmd *cobra.Command) (*migrator.Migrator, func()) {
+	cfg := migrationsConfig(cmd)
+
+	migrations, err := migrator.Load(cfg.Dir)
+
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///"+cfg.Database)
+
+	if err != nil {
+		fmt.Println("ERROR: Failed to acquire database conn:", err)
+		os.Exit(1)
+	}
+
+	m, err := migrator.New(ctx, conn, migrations)
+
+	if err != nil {
+		conn.Close(ctx)
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Database:", cfg.Database)
+
+	return m, func() {
+		err := m.Close(ctx)
+
+		if err != nil {
+			fmt.Println("WARNING: Failed to release migration lock:", err)
+		}
+
+		conn.Close(ctx)
+	}
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Versioned SQL migrations",
+	Long:  "Applies the numbered SQL migrations (NNNN_name.up.sql/NNNN_name.down.sql) in the directory set in the migrations section of project.yaml",
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Applies pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		steps, _ := cmd.Flags().GetInt("steps")
+
+		m, done := openMigrator(ctx, cmd)
+
+		applied, err := m.Up(ctx, steps)
+		done()
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("NOTE: No pending migrations")
+			return
+		}
+
+		fmt.Println("NOTE: Applied", len(applied), "migrations")
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Reverts the latest applied migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		steps, _ := cmd.Flags().GetInt("steps")
+
+		if steps <= 0 {
+			fmt.Println("ERROR: --steps must be positive")
+			os.Exit(1)
+		}
+
+		m, done := openMigrator(ctx, cmd)
+
+		reverted, err := m.Down(ctx, steps)
+		done()
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		if len(reverted) == 0 {
+			fmt.Println("NOTE: No applied migrations to revert")
+			return
+		}
+
+		fmt.Println("NOTE: Reverted", len(reverted), "migrations")
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows applied and pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		m, done := openMigrator(ctx, cmd)
+
+		statuses, err := m.Status(ctx)
+		done()
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+
+		var pending, modified int
+		for _, s := range statuses {
+			status := "pending"
+			appliedAt := "-"
+
+			switch {
+			case s.Applied == nil:
+				pending++
+			case s.Migration == nil:
+				status = "applied (file missing)"
+			case s.Modified():
+				status = "EDITED AFTER APPLYING"
+				modified++
+			default:
+				status = "applied"
+			}
+
+			if s.Applied != nil {
+				appliedAt = s.Applied.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", s.Version, s.Name, status, appliedAt)
+		}
+
+		w.Flush()
+
+		fmt.Println("\nPending:", pending)
+
+		if modified > 0 {
+			fmt.Println("ERROR:", modified, "applied migrations were edited, migrate up/down will refuse to run")
+			os.Exit(1)
+		}
+	},
+}
+
+var migrateNewCmd = &cobra.Command{
+	Use:   "new <name>",
+	Short: "Creates empty up/down files for a new migration",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := migrationsConfig(cmd)
+
+		up, down, err := migrator.Create(cfg.Dir, args[0])
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to create migration:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Created", up)
+		fmt.Println("Created", down)
+	},
+}
+
+func init() {
+	migrateCmd.PersistentFlags().String("db", "", "The database to migrate, overrides the database set in project.yaml")
+
+	migrateUpCmd.Flags().Int("steps", 0, "The number of pending migrations to apply, 0 applies all")
+	migrateDownCmd.Flags().Int("steps", 1, "The number of migrations to revert")
+
+	migrateCmd.AddCommand(migrateUpCmd)
+	migrateCmd.AddCommand(migrateDownCmd)
+	migrateCmd.AddCommand(migrateStatusCmd)
+	migrateCmd.AddCommand(migrateNewCmd)
+
+	dbCmd.AddCommand(migrateCmd)
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/InfinityBotList/ibldev/internal/piiscan"
+	"github.com/InfinityBotList/ibldev/internal/projectconfig"
+	"github.com/InfinityBotList/ibldev/types"
+	"github.com/spf13/cobra"
+)
+
+// Creates the PII scanner for `db new`, using the pii_scan section of project.yaml if present
+//
+// Returns nil if the scan was skipped with --skip-pii-scan
+func newPIIScanner(cmd *cobra.Command) *piiscan.Scanner {
+	if cmd.Flag("skip-pii-scan").Value.String() == "true" {
+		fmt.Println("WARNING: Skipping PII scan, make sure the file does not contain any sensitive data!")
+		return nil
+	}
+
+	var cfg *types.PIIScan
+
+	proj, err := projectconfig.LoadOptionalProjectConfig()
+
+	if err != nil {
+		fmt.Println("ERROR: Failed to load project.yaml:", err)
+		os.Exit(1)
+	}
+
+	if proj != nil {
+		cfg = proj.PIIScan
+	}
+
+	scanner, err := piiscan.New(cfg)
+
+	if err != nil {
+		fmt.Println("ERROR: Invalid PII scan config:", err)
+		os.Exit(1)
+	}
+
+	return scanner
+}
+
+// Scans an archive section for PII before it is written, exiting if anything that is not allowlisted is found
+func checkSectionForPII(scanner *piiscan.Scanner, section string, data *bytes.Buffer) {
+	if scanner == nil {
+		return
+	}
+
+	fmt.Println("Scanning", section, "for PII")
+
+	findings, err := scanner.ScanArchive(bytes.NewReader(data.Bytes()))
+
+	if err != nil {
+		fmt.Println("ERROR: Failed to scan", section, "for PII:", err)
+		os.Exit(1)
+	}
+
+	if len(findings) == 0 {
+		return
+	}
+
+	fmt.Println("ERROR: Found possible PII/secrets in", section)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tCOLUMN\tDETECTOR\tCOUNT\tSAMPLE HASH")
+
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", f.Table, f.Column, f.Detector, f.Count, f.SampleHash)
+	}
+
+	w.Flush()
+
+	fmt.Println("\nFix the sanitizer or, if these are safe, allowlist them in the pii_scan.allowlist section of project.yaml:")
+	fmt.Println("\npii_scan:\n  allowlist:")
+
+	for _, f := range findings {
+		fmt.Printf("    - table: %s\n      column: %s\n      detector: %s\n      reason: \"\"\n", f.Table, f.Column, f.Detector)
+	}
+
+	os.Exit(1)
+}
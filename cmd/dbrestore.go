@@ -0,0 +1,442 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/pgtoc"
+	"github.com/infinitybotlist/eureka/crypto"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Options for restoring only part of an archive
+type selectiveRestoreOpts struct {
+	// Which entries of the archive to restore
+	Filter pgtoc.Filter
+
+	// If set, the selected objects are restored into this schema instead of their original one
+	IntoSchema string
+
+	// Only restore data, not schema
+	DataOnly bool
+}
+
+// Returns whether or not a selective restore was requested
+func (o selectiveRestoreOpts) IsSet() bool {
+	return o.Filter.IsSet() || o.IntoSchema != ""
+}
+
+// Reads the selective restore flags of a command
+func selectiveRestoreOptsFromFlags(cmd *cobra.Command) selectiveRestoreOpts {
+	onlyTables, _ := cmd.Flags().GetStringSlice("only-table")
+	onlySchemas, _ := cmd.Flags().GetStringSlice("only-schema")
+	excludeTables, _ := cmd.Flags().GetStringSlice("exclude-table")
+
+	return selectiveRestoreOpts{
+		Filter: pgtoc.Filter{
+			OnlyTables:    onlyTables,
+			OnlySchemas:   onlySchemas,
+			ExcludeTables: excludeTables,
+		},
+		IntoSchema: cmd.Flag("into-schema").Value.String(),
+		DataOnly:   cmd.Flag("data-only").Value.String() == "true",
+	}
+}
+
+// Writes an archive to a temporary file, pg_restore needs a seekable archive to
+// restore entries out of order using -L
+func writeTempArchive(data []byte) (string, error) {
+	f, err := os.CreateTemp("", "ibl-archive-*.dump")
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary archive: %w", err)
+	}
+
+	defer f.Close()
+
+	_, err = f.Write(data)
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temporary archive: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+// Returns the table of contents of an archive file using pg_restore -l -v
+func archiveToc(archivePath string) ([]pgtoc.Entry, error) {
+	var listBuf = bytes.NewBuffer([]byte{})
+	listCmd := exec.Command("pg_restore", "-l", "-v", archivePath)
+	listCmd.Env = os.Environ()
+	listCmd.Stdout = listBuf
+
+	err := listCmd.Run()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archive contents: %w", err)
+	}
+
+	return pgtoc.ParseList(listBuf)
+}
+
+// Runs pg_restore using a list file containing only the given entries
+func restoreEntries(archivePath, dbName string, entries []pgtoc.Entry, extraArgs ...string) error {
+	listFile, err := os.CreateTemp("", "ibl-restore-*.list")
+
+	if err != nil {
+		return fmt.Errorf("failed to create list file: %w", err)
+	}
+
+	defer os.Remove(listFile.Name())
+
+	_, err = listFile.WriteString(pgtoc.FormatList(entries))
+
+	if err != nil {
+		listFile.Close()
+		return fmt.Errorf("failed to write list file: %w", err)
+	}
+
+	listFile.Close()
+
+	args := append([]string{"-d", dbName, "-L", listFile.Name()}, extraArgs...)
+	args = append(args, archivePath)
+
+	restoreCmd := exec.Command("pg_restore", args...)
+	restoreCmd.Stdout = os.Stdout
+	restoreCmd.Stderr = os.Stderr
+	restoreCmd.Env = os.Environ()
+
+	return restoreCmd.Run()
+}
+
+// Returns the qualified names of the tables among entries
+func selectedTables(entries []pgtoc.Entry) []string {
+	var tables []string
+
+	for _, e := range entries {
+		if e.Desc == "TABLE" {
+			tables = append(tables, pgx.Identifier{e.Schema, e.Name}.Sanitize())
+		}
+	}
+
+	return tables
+}
+
+// Checks which of the selected tables already exist in dbName and whether any of those have rows
+func existingTables(ctx context.Context, dbName string, tables []string) (existing []string, nonEmpty []string, err error) {
+	conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to acquire target database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	for _, table := range tables {
+		var exists bool
+
+		err = conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check if %s exists: %w", table, err)
+		}
+
+		if !exists {
+			continue
+		}
+
+		existing = append(existing, table)
+
+		var hasRows bool
+
+		err = conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM "+table+")").Scan(&hasRows)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check if %s is empty: %w", table, err)
+		}
+
+		if hasRows {
+			nonEmpty = append(nonEmpty, table)
+		}
+	}
+
+	return existing, nonEmpty, nil
+}
+
+// Splits the selected entries of a side schema restore into the data to load into the scratch
+// database and the post-data objects (indexes, constraints, triggers etc.) to create after it
+//
+// Foreign keys are left out as the tables they reference are not part of the side schema
+func sideSchemaEntries(selected []pgtoc.Entry, sections map[int]string) (data []pgtoc.Entry, postData []pgtoc.Entry) {
+	for _, e := range selected {
+		switch {
+		case e.Desc == "TABLE DATA" || e.Desc == "SEQUENCE SET":
+			data = append(data, e)
+		case e.Desc == "FK CONSTRAINT":
+			continue
+		case sections[e.DumpID] == "post-data":
+			postData = append(postData, e)
+		}
+	}
+
+	return data, postData
+}
+
+// Restores only the entries of an archive selected by opts into dbName
+//
+// If opts.IntoSchema is set, the whole schema of the archive is first restored into a scratch
+// database so that types, functions and referenced tables exist. Only the data of the selected
+// tables is loaded there, the tables are moved into the side schema and just that schema is then
+// copied into dbName. This allows comparing restored rows against the live ones before merging them back
+func selectiveRestore(ctx context.Context, sections map[string]*bytes.Buffer, data *bytes.Buffer, dbName string, opts selectiveRestoreOpts) error {
+	if opts.IntoSchema != "" && opts.DataOnly {
+		return fmt.Errorf("--data-only cannot be used with --into-schema")
+	}
+
+	archivePath, err := writeTempArchive(data.Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(archivePath)
+
+	entries, err := archiveToc(archivePath)
+
+	if err != nil {
+		return err
+	}
+
+	selected := opts.Filter.Apply(entries)
+
+	if len(selected) == 0 {
+		return fmt.Errorf("no entries in the archive match the given filters")
+	}
+
+	fmt.Println("NOTE: Selected", len(selected), "of", len(entries), "archive entries")
+
+	for _, e := range selected {
+		fmt.Println("  ", e.Desc, e.Schema, e.Name)
+	}
+
+	if opts.IntoSchema == "" {
+		dataOnly := opts.DataOnly
+
+		if !dataOnly {
+			// Recreating tables that still exist makes pg_restore fail halfway through
+			tables := selectedTables(selected)
+
+			existing, nonEmpty, err := existingTables(ctx, dbName, tables)
+
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case len(nonEmpty) > 0:
+				return fmt.Errorf("the selected tables %s already exist in %s and have rows. HINT: Truncate them first to restore their data, or use --into-schema to restore them side by side", strings.Join(nonEmpty, ", "), dbName)
+			case len(existing) > 0 && len(existing) < len(tables):
+				return fmt.Errorf("only some of the selected tables (%s) exist in %s. HINT: Select the existing and missing tables in separate restores", strings.Join(existing, ", "), dbName)
+			case len(existing) > 0:
+				fmt.Println("NOTE: All selected tables exist in", dbName, "and are empty, only restoring their data")
+				dataOnly = true
+			}
+		}
+
+		var extraArgs []string
+
+		if dataOnly {
+			extraArgs = append(extraArgs, "--data-only")
+		}
+
+		err = restoreEntries(archivePath, dbName, selected, extraArgs...)
+
+		if err != nil {
+			return fmt.Errorf("failed to restore selected entries: %w", err)
+		}
+
+		return nil
+	}
+
+	// Find the schema the selected objects come from
+	var srcSchema string
+
+	for _, e := range selected {
+		if e.Schema == "" {
+			continue
+		}
+
+		if srcSchema != "" && e.Schema != srcSchema {
+			return fmt.Errorf("--into-schema only supports restoring objects from a single schema, found %s and %s", srcSchema, e.Schema)
+		}
+
+		srcSchema = e.Schema
+	}
+
+	if srcSchema == "" {
+		return fmt.Errorf("none of the selected entries belong to a schema")
+	}
+
+	tables := selectedTables(selected)
+
+	if len(tables) == 0 {
+		return fmt.Errorf("none of the selected entries are tables")
+	}
+
+	// pg_restore -l does not list sections, so they are read from the archive itself
+	archive, err := pgtoc.ReadArchive(bytes.NewReader(data.Bytes()), false)
+
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	entrySections := map[int]string{}
+
+	for _, e := range archive.Entries {
+		entrySections[e.DumpID] = e.Section
+	}
+
+	dataEntries, postDataEntries := sideSchemaEntries(selected, entrySections)
+
+	conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+	if err != nil {
+		return fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	tconn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return fmt.Errorf("failed to acquire target database conn: %w", err)
+	}
+
+	var schemaExists bool
+	err = tconn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = $1)", opts.IntoSchema).Scan(&schemaExists)
+	tconn.Close(ctx)
+
+	if err != nil {
+		return fmt.Errorf("failed to check if side schema exists: %w", err)
+	}
+
+	if schemaExists {
+		return fmt.Errorf("schema %s already exists in %s", opts.IntoSchema, dbName)
+	}
+
+	scratchName := dbName + "__restore_" + strings.ToLower(crypto.RandString(8))
+
+	c := "CREATE DATABASE " + pgx.Identifier{scratchName}.Sanitize()
+	fmt.Println("[psql, scratchDb] =>", c)
+
+	_, err = conn.Exec(ctx, c)
+
+	if err != nil {
+		return fmt.Errorf("failed to create scratch database: %w", err)
+	}
+
+	defer func() {
+		fmt.Println("CLEANUP: Dropping scratch database", scratchName)
+
+		_, err := conn.Exec(ctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{scratchName}.Sanitize())
+
+		if err != nil {
+			fmt.Println("FATAL: Failed to drop scratch database '"+scratchName+"'! Please do so manually.\nError:", err)
+		}
+	}()
+
+	err = tryHandlingExtensions(sections, scratchName)
+
+	if err != nil {
+		return fmt.Errorf("failed to handle extensions: %w", err)
+	}
+
+	// The whole pre-data schema (types, functions, all tables), without foreign keys and indexes which are post-data
+	restoreCmd := exec.Command("pg_restore", "--section=pre-data", "--no-owner", "--no-privileges", "-d", scratchName, archivePath)
+	restoreCmd.Stdout = os.Stdout
+	restoreCmd.Stderr = os.Stderr
+	restoreCmd.Env = os.Environ()
+
+	err = restoreCmd.Run()
+
+	if err != nil {
+		return fmt.Errorf("failed to restore schema into scratch database: %w", err)
+	}
+
+	if len(dataEntries) > 0 {
+		err = restoreEntries(archivePath, scratchName, dataEntries, "--data-only")
+
+		if err != nil {
+			return fmt.Errorf("failed to restore selected data into scratch database: %w", err)
+		}
+	}
+
+	if len(postDataEntries) > 0 {
+		err = restoreEntries(archivePath, scratchName, postDataEntries, "--no-owner", "--no-privileges")
+
+		if err != nil {
+			return fmt.Errorf("failed to restore indexes and constraints into scratch database: %w", err)
+		}
+	}
+
+	sconn, err := pgx.Connect(ctx, "postgres:///"+scratchName)
+
+	if err != nil {
+		return fmt.Errorf("failed to acquire scratch database conn: %w", err)
+	}
+
+	// Only the selected tables move, types and functions (including those of extensions) stay
+	// where they are so that the dump references them by their original names
+	stmts := []string{"CREATE SCHEMA " + pgx.Identifier{opts.IntoSchema}.Sanitize()}
+
+	for _, table := range tables {
+		stmts = append(stmts, "ALTER TABLE "+table+" SET SCHEMA "+pgx.Identifier{opts.IntoSchema}.Sanitize())
+	}
+
+	for _, c := range stmts {
+		fmt.Println("[psql, scratchDb] =>", c)
+
+		_, err = sconn.Exec(ctx, c)
+
+		if err != nil {
+			sconn.Close(ctx)
+			return fmt.Errorf("failed to move restored tables into side schema: %w", err)
+		}
+	}
+
+	sconn.Close(ctx)
+
+	var sideBuf = bytes.NewBuffer([]byte{})
+	dumpCmd := exec.Command("pg_dump", "-Fc", "--no-owner", "--no-privileges", "-n", opts.IntoSchema, "-d", scratchName)
+	dumpCmd.Env = os.Environ()
+	dumpCmd.Stdout = sideBuf
+	dumpCmd.Stderr = os.Stderr
+
+	err = dumpCmd.Run()
+
+	if err != nil {
+		return fmt.Errorf("failed to dump side schema: %w", err)
+	}
+
+	restoreCmd = exec.Command("pg_restore", "--no-owner", "-d", dbName)
+	restoreCmd.Stdout = os.Stdout
+	restoreCmd.Stderr = os.Stderr
+	restoreCmd.Stdin = sideBuf
+	restoreCmd.Env = os.Environ()
+
+	err = restoreCmd.Run()
+
+	if err != nil {
+		return fmt.Errorf("failed to restore side schema: %w", err)
+	}
+
+	fmt.Println("NOTE: Restored selected tables into schema", opts.IntoSchema, "of", dbName, "without their foreign keys")
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/InfinityBotList/ibldev/internal/pgtoc"
+	"github.com/infinitybotlist/eureka/crypto"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestSideSchemaEntries(t *testing.T) {
+	selected := []pgtoc.Entry{
+		{DumpID: 1, Desc: "TABLE", Schema: "public", Name: "votes"},
+		{DumpID: 2, Desc: "SEQUENCE", Schema: "public", Name: "votes_id_seq"},
+		{DumpID: 3, Desc: "TABLE DATA", Schema: "public", Name: "votes"},
+		{DumpID: 4, Desc: "SEQUENCE SET", Schema: "public", Name: "votes_id_seq"},
+		{DumpID: 5, Desc: "CONSTRAINT", Schema: "public", Name: "votes votes_pkey"},
+		{DumpID: 6, Desc: "INDEX", Schema: "public", Name: "votes_bot_idx"},
+		{DumpID: 7, Desc: "FK CONSTRAINT", Schema: "public", Name: "votes votes_bot_id_fkey"},
+	}
+
+	sections := map[int]string{1: "pre-data", 2: "pre-data", 3: "data", 4: "data", 5: "post-data", 6: "post-data", 7: "post-data"}
+
+	data, postData := sideSchemaEntries(selected, sections)
+
+	ids := func(entries []pgtoc.Entry) []int {
+		var r []int
+		for _, e := range entries {
+			r = append(r, e.DumpID)
+		}
+		return r
+	}
+
+	if got := ids(data); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("data entries = %v, want [3 4]", got)
+	}
+
+	if got := ids(postData); len(got) != 2 || got[0] != 5 || got[1] != 6 {
+		t.Errorf("post-data entries = %v, want [5 6] (no foreign keys)", got)
+	}
+}
+
+// Creates a database for a test, dropping it when the test ends. Skips the test if there is no local postgres
+func testDatabase(t *testing.T, conn *pgx.Conn, prefix string) string {
+	t.Helper()
+
+	name := prefix + "_" + strings.ToLower(crypto.RandString(8))
+
+	_, err := conn.Exec(context.Background(), "CREATE DATABASE "+pgx.Identifier{name}.Sanitize())
+
+	if err != nil {
+		t.Fatalf("failed to create database %s: %v", name, err)
+	}
+
+	t.Cleanup(func() {
+		conn.Exec(context.Background(), "DROP DATABASE IF EXISTS "+pgx.Identifier{name}.Sanitize()+" WITH (FORCE)")
+	})
+
+	return name
+}
+
+func testExec(t *testing.T, dbName string, sql string) {
+	t.Helper()
+
+	conn, err := pgx.Connect(context.Background(), "postgres:///"+dbName)
+
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", dbName, err)
+	}
+
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(context.Background(), sql)
+
+	if err != nil {
+		t.Fatalf("failed to run %q: %v", sql, err)
+	}
+}
+
+func testQueryInt(t *testing.T, dbName string, sql string) int {
+	t.Helper()
+
+	conn, err := pgx.Connect(context.Background(), "postgres:///"+dbName)
+
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", dbName, err)
+	}
+
+	defer conn.Close(context.Background())
+
+	var n int
+
+	err = conn.QueryRow(context.Background(), sql).Scan(&n)
+
+	if err != nil {
+		t.Fatalf("failed to run %q: %v", sql, err)
+	}
+
+	return n
+}
+
+// A table with a foreign key and an enum column, restored on its own
+func TestSelectiveRestoreForeignKeyAndEnum(t *testing.T) {
+	ctx := context.Background()
+
+	for _, bin := range []string{"pg_dump", "pg_restore"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip(bin, "is not installed")
+		}
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+	if err != nil {
+		t.Skip("no local postgres server:", err)
+	}
+
+	defer conn.Close(ctx)
+
+	src := testDatabase(t, conn, "ibl_test_src")
+
+	testExec(t, src, `CREATE TYPE vote_kind AS ENUM ('up', 'down');
+CREATE TABLE bots (bot_id text PRIMARY KEY);
+CREATE TABLE votes (id serial PRIMARY KEY, bot_id text NOT NULL REFERENCES bots(bot_id), kind vote_kind NOT NULL DEFAULT 'up');
+CREATE INDEX votes_bot_idx ON votes (bot_id);
+INSERT INTO bots VALUES ('a'), ('b');
+INSERT INTO votes (bot_id, kind) VALUES ('a', 'up'), ('b', 'down'), ('a', 'down');`)
+
+	dump, err := exec.Command("pg_dump", "-Fc", "-d", src).Output()
+
+	if err != nil {
+		t.Fatalf("pg_dump failed: %v", err)
+	}
+
+	target := testDatabase(t, conn, "ibl_test_target")
+
+	restoreCmd := exec.Command("pg_restore", "--no-owner", "-d", target)
+	restoreCmd.Stdin = bytes.NewReader(dump)
+	restoreCmd.Stderr = os.Stderr
+
+	err = restoreCmd.Run()
+
+	if err != nil {
+		t.Fatalf("pg_restore failed: %v", err)
+	}
+
+	opts := selectiveRestoreOpts{Filter: pgtoc.Filter{OnlyTables: []string{"votes"}}}
+
+	t.Run("into schema", func(t *testing.T) {
+		opts := opts
+		opts.IntoSchema = "side"
+
+		err := selectiveRestore(ctx, map[string]*bytes.Buffer{}, bytes.NewBuffer(dump), target, opts)
+
+		if err != nil {
+			t.Fatalf("selectiveRestore failed: %v", err)
+		}
+
+		if n := testQueryInt(t, target, "SELECT count(*) FROM side.votes WHERE kind = 'down'"); n != 2 {
+			t.Errorf("side.votes has %d down votes, want 2", n)
+		}
+
+		if n := testQueryInt(t, target, "SELECT count(*) FROM pg_constraint WHERE conrelid = 'side.votes'::regclass AND contype = 'f'"); n != 0 {
+			t.Errorf("side.votes has %d foreign keys, want 0", n)
+		}
+
+		if n := testQueryInt(t, target, "SELECT count(*) FROM pg_tables WHERE schemaname = 'side'"); n != 1 {
+			t.Errorf("side schema has %d tables, want only votes", n)
+		}
+	})
+
+	t.Run("existing non empty table", func(t *testing.T) {
+		err := selectiveRestore(ctx, map[string]*bytes.Buffer{}, bytes.NewBuffer(dump), target, opts)
+
+		if err == nil || !strings.Contains(err.Error(), "have rows") {
+			t.Fatalf("selectiveRestore error = %v, want a refusal as votes has rows", err)
+		}
+	})
+
+	t.Run("wiped table", func(t *testing.T) {
+		testExec(t, target, "TRUNCATE votes")
+
+		err := selectiveRestore(ctx, map[string]*bytes.Buffer{}, bytes.NewBuffer(dump), target, opts)
+
+		if err != nil {
+			t.Fatalf("selectiveRestore failed: %v", err)
+		}
+
+		if n := testQueryInt(t, target, "SELECT count(*) FROM votes"); n != 3 {
+			t.Errorf("votes has %d rows, want 3", n)
+		}
+	})
+}
@@ -0,0 +1,350 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// The superuser of sandbox clusters
+const sandboxUser = "postgres"
+
+// A running sandbox, stored as sandbox.json in its directory
+type sandboxState struct {
+	Name      string    `json:"name"`
+	Dir       string    `json:"dir"`
+	Port      int       `json:"port"`
+	Database  string    `json:"database"`
+	Seed      string    `json:"seed,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *sandboxState) dataDir() string {
+	return filepath.Join(s.Dir, "data")
+}
+
+func (s *sandboxState) logFile() string {
+	return filepath.Join(s.Dir, "postgres.log")
+}
+
+// Returns the DSN of the sandbox database
+func (s *sandboxState) dsn() string {
+	return "postgres://" + sandboxUser + "@127.0.0.1:" + strconv.Itoa(s.Port) + "/" + s.Database + "?sslmode=disable"
+}
+
+// Returns the libpq environment variables pointing to the sandbox
+func (s *sandboxState) env() []string {
+	return []string{
+		"PGHOST=127.0.0.1",
+		"PGPORT=" + strconv.Itoa(s.Port),
+		"PGUSER=" + sandboxUser,
+		"PGDATABASE=" + s.Database,
+		"PGSSLMODE=disable",
+		"DATABASE_URL=" + s.dsn(),
+	}
+}
+
+// Returns the directory of a sandbox
+func sandboxDir(name string) string {
+	return filepath.Join(os.TempDir(), "ibl-sandbox-"+name)
+}
+
+// Loads the state of a sandbox, returns os.ErrNotExist if it is not running
+func loadSandbox(name string) (*sandboxState, error) {
+	data, err := os.ReadFile(filepath.Join(sandboxDir(name), "sandbox.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s sandboxState
+
+	err = json.Unmarshal(data, &s)
+
+	if err != nil {
+		return nil, fmt.Errorf("sandbox state is corrupt: %w", err)
+	}
+
+	return &s, nil
+}
+
+// Finds a postgres server binary, falling back to the bindir of pg_config as initdb and
+// pg_ctl are often not on the PATH (e.g. on Debian)
+func pgBinary(name string) (string, error) {
+	path, err := exec.LookPath(name)
+
+	if err == nil {
+		return path, nil
+	}
+
+	out, cerr := exec.Command("pg_config", "--bindir").Output()
+
+	if cerr == nil {
+		path = filepath.Join(strings.TrimSpace(string(out)), name)
+
+		if _, serr := os.Stat(path); serr == nil {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("could not find %s on the PATH or in the pg_config bindir: %w", name, err)
+}
+
+// Returns a TCP port that is free right now
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func runPgBinary(name string, args ...string) error {
+	path, err := pgBinary(name)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("=>", name, strings.Join(args, " "))
+
+	c := exec.Command(path, args...)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Env = os.Environ()
+
+	return c.Run()
+}
+
+// Stops the server of a sandbox and removes its directory
+func destroySandbox(s *sandboxState) error {
+	if _, err := os.Stat(filepath.Join(s.dataDir(), "postmaster.pid")); err == nil {
+		err = runPgBinary("pg_ctl", "-D", s.dataDir(), "-m", "fast", "-w", "stop")
+
+		if err != nil {
+			fmt.Println("WARNING: Failed to stop sandbox server:", err)
+		}
+	}
+
+	return os.RemoveAll(s.Dir)
+}
+
+var sandboxCmd = &cobra.Command{
+	Use:   "sandbox",
+	Short: "Disposable local postgres clusters for development and tests",
+	Long:  "Disposable local postgres clusters for development and tests. Each sandbox runs its own postgres server (started with initdb and pg_ctl) in a temporary directory on a free port",
+}
+
+var sandboxUpCmd = &cobra.Command{
+	Use:     "up",
+	Example: "up --seed <seed file>/<seed url>",
+	Short:   "Starts a sandbox, optionally loading a seed into it",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		name := cmd.Flag("name").Value.String()
+
+		if _, err := loadSandbox(name); err == nil {
+			fmt.Println("ERROR: Sandbox", name, "is already up")
+			fmt.Println("HINT: Run `ibl db sandbox down` first or use --name to start another one")
+			os.Exit(1)
+		}
+
+		port, err := freePort()
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to find a free port:", err)
+			os.Exit(1)
+		}
+
+		s := &sandboxState{
+			Name:      name,
+			Dir:       sandboxDir(name),
+			Port:      port,
+			Database:  cmd.Flag("db").Value.String(),
+			Seed:      cmd.Flag("seed").Value.String(),
+			CreatedAt: time.Now(),
+		}
+
+		// Removes the half created sandbox and exits
+		fail := func(msg ...any) {
+			fmt.Println(append([]any{"ERROR:"}, msg...)...)
+			fmt.Println("CLEANUP: Removing sandbox", name)
+
+			err := destroySandbox(s)
+
+			if err != nil {
+				fmt.Println("FATAL: Failed to remove sandbox directory '"+s.Dir+"'! Please do so manually.\nError:", err)
+			}
+
+			os.Exit(1)
+		}
+
+		// Leftovers of a sandbox whose up failed or was interrupted
+		err = os.RemoveAll(s.Dir)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to remove stale sandbox directory:", err)
+			os.Exit(1)
+		}
+
+		err = os.MkdirAll(s.Dir, 0700)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to create sandbox directory:", err)
+			os.Exit(1)
+		}
+
+		err = runPgBinary("initdb", "-D", s.dataDir(), "-U", sandboxUser, "--auth=trust", "-E", "UTF8", "--no-sync")
+
+		if err != nil {
+			fail("Failed to initialize cluster:", err)
+		}
+
+		// Sockets go in the sandbox directory so they never clash with the system server.
+		// Durability is not needed for a disposable database
+		opts := "-p " + strconv.Itoa(port) + " -k '" + s.Dir + "' -c listen_addresses=127.0.0.1 -c fsync=off -c synchronous_commit=off -c full_page_writes=off"
+
+		err = runPgBinary("pg_ctl", "-D", s.dataDir(), "-l", s.logFile(), "-o", opts, "-w", "start")
+
+		if err != nil {
+			fail("Failed to start server, see", s.logFile()+":", err)
+		}
+
+		state, err := json.MarshalIndent(s, "", "  ")
+
+		if err != nil {
+			fail("Failed to encode sandbox state:", err)
+		}
+
+		err = os.WriteFile(filepath.Join(s.Dir, "sandbox.json"), state, 0600)
+
+		if err != nil {
+			fail("Failed to write sandbox state:", err)
+		}
+
+		if s.Seed != "" {
+			// Load the seed with `ibl db load` pointed at the sandbox
+			self, err := os.Executable()
+
+			if err != nil {
+				fail("Failed to find the ibl executable:", err)
+			}
+
+			loadArgs := []string{"db", "load", s.Seed, "--db", s.Database}
+
+			if privKey := cmd.Flag("priv-key").Value.String(); privKey != "" {
+				loadArgs = append(loadArgs, "--priv-key", privKey)
+			}
+
+			fmt.Println("=> ibl", strings.Join(loadArgs, " "))
+
+			load := exec.Command(self, loadArgs...)
+			load.Stdout = os.Stdout
+			load.Stderr = os.Stderr
+			load.Env = append(os.Environ(), s.env()...)
+
+			err = load.Run()
+
+			if err != nil {
+				fail("Failed to load seed:", err)
+			}
+		} else {
+			conn, err := pgx.Connect(ctx, "postgres://"+sandboxUser+"@127.0.0.1:"+strconv.Itoa(port)+"/postgres?sslmode=disable")
+
+			if err != nil {
+				fail("Failed to acquire database conn:", err)
+			}
+
+			_, err = conn.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{s.Database}.Sanitize())
+			conn.Close(ctx)
+
+			if err != nil {
+				fail("Failed to create database:", err)
+			}
+		}
+
+		fmt.Println("\nSandbox", name, "is up")
+		fmt.Println("DSN:", s.dsn())
+		fmt.Println("HINT: Run `eval \"$(ibl db sandbox env)\"` to point psql and ibl at it, and `ibl db sandbox down` to remove it")
+	},
+}
+
+var sandboxEnvCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Prints shell exports pointing libpq (psql, ibl etc.) at a sandbox",
+	Long:  "Prints shell exports pointing libpq (psql, ibl etc.) at a sandbox. Use with eval \"$(ibl db sandbox env)\"",
+	Run: func(cmd *cobra.Command, args []string) {
+		name := cmd.Flag("name").Value.String()
+
+		s, err := loadSandbox(name)
+
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, "ERROR: Sandbox", name, "is not up")
+			os.Exit(1)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+
+		for _, v := range s.env() {
+			key, value, _ := strings.Cut(v, "=")
+			fmt.Println("export " + key + "='" + value + "'")
+		}
+	},
+}
+
+var sandboxDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Stops a sandbox and removes all of its data",
+	Run: func(cmd *cobra.Command, args []string) {
+		name := cmd.Flag("name").Value.String()
+
+		s, err := loadSandbox(name)
+
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Println("NOTE: Sandbox", name, "is not up")
+			return
+		} else if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		err = destroySandbox(s)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to remove sandbox directory:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("NOTE: Sandbox", name, "removed")
+	},
+}
+
+func init() {
+	sandboxCmd.PersistentFlags().String("name", "default", "The name of the sandbox, allows running more than one")
+
+	sandboxUpCmd.Flags().String("seed", "", "The seed file or URL to load into the sandbox")
+	sandboxUpCmd.Flags().String("db", "infinity", "The name of the database to create or load the seed into")
+	sandboxUpCmd.Flags().String("priv-key", "", "The private key to decrypt the seed with")
+
+	sandboxCmd.AddCommand(sandboxUpCmd)
+	sandboxCmd.AddCommand(sandboxEnvCmd)
+	sandboxCmd.AddCommand(sandboxDownCmd)
+	dbCmd.AddCommand(sandboxCmd)
+}
@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/InfinityBotList/ibldev/internal/dbtypegen"
+	"github.com/InfinityBotList/ibldev/internal/downloader"
+	"github.com/InfinityBotList/ibldev/internal/migrator"
+	"github.com/InfinityBotList/ibldev/internal/schemadiff"
+	"github.com/InfinityBotList/ibldev/internal/schemaexport"
+	"github.com/infinitybotlist/eureka/crypto"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Tables ibl itself creates in loaded databases, these are never part of a seed's schema
+var bookkeepingTables = []string{"seed_info", migrator.Table}
+
+// Reads the catalog of the schema of a seed file
+//
+// As seeds only contain a pg_dump archive, the schema is restored into a scratch database first
+func seedCatalog(ctx context.Context, cmd *cobra.Command, filename string) (*dbparser.Catalog, error) {
+	if downloader.IsURL(filename) {
+		fmt.Println("Downloading", filename)
+
+		path, err := downloader.DownloadFileCached(filename)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to download seed: %w", err)
+		}
+
+		filename = path
+	}
+
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open seed file: %w", err)
+	}
+
+	defer f.Close()
+
+	sections, _, err := openAutoEncryptedFullFile(cmd, f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := iblfile.LoadMetadata(sections)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if meta.Type != "db.seed" {
+		return nil, fmt.Errorf("expected a db.seed file, got %s", meta.Type)
+	}
+
+	schema, ok := sections["schema"]
+
+	if !ok {
+		return nil, fmt.Errorf("seed file is corrupt [no schema]")
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	scratchName := "ibl_schema_" + strings.ToLower(crypto.RandString(10))
+
+	c := "CREATE DATABASE " + pgx.Identifier{scratchName}.Sanitize()
+	fmt.Println("[psql, scratchDb] =>", c)
+
+	_, err = conn.Exec(ctx, c)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch database: %w", err)
+	}
+
+	defer func() {
+		fmt.Println("CLEANUP: Dropping scratch database", scratchName)
+
+		_, err := conn.Exec(ctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{scratchName}.Sanitize())
+
+		if err != nil {
+			fmt.Println("FATAL: Failed to drop scratch database '"+scratchName+"'! Please do so manually.\nError:", err)
+		}
+	}()
+
+	err = tryHandlingExtensions(sections, scratchName)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to handle extensions: %w", err)
+	}
+
+	restoreCmd := exec.Command("pg_restore", "--no-owner", "--no-privileges", "-d", scratchName)
+	restoreCmd.Stdout = os.Stdout
+	restoreCmd.Stderr = os.Stderr
+	restoreCmd.Stdin = schema
+	restoreCmd.Env = os.Environ()
+
+	err = restoreCmd.Run()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore seed schema: %w", err)
+	}
+
+	sconn, err := pgx.Connect(ctx, "postgres:///"+scratchName)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire scratch database conn: %w", err)
+	}
+
+	defer sconn.Close(ctx)
+
+	return dbparser.GetCatalog(ctx, sconn)
+}
+
+// Reads the catalog of a live database
+func liveCatalog(ctx context.Context, dsn string) (*dbparser.Catalog, error) {
+	conn, err := pgx.Connect(ctx, dsn)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	return dbparser.GetCatalog(ctx, conn)
+}
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Database schema utilities",
+	Long:  "Database schema utilities",
+}
+
+var schemaDiffCmd = &cobra.Command{
+	Use:     "diff <seed file>",
+	Example: "diff <seed file>/<seed url> --db infinity",
+	Short:   "Compares the schema of a seed file against a live database",
+	Long:    "Compares the tables, columns, types, defaults, indexes, constraints, enums and functions of a seed file against a live database and prints the ALTER statements needed to bring the live database in line. Statements that would drop data are only printed as comments",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		want, err := seedCatalog(ctx, cmd, args[0])
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		dbName := cmd.Flag("db").Value.String()
+
+		have, err := liveCatalog(ctx, "postgres:///"+dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read schema of", dbName+":", err)
+			os.Exit(1)
+		}
+
+		changes := schemadiff.Diff(want, have, bookkeepingTables)
+
+		if len(changes) == 0 {
+			fmt.Println("NOTE: Database", dbName, "matches the seed schema")
+			return
+		}
+
+		fmt.Println("\n== Schema Diff ==")
+
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+
+		sql := "-- Generated by ibl db schema diff to bring " + dbName + " in line with " + args[0] + "\n" + schemadiff.SQL(changes)
+
+		fmt.Println("\n== Migration SQL ==")
+		fmt.Print(sql)
+
+		out := cmd.Flag("out").Value.String()
+
+		if out != "" {
+			err = os.WriteFile(out, []byte(sql), 0644)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to write migration SQL:", err)
+				os.Exit(1)
+			}
+
+			fmt.Println("\nNOTE: Wrote migration SQL to", out)
+		}
+	},
+}
+
+var schemaCheckCmd = &cobra.Command{
+	Use:     "check <seed-ci.json>",
+	Example: "check seed-ci.json --dsn postgres:///infinity",
+	Short:   "Checks a live database against a seed-ci.json file",
+	Long: `Checks a live database against a seed-ci.json file (of any version) and reports missing tables, columns, views and enum values, type mismatches and nullability changes.
+
+Every difference is classified as breaking (code written against seed-ci.json will fail) or compatible.
+
+Exits with status 2 if there are breaking changes and 1 on errors, so CI pipelines can block code that expects columns that do not exist`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		data, err := os.ReadFile(args[0])
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read seed-ci.json:", err)
+			os.Exit(1)
+		}
+
+		want, err := dbparser.ParseCISchema(data)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		if want.Version < dbparser.CISchemaVersion {
+			fmt.Println("NOTE:", args[0], "uses the legacy format, only public tables and columns are checked and type modifiers are ignored")
+		}
+
+		conn, err := pgx.Connect(ctx, cmd.Flag("dsn").Value.String())
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		have, err := dbparser.GetCISchema(ctx, conn)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read schema:", err)
+			os.Exit(1)
+		}
+
+		findings := schemadiff.CheckCI(want, have, bookkeepingTables)
+
+		var breaking int
+
+		for _, f := range findings {
+			if f.Severity == schemadiff.Breaking {
+				breaking++
+			}
+		}
+
+		if len(findings) > 0 {
+			fmt.Println("\n== Schema Check ==")
+
+			// Breaking changes first
+			for _, severity := range []string{schemadiff.Breaking, schemadiff.Compatible} {
+				for _, f := range findings {
+					if f.Severity == severity {
+						fmt.Println(f)
+					}
+				}
+			}
+
+			fmt.Println("")
+		}
+
+		fmt.Println(breaking, "breaking and", len(findings)-breaking, "compatible differences")
+
+		if breaking > 0 {
+			fmt.Println("ERROR: The database has breaking changes compared to", args[0])
+			conn.Close(ctx)
+			os.Exit(2)
+		}
+	},
+}
+
+var schemaExportCmd = &cobra.Command{
+	Use:     "export",
+	Example: "export --format openapi --out docs/db.json",
+	Short:   "Exports the database schema as JSON Schema or OpenAPI components",
+	Long: `Renders every table and view of a database as a JSON Schema object and every enum as a string schema, either as the $defs of a JSON Schema document (--format jsonschema) or as the components/schemas of an OpenAPI 3 document (--format openapi).
+
+Descriptions are taken from COMMENT ON TABLE/VIEW/COLUMN so API docs stay in sync with the database`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		format := cmd.Flag("format").Value.String()
+		out := cmd.Flag("out").Value.String()
+
+		if out == "" {
+			fmt.Println("ERROR: You must specify a file to write the schema to with --out")
+			os.Exit(1)
+		}
+
+		conn, err := pgx.Connect(ctx, cmd.Flag("dsn").Value.String())
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		schema, err := dbparser.GetCISchema(ctx, conn)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read schema:", err)
+			os.Exit(1)
+		}
+
+		rels := slices.DeleteFunc(dbtypegen.Relations(schema), func(r dbtypegen.Relation) bool {
+			return slices.Contains(bookkeepingTables, r.Name)
+		})
+
+		defs, err := schemaexport.Export(schema, rels, format)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		var doc any = schemaexport.JSONSchema(defs)
+
+		if format == schemaexport.FormatOpenAPI {
+			doc, err = schemaexport.OpenAPI(defs, conn.Config().Database+" database schema")
+
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+		}
+
+		data, err := json.MarshalIndent(doc, "", "  ")
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to encode schema:", err)
+			os.Exit(1)
+		}
+
+		err = os.WriteFile(out, append(data, '\n'), 0644)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to write schema:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Wrote", len(defs), "schemas to", out)
+	},
+}
+
+func init() {
+	schemaExportCmd.Flags().String("format", schemaexport.FormatJSONSchema, "The output format (jsonschema, openapi)")
+	schemaExportCmd.Flags().String("out", "", "The file to write the schema to")
+	schemaExportCmd.Flags().String("dsn", "postgres:///infinity", "The database to export the schema of")
+
+	schemaCmd.AddCommand(schemaExportCmd)
+
+	schemaCheckCmd.Flags().String("dsn", "postgres:///infinity", "The database to check")
+
+	schemaCmd.AddCommand(schemaCheckCmd)
+
+	schemaDiffCmd.Flags().String("db", "infinity", "The live database to compare against")
+	schemaDiffCmd.Flags().String("out", "", "Also write the migration SQL to this file")
+	schemaDiffCmd.Flags().String("priv-key", "", "The private key [pem] to decrypt the seed with")
+	schemaDiffCmd.Flags().String("enc-key", "", "The encryption key [aes256] to decrypt the seed with")
+
+	schemaCmd.AddCommand(schemaDiffCmd)
+	dbCmd.AddCommand(schemaCmd)
+}
@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/pgtoc"
+	"github.com/InfinityBotList/ibldev/internal/seeddata"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Older format versions that can still be loaded, keyed by file type
+var compatibleFormatVersions = map[string][]string{
+	// a2 seeds only store pg_dump archives, which is the same as a3 with the pg data format
+	"db.seed": {"a2"},
+}
+
+// Like iblfile.ParseMetadata, but also accepts the older format versions in compatibleFormatVersions
+func parseDbMetadata(sections map[string]*bytes.Buffer) (*iblfile.Meta, error) {
+	meta, err := iblfile.LoadMetadata(sections)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Protocol != iblfile.Protocol {
+		return nil, fmt.Errorf("invalid protocol: %s", meta.Protocol)
+	}
+
+	f, err := iblfile.GetFormat(meta.Type)
+
+	if f == nil {
+		return nil, fmt.Errorf("unknown format: %s %s", meta.Type, err)
+	}
+
+	if meta.FormatVersion != f.Version && !slices.Contains(compatibleFormatVersions[meta.Type], meta.FormatVersion) {
+		return nil, fmt.Errorf("this %s uses format version %s, but this iblfile version only supports version %s", meta.Type, meta.FormatVersion, f.Version)
+	}
+
+	return meta, nil
+}
+
+// Returns the format version to write a seed with. Seeds with pg data are still written as a2 so
+// older versions of ibl can load them, only plain data formats need the current version
+func seedFormatVersion(f *iblfile.Format, dataFormat string) string {
+	if seeddata.IsPlain(dataFormat) {
+		return f.Version
+	}
+
+	return "a2"
+}
+
+// Opens a db file for loading, decrypting it with the priv-key/enc-key flags of cmd
+//
+// Needs priv-key and enc-key to be registered as args
+func openDbFile(cmd *cobra.Command, f io.ReadSeeker) (map[string]*bytes.Buffer, *iblfile.Meta, error) {
+	fileType, err := iblfile.DeduceType(f, false)
+
+	if err != nil {
+		fmt.Println("WARNING: Failed to deduce file type:", err, "- defaulting to AutoEncryptedFile_FullFile")
+	} else if fileType.Type != iblfile.DeducedTypeAutoEncryptedFile_FullFile {
+		return nil, nil, fmt.Errorf("invalid file type: %s. Try using the `iblcli upgrade` command to upgrade the file", fileType.Type.String())
+	}
+
+	sections, _, err := openAutoEncryptedFullFile(cmd, f)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta, err := parseDbMetadata(sections)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+
+	return sections, meta, nil
+}
+
+// Returns the data format of a seed, seeds made before data formats were added use pg
+func dataFormatOrDefault(format string) string {
+	if format == "" {
+		return seeddata.FormatPg
+	}
+
+	return format
+}
+
+// Returns the name of the section holding the plain data of a seed table
+func plainSeedSection(table string) string {
+	return "plain/" + table
+}
+
+// Returns the column types and primary key columns of a table
+func tableColumnInfo(ctx context.Context, conn *pgx.Conn, table string) (map[string]string, []string, error) {
+	rows, err := conn.Query(ctx, `SELECT a.attname, format_type(a.atttypid, a.atttypmod) FROM pg_attribute a
+WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped`, table)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+
+	types := map[string]string{}
+
+	for rows.Next() {
+		var name, typ string
+
+		err = rows.Scan(&name, &typ)
+
+		if err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("failed to read column of %s: %w", table, err)
+		}
+
+		types[name] = typ
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+
+	rows, err = conn.Query(ctx, `SELECT a.attname FROM pg_index i
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE i.indrelid = $1::regclass AND i.indisprimary
+ORDER BY array_position(i.indkey::int2[], a.attnum)`, table)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read primary key of %s: %w", table, err)
+	}
+
+	defer rows.Close()
+
+	var pk []string
+
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read primary key of %s: %w", table, err)
+		}
+
+		pk = append(pk, name)
+	}
+
+	return types, pk, rows.Err()
+}
+
+// Converts the pg_dump archive of a single seed table to a plain data format, with rows sorted by primary key
+func archiveToPlain(ctx context.Context, dbName, table string, archive *bytes.Buffer, format string) (*bytes.Buffer, error) {
+	conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	types, pk, err := tableColumnInfo(ctx, conn, table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := seeddata.FromArchive(bytes.NewReader(archive.Bytes()), types)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dump of %s: %w", table, err)
+	}
+
+	t.Sort(pk)
+
+	var buf bytes.Buffer
+
+	err = t.Encode(&buf, format)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", table, err)
+	}
+
+	return &buf, nil
+}
+
+// Restores the plain data of a seed table into dbName using COPY, then moves the
+// sequences owned by the table past the restored values
+func restorePlainSeedTable(ctx context.Context, sections map[string]*bytes.Buffer, format, dbName, table string) error {
+	buf, ok := sections[plainSeedSection(table)]
+
+	if !ok {
+		return fmt.Errorf("failed to find data for table %s", table)
+	}
+
+	t, err := seeddata.Decode(bytes.NewReader(buf.Bytes()), format)
+
+	if err != nil {
+		return fmt.Errorf("data for table %s is corrupt: %w", table, err)
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	var ident string
+
+	err = conn.QueryRow(ctx, "SELECT $1::regclass::text", table).Scan(&ident)
+
+	if err != nil {
+		return fmt.Errorf("failed to find table %s: %w", table, err)
+	}
+
+	if len(t.Columns) == 0 {
+		return nil
+	}
+
+	_, err = conn.PgConn().CopyFrom(ctx, t.CopyData(), "COPY "+ident+" ("+t.ColumnList()+") FROM STDIN")
+
+	if err != nil {
+		return fmt.Errorf("failed to copy data into %s: %w", table, err)
+	}
+
+	for _, c := range t.Columns {
+		var seq *string
+
+		err = conn.QueryRow(ctx, "SELECT pg_get_serial_sequence($1, $2)", ident, c.Name).Scan(&seq)
+
+		if err != nil {
+			return fmt.Errorf("failed to find sequence of %s.%s: %w", table, c.Name, err)
+		}
+
+		if seq == nil {
+			continue
+		}
+
+		col := pgx.Identifier{c.Name}.Sanitize()
+
+		_, err = conn.Exec(ctx, "SELECT setval($1, COALESCE((SELECT MAX("+col+") FROM "+ident+"), 0) + 1, false)", *seq)
+
+		if err != nil {
+			return fmt.Errorf("failed to reset sequence %s: %w", *seq, err)
+		}
+	}
+
+	return nil
+}
+
+// Converts a section to a reviewable form for `file extract --plain`, returning the
+// new data and the extension to add to the section name
+//
+// pg_dump archives become SQL, JSON is indented and plain seed data gets the
+// extension of its format. Anything else is returned unchanged
+func plainSection(sections map[string]*bytes.Buffer, name string, buf *bytes.Buffer) (*bytes.Buffer, string, error) {
+	switch {
+	case pgtoc.IsArchive(buf.Bytes()):
+		var out bytes.Buffer
+		restoreCmd := exec.Command("pg_restore", "-f", "-")
+		restoreCmd.Stdin = bytes.NewReader(buf.Bytes())
+		restoreCmd.Stdout = &out
+		restoreCmd.Stderr = os.Stderr
+		restoreCmd.Env = os.Environ()
+
+		err := restoreCmd.Run()
+
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to convert %s to SQL: %w", name, err)
+		}
+
+		return &out, ".sql", nil
+	case strings.HasPrefix(name, "plain/"):
+		var smeta SeedMetadata
+
+		seedMetaBuf, ok := sections["seed_meta"]
+
+		if !ok {
+			return buf, "", nil
+		}
+
+		err := json.NewDecoder(bytes.NewReader(seedMetaBuf.Bytes())).Decode(&smeta)
+
+		if err != nil || !seeddata.IsPlain(smeta.DataFormat) {
+			return buf, "", nil
+		}
+
+		return buf, seeddata.Ext(smeta.DataFormat), nil
+	case json.Valid(buf.Bytes()):
+		var out bytes.Buffer
+
+		err := json.Indent(&out, buf.Bytes(), "", "  ")
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		return &out, ".json", nil
+	default:
+		return buf, "", nil
+	}
+}
@@ -0,0 +1,497 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/infinitybotlist/iblfile"
+	"github.com/infinitybotlist/iblfile/encryptors/noencryption"
+	"github.com/infinitybotlist/iblfile/encryptors/pem"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Metadata about a snapshot. This is stored in the ibl_snapshots bookkeeping
+// table and in the snapshot_meta section of exported snapshots
+type SnapshotMetadata struct {
+	// Name of the snapshot
+	Name string `json:"n"`
+
+	// Database the snapshot was taken of
+	SourceDatabase string `json:"s"`
+
+	// Git commit of the working tree when the snapshot was taken
+	GitCommit string `json:"g"`
+
+	// When the snapshot was taken
+	CreatedAt time.Time `json:"c"`
+}
+
+var snapshotNameRegex = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// Returns the name of the template database backing a snapshot
+func snapshotDbName(dbName, name string) string {
+	return dbName + "__snap_" + name
+}
+
+// Returns the git commit of the current working tree, suffixed with -dirty
+// if there are uncommitted changes
+func workingTreeCommit() string {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+
+	if err != nil {
+		return "unknown"
+	}
+
+	commit := strings.TrimSpace(string(out))
+
+	status, err := exec.Command("git", "status", "--porcelain").Output()
+
+	if err == nil && len(bytes.TrimSpace(status)) > 0 {
+		commit += "-dirty"
+	}
+
+	return commit
+}
+
+// Connects to the maintenance database and ensures the snapshot bookkeeping table exists
+func snapshotConn(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS ibl_snapshots (
+		name TEXT NOT NULL,
+		source_database TEXT NOT NULL,
+		git_commit TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (source_database, name)
+	)`)
+
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("failed to create snapshot bookkeeping table: %w", err)
+	}
+
+	return conn, nil
+}
+
+var snapshotSaveCmd = &cobra.Command{
+	Use:   "save <name>",
+	Short: "Saves a snapshot of a local database",
+	Long:  "Saves a snapshot of a local database as a template database. The database must not have any active connections unless --force is set",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		dbName := cmd.Flag("db").Value.String()
+		force := cmd.Flag("force").Value.String() == "true"
+
+		if !snapshotNameRegex.MatchString(name) {
+			fmt.Println("ERROR: Invalid snapshot name. Snapshot names must match", snapshotNameRegex.String())
+			os.Exit(1)
+		}
+
+		ctx := context.Background()
+
+		conn, err := snapshotConn(ctx)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		exists, err := databaseExists(ctx, conn, dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to check if database exists:", err)
+			os.Exit(1)
+		}
+
+		if !exists {
+			fmt.Println("ERROR: Database", dbName, "does not exist")
+			os.Exit(1)
+		}
+
+		snapName := snapshotDbName(dbName, name)
+
+		exists, err = databaseExists(ctx, conn, snapName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to check if snapshot exists:", err)
+			os.Exit(1)
+		}
+
+		if exists {
+			fmt.Println("ERROR: Snapshot", name, "already exists for", dbName+". Remove it first using `db snapshot rm`")
+			os.Exit(1)
+		}
+
+		activeConns, err := activeConnections(ctx, conn, dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to check for active connections:", err)
+			os.Exit(1)
+		}
+
+		if activeConns > 0 {
+			if !force {
+				fmt.Println("ERROR:", dbName, "has", activeConns, "active connection(s). Close them or use --force to terminate them")
+				os.Exit(1)
+			}
+
+			err = terminateConnections(ctx, conn, dbName)
+
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+		}
+
+		c := "CREATE DATABASE " + pgx.Identifier{snapName}.Sanitize() + " TEMPLATE " + pgx.Identifier{dbName}.Sanitize()
+		fmt.Println("[psql, snapshot] =>", c)
+
+		_, err = conn.Exec(ctx, c)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to create snapshot:", err)
+			os.Exit(1)
+		}
+
+		smeta := SnapshotMetadata{
+			Name:           name,
+			SourceDatabase: dbName,
+			GitCommit:      workingTreeCommit(),
+			CreatedAt:      time.Now(),
+		}
+
+		_, err = conn.Exec(ctx, "INSERT INTO ibl_snapshots (name, source_database, git_commit, created_at) VALUES ($1, $2, $3, $4)", smeta.Name, smeta.SourceDatabase, smeta.GitCommit, smeta.CreatedAt)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to save snapshot metadata:", err)
+
+			// A snapshot without metadata is invisible to list and restore
+			c := "DROP DATABASE IF EXISTS " + pgx.Identifier{snapName}.Sanitize()
+			fmt.Println("CLEANUP: [psql, snapshot] =>", c)
+
+			_, err = conn.Exec(ctx, c)
+
+			if err != nil {
+				fmt.Println("CLEANUP: Failed to drop snapshot database", snapName+":", err)
+			}
+
+			os.Exit(1)
+		}
+
+		fmt.Println("NOTE: Saved snapshot", name, "of", dbName, "at commit", smeta.GitCommit)
+
+		exportPath := cmd.Flag("export").Value.String()
+
+		if exportPath == "" {
+			return
+		}
+
+		var file *iblfile.AutoEncryptedFile_FullFile
+
+		pubKeyFile := cmd.Flag("pubkey").Value.String()
+
+		if pubKeyFile != "" {
+			pubKeyFileContents, err := os.ReadFile(pubKeyFile)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to read public key file:", err)
+				os.Exit(1)
+			}
+
+			file = iblfile.NewAutoEncryptedFile_FullFile(&pem.PemEncryptedSource{
+				KeyCount:  16,
+				PublicKey: pubKeyFileContents,
+			})
+		} else {
+			fmt.Println("NOTE: No public key specified, will not encrypt exported snapshot")
+			file = iblfile.NewAutoEncryptedFile_FullFile(&noencryption.NoEncryptionSource{})
+		}
+
+		var backupBuf = bytes.NewBuffer([]byte{})
+		backupCmd := exec.Command("pg_dump", "-Fc", "-d", snapName)
+		backupCmd.Env = os.Environ()
+		backupCmd.Stdout = backupBuf
+
+		err = backupCmd.Run()
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to dump snapshot:", err)
+			os.Exit(1)
+		}
+
+		err = file.WriteSection(backupBuf, "data")
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to write snapshot to tar file:", err)
+			os.Exit(1)
+		}
+
+		err = file.WriteJsonSection(smeta, "snapshot_meta")
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to write snapshot metadata to tar file:", err)
+			os.Exit(1)
+		}
+
+		f, err := iblfile.GetFormat("db.snapshot")
+
+		if f == nil {
+			fmt.Println("ERROR: Internal error: format is not registered: snapshot", err)
+			os.Exit(1)
+		}
+
+		err = file.WriteJsonSection(iblfile.Meta{
+			CreatedAt:     time.Now(),
+			Protocol:      iblfile.Protocol,
+			Type:          "db.snapshot",
+			FormatVersion: f.Version,
+		}, "meta")
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to write metadata to tar file:", err)
+			os.Exit(1)
+		}
+
+		out, err := os.Create(exportPath)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to create export file:", err)
+			os.Exit(1)
+		}
+
+		defer out.Close()
+
+		err = file.WriteOutput(out)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to write export file:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("NOTE: Exported snapshot to", exportPath)
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore <name>",
+	Short: "Restores a local database from a snapshot",
+	Long:  "Restores a local database from a snapshot. All connections to the database will be terminated. The database is dropped before it is recreated, so if recreating it fails the database does not exist until a snapshot is restored successfully",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		dbName := cmd.Flag("db").Value.String()
+
+		ctx := context.Background()
+
+		conn, err := snapshotConn(ctx)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		snapName := snapshotDbName(dbName, name)
+
+		exists, err := databaseExists(ctx, conn, snapName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to check if snapshot exists:", err)
+			os.Exit(1)
+		}
+
+		if !exists {
+			fmt.Println("ERROR: Snapshot", name, "does not exist for", dbName)
+			os.Exit(1)
+		}
+
+		start := time.Now()
+
+		err = cloneDatabase(ctx, conn, snapName, dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to restore snapshot:", err)
+
+			if errors.Is(err, errCloneDropped) {
+				fmt.Println("WARNING:", dbName, "was dropped and does not exist until a snapshot is restored successfully")
+				fmt.Println("HINT: Run `ibl db snapshot restore", name, "--db", dbName+"` again once the error above is fixed")
+			}
+
+			os.Exit(1)
+		}
+
+		fmt.Println("NOTE: Restored", dbName, "from snapshot", name, "in", time.Since(start).Round(time.Millisecond))
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "Lists all snapshots of a local database",
+	Long:    "Lists all snapshots of a local database",
+	Aliases: []string{"ls"},
+	Run: func(cmd *cobra.Command, args []string) {
+		dbName := cmd.Flag("db").Value.String()
+
+		ctx := context.Background()
+
+		conn, err := snapshotConn(ctx)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		rows, err := conn.Query(ctx, "SELECT name, git_commit, created_at FROM ibl_snapshots WHERE source_database = $1 ORDER BY created_at", dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to fetch snapshots:", err)
+			os.Exit(1)
+		}
+
+		defer rows.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED AT\tGIT COMMIT")
+
+		for rows.Next() {
+			var smeta SnapshotMetadata
+
+			err = rows.Scan(&smeta.Name, &smeta.GitCommit, &smeta.CreatedAt)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to read snapshot:", err)
+				os.Exit(1)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\n", smeta.Name, smeta.CreatedAt.Format(time.RFC3339), smeta.GitCommit)
+		}
+
+		if rows.Err() != nil {
+			fmt.Println("ERROR: Failed to fetch snapshots:", rows.Err())
+			os.Exit(1)
+		}
+
+		w.Flush()
+	},
+}
+
+var snapshotRmCmd = &cobra.Command{
+	Use:     "rm <name>",
+	Short:   "Removes a snapshot of a local database",
+	Long:    "Removes a snapshot of a local database",
+	Aliases: []string{"remove", "delete"},
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		dbName := cmd.Flag("db").Value.String()
+
+		ctx := context.Background()
+
+		conn, err := snapshotConn(ctx)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		snapName := snapshotDbName(dbName, name)
+
+		exists, err := databaseExists(ctx, conn, snapName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to check if snapshot database exists:", err)
+			os.Exit(1)
+		}
+
+		var hasMeta bool
+
+		err = conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM ibl_snapshots WHERE source_database = $1 AND name = $2)", dbName, name).Scan(&hasMeta)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to fetch snapshot metadata:", err)
+			os.Exit(1)
+		}
+
+		if !exists && !hasMeta {
+			fmt.Println("ERROR: No snapshot named", name, "of", dbName)
+			fmt.Println("HINT: Run `ibl db snapshot list --db", dbName+"` to see the available snapshots")
+			os.Exit(1)
+		}
+
+		if exists {
+			err = terminateConnections(ctx, conn, snapName)
+
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+
+			c := "DROP DATABASE " + pgx.Identifier{snapName}.Sanitize()
+			fmt.Println("[psql, snapshot] =>", c)
+
+			_, err = conn.Exec(ctx, c)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to drop snapshot:", err)
+				os.Exit(1)
+			}
+		} else {
+			fmt.Println("WARNING: Snapshot database", snapName, "does not exist, only removing its metadata")
+		}
+
+		tag, err := conn.Exec(ctx, "DELETE FROM ibl_snapshots WHERE source_database = $1 AND name = $2", dbName, name)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to delete snapshot metadata:", err)
+			os.Exit(1)
+		}
+
+		if tag.RowsAffected() == 0 {
+			fmt.Println("WARNING: Snapshot", name, "had no metadata, only dropped its database")
+		}
+
+		fmt.Println("NOTE: Removed snapshot", name, "of", dbName)
+	},
+}
+
+// snapshotCmd represents the db snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Local database snapshots",
+	Long:  `Save, restore and manage named snapshots of local databases. Snapshots are stored as template databases`,
+}
+
+func init() {
+	snapshotCmd.PersistentFlags().String("db", "infinity", "The database to operate on")
+
+	snapshotSaveCmd.Flags().Bool("force", false, "Terminate active connections to the database before taking the snapshot")
+	snapshotSaveCmd.Flags().String("export", "", "Also export the snapshot to an iblfile at this path")
+	snapshotSaveCmd.Flags().String("pubkey", "", "The public key to encrypt the exported snapshot with")
+
+	snapshotCmd.AddCommand(snapshotSaveCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotRmCmd)
+	dbCmd.AddCommand(snapshotCmd)
+}
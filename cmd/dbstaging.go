@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+var stagingResetCmd = &cobra.Command{
+	Use:   "reset <db>",
+	Short: "Resets a staging database to its pristine state using its prodmarker",
+	Long:  "Resets a staging database to its pristine state by recreating it from <db>__prodmarker as a template database. The prodmarker is created when a staging file is loaded using `db load`. <db> is dropped before it is recreated, so if recreating it fails <db> does not exist until the next successful reset",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dbName := args[0]
+		prodMarkerName := dbName + "__prodmarker"
+
+		ctx := context.Background()
+
+		conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		exists, err := databaseExists(ctx, conn, prodMarkerName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to check if prodmarker exists:", err)
+			os.Exit(1)
+		}
+
+		if !exists {
+			fmt.Println("ERROR: No prodmarker found for", dbName, "[expected '"+prodMarkerName+"']. Load a staging file using `db load` first")
+			os.Exit(1)
+		}
+
+		start := time.Now()
+
+		err = cloneDatabase(ctx, conn, prodMarkerName, dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to reset staging database:", err)
+
+			if errors.Is(err, errCloneDropped) {
+				fmt.Println("WARNING:", dbName, "was dropped and does not exist until the next successful reset")
+				fmt.Println("HINT: Run `ibl db staging reset " + dbName + "` again once the error above is fixed")
+			}
+
+			os.Exit(1)
+		}
+
+		fmt.Println("NOTE: Staging database", dbName, "reset successfully in", time.Since(start).Round(time.Millisecond))
+	},
+}
+
+// stagingCmd represents the db staging command
+var stagingCmd = &cobra.Command{
+	Use:   "staging",
+	Short: "Staging database operations",
+	Long:  `Staging database operations`,
+}
+
+func init() {
+	stagingCmd.AddCommand(stagingResetCmd)
+	dbCmd.AddCommand(stagingCmd)
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbstats"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Runs pg_dump on dbName while collecting table statistics in the same snapshot, so
+// the row counts in the stats manifest match the dump exactly
+func dumpWithStats(ctx context.Context, dbName, watermarkColumn string, tables []string, dumpArgs ...string) (*bytes.Buffer, *dbstats.Manifest, error) {
+	conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	var snapshot string
+
+	err = tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&snapshot)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to export snapshot: %w", err)
+	}
+
+	manifest, err := dbstats.Collect(ctx, tx, watermarkColumn, tables)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to collect table stats: %w", err)
+	}
+
+	var buf = bytes.NewBuffer([]byte{})
+	args := append(dumpArgs, "--snapshot="+snapshot, "-d", dbName)
+	dumpCmd := exec.Command("pg_dump", args...)
+	dumpCmd.Env = os.Environ()
+	dumpCmd.Stdout = buf
+	dumpCmd.Stderr = os.Stderr
+
+	err = dumpCmd.Run()
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create db backup: %w", err)
+	}
+
+	return buf, manifest, nil
+}
+
+// Writes a stats manifest to the stats section of a file
+func writeStatsSection(file *iblfile.AutoEncryptedFile_FullFile, manifest *dbstats.Manifest) error {
+	var buf bytes.Buffer
+
+	err := json.NewEncoder(&buf).Encode(manifest)
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal stats: %w", err)
+	}
+
+	return file.WriteSection(&buf, "stats")
+}
+
+// Compares the stats section of a loaded file against dbName
+//
+// Returns a nil manifest if the file has no stats section
+func compareLoadedStats(ctx context.Context, sections map[string]*bytes.Buffer, dbName string) (*dbstats.Manifest, []dbstats.Comparison, error) {
+	statsBuf, ok := sections["stats"]
+
+	if !ok {
+		return nil, nil, nil
+	}
+
+	var expected dbstats.Manifest
+
+	err := json.NewDecoder(bytes.NewReader(statsBuf.Bytes())).Decode(&expected)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("file is corrupt [invalid stats]: %w", err)
+	}
+
+	conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	actual, err := dbstats.Collect(ctx, tx, expected.WatermarkColumn, nil)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to collect table stats: %w", err)
+	}
+
+	return &expected, dbstats.Compare(&expected, actual), nil
+}
+
+// Returns the status of a stats comparison for display
+func comparisonStatus(c dbstats.Comparison) string {
+	switch {
+	case c.Actual == nil:
+		return "MISSING"
+	case c.Actual.Rows != c.Expected.Rows:
+		return "ROW COUNT MISMATCH"
+	case !c.Ok():
+		return "WATERMARK MISMATCH"
+	default:
+		return "ok"
+	}
+}
+
+// Prints a stats comparison as a table, returning false if any table differs
+func printStatsComparison(expected *dbstats.Manifest, comparisons []dbstats.Comparison) bool {
+	fmt.Println("\n== Stats ==")
+
+	if expected.WatermarkColumn != "" {
+		fmt.Println("Watermark Column:", expected.WatermarkColumn)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tEXPECTED ROWS\tACTUAL ROWS\tSIZE AT BACKUP\tSIZE NOW\tWATERMARK\tSTATUS")
+
+	allOk := true
+	for _, c := range comparisons {
+		actualRows, actualSize := "-", "-"
+
+		if c.Actual != nil {
+			actualRows = strconv.FormatInt(c.Actual.Rows, 10)
+			actualSize = strconv.FormatInt(c.Actual.TotalSize, 10)
+		}
+
+		watermark := "-"
+
+		if c.Expected.Watermark != nil {
+			watermark = *c.Expected.Watermark
+		}
+
+		if !c.Ok() {
+			allOk = false
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\t%s\n", c.Expected.QualifiedName(), c.Expected.Rows, actualRows, c.Expected.TotalSize, actualSize, watermark, comparisonStatus(c))
+	}
+
+	w.Flush()
+
+	return allOk
+}
+
+// Verifies the stats of a loaded file, exiting if they differ and --strict-stats is set
+func checkLoadedStats(cmd *cobra.Command, sections map[string]*bytes.Buffer, dbName string) {
+	expected, comparisons, err := compareLoadedStats(context.Background(), sections, dbName)
+
+	ok := true
+	switch {
+	case err != nil:
+		fmt.Println("WARNING: Failed to verify stats:", err)
+		ok = false
+	case expected == nil:
+		fmt.Println("NOTE: File has no stats section, skipping row count verification")
+	default:
+		ok = printStatsComparison(expected, comparisons)
+	}
+
+	if ok {
+		return
+	}
+
+	if cmd.Flag("strict-stats").Value.String() == "true" {
+		fmt.Println("ERROR: Restored database does not match the stats recorded at backup time")
+		os.Exit(1)
+	}
+
+	fmt.Println("WARNING: Restored database does not match the stats recorded at backup time")
+}
@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/InfinityBotList/ibldev/internal/downloader"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// A loaded file as recorded in the ibl_loads bookkeeping table or the seed_info table of a seeded database
+//
+// Older versions of ibl only stored the nonce and created_at columns in seed_info, so all other fields may be empty
+type SeedInfo struct {
+	// Seed nonce, empty for non-seed files
+	Nonce string `json:"nonce"`
+
+	// When the loaded file was created
+	CreatedAt time.Time `json:"created_at"`
+
+	// Type of the loaded file (e.g. db.seed)
+	FileType string `json:"file_type"`
+
+	// Source database of the loaded file, if known
+	SourceDatabase string `json:"source_database"`
+
+	// When the file was loaded
+	LoadedAt *time.Time `json:"loaded_at"`
+}
+
+// Records a loaded seed in the seed_info table of dbName, upgrading the table if needed
+//
+// Only seeds get a seed_info table, other loads are recorded with recordLoad so restored
+// backups, staging dumps and snapshots are not modified
+func recordSeedInfo(ctx context.Context, dbName string, info SeedInfo) error {
+	conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		return fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	defer conn.Close(ctx)
+
+	sqlCmds := []string{
+		"CREATE TABLE IF NOT EXISTS seed_info (nonce TEXT NOT NULL, created_at TIMESTAMPTZ NOT NULL)",
+		"ALTER TABLE seed_info ADD COLUMN IF NOT EXISTS file_type TEXT",
+		"ALTER TABLE seed_info ADD COLUMN IF NOT EXISTS source_database TEXT",
+		"ALTER TABLE seed_info ADD COLUMN IF NOT EXISTS loaded_at TIMESTAMPTZ DEFAULT NOW()",
+	}
+
+	for _, c := range sqlCmds {
+		_, err = conn.Exec(ctx, c)
+
+		if err != nil {
+			return fmt.Errorf("failed to create seed_info table: %w", err)
+		}
+	}
+
+	_, err = conn.Exec(ctx, "INSERT INTO seed_info (nonce, created_at, file_type, source_database) VALUES ($1, $2, $3, $4)", info.Nonce, info.CreatedAt, info.FileType, info.SourceDatabase)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert seed info: %w", err)
+	}
+
+	return nil
+}
+
+// Connects to the maintenance database and ensures the load bookkeeping table exists
+func loadsConn(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire database conn: %w", err)
+	}
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS ibl_loads (
+		datname TEXT NOT NULL,
+		nonce TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL,
+		file_type TEXT NOT NULL,
+		source_database TEXT NOT NULL DEFAULT '',
+		loaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("failed to create load bookkeeping table: %w", err)
+	}
+
+	return conn, nil
+}
+
+// Records a file loaded into dbName in the ibl_loads table of the maintenance database
+func recordLoad(ctx context.Context, dbName string, info SeedInfo) error {
+	conn, err := loadsConn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "INSERT INTO ibl_loads (datname, nonce, created_at, file_type, source_database) VALUES ($1, $2, $3, $4, $5)", dbName, info.Nonce, info.CreatedAt, info.FileType, info.SourceDatabase)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert load info: %w", err)
+	}
+
+	return nil
+}
+
+// Returns the file most recently loaded into dbName from the ibl_loads table, pgx.ErrNoRows if there is none
+func latestLoad(ctx context.Context, dbName string) (*SeedInfo, error) {
+	conn, err := loadsConn(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close(ctx)
+
+	var info SeedInfo
+	var loadedAt time.Time
+
+	err = conn.QueryRow(ctx, "SELECT nonce, created_at, file_type, source_database, loaded_at FROM ibl_loads WHERE datname = $1 ORDER BY loaded_at DESC LIMIT 1", dbName).Scan(&info.Nonce, &info.CreatedAt, &info.FileType, &info.SourceDatabase, &loadedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info.LoadedAt = &loadedAt
+
+	return &info, nil
+}
+
+// Returns the most recently loaded file from the seed_info table
+//
+// to_jsonb is used so both old and new seed_info tables can be read
+func latestSeedInfo(ctx context.Context, conn *pgx.Conn) (*SeedInfo, error) {
+	var data []byte
+
+	err := conn.QueryRow(ctx, "SELECT to_jsonb(s) FROM seed_info s ORDER BY to_jsonb(s)->>'loaded_at' DESC NULLS LAST, created_at DESC LIMIT 1").Scan(&data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var info SeedInfo
+
+	err = json.Unmarshal(data, &info)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode seed info: %w", err)
+	}
+
+	return &info, nil
+}
+
+// Formats the age of a timestamp in a human readable way
+func formatAge(t time.Time) string {
+	age := time.Since(t)
+
+	switch {
+	case age < time.Hour:
+		return age.Round(time.Second).String()
+	case age < 48*time.Hour:
+		return age.Round(time.Minute).String()
+	default:
+		return fmt.Sprintf("%d days", int(age.Hours()/24))
+	}
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status [db]",
+	Short: "Shows the provenance and freshness of the seed/backup loaded into a database",
+	Long:  "Shows the provenance and freshness of the seed/backup loaded into a database along with its installed extensions. If --seed is provided, also checks whether a newer seed is available",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dbName := "infinity"
+
+		if len(args) > 0 {
+			dbName = args[0]
+		}
+
+		ctx := context.Background()
+
+		conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		fmt.Println("== Database:", dbName, "==")
+
+		info, err := latestLoad(ctx, dbName)
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Databases seeded by older versions of ibl only have a seed_info table
+			info, err = latestSeedInfo(ctx, conn)
+		}
+
+		if err != nil {
+			fmt.Println("No seed info found:", err)
+		} else {
+			fileType := info.FileType
+
+			if fileType == "" {
+				fileType = "db.seed (legacy seed_info)"
+			}
+
+			fmt.Println("File Type:", fileType)
+
+			if info.Nonce != "" {
+				fmt.Println("Nonce:", info.Nonce)
+			}
+
+			if info.SourceDatabase != "" {
+				fmt.Println("Source Database:", info.SourceDatabase)
+			}
+
+			fmt.Println("Created At:", info.CreatedAt.Format(time.RFC3339), "("+formatAge(info.CreatedAt)+" ago)")
+
+			if info.LoadedAt != nil {
+				fmt.Println("Loaded At:", info.LoadedAt.Format(time.RFC3339), "("+formatAge(*info.LoadedAt)+" ago)")
+			}
+		}
+
+		fmt.Println("\n== Extensions ==")
+
+		rows, err := conn.Query(ctx, "SELECT extname, extversion FROM pg_extension ORDER BY extname")
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to fetch extensions:", err)
+			os.Exit(1)
+		}
+
+		for rows.Next() {
+			var name, version string
+
+			err = rows.Scan(&name, &version)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to read extension:", err)
+				os.Exit(1)
+			}
+
+			fmt.Println(name, version)
+		}
+
+		rows.Close()
+
+		seed := cmd.Flag("seed").Value.String()
+
+		if seed == "" {
+			return
+		}
+
+		fmt.Println("\n== Seed Freshness ==")
+
+		if downloader.IsURL(seed) {
+			seed, err = downloader.DownloadFileCached(seed)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to download seed:", err)
+				os.Exit(1)
+			}
+		}
+
+		f, err := os.Open(seed)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to open seed file:", err)
+			os.Exit(1)
+		}
+
+		defer f.Close()
+
+		sections := parseAutoEncryptedFullFile(cmd, f)
+
+		meta, err := iblfile.LoadMetadata(sections)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to load metadata:", err)
+			os.Exit(1)
+		}
+
+		if meta.Type != "db.seed" {
+			fmt.Println("ERROR: Expected a db.seed file, got", meta.Type)
+			os.Exit(1)
+		}
+
+		seedMetaBuf, ok := sections["seed_meta"]
+
+		if !ok {
+			fmt.Println("ERROR: Seed file is corrupt [no seed meta]")
+			os.Exit(1)
+		}
+
+		var smeta SeedMetadata
+
+		err = json.NewDecoder(seedMetaBuf).Decode(&smeta)
+
+		if err != nil {
+			fmt.Println("ERROR: Seed file is corrupt [invalid seed meta]")
+			os.Exit(1)
+		}
+
+		fmt.Println("Seed Nonce:", smeta.Nonce)
+		fmt.Println("Seed Created At:", meta.CreatedAt.Format(time.RFC3339), "("+formatAge(meta.CreatedAt)+" ago)")
+
+		switch {
+		case info == nil:
+			fmt.Println("Status: no seed loaded, run `ibl db load` to load this seed")
+		case info.Nonce == smeta.Nonce:
+			fmt.Println("Status: up to date")
+		case meta.CreatedAt.After(info.CreatedAt):
+			fmt.Println("Status: a newer seed is available")
+		default:
+			fmt.Println("Status: the database was loaded from a different seed that is newer than or as new as the one provided")
+		}
+	},
+}
+
+func init() {
+	statusCmd.Flags().String("seed", "", "A seed file path or URL to compare the database against")
+	statusCmd.Flags().String("enc-key", "", "The encryption key [aes256] to use to open the seed")
+	statusCmd.Flags().String("priv-key", "", "The private key [pem] to use to open the seed")
+
+	dbCmd.AddCommand(statusCmd)
+}
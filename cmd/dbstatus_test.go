@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Loads of backups, staging dumps and snapshots are recorded outside of the restored database
+func TestRecordLoadLeavesDatabaseUntouched(t *testing.T) {
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+	if err != nil {
+		t.Skip("no local postgres server:", err)
+	}
+
+	defer conn.Close(ctx)
+
+	dbName := testDatabase(t, conn, "ibl_test_load")
+
+	t.Cleanup(func() {
+		conn.Exec(context.Background(), "DELETE FROM ibl_loads WHERE datname = $1", dbName)
+	})
+
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	err = recordLoad(ctx, dbName, SeedInfo{CreatedAt: createdAt, FileType: "db.staging"})
+
+	if err != nil {
+		t.Fatalf("recordLoad failed: %v", err)
+	}
+
+	if n := testQueryInt(t, dbName, "SELECT count(*) FROM pg_tables WHERE schemaname NOT IN ('pg_catalog', 'information_schema')"); n != 0 {
+		t.Errorf("recordLoad created %d tables in the loaded database", n)
+	}
+
+	info, err := latestLoad(ctx, dbName)
+
+	if err != nil {
+		t.Fatalf("latestLoad failed: %v", err)
+	}
+
+	if info.FileType != "db.staging" || !info.CreatedAt.Equal(createdAt) || info.LoadedAt == nil {
+		t.Errorf("latestLoad = %+v, want a db.staging load created at %v", info, createdAt)
+	}
+}
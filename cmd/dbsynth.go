@@ -0,0 +1,558 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/InfinityBotList/ibldev/internal/pgcopy"
+	"github.com/InfinityBotList/ibldev/internal/projectconfig"
+	"github.com/InfinityBotList/ibldev/internal/synth"
+	"github.com/InfinityBotList/ibldev/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+// Returns the generator override of a column from the synth config or nil
+func synthOverride(cfg *types.Synth, t *synth.Table, column string) (*types.SynthColumn, error) {
+	for key, override := range cfg.Columns {
+		table, col, ok := cutLast(key, ".")
+
+		if !ok {
+			return nil, fmt.Errorf("invalid synth column %s, must be table.column or schema.table.column", key)
+		}
+
+		if col == column && t.Matches(table) {
+			return &override, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+
+	if i < 0 {
+		return "", "", false
+	}
+
+	return s[:i], s[i+len(sep):], true
+}
+
+// The rows of the table referenced by a foreign key
+type synthFkPool struct {
+	rows [][]*string
+
+	// If set, row n uses rows[order[n/stride%len(order)]]. The pools of a unique key get strides 1,
+	// the size of the first pool and so on so that every row uses a different combination
+	order  []int
+	stride int
+}
+
+// A column filled from the idx'th referenced column of a pool
+type synthFkColumn struct {
+	pool *synthFkPool
+	idx  int
+}
+
+// Returns the values of the referenced row to use for row n
+func (p *synthFkPool) pick(r *rand.Rand, n int) []*string {
+	if p.order != nil {
+		return p.rows[p.order[n/p.stride%len(p.order)]]
+	}
+
+	return p.rows[r.Intn(len(p.rows))]
+}
+
+// Reads the referenced columns of all rows of a foreign key's table
+func loadFkPool(ctx context.Context, tx pgx.Tx, fk synth.ForeignKey) ([][]*string, error) {
+	cols := make([]string, len(fk.RefColumns))
+
+	for i, c := range fk.RefColumns {
+		cols[i] = pgx.Identifier{c}.Sanitize() + "::text"
+	}
+
+	rows, err := tx.Query(ctx, "SELECT "+strings.Join(cols, ", ")+" FROM "+pgx.Identifier{fk.RefSchema, fk.RefTable}.Sanitize()+" ORDER BY 1")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var pool [][]*string
+
+	for rows.Next() {
+		values := make([]*string, len(cols))
+		dest := make([]any, len(cols))
+
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		err = rows.Scan(dest...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool = append(pool, values)
+	}
+
+	return pool, rows.Err()
+}
+
+// Fills a single table with count rows, returning the number of rows inserted
+func synthTable(ctx context.Context, tx pgx.Tx, r *rand.Rand, cfg *types.Synth, t *synth.Table, count int, enums map[string][]string) (int, error) {
+	var columns []string
+	var gens []synth.Generator
+
+	// Foreign key columns are filled from pools, keyed by column index
+	fkCols := map[int]synthFkColumn{}
+
+	pools := map[int]*synthFkPool{}
+
+	// Generators set in the synth config, these take precedence over foreign keys
+	overrides := map[string]*types.SynthColumn{}
+	overrideGens := map[string]synth.Generator{}
+
+	for _, c := range t.Columns {
+		if t.Omit[c.Name] {
+			continue
+		}
+
+		override, err := synthOverride(cfg, t, c.Name)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if override == nil {
+			continue
+		}
+
+		g, err := synth.FromConfig(*override)
+
+		if err != nil {
+			return 0, fmt.Errorf("column %s: %w", c.Name, err)
+		}
+
+		if g != nil {
+			overrides[c.Name] = override
+			overrideGens[c.Name] = g
+		}
+	}
+
+	fkFilled := func(column string) bool {
+		_, ok := overrideGens[column]
+		return !ok && t.ForeignKey(column) != nil
+	}
+
+	// A unique key with a generated column is satisfied by one column that never repeats a value,
+	// keys of only foreign key columns need distinct combinations of referenced rows (see below)
+	uniqueCols := map[string]bool{}
+	var fkKeys [][]string
+
+	keys := slices.Clone(t.UniqueKeys)
+	slices.SortStableFunc(keys, func(a, b []string) int { return len(a) - len(b) })
+
+	for _, key := range keys {
+		if slices.ContainsFunc(key, func(c string) bool { return t.Omit[c] || uniqueCols[c] }) {
+			continue
+		}
+
+		i := slices.IndexFunc(key, func(c string) bool { return !fkFilled(c) })
+
+		if i < 0 {
+			fkKeys = append(fkKeys, key)
+			continue
+		}
+
+		uniqueCols[key[i]] = true
+	}
+
+	for _, c := range t.Columns {
+		if t.Omit[c.Name] {
+			continue
+		}
+
+		if g, ok := overrideGens[c.Name]; ok {
+			if uniqueCols[c.Name] && !synth.UniqueConfig(*overrides[c.Name]) {
+				return 0, fmt.Errorf("column %s is unique but its generator in project.yaml repeats values, use a pattern with {n} or one of the %s generators", c.Name, strings.Join(synth.UniqueBuiltins(), "/"))
+			}
+
+			if !c.NotNull {
+				g = synth.WithNulls(g, overrides[c.Name].NullFraction)
+			}
+
+			columns = append(columns, c.Name)
+			gens = append(gens, g)
+			continue
+		}
+
+		if fk := t.ForeignKey(c.Name); fk != nil {
+			fkIdx := slices.IndexFunc(t.ForeignKeys, func(f synth.ForeignKey) bool {
+				return slices.Equal(f.Columns, fk.Columns) && f.RefTable == fk.RefTable && f.RefSchema == fk.RefSchema
+			})
+
+			pool, ok := pools[fkIdx]
+
+			if !ok {
+				rows, err := loadFkPool(ctx, tx, *fk)
+
+				if err != nil {
+					return 0, fmt.Errorf("failed to read rows of %s.%s: %w", fk.RefSchema, fk.RefTable, err)
+				}
+
+				pool = &synthFkPool{rows: rows}
+				pools[fkIdx] = pool
+			}
+
+			if len(pool.rows) == 0 {
+				if c.NotNull {
+					return 0, fmt.Errorf("column %s references %s.%s which has no rows", c.Name, fk.RefSchema, fk.RefTable)
+				}
+
+				continue
+			}
+
+			fkCols[len(columns)] = synthFkColumn{pool: pool, idx: slices.Index(fk.Columns, c.Name)}
+
+			columns = append(columns, c.Name)
+			gens = append(gens, nil)
+			continue
+		}
+
+		genForType := synth.ForType
+
+		if uniqueCols[c.Name] {
+			genForType = synth.UniqueForType
+		}
+
+		g, err := genForType(c.Type, enums)
+
+		if err != nil {
+			// A constant default would repeat in a unique column, NULLs never conflict
+			if !c.NotNull || (c.Default != nil && !uniqueCols[c.Name]) {
+				fmt.Println("WARNING:", t.QualifiedName()+"."+c.Name+":", err, "=> leaving it to the database")
+				continue
+			}
+
+			return 0, fmt.Errorf("column %s: %w", c.Name, err)
+		}
+
+		if limit := synth.UniqueLimit(c.Type); uniqueCols[c.Name] && limit > 0 && int64(count) > limit {
+			return 0, fmt.Errorf("column %s is unique but %s can only hold %d distinct generated values, lower --rows or set a generator for it in the synth.columns section of project.yaml", c.Name, c.Type, limit)
+		}
+
+		columns = append(columns, c.Name)
+		gens = append(gens, g)
+	}
+
+	// Each combination of referenced rows can only be used once in a unique key of foreign key columns.
+	// The pools of the key get increasing strides so that row n uses a different combination
+	for _, key := range fkKeys {
+		var keyPools []*synthFkPool
+		satisfied := false
+
+		for _, c := range key {
+			i := slices.Index(columns, c)
+
+			// Left NULL, which never conflicts
+			if i < 0 {
+				satisfied = true
+				break
+			}
+
+			pool := fkCols[i].pool
+
+			// Already used once per row by another key
+			if pool.stride == 1 && count <= len(pool.rows) {
+				satisfied = true
+				break
+			}
+
+			if pool.order == nil && !slices.Contains(keyPools, pool) {
+				keyPools = append(keyPools, pool)
+			}
+		}
+
+		if satisfied {
+			continue
+		}
+
+		for fkIdx, pool := range pools {
+			if !slices.Contains(keyPools, pool) {
+				continue
+			}
+
+			for _, c := range t.ForeignKeys[fkIdx].Columns {
+				if !slices.Contains(key, c) {
+					return 0, fmt.Errorf("unique key (%s) only covers part of the foreign key (%s), set a generator for one of its columns in the synth.columns section of project.yaml", strings.Join(key, ", "), strings.Join(t.ForeignKeys[fkIdx].Columns, ", "))
+				}
+			}
+		}
+
+		if len(keyPools) == 0 {
+			return 0, fmt.Errorf("unique key (%s) conflicts with another unique key on the same foreign keys, set a generator for one of its columns in the synth.columns section of project.yaml", strings.Join(key, ", "))
+		}
+
+		combinations := 1
+
+		for _, pool := range keyPools {
+			pool.order = r.Perm(len(pool.rows))
+			pool.stride = combinations
+			combinations *= len(pool.rows)
+		}
+
+		if count > combinations {
+			fmt.Println("NOTE: Only generating", combinations, "rows for", t.QualifiedName(), "as ("+strings.Join(key, ", ")+") is unique and there are only", combinations, "combinations of referenced rows")
+			count = combinations
+		}
+	}
+
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("no columns to generate")
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		row := make([]*string, len(columns))
+		picked := map[*synthFkPool][]*string{}
+
+		for n := 0; n < count; n++ {
+			clear(picked)
+
+			for i, g := range gens {
+				if fc, ok := fkCols[i]; ok {
+					values, ok := picked[fc.pool]
+
+					if !ok {
+						values = fc.pool.pick(r, n)
+						picked[fc.pool] = values
+					}
+
+					row[i] = values[fc.idx]
+					continue
+				}
+
+				row[i] = g(r, n)
+			}
+
+			_, err := io.WriteString(pw, pgcopy.EncodeRow(row)+"\n")
+
+			if err != nil {
+				return
+			}
+		}
+
+		pw.Close()
+	}()
+
+	cols := make([]string, len(columns))
+
+	for i, c := range columns {
+		cols[i] = pgx.Identifier{c}.Sanitize()
+	}
+
+	tag, err := tx.Conn().PgConn().CopyFrom(ctx, pr, "COPY "+t.Ident()+" ("+strings.Join(cols, ", ")+") FROM STDIN")
+	pr.Close()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+var synthCmd = &cobra.Command{
+	Use:     "synth",
+	Example: "synth --db infinity_loadtest --rows 10000",
+	Short:   "Fills an empty database with synthetic data",
+	Long: `Fills every table of an empty database with type correct synthetic data that respects foreign keys and unique indexes.
+
+Generators can be overridden per column in the synth section of project.yaml:
+
+synth:
+  rows:
+    users: 50000
+  skip:
+    - audit_logs
+  columns:
+    users.user_id:
+      generator: snowflake
+    bots.type:
+      values: [approved, pending]
+    users.about:
+      pattern: "about {n}"
+      null_fraction: 0.5
+
+Builtin generators: ` + strings.Join(synth.Builtins(), ", "),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		dbName := cmd.Flag("db").Value.String()
+
+		if dbName == "" {
+			fmt.Println("ERROR: You must specify a database to fill with --db")
+			os.Exit(1)
+		}
+
+		rows, _ := cmd.Flags().GetInt("rows")
+		seed, _ := cmd.Flags().GetInt64("seed")
+
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+
+		fmt.Println("NOTE: Using seed", seed, "(pass --seed to reproduce this data)")
+
+		cfg := &types.Synth{}
+
+		proj, err := projectconfig.LoadOptionalProjectConfig()
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to load project.yaml:", err)
+			os.Exit(1)
+		}
+
+		if proj != nil && proj.Synth != nil {
+			cfg = proj.Synth
+		}
+
+		conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		cat, err := dbparser.GetCatalog(ctx, conn)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read schema:", err)
+			os.Exit(1)
+		}
+
+		tables, err := synth.Inspect(ctx, conn, cat)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read schema:", err)
+			os.Exit(1)
+		}
+
+		tables = slices.DeleteFunc(tables, func(t *synth.Table) bool {
+			if slices.Contains(bookkeepingTables, t.Name) {
+				return true
+			}
+
+			return slices.ContainsFunc(cfg.Skip, t.Matches)
+		})
+
+		var nonEmpty []string
+
+		for _, t := range tables {
+			var exists bool
+
+			err = conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM "+t.Ident()+")").Scan(&exists)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to check if", t.QualifiedName(), "is empty:", err)
+				os.Exit(1)
+			}
+
+			if exists {
+				nonEmpty = append(nonEmpty, t.QualifiedName())
+			}
+		}
+
+		if len(nonEmpty) > 0 {
+			fmt.Println("ERROR: db synth only fills empty databases, these tables already have rows:", strings.Join(nonEmpty, ", "))
+			os.Exit(1)
+		}
+
+		tables, err = synth.Order(tables)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		enums := map[string][]string{}
+
+		for _, e := range cat.Enums {
+			enums[e.Ident()] = e.Values
+			enums[e.Schema+"."+e.Name] = e.Values
+
+			if e.Schema == "public" {
+				enums[e.Name] = e.Values
+			}
+		}
+
+		r := rand.New(rand.NewSource(seed))
+
+		tx, err := conn.Begin(ctx)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to start transaction:", err)
+			os.Exit(1)
+		}
+
+		defer tx.Rollback(ctx)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tROWS")
+
+		for i, t := range tables {
+			count := rows
+
+			for name, c := range cfg.Rows {
+				if t.Matches(name) {
+					count = c
+				}
+			}
+
+			fmt.Printf("Generating table: [%d/%d] %s (%d rows)\n", i+1, len(tables), t.QualifiedName(), count)
+
+			inserted, err := synthTable(ctx, tx, r, cfg, t, count, enums)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to generate", t.QualifiedName()+":", err)
+				fmt.Println("HINT: Override the generator of the failing column in the synth section of project.yaml or skip the table")
+				os.Exit(1)
+			}
+
+			fmt.Fprintln(w, t.QualifiedName()+"\t"+strconv.Itoa(inserted))
+		}
+
+		err = tx.Commit(ctx)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to commit synthetic data:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("")
+		w.Flush()
+	},
+}
+
+func init() {
+	synthCmd.Flags().String("db", "", "The empty database to fill")
+	synthCmd.Flags().Int("rows", 1000, "The number of rows to generate per table, can be overridden per table in project.yaml")
+	synthCmd.Flags().Int64("seed", 0, "The random seed to use, defaults to a random one")
+
+	dbCmd.AddCommand(synthCmd)
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/InfinityBotList/ibldev/internal/synth"
+	"github.com/InfinityBotList/ibldev/types"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestSynthTable(t *testing.T) {
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, "postgres:///postgres")
+
+	if err != nil {
+		t.Skip("no local postgres server:", err)
+	}
+
+	defer conn.Close(ctx)
+
+	dbName := testDatabase(t, conn, "ibl_test_synth")
+
+	testExec(t, dbName, `
+		CREATE TABLE users (id BIGINT PRIMARY KEY, price NUMERIC(4,2) NOT NULL UNIQUE, rank SMALLINT NOT NULL);
+		CREATE TABLE votes (user_id BIGINT NOT NULL UNIQUE REFERENCES users(id), comment TEXT);
+	`)
+
+	dbConn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dbConn.Close(ctx)
+
+	cat, err := dbparser.GetCatalog(ctx, dbConn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := synth.Inspect(ctx, dbConn, cat)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err = synth.Order(tables)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tables) != 2 || tables[0].Name != "users" || tables[1].Name != "votes" {
+		t.Fatalf("unexpected tables %v", tables)
+	}
+
+	tx, err := dbConn.Begin(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	r := rand.New(rand.NewSource(1))
+	cfg := &types.Synth{}
+
+	// numeric(4,2) only holds 9999 distinct positive values
+	_, err = synthTable(ctx, tx, r, cfg, tables[0], 10000, nil)
+
+	if err == nil || !strings.Contains(err.Error(), "price") {
+		t.Fatalf("synthTable with more rows than price can hold = %v, want an error about price", err)
+	}
+
+	inserted, err := synthTable(ctx, tx, r, cfg, tables[0], 200, nil)
+
+	if err != nil {
+		t.Fatalf("synthTable(users) failed: %v", err)
+	}
+
+	if inserted != 200 {
+		t.Errorf("synthTable(users) inserted %d rows, want 200", inserted)
+	}
+
+	// votes.user_id is unique, so there can only be one vote per user
+	inserted, err = synthTable(ctx, tx, r, cfg, tables[1], 500, nil)
+
+	if err != nil {
+		t.Fatalf("synthTable(votes) failed: %v", err)
+	}
+
+	if inserted != 200 {
+		t.Errorf("synthTable(votes) inserted %d rows, want 200 (one per user)", inserted)
+	}
+}
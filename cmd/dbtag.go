@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+var tagTablesCmd = &cobra.Command{
+	Use:   "tag-tables",
+	Short: "Adds an itag uuid column to all tables in the public schema that lack one",
+	Long:  "Adds an itag uuid column to all tables in the public schema that lack one. Use --dry-run to only print the statements",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		conn, err := pgx.Connect(ctx, cmd.Flag("dsn").Value.String())
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		tables, err := dbparser.UntaggedTables(ctx, conn)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		if len(tables) == 0 {
+			fmt.Println("NOTE: All tables are already tagged")
+			return
+		}
+
+		for _, table := range tables {
+			fmt.Println(dbparser.TagStatement(table) + ";")
+		}
+
+		if cmd.Flag("dry-run").Value.String() == "true" {
+			fmt.Println("\nNOTE: Dry run,", len(tables), "tables would be tagged")
+			return
+		}
+
+		err = dbparser.TagTables(ctx, conn, tables)
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("\nNOTE: Tagged", len(tables), "tables")
+	},
+}
+
+func init() {
+	tagTablesCmd.Flags().String("dsn", "postgres:///infinity", "The database to tag")
+	tagTablesCmd.Flags().Bool("dry-run", false, "Only print the ALTER TABLE statements")
+
+	dbCmd.AddCommand(tagTablesCmd)
+}
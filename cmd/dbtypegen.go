@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/InfinityBotList/ibldev/internal/dbtypegen"
+	"github.com/InfinityBotList/ibldev/internal/projectconfig"
+	"github.com/InfinityBotList/ibldev/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+)
+
+var dbTypegenCmd = &cobra.Command{
+	Use:     "typegen",
+	Example: "typegen --lang go",
+	Short:   "Generates Go or TypeScript row types from the database schema",
+	Long: `Generates a Go struct or TypeScript interface per table and view, and a type per enum, straight from the database schema.
+
+Output paths are set in the db_typegen section of project.yaml:
+
+db_typegen:
+  database: infinity
+  skip:
+    - audit_logs
+  go:
+    path: types/dbtypes/dbtypes.go
+    pgtype: true
+  ts:
+    path: src/utils/generated/db.ts
+
+Use --out to override the path`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		lang := cmd.Flag("lang").Value.String()
+
+		if lang != "go" && lang != "ts" {
+			fmt.Println("ERROR: --lang must be one of go, ts")
+			os.Exit(1)
+		}
+
+		cfg := &types.DbTypeGen{}
+
+		proj, err := projectconfig.LoadOptionalProjectConfig()
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to load project.yaml:", err)
+			os.Exit(1)
+		}
+
+		if proj != nil && proj.DbTypeGen != nil {
+			cfg = proj.DbTypeGen
+		}
+
+		target := &types.DbTypeGenTarget{}
+
+		if lang == "go" && cfg.Go != nil {
+			target = cfg.Go
+		} else if lang == "ts" && cfg.TS != nil {
+			target = cfg.TS
+		}
+
+		out := cmd.Flag("out").Value.String()
+
+		if out == "" {
+			out = target.Path
+		}
+
+		if out == "" {
+			fmt.Println("ERROR: No output path for", lang, "in the db_typegen section of project.yaml")
+			fmt.Println("HINT: Use --out to set one")
+			os.Exit(1)
+		}
+
+		dbName := cmd.Flag("db").Value.String()
+
+		if dbName == "" {
+			dbName = cfg.Database
+		}
+
+		if dbName == "" {
+			dbName = "infinity"
+		}
+
+		conn, err := pgx.Connect(ctx, "postgres:///"+dbName)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to acquire database conn:", err)
+			os.Exit(1)
+		}
+
+		defer conn.Close(ctx)
+
+		schema, err := dbparser.GetCISchema(ctx, conn)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read schema:", err)
+			os.Exit(1)
+		}
+
+		rels := slices.DeleteFunc(dbtypegen.Relations(schema), func(r dbtypegen.Relation) bool {
+			if slices.Contains(bookkeepingTables, r.Name) {
+				return true
+			}
+
+			return slices.ContainsFunc(cfg.Skip, func(name string) bool {
+				return name == r.Schema+"."+r.Name || (r.Schema == "public" && name == r.Name)
+			})
+		})
+
+		var src []byte
+
+		if lang == "go" {
+			pkg := target.Package
+
+			if pkg == "" {
+				pkg = filepath.Base(filepath.Dir(out))
+			}
+
+			if !token.IsIdentifier(pkg) {
+				pkg = "dbtypes"
+			}
+
+			pgtype, _ := cmd.Flags().GetBool("pgtype")
+
+			src, err = dbtypegen.Go(schema, rels, dbtypegen.GoOptions{
+				Package: pkg,
+				PgType:  pgtype || target.PgType,
+			})
+		} else {
+			src, err = dbtypegen.TS(schema, rels)
+		}
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to generate types:", err)
+			os.Exit(1)
+		}
+
+		err = os.MkdirAll(filepath.Dir(out), 0755)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to create output directory:", err)
+			os.Exit(1)
+		}
+
+		err = os.WriteFile(out, src, 0644)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to write types:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Wrote", len(rels), "types and", len(schema.Enums), "enums to", out)
+	},
+}
+
+func init() {
+	dbTypegenCmd.Flags().String("lang", "", "The language to generate types for (go, ts)")
+	dbTypegenCmd.Flags().String("out", "", "The file to write the types to, defaults to the path in project.yaml")
+	dbTypegenCmd.Flags().String("db", "", "The database to read the schema of, defaults to infinity")
+	dbTypegenCmd.Flags().Bool("pgtype", false, "Use pgtype types for nullable columns instead of pointers (go only)")
+
+	dbCmd.AddCommand(dbTypegenCmd)
+}
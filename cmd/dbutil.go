@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Returns whether or not a database with the given name exists
+func databaseExists(ctx context.Context, conn *pgx.Conn, dbName string) (bool, error) {
+	var exists bool
+
+	err := conn.QueryRow(ctx, "SELECT EXISTS(SELECT datname FROM pg_catalog.pg_database WHERE datname = $1)", dbName).Scan(&exists)
+
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// Returns the number of other active connections to a database
+func activeConnections(ctx context.Context, conn *pgx.Conn, dbName string) (int, error) {
+	var count int
+
+	err := conn.QueryRow(ctx, "SELECT COUNT(*) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()", dbName).Scan(&count)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Terminates all other connections to a database
+//
+// This is needed before a database can be dropped or used as a template
+func terminateConnections(ctx context.Context, conn *pgx.Conn, dbName string) error {
+	fmt.Println("[psql, terminate] => Terminating connections to", dbName)
+
+	_, err := conn.Exec(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()", dbName)
+
+	if err != nil {
+		return fmt.Errorf("failed to terminate connections to %s: %w", dbName, err)
+	}
+
+	return nil
+}
+
+// Returned by cloneDatabase when the target database was dropped but could not be recreated
+var errCloneDropped = errors.New("the database was dropped but could not be recreated")
+
+// Recreates dbName as a copy of templateName using CREATE DATABASE ... TEMPLATE
+//
+// All connections to both databases are terminated first as postgres will refuse to
+// copy a template database that is in use. There is no recovery if the CREATE fails, in which
+// case dbName is left dropped and errCloneDropped is returned
+func cloneDatabase(ctx context.Context, conn *pgx.Conn, templateName, dbName string) error {
+	for _, name := range []string{dbName, templateName} {
+		err := terminateConnections(ctx, conn, name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	dropCmd := "DROP DATABASE IF EXISTS " + pgx.Identifier{dbName}.Sanitize()
+
+	fmt.Println("[psql, clone] =>", dropCmd)
+
+	_, err := conn.Exec(ctx, dropCmd)
+
+	if err != nil {
+		return fmt.Errorf("failed to execute sql command: %w", err)
+	}
+
+	createCmd := "CREATE DATABASE " + pgx.Identifier{dbName}.Sanitize() + " TEMPLATE " + pgx.Identifier{templateName}.Sanitize()
+
+	fmt.Println("[psql, clone] =>", createCmd)
+
+	_, err = conn.Exec(ctx, createCmd)
+
+	if err != nil {
+		return fmt.Errorf("%w: failed to execute sql command: %w", errCloneDropped, err)
+	}
+
+	return nil
+}
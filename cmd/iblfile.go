@@ -10,95 +10,117 @@ import (
 	"io"
 	"os"
 	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/InfinityBotList/ibldev/internal/iblfile_legacyenc"
+	"github.com/InfinityBotList/ibldev/internal/multipem"
+	"github.com/InfinityBotList/ibldev/internal/pgtoc"
 	"github.com/go-andiamo/splitter"
 	"github.com/infinitybotlist/iblfile"
 	"github.com/infinitybotlist/iblfile/encryptors/aes256"
 	"github.com/infinitybotlist/iblfile/encryptors/noencryption"
 	"github.com/infinitybotlist/iblfile/encryptors/pem"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
+// Returns the encryptor to decrypt a file encrypted with encryptor from the priv-key/enc-key flags of cmd
+//
 // Needs priv-key and enc-key to be registered as args
-func parseAutoEncryptedFullFile(cmd *cobra.Command, f io.ReadSeeker) map[string]*bytes.Buffer {
-	// We need to block parse it
-	_, err := f.Seek(0, 0)
-
-	if err != nil {
-		fmt.Println("ERROR: Failed to seek back to start of file:", err)
-		os.Exit(1)
-	}
-
-	block, err := iblfile.QuickBlockParser(f)
-
-	if err != nil {
-		fmt.Println("ERROR: Failed to parse block:", err)
-		os.Exit(1)
-	}
-
-	fmt.Println("Encryptor:", string(block.Encryptor))
-
-	var file *iblfile.AutoEncryptedFile_FullFile
-
+func decryptorFromFlags(cmd *cobra.Command, encryptor string) (iblfile.AutoEncryptor, error) {
 	pemEnc := pem.PemEncryptedSource{}
+	multiPemEnc := multipem.MultiPemEncryptedSource{}
 	aes256Enc := aes256.AES256Source{}
 	noencryptionEnc := noencryption.NoEncryptionSource{}
-	if string(block.Encryptor) == pemEnc.ID() {
+	if encryptor == pemEnc.ID() || encryptor == multiPemEnc.ID() {
 		privKeyFile := cmd.Flag("priv-key").Value.String()
 
 		if privKeyFile == "" {
-			fmt.Println("ERROR: You must specify a private key to decrypt the file with!")
-			os.Exit(1)
+			return nil, fmt.Errorf("you must specify a private key to decrypt the file with")
 		}
 
 		privKeyFileContents, err := os.ReadFile(privKeyFile)
 
 		if err != nil {
-			fmt.Println("ERROR: Failed to read private key file:", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("failed to read private key file: %w", err)
 		}
 
-		pemEnc.PrivateKey = privKeyFileContents
-		file, err = iblfile.OpenAutoEncryptedFile_FullFile(f, &pemEnc)
-
-		if err != nil {
-			fmt.Println("ERROR: Failed to open auto encrypted file:", err)
-			os.Exit(1)
+		if encryptor == multiPemEnc.ID() {
+			multiPemEnc.PrivateKey = privKeyFileContents
+			return &multiPemEnc, nil
 		}
-	} else if string(block.Encryptor) == aes256Enc.ID() {
+
+		pemEnc.PrivateKey = privKeyFileContents
+		return &pemEnc, nil
+	} else if encryptor == aes256Enc.ID() {
 		encKey := cmd.Flag("enc-key").Value.String()
 
 		if encKey == "" {
-			fmt.Println("ERROR: You must specify an encryption key to decrypt the file with!")
-			os.Exit(1)
+			return nil, fmt.Errorf("you must specify an encryption key to decrypt the file with")
 		}
 
 		aes256Enc.EncryptionKey = encKey
-		file, err = iblfile.OpenAutoEncryptedFile_FullFile(f, &aes256Enc)
+		return &aes256Enc, nil
+	} else if encryptor == noencryptionEnc.ID() {
+		return &noencryptionEnc, nil
+	}
 
-		if err != nil {
-			fmt.Println("ERROR: Failed to open auto encrypted file:", err)
-			os.Exit(1)
-		}
-	} else if string(block.Encryptor) == noencryptionEnc.ID() {
-		file, err = iblfile.OpenAutoEncryptedFile_FullFile(f, &noencryption.NoEncryptionSource{})
+	return nil, fmt.Errorf("invalid encryptor: %s. Try using the `iblcli upgrade` command to upgrade the file", encryptor)
+}
 
-		if err != nil {
-			fmt.Println("ERROR: Failed to open auto encrypted file:", err)
-			os.Exit(1)
-		}
-	} else {
-		fmt.Println("ERROR: Invalid encryptor:", string(block.Encryptor), ". Try using the `iblcli upgrade` command to upgrade the file")
-		os.Exit(1)
+// Opens an auto encrypted file using the priv-key/enc-key flags of cmd, returning its sections and encryptor
+//
+// Needs priv-key and enc-key to be registered as args
+func openAutoEncryptedFullFile(cmd *cobra.Command, f io.ReadSeeker) (map[string]*bytes.Buffer, string, error) {
+	// We need to block parse it
+	_, err := f.Seek(0, 0)
+
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to seek back to start of file: %w", err)
+	}
+
+	block, err := iblfile.QuickBlockParser(f)
+
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse block: %w", err)
+	}
+
+	encryptor := string(block.Encryptor)
+
+	src, err := decryptorFromFlags(cmd, encryptor)
+
+	if err != nil {
+		return nil, encryptor, err
+	}
+
+	file, err := iblfile.OpenAutoEncryptedFile_FullFile(f, src)
+
+	if err != nil {
+		return nil, encryptor, fmt.Errorf("failed to open auto encrypted file: %w", err)
 	}
 
 	sections, err := file.Sections()
 
 	if err != nil {
-		fmt.Println("ERROR: Failed to get sections:", err)
+		return nil, encryptor, fmt.Errorf("failed to get sections: %w", err)
+	}
+
+	return sections, encryptor, nil
+}
+
+func parseAutoEncryptedFullFile(cmd *cobra.Command, f io.ReadSeeker) map[string]*bytes.Buffer {
+	sections, encryptor, err := openAutoEncryptedFullFile(cmd, f)
+
+	if encryptor != "" {
+		fmt.Println("Encryptor:", encryptor)
+	}
+
+	if err != nil {
+		fmt.Println("ERROR:", err)
 		os.Exit(1)
 	}
 
@@ -111,18 +133,119 @@ var iblFileCmd = &cobra.Command{
 	Long:  "Retrieve information about an IBL file",
 }
 
+// A section of a file as shown by file info
+type fileInfoSection struct {
+	Name string `json:"name"`
+
+	// Size in bytes as stored in the file (encrypted for per section encrypted files)
+	Size int `json:"size"`
+
+	// Encryptor of the section, only set for per section encrypted files
+	Encryptor string `json:"encryptor,omitempty"`
+}
+
+// Metadata of a file as shown by file info
+type fileInfoMeta struct {
+	Protocol      string            `json:"protocol"`
+	FormatVersion string            `json:"format_version"`
+	Type          string            `json:"type"`
+	CreatedAt     time.Time         `json:"created_at"`
+	ExtraMetadata map[string]string `json:"extra_metadata,omitempty"`
+}
+
+// Output of file info with --output json/yaml
+//
+// Fields are only ever added to this so monitoring can rely on it
+type fileInfo struct {
+	DeducedType string                    `json:"deduced_type"`
+	Encryptor   string                    `json:"encryptor,omitempty"`
+	Sections    []fileInfoSection         `json:"sections"`
+	ParseErrors []string                  `json:"parse_errors"`
+	Metadata    fileInfoMeta              `json:"metadata"`
+	Extended    map[string]any            `json:"extended,omitempty"`
+	Toc         map[string]*pgtoc.Archive `json:"toc,omitempty"`
+}
+
+// Writes v as indented JSON or as YAML with the same keys (in the same order) as the JSON
+func writeStructured(w io.Writer, format string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+
+	// JSON is valid YAML, going through a node keeps the key order
+	var node yaml.Node
+
+	err = yaml.Unmarshal(data, &node)
+
+	if err != nil {
+		return err
+	}
+
+	resetYAMLStyle(&node)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+
+	err = enc.Encode(&node)
+
+	if err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// Clears the JSON (flow, double quoted) style of decoded nodes so they are written as block YAML
+func resetYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+
+	for _, child := range node.Content {
+		resetYAMLStyle(child)
+	}
+}
+
+// Returns the sorted keys of a map
+func sortedKeys[T any](m map[string]T) []string {
+	keys := iblfile.MapKeys(m)
+	sort.Strings(keys)
+	return keys
+}
+
 var infoCmd = &cobra.Command{
 	Use:   "info",
 	Short: "Gets info about a ibl file",
-	Long:  `Gets info about a ibl file`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Gets info about a ibl file
+
+Use --output json or --output yaml for a stable machine readable schema, in which case errors are written to stderr`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		filename := args[0]
 
+		output := cmd.Flag("output").Value.String()
+
+		if output != "text" && output != "json" && output != "yaml" {
+			fmt.Println("ERROR: Invalid output format:", output)
+			os.Exit(1)
+		}
+
+		// Keep stdout parseable with json/yaml output
+		var msgOut io.Writer = os.Stdout
+
+		if output != "text" {
+			msgOut = os.Stderr
+		}
+
 		f, err := os.Open(filename)
 
 		if err != nil {
-			fmt.Println("ERROR: Failed to open file:", err)
+			fmt.Fprintln(msgOut, "ERROR: Failed to open file:", err)
 			os.Exit(1)
 		}
 
@@ -131,27 +254,120 @@ var infoCmd = &cobra.Command{
 		deducedFile, err := iblfile.DeduceType(f, false)
 
 		if err != nil {
-			fmt.Println("ERROR: Failed to deduce file type:", err)
+			fmt.Fprintln(msgOut, "ERROR: Failed to deduce file type:", err)
 			os.Exit(1)
 		}
 
-		fmt.Println("Deduced file type:", deducedFile.Type.String())
+		info := fileInfo{
+			DeducedType: deducedFile.Type.String(),
+			Sections:    []fileInfoSection{},
+			ParseErrors: []string{},
+		}
 
 		if deducedFile.Type == iblfile.DeducedTypeAutoEncryptedFile_FullFile {
-			sections := parseAutoEncryptedFullFile(cmd, f)
+			sections, encryptor, err := openAutoEncryptedFullFile(cmd, f)
+
+			info.Encryptor = encryptor
+
+			if err != nil {
+				fmt.Fprintln(msgOut, "ERROR:", err)
+				os.Exit(1)
+			}
+
 			deducedFile.Sections = sections
 		}
 
-		fmt.Println("Deduced sections:", iblfile.MapKeys(deducedFile.Sections))
-		fmt.Println("Deduction parse errors:", deducedFile.ParseErrors)
+		for _, perr := range deducedFile.ParseErrors {
+			info.ParseErrors = append(info.ParseErrors, perr.Error())
+		}
+
+		for _, name := range sortedKeys(deducedFile.Sections) {
+			section := fileInfoSection{
+				Name: name,
+				Size: deducedFile.Sections[name].Len(),
+			}
+
+			if deducedFile.Type == iblfile.DeducedTypeAutoEncryptedFile_PerSection {
+				// All sections are blocks, so just quickblockparse them
+				block, err := iblfile.QuickBlockParser(bytes.NewReader(deducedFile.Sections[name].Bytes()))
+
+				if err != nil {
+					fmt.Fprintln(msgOut, "ERROR: Failed to parse block '"+name+"' :", err)
+				} else {
+					section.Encryptor = string(block.Encryptor)
+				}
+			}
+
+			info.Sections = append(info.Sections, section)
+		}
+
+		if output == "text" {
+			fmt.Println("Deduced file type:", info.DeducedType)
+
+			if info.Encryptor != "" {
+				fmt.Println("Encryptor:", info.Encryptor)
+			}
+
+			var names []string
+
+			for _, section := range info.Sections {
+				names = append(names, section.Name)
+			}
+
+			fmt.Println("Deduced sections:", names)
+			fmt.Println("Deduction parse errors:", info.ParseErrors)
+		}
 
 		meta, err := iblfile.LoadMetadata(deducedFile.Sections)
 
 		if err != nil {
-			fmt.Println("ERROR: Failed to load metadata:", err)
+			fmt.Fprintln(msgOut, "ERROR: Failed to load metadata:", err)
 			os.Exit(1)
 		}
 
+		info.Metadata = fileInfoMeta{
+			Protocol:      meta.Protocol,
+			FormatVersion: meta.FormatVersion,
+			Type:          meta.Type,
+			CreatedAt:     meta.CreatedAt,
+			ExtraMetadata: meta.ExtraMetadata,
+		}
+
+		format, err := iblfile.GetFormat(meta.Type)
+
+		if err != nil {
+			fmt.Fprintln(msgOut, "WARNING: Unknown/unregistered format:", meta.Type, "due to error: ", err)
+		}
+
+		if format != nil && format.GetExtended != nil {
+			info.Extended, err = format.GetExtended(deducedFile.Sections, meta)
+
+			if err != nil {
+				fmt.Fprintln(msgOut, "ERROR:", err)
+				os.Exit(1)
+			}
+		}
+
+		if cmd.Flag("toc").Value.String() == "true" {
+			info.Toc, err = readArchiveTocs(deducedFile.Sections)
+
+			if err != nil {
+				fmt.Fprintln(msgOut, "ERROR:", err)
+				os.Exit(1)
+			}
+		}
+
+		if output != "text" {
+			err = writeStructured(os.Stdout, output, info)
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: Failed to encode file info:", err)
+				os.Exit(1)
+			}
+
+			return
+		}
+
 		fmt.Println("\n== Metadata ==")
 		fmt.Println("Protocol:", meta.Protocol)
 		fmt.Println("File Version:", meta.FormatVersion)
@@ -160,41 +376,105 @@ var infoCmd = &cobra.Command{
 
 		if deducedFile.Type == iblfile.DeducedTypeAutoEncryptedFile_PerSection {
 			fmt.Println("\n== Section Encryptors ==")
-			for section := range deducedFile.Sections {
-				// All sections are blocks, so just quickblockparse them
-				block, err := iblfile.QuickBlockParser(bytes.NewReader(deducedFile.Sections[section].Bytes()))
+			for _, section := range info.Sections {
+				if section.Encryptor != "" {
+					fmt.Println(section.Name + ": " + section.Encryptor)
+				}
+			}
+		}
+
+		if info.Extended != nil {
+			fmt.Println("\n== Extended Info ==")
+
+			for _, k := range sortedKeys(info.Extended) {
+				fmt.Println(k+":", info.Extended[k])
+			}
+		}
+
+		if info.Toc != nil {
+			switch cmd.Flag("toc-format").Value.String() {
+			case "json":
+				fmt.Println("\n== Table of Contents ==")
+
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+
+				err = enc.Encode(info.Toc)
 
 				if err != nil {
-					fmt.Println("ERROR: Failed to parse block '"+section+"' :", err)
-					continue
+					fmt.Println("ERROR: Failed to encode table of contents:", err)
+					os.Exit(1)
 				}
-
-				fmt.Println(section + ": " + string(block.Encryptor))
+			case "table":
+				for _, name := range sortedKeys(info.Toc) {
+					printArchiveToc(name, info.Toc[name])
+				}
+			default:
+				fmt.Println("ERROR: Invalid toc format:", cmd.Flag("toc-format").Value.String())
+				os.Exit(1)
 			}
 		}
+	},
+}
 
-		format, err := iblfile.GetFormat(meta.Type)
+// Reads the table of contents of all sections which are pg_dump custom format archives
+// (e.g. data, schema and backup/* of db files)
+func readArchiveTocs(sections map[string]*bytes.Buffer) (map[string]*pgtoc.Archive, error) {
+	tocs := map[string]*pgtoc.Archive{}
+
+	for name, buf := range sections {
+		if !pgtoc.IsArchive(buf.Bytes()) {
+			continue
+		}
+
+		archive, err := pgtoc.ReadArchive(bytes.NewReader(buf.Bytes()), true)
 
 		if err != nil {
-			fmt.Println("WARNING: Unknown/unregistered format:", meta.Type, "due to error: ", err)
+			return nil, fmt.Errorf("failed to read table of contents of section %s: %w", name, err)
 		}
 
-		if format != nil && format.GetExtended != nil {
-			extendedMeta, err := format.GetExtended(deducedFile.Sections, meta)
+		tocs[name] = archive
+	}
 
-			if err != nil {
-				fmt.Println("ERROR:", err)
-				os.Exit(1)
-			}
+	return tocs, nil
+}
 
-			fmt.Println("\n== Extended Info ==")
+// Prints the table of contents of an archive as a table
+func printArchiveToc(section string, archive *pgtoc.Archive) {
+	fmt.Println("\n== Table of Contents:", section, "==")
+	fmt.Println("Archive Version:", archive.Header.Version)
+	fmt.Println("Compression:", archive.Header.Compression)
+	fmt.Println("Database:", archive.Header.DatabaseName)
+	fmt.Println("Server Version:", archive.Header.ServerVersion)
+	fmt.Println("Dumped At:", archive.Header.CreatedAt)
+	fmt.Println("")
 
-			for k, v := range extendedMeta {
-				// If v is a struct marshal it into newline seperated key: value format
-				fmt.Println(k+":", v)
-			}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tSCHEMA\tNAME\tROWS\tDATA SIZE")
+
+	for _, e := range archive.Entries {
+		rows := "-"
+
+		if e.Rows != nil {
+			rows = strconv.FormatInt(*e.Rows, 10)
 		}
-	},
+
+		size := "-"
+
+		if e.DataSize > 0 {
+			size = strconv.FormatInt(e.DataSize, 10)
+		}
+
+		schema := e.Schema
+
+		if schema == "" {
+			schema = "-"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.DumpID, e.Desc, schema, e.Name, rows, size)
+	}
+
+	w.Flush()
 }
 
 var iblFileUpgrade = &cobra.Command{
@@ -574,8 +854,21 @@ var iblFileExtract = &cobra.Command{
 			sections = deducedFile.Sections
 		}
 
+		plain := cmd.Flag("plain").Value.String() == "true"
+
 		// Write sections to output dir
 		for name, buf := range sections {
+			var ext string
+
+			if plain {
+				buf, ext, err = plainSection(sections, name, buf)
+
+				if err != nil {
+					fmt.Println("ERROR: Failed to convert section to plain text:", name, err)
+					os.Exit(1)
+				}
+			}
+
 			if os.Getenv("EXTRACT_NOSTRIP") != "true" {
 				name = strings.ReplaceAll(name, ".", "")
 			}
@@ -587,6 +880,9 @@ var iblFileExtract = &cobra.Command{
 				}
 			}
 
+			// The extension is added after stripping so it is kept
+			name += ext
+
 			fmt.Println("Extracting section:", name)
 
 			// Make all parent directories
@@ -612,9 +908,13 @@ var iblFileExtract = &cobra.Command{
 func init() {
 	infoCmd.PersistentFlags().String("enc-key", "", "The encryption key [aes256] to use [backup only]")
 	infoCmd.PersistentFlags().String("priv-key", "", "The private key [pem] to use [backup only]")
+	infoCmd.PersistentFlags().Bool("toc", false, "Show the table of contents of pg_dump archive sections (data, schema, backup/*)")
+	infoCmd.PersistentFlags().String("toc-format", "table", "The format to show the table of contents in. One of table/json")
+	infoCmd.PersistentFlags().String("output", "text", "The output format. One of text/json/yaml, json and yaml include the table of contents with --toc")
 
 	iblFileExtract.PersistentFlags().String("enc-key", "", "The encryption key [aes256] to use [backup only]")
 	iblFileExtract.PersistentFlags().String("priv-key", "", "The private key [pem] to use [backup only]")
+	iblFileExtract.PersistentFlags().Bool("plain", false, "Convert sections to reviewable text: pg_dump archives to SQL, JSON to indented JSON and seed table data to .jsonl/.csv files")
 
 	iblFileCmd.AddCommand(iblFileExtract)
 	iblFileCmd.AddCommand(infoCmd)
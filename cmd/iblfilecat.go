@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var iblFileCat = &cobra.Command{
+	Use:     "cat <file> <section>",
+	Example: "cat seed.iblcli-seed seed_meta --pretty\ncat backup.iblcli-backup data --priv-key key.pem | pg_restore -l",
+	Short:   "Writes a single section of an ibl file to stdout",
+	Long: `Decrypts an ibl file in memory and writes a single section to stdout, without extracting the rest of the file to disk.
+
+With --pretty, JSON sections are indented. Errors are written to stderr so the output can be piped into e.g. jq or pg_restore`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		sections, err := readIblFileSections(cmd, args[0])
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+
+		data, ok := sections[args[1]]
+
+		if !ok {
+			fmt.Fprintln(os.Stderr, "ERROR: No section named", args[1], "in", args[0])
+			fmt.Fprintln(os.Stderr, "HINT: The file has these sections:", strings.Join(sortedKeys(sections), ", "))
+			os.Exit(1)
+		}
+
+		if cmd.Flag("pretty").Value.String() == "true" {
+			var buf bytes.Buffer
+
+			err = json.Indent(&buf, bytes.TrimSpace(data), "", "  ")
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: Section", args[1], "is not JSON and cannot be pretty printed:", err)
+				os.Exit(1)
+			}
+
+			data = append(buf.Bytes(), '\n')
+		}
+
+		_, err = os.Stdout.Write(data)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: Failed to write section:", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	iblFileCat.Flags().String("priv-key", "", "The private key [pem] to decrypt the file with")
+	iblFileCat.Flags().String("enc-key", "", "The encryption key [aes256] to decrypt the file with")
+	iblFileCat.Flags().Bool("pretty", false, "Indent JSON sections")
+
+	iblFileCmd.AddCommand(iblFileCat)
+}
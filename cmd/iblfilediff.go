@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/InfinityBotList/ibldev/internal/jsondiff"
+	"github.com/InfinityBotList/ibldev/internal/pgtoc"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/spf13/cobra"
+)
+
+// The format aware diff of a single section
+type sectionDiff struct {
+	Section string
+	Lines   []string
+}
+
+// A format aware diff of the sections of two files of the same type. Sections it returns diffs
+// for are skipped by the generic JSON diff
+//
+// Only sections present in both files with different contents need to be diffed
+type formatDiffer func(a, b map[string][]byte) ([]sectionDiff, error)
+
+var formatDiffers = map[string]formatDiffer{}
+
+// Registers a format aware diff for a file type, call alongside iblfile.RegisterFormat
+func registerFormatDiffer(fileType string, d formatDiffer) {
+	formatDiffers[fileType] = d
+}
+
+// Reads the sections of an ibl file, decrypting it with the priv-key/enc-key flags of cmd
+//
+// Needs priv-key and enc-key to be registered as args
+func readIblFileSections(cmd *cobra.Command, filename string) (map[string][]byte, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	defer f.Close()
+
+	deducedFile, err := iblfile.DeduceType(f, false)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to deduce file type: %w", err)
+	}
+
+	sections := deducedFile.Sections
+
+	switch deducedFile.Type {
+	case iblfile.DeducedTypeAutoEncryptedFile_FullFile:
+		sections, _, err = openAutoEncryptedFullFile(cmd, f)
+
+		if err != nil {
+			return nil, err
+		}
+	case iblfile.DeducedTypeAutoEncryptedFile_PerSection:
+		return nil, fmt.Errorf("per section encrypted files are not supported, use `file extract` instead")
+	}
+
+	data := map[string][]byte{}
+
+	for name, buf := range sections {
+		data[name] = buf.Bytes()
+	}
+
+	return data, nil
+}
+
+// Returns the first 12 hex characters of the sha256 of a section, like a short git hash
+func sectionHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Diffs the tables of contents of changed pg_dump archive sections (data, schema, backup/*)
+func diffArchiveSections(a, b map[string][]byte) ([]sectionDiff, error) {
+	var diffs []sectionDiff
+
+	for _, name := range sortedKeys(a) {
+		bData, ok := b[name]
+
+		if !ok || bytes.Equal(a[name], bData) || !pgtoc.IsArchive(a[name]) || !pgtoc.IsArchive(bData) {
+			continue
+		}
+
+		aToc, err := pgtoc.ReadArchive(bytes.NewReader(a[name]), true)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read table of contents of section %s: %w", name, err)
+		}
+
+		bToc, err := pgtoc.ReadArchive(bytes.NewReader(bData), true)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read table of contents of section %s: %w", name, err)
+		}
+
+		d := sectionDiff{Section: name + " (table of contents)"}
+
+		for _, c := range pgtoc.Diff(aToc, bToc) {
+			d.Lines = append(d.Lines, c.String())
+		}
+
+		if len(d.Lines) == 0 {
+			d.Lines = []string{"No changes to the table of contents or object definitions"}
+		}
+
+		diffs = append(diffs, d)
+	}
+
+	return diffs, nil
+}
+
+// Diffs the seed_meta and pg_dump archive sections of two seeds
+func diffSeedFiles(a, b map[string][]byte) ([]sectionDiff, error) {
+	diffs, err := diffArchiveSections(a, b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(a["seed_meta"], b["seed_meta"]) || a["seed_meta"] == nil || b["seed_meta"] == nil {
+		return diffs, nil
+	}
+
+	var aMeta, bMeta SeedMetadata
+
+	err = json.Unmarshal(a["seed_meta"], &aMeta)
+
+	if err != nil {
+		return nil, fmt.Errorf("seed_meta of the first file is invalid: %w", err)
+	}
+
+	err = json.Unmarshal(b["seed_meta"], &bMeta)
+
+	if err != nil {
+		return nil, fmt.Errorf("seed_meta of the second file is invalid: %w", err)
+	}
+
+	d := sectionDiff{Section: "seed_meta"}
+
+	changed := func(field, av, bv string) {
+		if av != bv {
+			d.Lines = append(d.Lines, field+": "+av+" -> "+bv)
+		}
+	}
+
+	changed("DefaultDatabase", aMeta.DefaultDatabase, bMeta.DefaultDatabase)
+	changed("SourceDatabase", aMeta.SourceDatabase, bMeta.SourceDatabase)
+	changed("DataFormat", dataFormatOrDefault(aMeta.DataFormat), dataFormatOrDefault(bMeta.DataFormat))
+	changed("Nonce", aMeta.Nonce, bMeta.Nonce)
+
+	tablesChanged := false
+
+	for _, table := range bMeta.RestoreOrder {
+		if !slices.Contains(aMeta.RestoreOrder, table) {
+			d.Lines = append(d.Lines, "added table: "+table)
+			tablesChanged = true
+		}
+	}
+
+	for _, table := range aMeta.RestoreOrder {
+		if !slices.Contains(bMeta.RestoreOrder, table) {
+			d.Lines = append(d.Lines, "removed table: "+table)
+			tablesChanged = true
+		}
+	}
+
+	if !tablesChanged && !slices.Equal(aMeta.RestoreOrder, bMeta.RestoreOrder) {
+		d.Lines = append(d.Lines, "RestoreOrder: "+strings.Join(aMeta.RestoreOrder, ", ")+" -> "+strings.Join(bMeta.RestoreOrder, ", "))
+	}
+
+	return append([]sectionDiff{d}, diffs...), nil
+}
+
+var iblFileDiff = &cobra.Command{
+	Use:     "diff <file a> <file b>",
+	Example: "diff old.iblcli-seed new.iblcli-seed",
+	Short:   "Compares two ibl files",
+	Long: `Compares the metadata, sections, section sizes and section hashes (the first 12 hex characters of their sha256) of two ibl files.
+
+Sections present in both files with different contents are also diffed by format: the seed metadata and pg_dump table of contents of db files, and a structural diff of any other JSON section.
+
+Both files are decrypted with the same --priv-key/--enc-key`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		a, err := readIblFileSections(cmd, args[0])
+
+		if err != nil {
+			fmt.Println("ERROR:", args[0]+":", err)
+			os.Exit(1)
+		}
+
+		b, err := readIblFileSections(cmd, args[1])
+
+		if err != nil {
+			fmt.Println("ERROR:", args[1]+":", err)
+			os.Exit(1)
+		}
+
+		aMeta, err := iblfile.LoadMetadata(sectionBuffers(a))
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to load metadata of", args[0]+":", err)
+			os.Exit(1)
+		}
+
+		bMeta, err := iblfile.LoadMetadata(sectionBuffers(b))
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to load metadata of", args[1]+":", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("== Metadata ==")
+
+		metaRows := [][3]string{
+			{"Protocol", aMeta.Protocol, bMeta.Protocol},
+			{"File Version", aMeta.FormatVersion, bMeta.FormatVersion},
+			{"Type", aMeta.Type, bMeta.Type},
+			{"Created At", aMeta.CreatedAt.String(), bMeta.CreatedAt.String()},
+		}
+
+		for _, k := range sortedKeys(aMeta.ExtraMetadata) {
+			metaRows = append(metaRows, [3]string{k, aMeta.ExtraMetadata[k], bMeta.ExtraMetadata[k]})
+		}
+
+		for _, k := range sortedKeys(bMeta.ExtraMetadata) {
+			if _, ok := aMeta.ExtraMetadata[k]; !ok {
+				metaRows = append(metaRows, [3]string{k, "", bMeta.ExtraMetadata[k]})
+			}
+		}
+
+		for _, row := range metaRows {
+			if row[1] == row[2] {
+				fmt.Println(row[0]+":", row[1])
+			} else {
+				fmt.Println(row[0]+":", row[1], "->", row[2])
+			}
+		}
+
+		fmt.Println("\n== Sections ==")
+
+		names := sortedKeys(a)
+
+		for _, name := range sortedKeys(b) {
+			if _, ok := a[name]; !ok {
+				names = append(names, name)
+			}
+		}
+
+		slices.Sort(names)
+
+		var changedSections []string
+		identical := true
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SECTION\tSTATUS\tSIZE\tSHA256")
+
+		for _, name := range names {
+			aData, inA := a[name]
+			bData, inB := b[name]
+
+			switch {
+			case !inA:
+				identical = false
+				fmt.Fprintf(w, "%s\tadded\t%d\t%s\n", name, len(bData), sectionHash(bData))
+			case !inB:
+				identical = false
+				fmt.Fprintf(w, "%s\tremoved\t%d\t%s\n", name, len(aData), sectionHash(aData))
+			case bytes.Equal(aData, bData):
+				fmt.Fprintf(w, "%s\tunchanged\t%d\t%s\n", name, len(aData), sectionHash(aData))
+			default:
+				identical = false
+				changedSections = append(changedSections, name)
+				fmt.Fprintf(w, "%s\tchanged\t%s\t%s\n", name, strconv.Itoa(len(aData))+" -> "+strconv.Itoa(len(bData)), sectionHash(aData)+" -> "+sectionHash(bData))
+			}
+		}
+
+		w.Flush()
+
+		var diffs []sectionDiff
+
+		if differ, ok := formatDiffers[aMeta.Type]; ok && aMeta.Type == bMeta.Type {
+			diffs, err = differ(a, b)
+
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+		}
+
+		// Structural diff of the JSON sections the format did not diff. meta is already compared above
+		for _, name := range changedSections {
+			if name == "meta" || !json.Valid(a[name]) || !json.Valid(b[name]) || slices.ContainsFunc(diffs, func(d sectionDiff) bool { return d.Section == name }) {
+				continue
+			}
+
+			changes, err := jsondiff.DiffBytes(a[name], b[name])
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to diff section", name+":", err)
+				os.Exit(1)
+			}
+
+			d := sectionDiff{Section: name}
+
+			for _, c := range changes {
+				d.Lines = append(d.Lines, c.String())
+			}
+
+			diffs = append(diffs, d)
+		}
+
+		for _, d := range diffs {
+			fmt.Println("\n== " + d.Section + " ==")
+
+			if len(d.Lines) == 0 {
+				fmt.Println("No changes")
+			}
+
+			for _, line := range d.Lines {
+				fmt.Println(line)
+			}
+		}
+
+		if identical {
+			fmt.Println("\nNOTE: All sections are identical")
+		}
+	},
+}
+
+func init() {
+	iblFileDiff.Flags().String("priv-key", "", "The private key [pem] to decrypt the files with")
+	iblFileDiff.Flags().String("enc-key", "", "The encryption key [aes256] to decrypt the files with")
+
+	iblFileCmd.AddCommand(iblFileDiff)
+}
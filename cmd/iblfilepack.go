@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/InfinityBotList/ibldev/internal/multipem"
+	"github.com/InfinityBotList/ibldev/internal/seeddata"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/infinitybotlist/iblfile/encryptors/aes256"
+	"github.com/infinitybotlist/iblfile/encryptors/noencryption"
+	"github.com/infinitybotlist/iblfile/encryptors/pem"
+	"github.com/spf13/cobra"
+)
+
+// Returns the encryptor to write a file with from the public key and encryption key flags of cmd,
+// no encryption if neither is set. Several public keys use multipem so any of their private keys can decrypt the file
+//
+// The public key flag must be a string slice
+func encryptorFromFlags(cmd *cobra.Command, pubKeyFlag, encKeyFlag string) (iblfile.AutoEncryptor, error) {
+	pubKeyFiles, err := cmd.Flags().GetStringSlice(pubKeyFlag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encKey := cmd.Flag(encKeyFlag).Value.String()
+
+	if len(pubKeyFiles) > 0 && encKey != "" {
+		return nil, fmt.Errorf("only one of --%s and --%s can be set", pubKeyFlag, encKeyFlag)
+	}
+
+	if encKey != "" {
+		return &aes256.AES256Source{EncryptionKey: encKey}, nil
+	}
+
+	if len(pubKeyFiles) == 0 {
+		return &noencryption.NoEncryptionSource{}, nil
+	}
+
+	var pubKeys [][]byte
+
+	for _, pubKeyFile := range pubKeyFiles {
+		pubKeyFileContents, err := os.ReadFile(pubKeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key file: %w", err)
+		}
+
+		pubKeys = append(pubKeys, pubKeyFileContents)
+	}
+
+	if len(pubKeys) == 1 {
+		return &pem.PemEncryptedSource{
+			KeyCount:  16,
+			PublicKey: pubKeys[0],
+		}, nil
+	}
+
+	return &multipem.MultiPemEncryptedSource{PublicKeys: pubKeys}, nil
+}
+
+// Sections each file type needs besides meta
+var requiredSections = map[string][]string{
+	"db.backup":   {"data"},
+	"db.seed":     {"schema", "seed_meta"},
+	"db.staging":  {"data"},
+	"db.snapshot": {"data", "snapshot_meta"},
+}
+
+// Checks that the sections of a db.seed match its seed_meta
+func validateSeedSections(sections map[string]*bytes.Buffer) error {
+	var smeta SeedMetadata
+
+	err := json.Unmarshal(sections["seed_meta"].Bytes(), &smeta)
+
+	if err != nil {
+		return fmt.Errorf("seed_meta is invalid: %w", err)
+	}
+
+	format := dataFormatOrDefault(smeta.DataFormat)
+
+	if format != seeddata.FormatPg && !seeddata.IsPlain(format) {
+		return fmt.Errorf("seed_meta has unknown data format %s", format)
+	}
+
+	for _, table := range smeta.RestoreOrder {
+		section := "backup/" + table
+
+		if seeddata.IsPlain(format) {
+			section = plainSeedSection(table)
+		}
+
+		if _, ok := sections[section]; !ok {
+			return fmt.Errorf("seed_meta lists table %s but there is no %s section", table, section)
+		}
+	}
+
+	return nil
+}
+
+// Returns fresh buffers over section data, as reading a section (e.g. in iblfile.LoadMetadata) drains its buffer
+func sectionBuffers(data map[string][]byte) map[string]*bytes.Buffer {
+	sections := map[string]*bytes.Buffer{}
+
+	for name, d := range data {
+		sections[name] = bytes.NewBuffer(d)
+	}
+
+	return sections
+}
+
+// Reads every file under dir as a section named after its slash separated path relative to dir
+func readSectionsDir(dir string) (map[string][]byte, error) {
+	sections := map[string][]byte{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		sections[filepath.ToSlash(rel)] = data
+		return nil
+	})
+
+	return sections, err
+}
+
+var iblFilePack = &cobra.Command{
+	Use:     "pack <dir> <out>",
+	Example: "pack seed-dir seed.iblcli-seed --type db.seed",
+	Short:   "Packs a directory of sections into an ibl file",
+	Long: `Packs a directory of sections (e.g. made with ` + "`file extract`" + `) into an ibl file, the inverse of extract. Every file becomes a section named after its path relative to the directory.
+
+If the directory has a meta section, it is validated against --type and the registered format. Otherwise, one is generated for --type.
+
+Files are written without encryption unless --pubkey (pem, repeat it to encrypt to several keys) or --enc-key (aes256) is set.
+
+HINT: extract with EXTRACT_NOSTRIP=true and without --plain so that section names and contents survive the round trip`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		fileType := cmd.Flag("type").Value.String()
+
+		sections, err := readSectionsDir(args[0])
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read sections:", err)
+			os.Exit(1)
+		}
+
+		if len(sections) == 0 {
+			fmt.Println("ERROR: No sections found in", args[0])
+			os.Exit(1)
+		}
+
+		if _, ok := sections["meta"]; ok {
+			meta, err := iblfile.LoadMetadata(sectionBuffers(sections))
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to load meta section:", err)
+				os.Exit(1)
+			}
+
+			if fileType != "" && meta.Type != fileType {
+				fmt.Println("ERROR: The meta section is for a", meta.Type, "file but --type is", fileType)
+				fmt.Println("HINT: Remove the meta section to generate a new one")
+				os.Exit(1)
+			}
+
+			fileType = meta.Type
+		} else {
+			if fileType == "" {
+				fmt.Println("ERROR: There is no meta section, you must specify the type of file to pack with --type")
+				os.Exit(1)
+			}
+
+			f, err := iblfile.GetFormat(fileType)
+
+			if f == nil {
+				fmt.Println("ERROR: Unknown file type:", fileType, err)
+				os.Exit(1)
+			}
+
+			formatVersion := f.Version
+
+			if fileType == "db.seed" {
+				var smeta SeedMetadata
+
+				// A missing or invalid seed_meta is reported by validateSeedSections below
+				json.Unmarshal(sections["seed_meta"], &smeta)
+
+				formatVersion = seedFormatVersion(f, smeta.DataFormat)
+			}
+
+			mdBuf := bytes.NewBuffer([]byte{})
+
+			err = json.NewEncoder(mdBuf).Encode(iblfile.Meta{
+				CreatedAt:     time.Now(),
+				Protocol:      iblfile.Protocol,
+				Type:          fileType,
+				FormatVersion: formatVersion,
+			})
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to write metadata:", err)
+				os.Exit(1)
+			}
+
+			fmt.Println("NOTE: Generated meta section for", fileType, "format version", formatVersion)
+			sections["meta"] = mdBuf.Bytes()
+		}
+
+		meta, err := parseDbMetadata(sectionBuffers(sections))
+
+		if err != nil {
+			fmt.Println("ERROR: Invalid meta section:", err)
+			os.Exit(1)
+		}
+
+		for _, name := range requiredSections[meta.Type] {
+			if _, ok := sections[name]; !ok {
+				fmt.Println("ERROR:", meta.Type, "files need a", name, "section")
+				os.Exit(1)
+			}
+		}
+
+		if meta.Type == "db.seed" {
+			err = validateSeedSections(sectionBuffers(sections))
+
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+		}
+
+		// The same check `file info` does, catches e.g. corrupt seed_meta/snapshot_meta
+		f, _ := iblfile.GetFormat(meta.Type)
+
+		if f.GetExtended != nil {
+			_, err = f.GetExtended(sectionBuffers(sections), meta)
+
+			if err != nil {
+				fmt.Println("ERROR: Sections are not valid for", meta.Type+":", err)
+				os.Exit(1)
+			}
+		}
+
+		enc, err := encryptorFromFlags(cmd, "pubkey", "enc-key")
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		file := iblfile.NewAutoEncryptedFile_FullFile(enc)
+
+		var names []string
+
+		for name := range sections {
+			if name != "meta" {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+
+		// Metadata goes last like in files made by `db new`
+		for _, name := range append(names, "meta") {
+			fmt.Println("Packing section:", name)
+
+			err = file.WriteSection(bytes.NewBuffer(sections[name]), name)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to write section:", name, err)
+				os.Exit(1)
+			}
+		}
+
+		out, err := os.Create(args[1])
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to create output file:", err)
+			os.Exit(1)
+		}
+
+		defer out.Close()
+
+		err = file.WriteOutput(out)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to write file:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("NOTE: Packed", len(sections), "sections into", args[1], "("+strings.TrimRight(enc.ID(), "$")+")")
+	},
+}
+
+func init() {
+	iblFilePack.Flags().String("type", "", "The type of file to pack (e.g. db.seed), defaults to the type in the meta section")
+	iblFilePack.Flags().StringSlice("pubkey", nil, "The public key [pem] to encrypt the file with, can be repeated to allow any of several private keys to decrypt it")
+	iblFilePack.Flags().String("enc-key", "", "The encryption key [aes256] to encrypt the file with")
+
+	iblFileCmd.AddCommand(iblFilePack)
+}
@@ -0,0 +1,406 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/multipem"
+	"github.com/infinitybotlist/iblfile"
+	"github.com/infinitybotlist/iblfile/encryptors/aes256"
+	"github.com/infinitybotlist/iblfile/encryptors/noencryption"
+	"github.com/infinitybotlist/iblfile/encryptors/pem"
+	"github.com/spf13/cobra"
+)
+
+// A section of a file, in file order
+type orderedSection struct {
+	Name string
+	Data []byte
+}
+
+// Decrypts an auto encrypted full file, returning its sections in the order they are stored in
+//
+// iblfile only exposes sections as a map, so the decrypted tar is read here directly
+func decryptOrderedSections(data []byte, src iblfile.AutoEncryptor) ([]orderedSection, error) {
+	block, err := iblfile.ParseAutoEncryptedFileBlock(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse block: %w", err)
+	}
+
+	err = block.Validate()
+
+	if err != nil {
+		return nil, fmt.Errorf("block is not valid: %w", err)
+	}
+
+	decrypted, err := block.Decrypt(src)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file: %w", err)
+	}
+
+	var sections []orderedSection
+
+	tarReader := tar.NewReader(bytes.NewReader(decrypted))
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sections: %w", err)
+		}
+
+		section, err := io.ReadAll(tarReader)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read section %s: %w", header.Name, err)
+		}
+
+		sections = append(sections, orderedSection{Name: header.Name, Data: section})
+	}
+
+	return sections, nil
+}
+
+// Returns an encryptor that can decrypt files written with enc, nil if that needs a private key that was not given
+func verifierFor(enc iblfile.AutoEncryptor, verifyKey []byte) iblfile.AutoEncryptor {
+	switch e := enc.(type) {
+	case *aes256.AES256Source:
+		return &aes256.AES256Source{EncryptionKey: e.EncryptionKey}
+	case *noencryption.NoEncryptionSource:
+		return &noencryption.NoEncryptionSource{}
+	case *pem.PemEncryptedSource:
+		if verifyKey != nil {
+			return &pem.PemEncryptedSource{PrivateKey: verifyKey}
+		}
+	case *multipem.MultiPemEncryptedSource:
+		if verifyKey != nil {
+			return &multipem.MultiPemEncryptedSource{PrivateKey: verifyKey}
+		}
+	}
+
+	return nil
+}
+
+// Checks that a re-encrypted file is intact and, if verifier is set, decrypts to the same sections in the same order
+func verifyReencrypted(data []byte, enc iblfile.AutoEncryptor, verifier iblfile.AutoEncryptor, want []orderedSection) error {
+	block, err := iblfile.ParseAutoEncryptedFileBlock(data)
+
+	if err != nil {
+		return fmt.Errorf("failed to parse block: %w", err)
+	}
+
+	err = block.Validate()
+
+	if err != nil {
+		return fmt.Errorf("block is not valid: %w", err)
+	}
+
+	if string(block.Encryptor) != enc.ID() {
+		return fmt.Errorf("file is encrypted with %s, expected %s", block.Encryptor, enc.ID())
+	}
+
+	if verifier == nil {
+		return nil
+	}
+
+	have, err := decryptOrderedSections(data, verifier)
+
+	if err != nil {
+		return err
+	}
+
+	if len(have) != len(want) {
+		return fmt.Errorf("file has %d sections, expected %d", len(have), len(want))
+	}
+
+	for i := range want {
+		if have[i].Name != want[i].Name {
+			return fmt.Errorf("section %d is %s, expected %s", i, have[i].Name, want[i].Name)
+		}
+
+		if !bytes.Equal(have[i].Data, want[i].Data) {
+			return fmt.Errorf("section %s does not match the original", want[i].Name)
+		}
+	}
+
+	return nil
+}
+
+// Re-encrypts in to out with enc, replacing out only once the new file has been verified
+func reencryptFile(cmd *cobra.Command, in, out string, enc iblfile.AutoEncryptor, verifyKey []byte) error {
+	data, err := os.ReadFile(in)
+
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	block, err := iblfile.ParseAutoEncryptedFileBlock(data)
+
+	if err != nil {
+		return fmt.Errorf("failed to parse block: %w", err)
+	}
+
+	src, err := decryptorFromFlags(cmd, string(block.Encryptor))
+
+	if err != nil {
+		return err
+	}
+
+	sections, err := decryptOrderedSections(data, src)
+
+	if err != nil {
+		return err
+	}
+
+	if len(sections) == 0 {
+		return fmt.Errorf("no sections found in file")
+	}
+
+	// Sections are copied byte for byte, so metadata (including its creation time) is kept as is
+	file := iblfile.NewAutoEncryptedFile_FullFile(enc)
+
+	for _, s := range sections {
+		err = file.WriteSection(bytes.NewBuffer(s.Data), s.Name)
+
+		if err != nil {
+			return fmt.Errorf("failed to write section %s: %w", s.Name, err)
+		}
+	}
+
+	newData := bytes.NewBuffer([]byte{})
+
+	err = file.WriteOutput(newData)
+
+	if err != nil {
+		return fmt.Errorf("failed to encrypt file: %w", err)
+	}
+
+	verifier := verifierFor(enc, verifyKey)
+
+	// A file nobody can decrypt must never replace the original
+	if verifier == nil && sameFile(in, out) {
+		return fmt.Errorf("re-encrypting in place needs --verify-key (the private key of a new public key) to check the new file can be decrypted")
+	}
+
+	err = verifyReencrypted(newData.Bytes(), enc, verifier, sections)
+
+	if err != nil {
+		return fmt.Errorf("verification of the re-encrypted file failed, the original was not touched: %w", err)
+	}
+
+	if verifier == nil {
+		fmt.Println("NOTE: Only the checksum of", out, "was verified as no --verify-key was given to decrypt it with")
+	}
+
+	mode := os.FileMode(0644)
+
+	if info, err := os.Stat(in); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Written next to out and renamed over it so out is never left half written
+	tmp, err := os.CreateTemp(filepath.Dir(out), "."+filepath.Base(out)+".reencrypt-*")
+
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(newData.Bytes())
+
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	err = tmp.Close()
+
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	err = os.Chmod(tmp.Name(), mode)
+
+	if err != nil {
+		return fmt.Errorf("failed to set mode of temporary file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), out)
+
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", out, err)
+	}
+
+	return nil
+}
+
+// Returns whether two paths are the same file
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+
+	if err != nil {
+		return false
+	}
+
+	bInfo, err := os.Stat(b)
+
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(aInfo, bInfo)
+}
+
+// Returns whether a file is an auto encrypted full file
+func isAutoEncryptedFile(path string) bool {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	block, err := iblfile.QuickBlockParser(f)
+
+	return err == nil && bytes.Equal(block.Magic, iblfile.AutoEncryptedFileMagic)
+}
+
+var iblFileReencrypt = &cobra.Command{
+	Use:     "reencrypt [<input file> [<output file>]]",
+	Example: "reencrypt backup.iblcli-backup --priv-key old.pem --pubkey new.pub --verify-key new.pem\nreencrypt --dir backups --priv-key old.pem --pubkey alice.pub --pubkey bob.pub --verify-key alice.pem",
+	Short:   "Re-encrypts ibl files with a new key",
+	Long: `Decrypts ibl files with the old key (--priv-key/--enc-key) and re-encrypts them with a new public key (--pubkey), several public keys (repeat --pubkey, any of their private keys can decrypt the file) or passphrase (--new-enc-key).
+
+Sections, including metadata, are copied byte for byte and in the same order.
+
+The file is replaced in place if no output file is given, and every file in a directory is re-encrypted in place with --dir. The re-encrypted file is decrypted and compared to the original before anything is replaced, so in place re-encryption to public keys needs the private key of one of them (--verify-key). Only when writing to a separate output file can --verify-key be left out, in which case just the checksum is verified`,
+	Args: cobra.RangeArgs(0, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := cmd.Flag("dir").Value.String()
+
+		if dir == "" && len(args) == 0 {
+			fmt.Println("ERROR: You must specify a file to re-encrypt or a directory with --dir")
+			os.Exit(1)
+		}
+
+		if dir != "" && len(args) > 0 {
+			fmt.Println("ERROR: --dir re-encrypts files in place and cannot be used with file arguments")
+			os.Exit(1)
+		}
+
+		pubKeys, _ := cmd.Flags().GetStringSlice("pubkey")
+
+		if len(pubKeys) == 0 && cmd.Flag("new-enc-key").Value.String() == "" {
+			fmt.Println("ERROR: You must specify the new key with --pubkey or --new-enc-key")
+			os.Exit(1)
+		}
+
+		enc, err := encryptorFromFlags(cmd, "pubkey", "new-enc-key")
+
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+
+		inPlace := dir != "" || len(args) == 1 || (len(args) == 2 && sameFile(args[0], args[1]))
+
+		if inPlace && len(pubKeys) > 0 && cmd.Flag("verify-key").Value.String() == "" {
+			fmt.Println("ERROR: Re-encrypting in place with --pubkey needs --verify-key, the private key of one of the new public keys")
+			fmt.Println("HINT: This makes sure the new files can be decrypted before the originals are replaced. Without it, write to a separate output file")
+			os.Exit(1)
+		}
+
+		var verifyKey []byte
+
+		if verifyKeyFile := cmd.Flag("verify-key").Value.String(); verifyKeyFile != "" {
+			verifyKey, err = os.ReadFile(verifyKeyFile)
+
+			if err != nil {
+				fmt.Println("ERROR: Failed to read verify key file:", err)
+				os.Exit(1)
+			}
+		}
+
+		if dir == "" {
+			out := args[0]
+
+			if len(args) == 2 {
+				out = args[1]
+			}
+
+			err = reencryptFile(cmd, args[0], out, enc, verifyKey)
+
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+
+			fmt.Println("Re-encrypted", args[0], "to", out, "("+strings.TrimRight(enc.ID(), "$")+")")
+			return
+		}
+
+		entries, err := os.ReadDir(dir)
+
+		if err != nil {
+			fmt.Println("ERROR: Failed to read directory:", err)
+			os.Exit(1)
+		}
+
+		var done, failed int
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+
+			if !entry.Type().IsRegular() {
+				continue
+			}
+
+			if !isAutoEncryptedFile(path) {
+				fmt.Println("NOTE: Skipping", path, "as it is not an ibl file")
+				continue
+			}
+
+			fmt.Println("Re-encrypting", path)
+
+			err = reencryptFile(cmd, path, path, enc, verifyKey)
+
+			if err != nil {
+				fmt.Println("ERROR:", path+":", err)
+				failed++
+				continue
+			}
+
+			done++
+		}
+
+		fmt.Println("Re-encrypted", done, "files,", failed, "failed", "("+strings.TrimRight(enc.ID(), "$")+")")
+
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	iblFileReencrypt.Flags().String("dir", "", "Re-encrypt every ibl file in this directory in place")
+	iblFileReencrypt.Flags().String("priv-key", "", "The old private key [pem] to decrypt the file with")
+	iblFileReencrypt.Flags().String("enc-key", "", "The old encryption key [aes256] to decrypt the file with")
+	iblFileReencrypt.Flags().StringSlice("pubkey", nil, "The new public key [pem] to encrypt the file with, can be repeated to allow any of several private keys to decrypt it")
+	iblFileReencrypt.Flags().String("new-enc-key", "", "The new encryption key [aes256] to encrypt the file with")
+	iblFileReencrypt.Flags().String("verify-key", "", "The private key of a new public key, used to fully verify the re-encrypted file")
+
+	iblFileCmd.AddCommand(iblFileReencrypt)
+}
@@ -0,0 +1,349 @@
+package dbparser
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Querier is implemented by *pgx.Conn, pgx.Tx and *pgxpool.Pool
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// A column of a table
+type Column struct {
+	Name string `json:"name"`
+
+	// Type as returned by format_type (e.g. "character varying(32)", "text[]")
+	Type string `json:"type"`
+
+	NotNull bool `json:"not_null"`
+
+	// Default expression, nil if the column has no default
+	Default *string `json:"default,omitempty"`
+}
+
+// An index that does not back a constraint
+type Index struct {
+	Name string `json:"name"`
+
+	// Definition as returned by pg_get_indexdef
+	Def string `json:"def"`
+}
+
+// A table constraint
+type Constraint struct {
+	Name string `json:"name"`
+
+	// One of p (primary key), u (unique), f (foreign key), c (check), x (exclusion)
+	Type string `json:"type"`
+
+	// Definition as returned by pg_get_constraintdef
+	Def string `json:"def"`
+}
+
+// A table along with its columns, indexes and constraints
+type Table struct {
+	Schema      string       `json:"schema"`
+	Name        string       `json:"name"`
+	Columns     []Column     `json:"columns"`
+	Indexes     []Index      `json:"indexes"`
+	Constraints []Constraint `json:"constraints"`
+}
+
+// Returns the qualified and quoted name of the table
+func (t *Table) Ident() string {
+	return pgx.Identifier{t.Schema, t.Name}.Sanitize()
+}
+
+// Returns the column with the given name or nil
+func (t *Table) Column(name string) *Column {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
+		}
+	}
+
+	return nil
+}
+
+// An enum type
+type Enum struct {
+	Schema string   `json:"schema"`
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// Returns the qualified and quoted name of the enum
+func (e *Enum) Ident() string {
+	return pgx.Identifier{e.Schema, e.Name}.Sanitize()
+}
+
+// A function or procedure
+type Function struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+
+	// Identity arguments as returned by pg_get_function_identity_arguments
+	Args string `json:"args"`
+
+	// Definition as returned by pg_get_functiondef
+	Def string `json:"def"`
+}
+
+// Returns the signature of the function (qualified name and identity arguments)
+func (f *Function) Signature() string {
+	return pgx.Identifier{f.Schema, f.Name}.Sanitize() + "(" + f.Args + ")"
+}
+
+// The user defined objects of a database, all lists are sorted by schema and name
+type Catalog struct {
+	Tables    []*Table    `json:"tables"`
+	Enums     []*Enum     `json:"enums"`
+	Functions []*Function `json:"functions"`
+}
+
+// Returns the table with the given schema and name or nil
+func (c *Catalog) Table(schema, name string) *Table {
+	for _, t := range c.Tables {
+		if t.Schema == schema && t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Returns the enum with the given schema and name or nil
+func (c *Catalog) Enum(schema, name string) *Enum {
+	for _, e := range c.Enums {
+		if e.Schema == schema && e.Name == name {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Returns the function with the given signature or nil
+func (c *Catalog) Function(signature string) *Function {
+	for _, f := range c.Functions {
+		if f.Signature() == signature {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// Filters out system schemas, alias is the alias of pg_namespace
+func userSchemaFilter(alias string) string {
+	return alias + ".nspname NOT IN ('pg_catalog', 'information_schema') AND " + alias + ".nspname NOT LIKE 'pg_toast%' AND " + alias + ".nspname NOT LIKE 'pg_temp%'"
+}
+
+// Filters out objects created by extensions
+func notExtensionFilter(catalog, oid string) string {
+	return "NOT EXISTS (SELECT 1 FROM pg_depend dep WHERE dep.classid = '" + catalog + "'::regclass AND dep.objid = " + oid + " AND dep.deptype = 'e')"
+}
+
+// GetCatalog reads the tables, columns, indexes, constraints, enums and functions of a database
+//
+// This only reads from the database and never modifies it
+func GetCatalog(ctx context.Context, q Querier) (*Catalog, error) {
+	cat := &Catalog{}
+
+	// Tables
+	rows, err := q.Query(ctx, `SELECT n.nspname, c.relname FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p') AND `+userSchemaFilter("n")+` AND `+notExtensionFilter("pg_class", "c.oid")+`
+ORDER BY n.nspname, c.relname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	for rows.Next() {
+		t := &Table{}
+
+		err = rows.Scan(&t.Schema, &t.Name)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read table: %w", err)
+		}
+
+		cat.Tables = append(cat.Tables, t)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	// Columns
+	rows, err = q.Query(ctx, `SELECT n.nspname, c.relname, a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull, pg_get_expr(d.adbin, d.adrelid) FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE c.relkind IN ('r', 'p') AND a.attnum > 0 AND NOT a.attisdropped AND `+userSchemaFilter("n")+`
+ORDER BY n.nspname, c.relname, a.attnum`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns: %w", err)
+	}
+
+	for rows.Next() {
+		var schema, table string
+		var col Column
+
+		err = rows.Scan(&schema, &table, &col.Name, &col.Type, &col.NotNull, &col.Default)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read column: %w", err)
+		}
+
+		if t := cat.Table(schema, table); t != nil {
+			t.Columns = append(t.Columns, col)
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list columns: %w", err)
+	}
+
+	// Indexes not backing a constraint
+	rows, err = q.Query(ctx, `SELECT n.nspname, t.relname, i.relname, pg_get_indexdef(i.oid) FROM pg_index x
+JOIN pg_class i ON i.oid = x.indexrelid
+JOIN pg_class t ON t.oid = x.indrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+WHERE `+userSchemaFilter("n")+` AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = x.indexrelid AND con.contype IN ('p', 'u', 'x'))
+ORDER BY n.nspname, t.relname, i.relname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	for rows.Next() {
+		var schema, table string
+		var idx Index
+
+		err = rows.Scan(&schema, &table, &idx.Name, &idx.Def)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read index: %w", err)
+		}
+
+		if t := cat.Table(schema, table); t != nil {
+			t.Indexes = append(t.Indexes, idx)
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	// Constraints, not null constraints are part of the columns
+	rows, err = q.Query(ctx, `SELECT n.nspname, t.relname, con.conname, con.contype::text, pg_get_constraintdef(con.oid) FROM pg_constraint con
+JOIN pg_class t ON t.oid = con.conrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+WHERE con.contype IN ('p', 'u', 'f', 'c', 'x') AND `+userSchemaFilter("n")+`
+ORDER BY n.nspname, t.relname, con.conname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list constraints: %w", err)
+	}
+
+	for rows.Next() {
+		var schema, table string
+		var con Constraint
+
+		err = rows.Scan(&schema, &table, &con.Name, &con.Type, &con.Def)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read constraint: %w", err)
+		}
+
+		if t := cat.Table(schema, table); t != nil {
+			t.Constraints = append(t.Constraints, con)
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list constraints: %w", err)
+	}
+
+	// Enums
+	rows, err = q.Query(ctx, `SELECT n.nspname, t.typname, array_agg(e.enumlabel::text ORDER BY e.enumsortorder) FROM pg_type t
+JOIN pg_enum e ON e.enumtypid = t.oid
+JOIN pg_namespace n ON n.oid = t.typnamespace
+WHERE `+userSchemaFilter("n")+` AND `+notExtensionFilter("pg_type", "t.oid")+`
+GROUP BY n.nspname, t.typname
+ORDER BY n.nspname, t.typname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enums: %w", err)
+	}
+
+	for rows.Next() {
+		e := &Enum{}
+
+		err = rows.Scan(&e.Schema, &e.Name, &e.Values)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read enum: %w", err)
+		}
+
+		cat.Enums = append(cat.Enums, e)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list enums: %w", err)
+	}
+
+	// Functions and procedures
+	rows, err = q.Query(ctx, `SELECT n.nspname, p.proname, pg_get_function_identity_arguments(p.oid), pg_get_functiondef(p.oid) FROM pg_proc p
+JOIN pg_namespace n ON n.oid = p.pronamespace
+WHERE p.prokind IN ('f', 'p') AND `+userSchemaFilter("n")+` AND `+notExtensionFilter("pg_proc", "p.oid")+`
+ORDER BY n.nspname, p.proname, 3`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list functions: %w", err)
+	}
+
+	for rows.Next() {
+		f := &Function{}
+
+		err = rows.Scan(&f.Schema, &f.Name, &f.Args, &f.Def)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read function: %w", err)
+		}
+
+		cat.Functions = append(cat.Functions, f)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list functions: %w", err)
+	}
+
+	return cat, nil
+}
@@ -0,0 +1,513 @@
+package dbparser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The version of the seed-ci.json format written by GetCISchema
+//
+// Version 1 (the legacy format) is a bare array of Schema and has no version field
+const CISchemaVersion = 2
+
+// The seed-ci.json format
+type CISchema struct {
+	Version int        `json:"version"`
+	Schemas []string   `json:"schemas"`
+	Tables  []*CITable `json:"tables"`
+	Views   []*CIView  `json:"views"`
+	Enums   []*Enum    `json:"enums"`
+}
+
+// Returns the table with the given schema and name or nil
+func (s *CISchema) Table(schema, name string) *CITable {
+	for _, t := range s.Tables {
+		if t.Schema == schema && t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Returns the view with the given schema and name or nil
+func (s *CISchema) View(schema, name string) *CIView {
+	for _, v := range s.Views {
+		if v.Schema == schema && v.Name == name {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// A column of a table or view
+type CIColumn struct {
+	Name string `json:"name"`
+
+	// Type as returned by format_type, without [] for arrays
+	Type       string  `json:"type"`
+	Array      bool    `json:"array"`
+	Nullable   bool    `json:"nullable"`
+	DefaultSQL *string `json:"default_sql"`
+	DefaultVal any     `json:"default_val"`
+
+	// Set with COMMENT ON COLUMN
+	Comment string `json:"comment,omitempty"`
+}
+
+// A primary key or unique constraint
+type CIKey struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+}
+
+// A foreign key constraint
+type CIForeignKey struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	RefSchema  string   `json:"ref_schema"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+
+	// One of NO ACTION, RESTRICT, CASCADE, SET NULL, SET DEFAULT
+	OnDelete string `json:"on_delete"`
+	OnUpdate string `json:"on_update"`
+}
+
+// A check constraint
+type CICheck struct {
+	Name string `json:"name"`
+	Def  string `json:"def"`
+}
+
+// An index that does not back a constraint
+type CIIndex struct {
+	Name   string `json:"name"`
+	Unique bool   `json:"unique"`
+	Def    string `json:"def"`
+}
+
+// A table in seed-ci.json
+type CITable struct {
+	Schema      string         `json:"schema"`
+	Name        string         `json:"name"`
+	Comment     string         `json:"comment,omitempty"` // Set with COMMENT ON TABLE
+	Columns     []CIColumn     `json:"columns"`
+	PrimaryKey  *CIKey         `json:"primary_key"`
+	UniqueKeys  []CIKey        `json:"unique_keys"`
+	ForeignKeys []CIForeignKey `json:"foreign_keys"`
+	Checks      []CICheck      `json:"checks"`
+	Indexes     []CIIndex      `json:"indexes"`
+}
+
+// Returns the column with the given name or nil
+func (t *CITable) Column(name string) *CIColumn {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
+		}
+	}
+
+	return nil
+}
+
+// A view or materialized view
+type CIView struct {
+	Schema       string     `json:"schema"`
+	Name         string     `json:"name"`
+	Materialized bool       `json:"materialized"`
+	Comment      string     `json:"comment,omitempty"` // Set with COMMENT ON VIEW
+	Columns      []CIColumn `json:"columns"`
+	Def          string     `json:"def"`
+}
+
+// Splits a type as returned by format_type into its element type and whether or not it is an array
+func splitArrayType(typ string) (string, bool) {
+	return strings.CutSuffix(typ, "[]")
+}
+
+func foreignKeyAction(action string) string {
+	switch action {
+	case "r":
+		return "RESTRICT"
+	case "c":
+		return "CASCADE"
+	case "n":
+		return "SET NULL"
+	case "d":
+		return "SET DEFAULT"
+	default:
+		return "NO ACTION"
+	}
+}
+
+// GetCISchema reads the schema of all user schemas for seed-ci.json
+//
+// Like GetSchema, this is read-only
+func GetCISchema(ctx context.Context, conn *pgx.Conn) (*CISchema, error) {
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
+		AccessMode: pgx.ReadOnly,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	cat, err := GetCatalog(ctx, tx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CISchema{
+		Version: CISchemaVersion,
+		Schemas: []string{},
+		Tables:  []*CITable{},
+		Views:   []*CIView{},
+		Enums:   cat.Enums,
+	}
+
+	if s.Enums == nil {
+		s.Enums = []*Enum{}
+	}
+
+	// Schemas
+	rows, err := tx.Query(ctx, `SELECT n.nspname FROM pg_namespace n WHERE `+userSchemaFilter("n")+` AND `+notExtensionFilter("pg_namespace", "n.oid")+` ORDER BY n.nspname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schemas: %w", err)
+	}
+
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read schema: %w", err)
+		}
+
+		s.Schemas = append(s.Schemas, name)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list schemas: %w", err)
+	}
+
+	for _, t := range cat.Tables {
+		ct := &CITable{
+			Schema:      t.Schema,
+			Name:        t.Name,
+			UniqueKeys:  []CIKey{},
+			ForeignKeys: []CIForeignKey{},
+			Checks:      []CICheck{},
+			Indexes:     []CIIndex{},
+		}
+
+		for _, c := range t.Columns {
+			typ, array := splitArrayType(c.Type)
+
+			col := CIColumn{
+				Name:       c.Name,
+				Type:       typ,
+				Array:      array,
+				Nullable:   !c.NotNull,
+				DefaultSQL: c.Default,
+			}
+
+			if c.Default != nil {
+				col.DefaultVal, err = evalDefault(ctx, tx, *c.Default)
+
+				if err != nil {
+					fmt.Println("NOTE: Not evaluating default of", t.Schema+"."+t.Name+"."+c.Name+":", err)
+				}
+			}
+
+			ct.Columns = append(ct.Columns, col)
+		}
+
+		s.Tables = append(s.Tables, ct)
+	}
+
+	// Constraints with their columns
+	rows, err = tx.Query(ctx, `SELECT n.nspname, t.relname, con.conname, con.contype::text, pg_get_constraintdef(con.oid),
+ARRAY(SELECT a.attname::text FROM unnest(con.conkey) WITH ORDINALITY k(num, ord) JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.num ORDER BY k.ord),
+COALESCE(rn.nspname, ''), COALESCE(r.relname, ''),
+ARRAY(SELECT a.attname::text FROM unnest(con.confkey) WITH ORDINALITY k(num, ord) JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.num ORDER BY k.ord),
+con.confdeltype::text, con.confupdtype::text
+FROM pg_constraint con
+JOIN pg_class t ON t.oid = con.conrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+LEFT JOIN pg_class r ON r.oid = con.confrelid
+LEFT JOIN pg_namespace rn ON rn.oid = r.relnamespace
+WHERE con.contype IN ('p', 'u', 'f', 'c') AND `+userSchemaFilter("n")+`
+ORDER BY n.nspname, t.relname, con.conname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list constraints: %w", err)
+	}
+
+	for rows.Next() {
+		var schema, table, name, typ, def, refSchema, refTable, onDelete, onUpdate string
+		var columns, refColumns []string
+
+		err = rows.Scan(&schema, &table, &name, &typ, &def, &columns, &refSchema, &refTable, &refColumns, &onDelete, &onUpdate)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read constraint: %w", err)
+		}
+
+		t := s.Table(schema, table)
+
+		if t == nil {
+			continue
+		}
+
+		switch typ {
+		case "p":
+			t.PrimaryKey = &CIKey{Name: name, Columns: columns}
+		case "u":
+			t.UniqueKeys = append(t.UniqueKeys, CIKey{Name: name, Columns: columns})
+		case "f":
+			t.ForeignKeys = append(t.ForeignKeys, CIForeignKey{
+				Name:       name,
+				Columns:    columns,
+				RefSchema:  refSchema,
+				RefTable:   refTable,
+				RefColumns: refColumns,
+				OnDelete:   foreignKeyAction(onDelete),
+				OnUpdate:   foreignKeyAction(onUpdate),
+			})
+		case "c":
+			t.Checks = append(t.Checks, CICheck{Name: name, Def: def})
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list constraints: %w", err)
+	}
+
+	// Indexes not backing a constraint
+	rows, err = tx.Query(ctx, `SELECT n.nspname, t.relname, i.relname, x.indisunique, pg_get_indexdef(i.oid) FROM pg_index x
+JOIN pg_class i ON i.oid = x.indexrelid
+JOIN pg_class t ON t.oid = x.indrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+WHERE `+userSchemaFilter("n")+` AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = x.indexrelid AND con.contype IN ('p', 'u', 'x'))
+ORDER BY n.nspname, t.relname, i.relname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	for rows.Next() {
+		var schema, table string
+		var idx CIIndex
+
+		err = rows.Scan(&schema, &table, &idx.Name, &idx.Unique, &idx.Def)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read index: %w", err)
+		}
+
+		if t := s.Table(schema, table); t != nil {
+			t.Indexes = append(t.Indexes, idx)
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	// Views
+	rows, err = tx.Query(ctx, `SELECT n.nspname, c.relname, c.relkind = 'm', pg_get_viewdef(c.oid) FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('v', 'm') AND `+userSchemaFilter("n")+` AND `+notExtensionFilter("pg_class", "c.oid")+`
+ORDER BY n.nspname, c.relname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list views: %w", err)
+	}
+
+	for rows.Next() {
+		v := &CIView{}
+
+		err = rows.Scan(&v.Schema, &v.Name, &v.Materialized, &v.Def)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read view: %w", err)
+		}
+
+		s.Views = append(s.Views, v)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list views: %w", err)
+	}
+
+	// View columns
+	rows, err = tx.Query(ctx, `SELECT n.nspname, c.relname, a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('v', 'm') AND a.attnum > 0 AND NOT a.attisdropped AND `+userSchemaFilter("n")+`
+ORDER BY n.nspname, c.relname, a.attnum`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list view columns: %w", err)
+	}
+
+	for rows.Next() {
+		var schema, view, name, typ string
+		var notNull bool
+
+		err = rows.Scan(&schema, &view, &name, &typ, &notNull)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read view column: %w", err)
+		}
+
+		for _, v := range s.Views {
+			if v.Schema == schema && v.Name == view {
+				typ, array := splitArrayType(typ)
+				v.Columns = append(v.Columns, CIColumn{Name: name, Type: typ, Array: array, Nullable: !notNull})
+			}
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list view columns: %w", err)
+	}
+
+	// Comments of tables, views and their columns (objsubid 0 is the relation itself)
+	rows, err = tx.Query(ctx, `SELECT n.nspname, c.relname, COALESCE(a.attname, ''), d.description FROM pg_description d
+JOIN pg_class c ON c.oid = d.objoid AND d.classoid = 'pg_class'::regclass
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = d.objsubid AND d.objsubid > 0
+WHERE c.relkind IN ('r', 'p', 'v', 'm') AND `+userSchemaFilter("n"))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list comments: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var schema, rel, column, comment string
+
+		err = rows.Scan(&schema, &rel, &column, &comment)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read comment: %w", err)
+		}
+
+		if t := s.Table(schema, rel); t != nil {
+			if column == "" {
+				t.Comment = comment
+			} else if c := t.Column(column); c != nil {
+				c.Comment = comment
+			}
+		}
+
+		for _, v := range s.Views {
+			if v.Schema != schema || v.Name != rel {
+				continue
+			}
+
+			if column == "" {
+				v.Comment = comment
+				continue
+			}
+
+			for i := range v.Columns {
+				if v.Columns[i].Name == column {
+					v.Columns[i].Comment = comment
+				}
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list comments: %w", err)
+	}
+
+	fmt.Println("Loaded", len(s.Tables), "tables and", len(s.Views), "views into seed-ci")
+
+	return s, nil
+}
+
+// ParseCISchema parses a seed-ci.json file of any version
+//
+// Legacy (version 1) files are converted to a CISchema with only public tables and columns.
+// Their types come from information_schema, so they lack type modifiers and enums are USER-DEFINED.
+// Views are listed as tables too as legacy files do not tell them apart
+func ParseCISchema(data []byte) (*CISchema, error) {
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		var legacy []Schema
+
+		err := json.Unmarshal(data, &legacy)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse legacy seed-ci.json: %w", err)
+		}
+
+		s := &CISchema{Version: 1, Schemas: []string{"public"}}
+
+		for _, c := range legacy {
+			t := s.Table("public", c.TableName)
+
+			if t == nil {
+				t = &CITable{Schema: "public", Name: c.TableName}
+				s.Tables = append(s.Tables, t)
+			}
+
+			t.Columns = append(t.Columns, CIColumn{
+				Name:       c.ColumnName,
+				Type:       c.Type,
+				Array:      c.Array,
+				Nullable:   c.IsNullable,
+				DefaultSQL: c.DefaultSQL,
+				DefaultVal: c.DefaultVal,
+			})
+		}
+
+		return s, nil
+	}
+
+	var s CISchema
+
+	err := json.Unmarshal(data, &s)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse seed-ci.json: %w", err)
+	}
+
+	if s.Version < 2 || s.Version > CISchemaVersion {
+		return nil, fmt.Errorf("unsupported seed-ci.json version %d, this version of ibl supports up to %d", s.Version, CISchemaVersion)
+	}
+
+	return &s, nil
+}
@@ -4,9 +4,7 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 type Schema struct {
@@ -28,74 +26,67 @@ type schemaData struct {
 	IsNullable    string  `db:"is_nullable"`
 }
 
-func GetSchema(ctx context.Context, pool *pgxpool.Pool) ([]Schema, error) {
+// GetSchema reads the columns of all tables in the public schema for seed-ci.json
+//
+// This is read-only: column defaults are evaluated in a read only transaction that is
+// rolled back, defaults that cannot be evaluated that way (e.g. nextval) are left nil
+func GetSchema(ctx context.Context, conn *pgx.Conn) ([]Schema, error) {
 	var sqlString string = `
 	SELECT c.is_nullable, c.table_name, c.column_name, c.column_default, c.data_type AS data_type, e.data_type AS element_type FROM information_schema.columns c LEFT JOIN information_schema.element_types e
 	ON ((c.table_catalog, c.table_schema, c.table_name, 'TABLE', c.dtd_identifier)
 = (e.object_catalog, e.object_schema, e.object_name, e.object_type, e.collection_type_identifier))
 WHERE table_schema = 'public' order by table_name, ordinal_position
 `
-	rows, err := pool.Query(ctx, sqlString)
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
+		AccessMode: pgx.ReadOnly,
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	var result []Schema
+	defer tx.Rollback(ctx)
 
-	for rows.Next() {
-		var schema Schema
+	rows, err := tx.Query(ctx, sqlString)
 
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []schemaData
+
+	for rows.Next() {
 		data := schemaData{}
 
 		err := rows.Scan(&data.IsNullable, &data.TableName, &data.ColumnName, &data.ColumnDefault, &data.DataType, &data.ElementType)
 
 		if err != nil {
-			fmt.Println(err)
+			rows.Close()
 			return nil, err
 		}
 
-		// Create new transaction to get default column
-		if data.ColumnDefault != nil && *data.ColumnDefault != "" {
-			tx, err := pool.Begin(ctx)
-			if err != nil {
-				return nil, err
-			}
+		columns = append(columns, data)
+	}
 
-			var defaultV any
+	rows.Close()
 
-			err = tx.QueryRow(ctx, "SELECT "+*data.ColumnDefault).Scan(&defaultV)
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-			if err != nil {
-				return nil, err
-			}
+	var result []Schema
 
-			err = tx.Rollback(ctx)
+	for _, data := range columns {
+		var schema Schema
 
-			if err != nil {
-				return nil, err
-			}
+		if data.ColumnDefault != nil && *data.ColumnDefault != "" {
+			defaultV, err := evalDefault(ctx, tx, *data.ColumnDefault)
 
-			// Check for [16]uint8 case
-			if defaultVal, ok := defaultV.([16]uint8); ok {
-				defaultV = fmt.Sprintf("%x-%x-%x-%x-%x", defaultVal[0:4], defaultVal[4:6], defaultVal[6:8], defaultVal[8:10], defaultVal[10:16])
+			if err != nil {
+				fmt.Println("NOTE: Not evaluating default of", data.TableName+"."+data.ColumnName+":", err)
 			}
 
 			schema.DefaultVal = defaultV
-		} else {
-			schema.DefaultVal = nil
-		}
-
-		// Now check if the column is tagged properly
-		var itag pgtype.UUID
-		if err := pool.QueryRow(ctx, "SELECT itag FROM"+data.TableName).Scan(&itag); err != nil {
-			if err == pgx.ErrNoRows {
-				fmt.Println("Tagging", data.TableName)
-				_, err := pool.Exec(ctx, "ALTER TABLE "+data.TableName+" ADD COLUMN itag uuid not null unique default uuid_generate_v4()")
-				if err != nil {
-					return nil, err
-				}
-			}
 		}
 
 		schema.ColumnName = data.ColumnName
@@ -118,3 +109,29 @@ WHERE table_schema = 'public' order by table_name, ordinal_position
 
 	return result, nil
 }
+
+// Evaluates a column default in a savepoint of a read only transaction
+func evalDefault(ctx context.Context, tx pgx.Tx, def string) (any, error) {
+	sp, err := tx.Begin(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer sp.Rollback(ctx)
+
+	var defaultV any
+
+	err = sp.QueryRow(ctx, "SELECT "+def).Scan(&defaultV)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for [16]uint8 case
+	if defaultVal, ok := defaultV.([16]uint8); ok {
+		defaultV = fmt.Sprintf("%x-%x-%x-%x-%x", defaultVal[0:4], defaultVal[4:6], defaultVal[6:8], defaultVal[8:10], defaultVal[10:16])
+	}
+
+	return defaultV, nil
+}
@@ -0,0 +1,67 @@
+package dbparser
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The column added to tables by TagTables
+const TagColumn = "itag"
+
+// UntaggedTables returns the tables in the public schema that have no itag column
+func UntaggedTables(ctx context.Context, q Querier) ([]string, error) {
+	rows, err := q.Query(ctx, `SELECT t.table_name FROM information_schema.tables t
+WHERE t.table_schema = 'public' AND t.table_type = 'BASE TABLE'
+AND NOT EXISTS (SELECT 1 FROM information_schema.columns c WHERE c.table_schema = t.table_schema AND c.table_name = t.table_name AND c.column_name = $1)
+ORDER BY t.table_name`, TagColumn)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list untagged tables: %w", err)
+	}
+
+	defer rows.Close()
+
+	var tables []string
+
+	for rows.Next() {
+		var table string
+
+		err = rows.Scan(&table)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read table: %w", err)
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
+
+// TagStatement returns the statement that tags a table
+func TagStatement(table string) string {
+	return "ALTER TABLE " + pgx.Identifier{"public", table}.Sanitize() + " ADD COLUMN " + TagColumn + " uuid not null unique default uuid_generate_v4()"
+}
+
+// TagTables adds an itag column to the given tables in a single transaction
+func TagTables(ctx context.Context, conn *pgx.Conn, tables []string) error {
+	tx, err := conn.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	for _, table := range tables {
+		_, err = tx.Exec(ctx, TagStatement(table))
+
+		if err != nil {
+			return fmt.Errorf("failed to tag %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,207 @@
+// Package dbstats collects and compares per-table statistics (row counts, sizes and watermarks)
+package dbstats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Tables that are expected to change when a file is loaded and are hence never collected
+var ignoredTables = []string{"seed_info"}
+
+// Statistics of a single table
+type TableStats struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+
+	// Exact number of rows in the table
+	Rows int64 `json:"rows"`
+
+	// Total size of the table including indexes and toast
+	TotalSize int64 `json:"total_size"`
+
+	// Max of the watermark column in its JSON form (timestamps are ISO 8601 in UTC), nil if the table
+	// has no watermark column or is empty
+	Watermark *string `json:"watermark,omitempty"`
+}
+
+// Returns the qualified name of the table
+func (t TableStats) QualifiedName() string {
+	return t.Schema + "." + t.Name
+}
+
+// A stats manifest, this is stored in the stats section of db files
+type Manifest struct {
+	CollectedAt     time.Time    `json:"collected_at"`
+	WatermarkColumn string       `json:"watermark_column,omitempty"`
+	Tables          []TableStats `json:"tables"`
+}
+
+// Merges the tables of other into m
+func (m *Manifest) Merge(other *Manifest) {
+	m.Tables = append(m.Tables, other.Tables...)
+
+	sort.Slice(m.Tables, func(i, j int) bool {
+		return m.Tables[i].QualifiedName() < m.Tables[j].QualifiedName()
+	})
+}
+
+type tableRef struct {
+	oid    uint32
+	schema string
+	name   string
+	size   int64
+}
+
+// Collects statistics of the given tables, or of all user tables if tables is empty
+//
+// Tables may be given as "table" or "schema.table". To get counts that match a dump, run this
+// in the same (repeatable read) snapshot that is passed to pg_dump
+//
+// If a watermark column is given, the TimeZone of tx is set to UTC
+func Collect(ctx context.Context, tx pgx.Tx, watermarkColumn string, tables []string) (*Manifest, error) {
+	var refs []tableRef
+
+	if len(tables) == 0 {
+		rows, err := tx.Query(ctx, `SELECT c.oid, n.nspname, c.relname, pg_total_relation_size(c.oid) FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r' AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%' AND NOT (c.relname = ANY($1))
+ORDER BY n.nspname, c.relname`, ignoredTables)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tables: %w", err)
+		}
+
+		for rows.Next() {
+			var ref tableRef
+
+			err = rows.Scan(&ref.oid, &ref.schema, &ref.name, &ref.size)
+
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read table: %w", err)
+			}
+
+			refs = append(refs, ref)
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list tables: %w", err)
+		}
+	}
+
+	for _, table := range tables {
+		var ref tableRef
+
+		err := tx.QueryRow(ctx, `SELECT c.oid, n.nspname, c.relname, pg_total_relation_size(c.oid) FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.oid = to_regclass($1)`, table).Scan(&ref.oid, &ref.schema, &ref.name, &ref.size)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to find table %s: %w", table, err)
+		}
+
+		refs = append(refs, ref)
+	}
+
+	if watermarkColumn != "" {
+		// Timestamps are rendered in the session time zone, pin it so watermarks from different
+		// sessions and servers compare equal. This only lasts until the end of the transaction
+		_, err := tx.Exec(ctx, "SELECT set_config('TimeZone', 'UTC', true)")
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to set time zone: %w", err)
+		}
+	}
+
+	m := &Manifest{
+		CollectedAt:     time.Now(),
+		WatermarkColumn: watermarkColumn,
+	}
+
+	for _, ref := range refs {
+		ident := pgx.Identifier{ref.schema, ref.name}.Sanitize()
+
+		ts := TableStats{
+			Schema:    ref.schema,
+			Name:      ref.name,
+			TotalSize: ref.size,
+		}
+
+		err := tx.QueryRow(ctx, "SELECT count(*) FROM "+ident).Scan(&ts.Rows)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to count rows of %s: %w", ts.QualifiedName(), err)
+		}
+
+		if watermarkColumn != "" {
+			var hasColumn bool
+
+			err = tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM pg_attribute WHERE attrelid = $1 AND attname = $2 AND attnum > 0 AND NOT attisdropped)", ref.oid, watermarkColumn).Scan(&hasColumn)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to check watermark column of %s: %w", ts.QualifiedName(), err)
+			}
+
+			if hasColumn {
+				// to_jsonb renders dates and timestamps as ISO 8601 regardless of DateStyle, #>> unwraps the JSON scalar
+				err = tx.QueryRow(ctx, "SELECT to_jsonb(max("+pgx.Identifier{watermarkColumn}.Sanitize()+")) #>> '{}' FROM "+ident).Scan(&ts.Watermark)
+
+				if err != nil {
+					return nil, fmt.Errorf("failed to get watermark of %s: %w", ts.QualifiedName(), err)
+				}
+			}
+		}
+
+		m.Tables = append(m.Tables, ts)
+	}
+
+	return m, nil
+}
+
+// The result of comparing a table against its expected statistics
+type Comparison struct {
+	Expected TableStats
+
+	// Nil if the table does not exist
+	Actual *TableStats
+}
+
+// Returns whether or not the table matches its expected statistics
+func (c Comparison) Ok() bool {
+	if c.Actual == nil || c.Actual.Rows != c.Expected.Rows {
+		return false
+	}
+
+	if c.Expected.Watermark == nil {
+		return true
+	}
+
+	return c.Actual.Watermark != nil && *c.Actual.Watermark == *c.Expected.Watermark
+}
+
+// Compares actual statistics against the expected ones, tables only in actual are ignored
+func Compare(expected, actual *Manifest) []Comparison {
+	byName := map[string]*TableStats{}
+
+	for i := range actual.Tables {
+		byName[actual.Tables[i].QualifiedName()] = &actual.Tables[i]
+	}
+
+	var result []Comparison
+
+	for _, t := range expected.Tables {
+		result = append(result, Comparison{
+			Expected: t,
+			Actual:   byName[t.QualifiedName()],
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,482 @@
+// Package dbtypegen generates Go and TypeScript row types from a database schema
+package dbtypegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+)
+
+// A table or view to generate a type for
+type Relation struct {
+	Schema  string
+	Name    string
+	View    bool
+	Comment string
+	Columns []dbparser.CIColumn
+}
+
+// Returns the relations of a schema in schema order, tables before views
+func Relations(s *dbparser.CISchema) []Relation {
+	var rels []Relation
+
+	for _, t := range s.Tables {
+		rels = append(rels, Relation{Schema: t.Schema, Name: t.Name, Comment: t.Comment, Columns: t.Columns})
+	}
+
+	for _, v := range s.Views {
+		rels = append(rels, Relation{Schema: v.Schema, Name: v.Name, View: true, Comment: v.Comment, Columns: v.Columns})
+	}
+
+	return rels
+}
+
+// Words that are written in all caps in Go identifiers
+var initialisms = map[string]bool{
+	"api": true, "id": true, "ip": true, "json": true, "url": true, "uuid": true,
+	"http": true, "https": true, "sql": true, "uri": true, "mfa": true, "ttl": true,
+}
+
+// Converts a snake_case (or otherwise separated) name to an exported Go identifier
+func GoName(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var b strings.Builder
+
+	for _, w := range words {
+		if initialisms[strings.ToLower(w)] {
+			b.WriteString(strings.ToUpper(w))
+			continue
+		}
+
+		r := []rune(w)
+		b.WriteString(string(unicode.ToUpper(r[0])) + string(r[1:]))
+	}
+
+	ident := b.String()
+
+	if ident == "" || unicode.IsDigit([]rune(ident)[0]) {
+		ident = "X" + ident
+	}
+
+	return ident
+}
+
+// TypeName returns the type name of a table, view or enum, non-public schemas are used as a prefix
+func TypeName(schema, name string) string {
+	if schema == "public" {
+		return GoName(name)
+	}
+
+	return GoName(schema + "_" + name)
+}
+
+// Go types of a postgres type: the native type, the pgtype type used for nullable
+// columns with PgType and the pgtype array type used for nullable arrays with PgType
+type goType struct {
+	native  string
+	pgtype  string
+	pgarray string
+}
+
+var goTypes = map[string]goType{
+	"smallint":                    {"int16", "pgtype.Int2", "pgtype.Int2Array"},
+	"integer":                     {"int32", "pgtype.Int4", "pgtype.Int4Array"},
+	"bigint":                      {"int64", "pgtype.Int8", "pgtype.Int8Array"},
+	"real":                        {"float32", "pgtype.Float4", "pgtype.Float4Array"},
+	"double precision":            {"float64", "pgtype.Float8", "pgtype.Float8Array"},
+	"numeric":                     {"pgtype.Numeric", "pgtype.Numeric", "pgtype.NumericArray"},
+	"boolean":                     {"bool", "pgtype.Bool", "pgtype.BoolArray"},
+	"text":                        {"string", "pgtype.Text", "pgtype.TextArray"},
+	"character varying":           {"string", "pgtype.Varchar", "pgtype.VarcharArray"},
+	"character":                   {"string", "pgtype.BPChar", "pgtype.BPCharArray"},
+	"citext":                      {"string", "pgtype.Text", "pgtype.TextArray"},
+	"name":                        {"string", "pgtype.Name", "pgtype.TextArray"},
+	"uuid":                        {"string", "pgtype.UUID", "pgtype.UUIDArray"},
+	"timestamp with time zone":    {"time.Time", "pgtype.Timestamptz", "pgtype.TimestamptzArray"},
+	"timestamp without time zone": {"time.Time", "pgtype.Timestamp", "pgtype.TimestampArray"},
+	"date":                        {"time.Time", "pgtype.Date", "pgtype.DateArray"},
+	"time without time zone":      {"pgtype.Time", "pgtype.Time", ""},
+	"interval":                    {"pgtype.Interval", "pgtype.Interval", ""},
+	"json":                        {"json.RawMessage", "pgtype.JSON", ""},
+	"jsonb":                       {"json.RawMessage", "pgtype.JSONB", "pgtype.JSONBArray"},
+	"inet":                        {"string", "pgtype.Inet", "pgtype.InetArray"},
+	"cidr":                        {"string", "pgtype.CIDR", "pgtype.CIDRArray"},
+	"bytea":                       {"[]byte", "pgtype.Bytea", "pgtype.ByteaArray"},
+}
+
+// Strips type modifiers such as (255) from a type as returned by format_type
+func baseType(typ string) string {
+	if open := strings.Index(typ, "("); open >= 0 {
+		if closing := strings.Index(typ, ")"); closing > open {
+			return strings.TrimSpace(typ[:open] + typ[closing+1:])
+		}
+	}
+
+	return typ
+}
+
+// Options for Go
+type GoOptions struct {
+	Package string
+
+	// Use pgtype types for nullable columns instead of pointers
+	PgType bool
+}
+
+type generator struct {
+	enums map[string]string // postgres enum name => type name
+}
+
+func newGenerator(s *dbparser.CISchema) *generator {
+	g := &generator{enums: map[string]string{}}
+
+	for _, e := range s.Enums {
+		name := TypeName(e.Schema, e.Name)
+
+		// Enums are referenced by format_type as name if they are in the search path
+		// and as schema.name otherwise
+		g.enums[e.Schema+"."+e.Name] = name
+
+		if e.Schema == "public" {
+			g.enums[e.Name] = name
+		}
+	}
+
+	return g
+}
+
+// Returns the enum type name of a column type or false if it isn't an enum
+func (g *generator) enum(typ string) (string, bool) {
+	name, ok := g.enums[strings.ReplaceAll(typ, `"`, "")]
+	return name, ok
+}
+
+// Checks that no two types end up with the same name
+func checkNames(s *dbparser.CISchema, rels []Relation) error {
+	seen := map[string]string{}
+
+	check := func(name, what string) error {
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("%s and %s both map to type %s", other, what, name)
+		}
+
+		seen[name] = what
+		return nil
+	}
+
+	for _, e := range s.Enums {
+		err := check(TypeName(e.Schema, e.Name), "enum "+e.Schema+"."+e.Name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range rels {
+		err := check(TypeName(r.Schema, r.Name), r.Schema+"."+r.Name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks that no Go identifiers clash: enum constants with each other or with a type, and
+// the fields of a struct with each other
+func checkGoNames(s *dbparser.CISchema, rels []Relation) error {
+	seen := map[string]string{}
+
+	for _, e := range s.Enums {
+		seen[TypeName(e.Schema, e.Name)] = "enum " + e.Schema + "." + e.Name
+	}
+
+	for _, r := range rels {
+		seen[TypeName(r.Schema, r.Name)] = r.Schema + "." + r.Name
+	}
+
+	for _, e := range s.Enums {
+		name := TypeName(e.Schema, e.Name)
+
+		for _, v := range e.Values {
+			constName := name + GoName(v)
+			what := "value " + strconv.Quote(v) + " of enum " + e.Schema + "." + e.Name
+
+			if other, ok := seen[constName]; ok {
+				return fmt.Errorf("%s and %s both map to %s", other, what, constName)
+			}
+
+			seen[constName] = what
+		}
+	}
+
+	for _, r := range rels {
+		fields := map[string]string{}
+
+		for _, c := range r.Columns {
+			field := GoName(c.Name)
+
+			if other, ok := fields[field]; ok {
+				return fmt.Errorf("columns %s and %s of %s.%s both map to field %s", other, c.Name, r.Schema, r.Name, field)
+			}
+
+			fields[field] = c.Name
+		}
+	}
+
+	return nil
+}
+
+// Returns the Go type of a column and the import it needs if any
+func (g *generator) goColumnType(c dbparser.CIColumn, opts GoOptions) (string, string) {
+	if name, ok := g.enum(c.Type); ok {
+		switch {
+		case c.Array:
+			return "[]" + name, ""
+		case c.Nullable:
+			return "*" + name, ""
+		default:
+			return name, ""
+		}
+	}
+
+	t, ok := goTypes[baseType(c.Type)]
+
+	if !ok {
+		// Postgres can send any type as text
+		t = goType{"string", "pgtype.Text", "pgtype.TextArray"}
+	}
+
+	typ := t.native
+
+	switch {
+	case c.Array && c.Nullable && opts.PgType && t.pgarray != "":
+		typ = t.pgarray
+	case c.Array:
+		typ = "[]" + t.native
+	case c.Nullable && opts.PgType:
+		typ = t.pgtype
+	case c.Nullable && !strings.HasPrefix(typ, "[]") && typ != "json.RawMessage" && !strings.HasPrefix(typ, "pgtype."):
+		// pgtype types and slices can already represent NULL
+		typ = "*" + typ
+	}
+
+	switch {
+	case strings.Contains(typ, "pgtype."):
+		return typ, "github.com/jackc/pgtype"
+	case strings.Contains(typ, "time."):
+		return typ, "time"
+	case strings.Contains(typ, "json."):
+		return typ, "encoding/json"
+	default:
+		return typ, ""
+	}
+}
+
+// Go generates a Go file with a struct per table and view and a string type per enum
+func Go(s *dbparser.CISchema, rels []Relation, opts GoOptions) ([]byte, error) {
+	err := checkNames(s, rels)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkGoNames(s, rels)
+
+	if err != nil {
+		return nil, err
+	}
+
+	g := newGenerator(s)
+	imports := map[string]bool{}
+
+	var body bytes.Buffer
+
+	for _, e := range s.Enums {
+		name := TypeName(e.Schema, e.Name)
+
+		fmt.Fprintf(&body, "// %s is the %s.%s enum\ntype %s string\n\n", name, e.Schema, e.Name, name)
+
+		if len(e.Values) > 0 {
+			body.WriteString("const (\n")
+
+			for _, v := range e.Values {
+				fmt.Fprintf(&body, "\t%s %s = %s\n", name+GoName(v), name, strconv.Quote(v))
+			}
+
+			body.WriteString(")\n\n")
+		}
+	}
+
+	for _, r := range rels {
+		name := TypeName(r.Schema, r.Name)
+
+		kind := "table"
+
+		if r.View {
+			kind = "view"
+		}
+
+		fmt.Fprintf(&body, "// %s is a row of the %s.%s %s\ntype %s struct {\n", name, r.Schema, r.Name, kind, name)
+
+		for _, c := range r.Columns {
+			typ, imp := g.goColumnType(c, opts)
+
+			if imp != "" {
+				imports[imp] = true
+			}
+
+			fmt.Fprintf(&body, "\t%s %s `db:%s json:%s`\n", GoName(c.Name), typ, strconv.Quote(c.Name), strconv.Quote(c.Name))
+		}
+
+		body.WriteString("}\n\n")
+	}
+
+	var out bytes.Buffer
+
+	out.WriteString("// Code generated by ibl db typegen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package %s\n\n", opts.Package)
+
+	if len(imports) > 0 {
+		var std, thirdParty []string
+
+		for imp := range imports {
+			if strings.Contains(imp, ".") {
+				thirdParty = append(thirdParty, strconv.Quote(imp))
+			} else {
+				std = append(std, strconv.Quote(imp))
+			}
+		}
+
+		sort.Strings(std)
+		sort.Strings(thirdParty)
+
+		groups := []string{}
+
+		for _, g := range [][]string{std, thirdParty} {
+			if len(g) > 0 {
+				groups = append(groups, strings.Join(g, "\n\t"))
+			}
+		}
+
+		out.WriteString("import (\n\t" + strings.Join(groups, "\n\n\t") + "\n)\n\n")
+	}
+
+	out.Write(body.Bytes())
+
+	src, err := format.Source(out.Bytes())
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %w", err)
+	}
+
+	return src, nil
+}
+
+// TypeScript types of postgres types, anything not listed is a string
+var tsTypes = map[string]string{
+	"smallint":         "number",
+	"integer":          "number",
+	"real":             "number",
+	"double precision": "number",
+	"boolean":          "boolean",
+	"json":             "any",
+	"jsonb":            "any",
+}
+
+// Returns the TypeScript type of a column
+func (g *generator) tsColumnType(c dbparser.CIColumn) string {
+	typ, ok := g.enum(c.Type)
+
+	if !ok {
+		// bigint and numeric are strings as they do not fit in a JS number
+		typ, ok = tsTypes[baseType(c.Type)]
+
+		if !ok {
+			typ = "string"
+		}
+	}
+
+	if c.Array {
+		typ += "[]"
+	}
+
+	if c.Nullable {
+		typ += " | null"
+	}
+
+	return typ
+}
+
+// TS generates a TypeScript file with an interface per table and view and a union type per enum
+func TS(s *dbparser.CISchema, rels []Relation) ([]byte, error) {
+	err := checkNames(s, rels)
+
+	if err != nil {
+		return nil, err
+	}
+
+	g := newGenerator(s)
+
+	var out bytes.Buffer
+
+	out.WriteString("// Code generated by ibl db typegen. DO NOT EDIT.\n")
+
+	for _, e := range s.Enums {
+		values := make([]string, len(e.Values))
+
+		for i, v := range e.Values {
+			values[i] = strconv.Quote(v)
+		}
+
+		if len(values) == 0 {
+			values = []string{"never"}
+		}
+
+		fmt.Fprintf(&out, "\n/** The %s.%s enum */\nexport type %s = %s;\n", e.Schema, e.Name, TypeName(e.Schema, e.Name), strings.Join(values, " | "))
+	}
+
+	for _, r := range rels {
+		kind := "table"
+
+		if r.View {
+			kind = "view"
+		}
+
+		fmt.Fprintf(&out, "\n/** A row of the %s.%s %s */\nexport interface %s {\n", r.Schema, r.Name, kind, TypeName(r.Schema, r.Name))
+
+		for _, c := range r.Columns {
+			field := c.Name
+
+			if !isTSIdent(field) {
+				field = strconv.Quote(field)
+			}
+
+			fmt.Fprintf(&out, "  %s: %s;\n", field, g.tsColumnType(c))
+		}
+
+		out.WriteString("}\n")
+	}
+
+	return out.Bytes(), nil
+}
+
+func isTSIdent(s string) bool {
+	for i, r := range s {
+		if r != '_' && r != '$' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+
+	return s != ""
+}
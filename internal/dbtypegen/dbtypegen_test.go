@@ -0,0 +1,227 @@
+package dbtypegen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+)
+
+func TestGoName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"bot_id", "BotID"},
+		{"api_token", "APIToken"},
+		{"userId", "UserId"},
+		{"in-review", "InReview"},
+		{"2fa_enabled", "X2faEnabled"},
+		{"", "X"},
+	}
+
+	for _, tt := range tests {
+		if got := GoName(tt.name); got != tt.want {
+			t.Errorf("GoName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The schema all output tests are generated from
+func testSchema() *dbparser.CISchema {
+	return &dbparser.CISchema{
+		Version: dbparser.CISchemaVersion,
+		Schemas: []string{"public", "billing"},
+		Tables: []*dbparser.CITable{
+			{Schema: "public", Name: "bots", Columns: []dbparser.CIColumn{
+				{Name: "bot_id", Type: "text"},
+				{Name: "votes", Type: "bigint"},
+				{Name: "kind", Type: "vote_kind", Nullable: true},
+				{Name: "tags", Type: "text", Array: true},
+				{Name: "created_at", Type: "timestamp with time zone"},
+				{Name: "extra", Type: "jsonb", Nullable: true},
+				{Name: "rating", Type: "numeric(4,2)", Nullable: true},
+			}},
+			{Schema: "billing", Name: "invoices", Columns: []dbparser.CIColumn{
+				{Name: "id", Type: "uuid"},
+				{Name: "plan", Type: `billing."plan"`},
+			}},
+		},
+		Views: []*dbparser.CIView{
+			{Schema: "public", Name: "top_bots", Columns: []dbparser.CIColumn{
+				{Name: "bot_id", Type: "text", Nullable: true},
+				{Name: "votes", Type: "bigint", Nullable: true},
+			}},
+		},
+		Enums: []*dbparser.Enum{
+			{Schema: "public", Name: "vote_kind", Values: []string{"up", "down"}},
+			{Schema: "billing", Name: "plan", Values: []string{"free", "pro"}},
+		},
+	}
+}
+
+func TestGo(t *testing.T) {
+	s := testSchema()
+
+	src, err := Go(s, Relations(s), GoOptions{Package: "dbtypes"})
+
+	if err != nil {
+		t.Fatalf("Go failed: %v", err)
+	}
+
+	out := string(src)
+
+	for _, want := range []string{
+		"// Code generated by ibl db typegen. DO NOT EDIT.",
+		"package dbtypes",
+		"\"encoding/json\"",
+		"\"time\"",
+		"type VoteKind string",
+		"VoteKindUp   VoteKind = \"up\"",
+		"type BillingPlan string",
+		"BillingPlanPro  BillingPlan = \"pro\"",
+		"// Bots is a row of the public.bots table",
+		"BotID     string          `db:\"bot_id\" json:\"bot_id\"`",
+		"Votes     int64           `db:\"votes\" json:\"votes\"`",
+		"Kind      *VoteKind       `db:\"kind\" json:\"kind\"`",
+		"Tags      []string        `db:\"tags\" json:\"tags\"`",
+		"CreatedAt time.Time       `db:\"created_at\" json:\"created_at\"`",
+		"Extra     json.RawMessage `db:\"extra\" json:\"extra\"`",
+		"Rating    pgtype.Numeric  `db:\"rating\" json:\"rating\"`",
+		"type BillingInvoices struct {",
+		"Plan BillingPlan `db:\"plan\" json:\"plan\"`",
+		"// TopBots is a row of the public.top_bots view",
+		"Votes *int64  `db:\"votes\" json:\"votes\"`",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Go output is missing %q:\n%s", want, out)
+		}
+	}
+
+	src, err = Go(s, Relations(s), GoOptions{Package: "dbtypes", PgType: true})
+
+	if err != nil {
+		t.Fatalf("Go with PgType failed: %v", err)
+	}
+
+	if !strings.Contains(string(src), "Votes pgtype.Int8 `db:\"votes\" json:\"votes\"`") {
+		t.Errorf("Go output with PgType does not use pgtype.Int8 for a nullable bigint:\n%s", src)
+	}
+}
+
+func TestTS(t *testing.T) {
+	s := testSchema()
+
+	src, err := TS(s, Relations(s))
+
+	if err != nil {
+		t.Fatalf("TS failed: %v", err)
+	}
+
+	want := `// Code generated by ibl db typegen. DO NOT EDIT.
+
+/** The public.vote_kind enum */
+export type VoteKind = "up" | "down";
+
+/** The billing.plan enum */
+export type BillingPlan = "free" | "pro";
+
+/** A row of the public.bots table */
+export interface Bots {
+  bot_id: string;
+  votes: string;
+  kind: VoteKind | null;
+  tags: string[];
+  created_at: string;
+  extra: any | null;
+  rating: string | null;
+}
+
+/** A row of the billing.invoices table */
+export interface BillingInvoices {
+  id: string;
+  plan: BillingPlan;
+}
+
+/** A row of the public.top_bots view */
+export interface TopBots {
+  bot_id: string | null;
+  votes: string | null;
+}
+`
+
+	if string(src) != want {
+		t.Errorf("TS output =\n%s\nwant\n%s", src, want)
+	}
+}
+
+func TestNameClashes(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(s *dbparser.CISchema)
+		// Substring of the error, empty if generation must succeed for both languages
+		err string
+		// Whether the clash only exists in Go
+		goOnly bool
+	}{
+		{
+			name: "no clashes",
+			edit: func(s *dbparser.CISchema) {},
+		},
+		{
+			name: "tables mapping to the same type",
+			edit: func(s *dbparser.CISchema) {
+				s.Tables = append(s.Tables, &dbparser.CITable{Schema: "public", Name: "billing_invoices"})
+			},
+			err: "billing.invoices and public.billing_invoices both map to type BillingInvoices",
+		},
+		{
+			name: "columns mapping to the same field",
+			edit: func(s *dbparser.CISchema) {
+				s.Tables[0].Columns = append(s.Tables[0].Columns, dbparser.CIColumn{Name: "bot-id", Type: "text"})
+			},
+			err:    "columns bot_id and bot-id of public.bots both map to field BotID",
+			goOnly: true,
+		},
+		{
+			name: "enum values mapping to the same constant",
+			edit: func(s *dbparser.CISchema) {
+				s.Enums[0].Values = []string{"in-review", "in_review"}
+			},
+			err:    `value "in-review" of enum public.vote_kind and value "in_review" of enum public.vote_kind both map to VoteKindInReview`,
+			goOnly: true,
+		},
+		{
+			name: "enum constant clashing with a table type",
+			edit: func(s *dbparser.CISchema) {
+				s.Tables = append(s.Tables, &dbparser.CITable{Schema: "public", Name: "vote_kind_up"})
+			},
+			err:    `public.vote_kind_up and value "up" of enum public.vote_kind both map to VoteKindUp`,
+			goOnly: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSchema()
+			tt.edit(s)
+
+			_, err := Go(s, Relations(s), GoOptions{Package: "dbtypes"})
+
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Go failed: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Go error = %v, want %q", err, tt.err)
+			}
+
+			_, err = TS(s, Relations(s))
+
+			switch {
+			case (tt.err == "" || tt.goOnly) && err != nil:
+				t.Errorf("TS failed: %v", err)
+			case tt.err != "" && !tt.goOnly && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("TS error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
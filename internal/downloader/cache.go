@@ -0,0 +1,255 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A cached download. Blobs are stored by their sha512 hash and this entry maps a URL to one
+type cacheEntry struct {
+	URL       string    `json:"url"`
+	ETag      string    `json:"etag"`
+	Sha512    string    `json:"sha512"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// Returns the directory downloads are cached in
+func CacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "ibl", "downloads"), nil
+}
+
+func indexPath(cacheDir, url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, "index", hex.EncodeToString(h[:])+".json")
+}
+
+func blobPath(cacheDir, hash string) string {
+	return filepath.Join(cacheDir, "blobs", hash)
+}
+
+func loadCacheEntry(cacheDir, url string) *cacheEntry {
+	data, err := os.ReadFile(indexPath(cacheDir, url))
+
+	if err != nil {
+		return nil
+	}
+
+	var entry cacheEntry
+
+	if json.Unmarshal(data, &entry) != nil || entry.URL != url {
+		return nil
+	}
+
+	// Ensure the blob itself still exists
+	if _, err := os.Stat(blobPath(cacheDir, entry.Sha512)); err != nil {
+		return nil
+	}
+
+	return &entry
+}
+
+// Re-hashes the cached blob of an entry, dropping the entry and blob if it no longer matches
+func verifyCacheEntry(cacheDir string, entry *cacheEntry) error {
+	f, err := os.Open(blobPath(cacheDir, entry.Sha512))
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	hasher := sha512.New()
+
+	_, err = io.Copy(hasher, f)
+
+	if err != nil {
+		return err
+	}
+
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != entry.Sha512 {
+		os.Remove(indexPath(cacheDir, entry.URL))
+		os.Remove(blobPath(cacheDir, entry.Sha512))
+		return fmt.Errorf("cached copy is corrupt: expected %s, got %s", entry.Sha512, hash)
+	}
+
+	return nil
+}
+
+// Fetches the published sha512 checksum for a URL from <url>.sha512
+//
+// The checksum file is expected to be in sha512sum format
+func fetchChecksum(url string) (string, error) {
+	resp, err := http.Get(url + ".sha512")
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errors.New("no checksum published at " + url + ".sha512, set NO_SHASUM=true to skip verification")
+	}
+
+	if resp.StatusCode >= 400 || resp.StatusCode < 200 {
+		return "", errors.New("illegal status code: " + resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(body))
+
+	if len(fields) == 0 {
+		return "", errors.New("checksum file is empty")
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// DownloadFileCached downloads a file with a progress bar into a content-addressed cache
+// under the user cache directory, returning the path to the cached file
+//
+// If the file has been downloaded before, If-None-Match is used to skip the download when
+// the server copy is unchanged. Cached copies are re-hashed before use and new downloads are
+// verified against <url>.sha512 (set NO_SHASUM=true to skip verification of new downloads)
+func DownloadFileCached(url string) (string, error) {
+	cacheDir, err := CacheDir()
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get cache dir: %w", err)
+	}
+
+	for _, dir := range []string{"index", "blobs"} {
+		err = os.MkdirAll(filepath.Join(cacheDir, dir), 0755)
+
+		if err != nil {
+			return "", fmt.Errorf("failed to create cache dir: %w", err)
+		}
+	}
+
+	entry := loadCacheEntry(cacheDir, url)
+
+	if entry != nil {
+		err = verifyCacheEntry(cacheDir, entry)
+
+		if err != nil {
+			fmt.Println("WARNING: Not using cached copy of", url+":", err)
+			entry = nil
+		}
+	}
+
+	header := http.Header{}
+
+	if entry != nil && entry.ETag != "" {
+		header.Set("If-None-Match", entry.ETag)
+	}
+
+	resp, err := get(url, header)
+
+	if err != nil {
+		var se *statusError
+
+		if entry != nil && !errors.As(err, &se) {
+			fmt.Println("WARNING: Failed to check for updates, using cached copy:", err)
+			return blobPath(cacheDir, entry.Sha512), nil
+		}
+
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		fmt.Println("NOTE: Using cached copy of", url)
+		return blobPath(cacheDir, entry.Sha512), nil
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Join(cacheDir, "blobs"), "download-*")
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hasher := sha512.New()
+
+	err = download(io.MultiWriter(tmpFile, hasher), resp)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = tmpFile.Close()
+
+	if err != nil {
+		return "", fmt.Errorf("failed to write downloaded file: %w", err)
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	if os.Getenv("NO_SHASUM") != "true" {
+		expected, err := fetchChecksum(url)
+
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch checksum: %w", err)
+		}
+
+		if expected != hash {
+			return "", fmt.Errorf("checksum mismatch: expected %s, got %s", expected, hash)
+		}
+
+		fmt.Println("NOTE: Checksum verified")
+	}
+
+	err = os.Rename(tmpFile.Name(), blobPath(cacheDir, hash))
+
+	if err != nil {
+		return "", fmt.Errorf("failed to move download into cache: %w", err)
+	}
+
+	entryBytes, err := json.Marshal(cacheEntry{
+		URL:       url,
+		ETag:      resp.Header.Get("ETag"),
+		Sha512:    hash,
+		FetchedAt: time.Now(),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	err = os.WriteFile(indexPath(cacheDir, url), entryBytes, 0644)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to write cache index: %w", err)
+	}
+
+	return blobPath(cacheDir, hash), nil
+}
+
+// Returns whether or not s is a http(s) URL
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Serves /file with an ETag and its checksum at /file.sha512, /unsigned has no checksum
+func testServer(t *testing.T, content []byte) *httptest.Server {
+	t.Helper()
+
+	sum := sha512.Sum512(content)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file", "/unsigned":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(content)
+		case "/file.sha512":
+			w.Write([]byte(hex.EncodeToString(sum[:]) + "  file\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	t.Cleanup(srv.Close)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("NO_SHASUM", "")
+
+	return srv
+}
+
+func TestDownloadFileCachedCorruptBlob(t *testing.T) {
+	content := []byte("ibl binary")
+	srv := testServer(t, content)
+
+	path, err := DownloadFileCached(srv.URL + "/file")
+
+	if err != nil {
+		t.Fatalf("first download failed: %v", err)
+	}
+
+	err = os.WriteFile(path, []byte("tampered"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server answers 304 to the cached ETag, so the corrupt blob must not be reused
+	path, err = DownloadFileCached(srv.URL + "/file")
+
+	if err != nil {
+		t.Fatalf("second download failed: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(content) {
+		t.Errorf("cached file = %q, want %q", got, content)
+	}
+}
+
+func TestDownloadFileCachedMissingChecksum(t *testing.T) {
+	srv := testServer(t, []byte("ibl binary"))
+
+	_, err := DownloadFileCached(srv.URL + "/unsigned")
+
+	if err == nil {
+		t.Fatal("download without a published checksum succeeded")
+	}
+
+	t.Setenv("NO_SHASUM", "true")
+
+	_, err = DownloadFileCached(srv.URL + "/unsigned")
+
+	if err != nil {
+		t.Fatalf("download with NO_SHASUM=true failed: %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package downloader
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,14 +10,28 @@ import (
 	"github.com/schollz/progressbar/v3"
 )
 
-// DownloadFileWithProgress downloads a file with a progress bar
-func DownloadFileWithProgress(url string) ([]byte, error) {
+// Returned when the server answers with an error status code
+type statusError struct {
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "illegal status code: " + e.status
+}
+
+// Sends a GET request to url with the given headers, failing with a *statusError if the
+// server does not answer with a 2xx or 3xx status. The caller must close the response body
+func get(url string, header http.Header) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
 	resp, err := http.DefaultClient.Do(req)
 
 	if err != nil {
@@ -26,20 +39,45 @@ func DownloadFileWithProgress(url string) ([]byte, error) {
 	}
 
 	if resp.StatusCode >= 400 || resp.StatusCode < 200 {
-		return nil, errors.New("illegal status code: " + resp.Status)
+		resp.Body.Close()
+		return nil, &statusError{status: resp.Status}
 	}
 
-	defer resp.Body.Close()
+	return resp, nil
+}
 
+// Copies the body of resp to w with a progress bar
+func download(w io.Writer, resp *http.Response) error {
 	bar := progressbar.DefaultBytes(
 		resp.ContentLength,
 		"downloading",
 	)
+
+	n, err := io.Copy(io.MultiWriter(w, bar), resp.Body)
+
+	if err != nil {
+		return fmt.Errorf("error downloading file: %w with %d written", err, n)
+	}
+
+	return nil
+}
+
+// DownloadFileWithProgress downloads a file with a progress bar
+func DownloadFileWithProgress(url string) ([]byte, error) {
+	resp, err := get(url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
 	var dlBuf = bytes.NewBuffer([]byte{})
-	w, err := io.Copy(io.MultiWriter(dlBuf, bar), resp.Body)
+
+	err = download(dlBuf, resp)
 
 	if err != nil {
-		return nil, fmt.Errorf("error downloading file: %w with %d written", err, w)
+		return nil, err
 	}
 
 	return dlBuf.Bytes(), nil
@@ -0,0 +1,29 @@
+package downloader
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDownloadFileWithProgress(t *testing.T) {
+	content := []byte("ibl binary")
+	srv := testServer(t, content)
+
+	got, err := DownloadFileWithProgress(srv.URL + "/file")
+
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+
+	if string(got) != string(content) {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+
+	_, err = DownloadFileWithProgress(srv.URL + "/missing")
+
+	var se *statusError
+
+	if !errors.As(err, &se) {
+		t.Errorf("download of a missing file = %v, want a status error", err)
+	}
+}
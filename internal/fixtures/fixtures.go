@@ -0,0 +1,526 @@
+// Package fixtures loads hand written seed fixtures
+//
+// A fixtures directory has one YAML or JSON file per table, named after the table
+// (e.g. users.yaml or public.users.yaml). Each file maps a row key to the columns of
+// the row:
+//
+//	alice:
+//	  user_id: "1001"
+//	  username: alice
+//
+// Rows can reference other rows with !ref table.row (the primary key of the row) or
+// !ref table.row.column. In JSON files, use {"$ref": "table.row"} instead
+package fixtures
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The YAML tag used for references
+const RefTag = "!ref"
+
+// A reference to another row
+type Ref struct {
+	Table string
+	Row   string
+
+	// Empty to reference the primary key of the row
+	Column string
+}
+
+func (r Ref) String() string {
+	if r.Column == "" {
+		return r.Table + "." + r.Row
+	}
+
+	return r.Table + "." + r.Row + "." + r.Column
+}
+
+// A single fixture row
+type Row struct {
+	Table string
+	Key   string
+
+	// Where the row is defined, for error messages
+	File string
+	Line int
+
+	// Columns in the order they are written in the file
+	Columns []string
+	Values  map[string]*yaml.Node
+}
+
+// Returns file:line (table.key) for error messages
+func (r *Row) Pos() string {
+	return fmt.Sprintf("%s:%d (%s.%s)", r.File, r.Line, r.Table, r.Key)
+}
+
+// A loaded fixtures directory
+type Set struct {
+	// Tables in file name order
+	Tables []string
+
+	// Rows of each table in file order
+	Rows map[string][]*Row
+}
+
+// Load reads all .yaml, .yml and .json files in dir
+func Load(dir string) (*Set, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixtures directory: %w", err)
+	}
+
+	set := &Set{Rows: map[string][]*Row{}}
+
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+
+		table := strings.TrimSuffix(e.Name(), ext)
+
+		if _, ok := set.Rows[table]; ok {
+			return nil, fmt.Errorf("table %s has more than one fixtures file", table)
+		}
+
+		path := filepath.Join(dir, e.Name())
+
+		rows, err := loadFile(path, table)
+
+		if err != nil {
+			return nil, err
+		}
+
+		set.Tables = append(set.Tables, table)
+		set.Rows[table] = rows
+	}
+
+	if len(set.Tables) == 0 {
+		return nil, fmt.Errorf("no fixture files found in %s", dir)
+	}
+
+	return set, nil
+}
+
+func loadFile(path, table string) ([]*Row, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var doc yaml.Node
+
+	err = yaml.Unmarshal(data, &doc)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	// Empty file
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: expected a mapping of row keys to rows", path, root.Line)
+	}
+
+	var rows []*Row
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		if value.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s:%d: row %s must be a mapping of columns to values", path, value.Line, key.Value)
+		}
+
+		row := &Row{
+			Table:  table,
+			Key:    key.Value,
+			File:   path,
+			Line:   key.Line,
+			Values: map[string]*yaml.Node{},
+		}
+
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			col := value.Content[j].Value
+
+			if _, ok := row.Values[col]; ok {
+				return nil, fmt.Errorf("%s: column %s is set twice", row.Pos(), col)
+			}
+
+			row.Columns = append(row.Columns, col)
+			row.Values[col] = value.Content[j+1]
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Returns the row with the given key or nil
+func (s *Set) Row(table, key string) *Row {
+	for _, r := range s.Rows[table] {
+		if r.Key == key {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// Returns the reference string of a node or false if the node is not a reference
+func refString(n *yaml.Node) (string, bool) {
+	if n.Kind == yaml.ScalarNode && n.Tag == RefTag {
+		return n.Value, true
+	}
+
+	// {"$ref": "table.row"} for JSON
+	if n.Kind == yaml.MappingNode && len(n.Content) == 2 && n.Content[0].Value == "$ref" {
+		return n.Content[1].Value, true
+	}
+
+	return "", false
+}
+
+// Parses a reference, table names may contain dots so the longest matching table is used
+func (s *Set) parseRef(ref string) (Ref, error) {
+	var best string
+
+	for _, t := range s.Tables {
+		if strings.HasPrefix(ref, t+".") && len(t) > len(best) {
+			best = t
+		}
+	}
+
+	if best == "" {
+		return Ref{}, fmt.Errorf("reference %s does not point to a fixture table", ref)
+	}
+
+	row, column, _ := strings.Cut(strings.TrimPrefix(ref, best+"."), ".")
+
+	if s.Row(best, row) == nil {
+		return Ref{}, fmt.Errorf("reference %s points to unknown row %s of %s", ref, row, best)
+	}
+
+	return Ref{Table: best, Row: row, Column: column}, nil
+}
+
+// Collects all references in a node
+func (s *Set) collectRefs(n *yaml.Node, refs *[]Ref) error {
+	if str, ok := refString(n); ok {
+		ref, err := s.parseRef(str)
+
+		if err != nil {
+			return err
+		}
+
+		*refs = append(*refs, ref)
+		return nil
+	}
+
+	for _, c := range n.Content {
+		err := s.collectRefs(c, refs)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Refs returns all references of a row
+func (s *Set) Refs(r *Row) ([]Ref, error) {
+	var refs []Ref
+
+	for _, col := range r.Columns {
+		err := s.collectRefs(r.Values[col], &refs)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: column %s: %w", r.Pos(), col, err)
+		}
+	}
+
+	return refs, nil
+}
+
+// Validate checks that all references point to existing rows
+func (s *Set) Validate() []error {
+	var errs []error
+
+	for _, t := range s.Tables {
+		for _, r := range s.Rows[t] {
+			_, err := s.Refs(r)
+
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// Sorts items topologically, deps maps an item to the items it depends on
+//
+// Items without dependencies between them keep their original order
+func topoSort(items []string, deps map[string][]string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	state := map[string]int{}
+	var order []string
+
+	var visit func(item string, path []string) error
+	visit = func(item string, path []string) error {
+		switch state[item] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, item), " -> "))
+		}
+
+		state[item] = visiting
+
+		d := append([]string{}, deps[item]...)
+		sort.Strings(d)
+
+		for _, dep := range d {
+			if dep == item {
+				continue
+			}
+
+			err := visit(dep, append(path, item))
+
+			if err != nil {
+				return err
+			}
+		}
+
+		state[item] = done
+		order = append(order, item)
+		return nil
+	}
+
+	for _, item := range items {
+		err := visit(item, nil)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// Order returns the fixture tables sorted so that referenced tables come first, along
+// with the rows of each table sorted the same way
+//
+// fkDeps maps a table to the tables it has foreign keys to, tables that are not part
+// of the fixtures are ignored
+func (s *Set) Order(fkDeps map[string][]string) ([]string, map[string][]*Row, error) {
+	tableDeps := map[string][]string{}
+	rowDeps := map[string]map[string][]string{}
+
+	for _, t := range s.Tables {
+		rowDeps[t] = map[string][]string{}
+
+		for _, dep := range fkDeps[t] {
+			if _, ok := s.Rows[dep]; ok {
+				tableDeps[t] = append(tableDeps[t], dep)
+			}
+		}
+
+		for _, r := range s.Rows[t] {
+			refs, err := s.Refs(r)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, ref := range refs {
+				if ref.Table == t {
+					rowDeps[t][r.Key] = append(rowDeps[t][r.Key], ref.Row)
+				} else {
+					tableDeps[t] = append(tableDeps[t], ref.Table)
+				}
+			}
+		}
+	}
+
+	tables, err := topoSort(s.Tables, tableDeps)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("tables: %w", err)
+	}
+
+	rows := map[string][]*Row{}
+
+	for _, t := range tables {
+		var keys []string
+
+		for _, r := range s.Rows[t] {
+			keys = append(keys, r.Key)
+		}
+
+		keys, err = topoSort(keys, rowDeps[t])
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("rows of %s: %w", t, err)
+		}
+
+		for _, k := range keys {
+			rows[t] = append(rows[t], s.Row(t, k))
+		}
+	}
+
+	return tables, rows, nil
+}
+
+// Render converts a fixture value to the text representation of a column value
+//
+// Sequences become array literals for array columns and JSON otherwise, mappings
+// always become JSON. resolve is called for every reference
+func (s *Set) Render(n *yaml.Node, array bool, resolve func(Ref) (*string, error)) (*string, error) {
+	if str, ok := refString(n); ok {
+		ref, err := s.parseRef(str)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return resolve(ref)
+	}
+
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return nil, nil
+		}
+
+		v := n.Value
+		return &v, nil
+	case yaml.SequenceNode:
+		if !array {
+			return s.renderJSON(n, resolve)
+		}
+
+		elems := make([]string, len(n.Content))
+
+		for i, c := range n.Content {
+			v, err := s.Render(c, false, resolve)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if v == nil {
+				elems[i] = "NULL"
+				continue
+			}
+
+			elems[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(*v) + `"`
+		}
+
+		v := "{" + strings.Join(elems, ",") + "}"
+		return &v, nil
+	case yaml.MappingNode:
+		return s.renderJSON(n, resolve)
+	case yaml.AliasNode:
+		return s.Render(n.Alias, array, resolve)
+	default:
+		return nil, fmt.Errorf("unsupported value at line %d", n.Line)
+	}
+}
+
+// Converts a node to a JSON compatible value, resolving references to strings
+func (s *Set) jsonValue(n *yaml.Node, resolve func(Ref) (*string, error)) (any, error) {
+	if _, ok := refString(n); ok {
+		v, err := s.Render(n, false, resolve)
+
+		if err != nil || v == nil {
+			return nil, err
+		}
+
+		return *v, nil
+	}
+
+	switch n.Kind {
+	case yaml.SequenceNode:
+		list := make([]any, len(n.Content))
+
+		for i, c := range n.Content {
+			v, err := s.jsonValue(c, resolve)
+
+			if err != nil {
+				return nil, err
+			}
+
+			list[i] = v
+		}
+
+		return list, nil
+	case yaml.MappingNode:
+		obj := map[string]any{}
+
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v, err := s.jsonValue(n.Content[i+1], resolve)
+
+			if err != nil {
+				return nil, err
+			}
+
+			obj[n.Content[i].Value] = v
+		}
+
+		return obj, nil
+	case yaml.AliasNode:
+		return s.jsonValue(n.Alias, resolve)
+	default:
+		var v any
+
+		err := n.Decode(&v)
+
+		return v, err
+	}
+}
+
+func (s *Set) renderJSON(n *yaml.Node, resolve func(Ref) (*string, error)) (*string, error) {
+	v, err := s.jsonValue(n, resolve)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	err = enc.Encode(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	str := strings.TrimSuffix(buf.String(), "\n")
+	return &str, nil
+}
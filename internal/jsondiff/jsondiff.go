@@ -0,0 +1,155 @@
+// Package jsondiff structurally compares two JSON documents
+package jsondiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// Kinds of a change
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// A difference between two JSON documents
+type Change struct {
+	// One of Added, Removed or Changed
+	Kind string
+
+	// Path of the value, e.g. $.tables[2].name
+	Path string
+
+	// Old and new value, Old is nil for Added and New is nil for Removed
+	Old any
+	New any
+}
+
+func encode(v any) string {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return "?"
+	}
+
+	return string(data)
+}
+
+// Returns the change as a line of human readable output
+func (c Change) String() string {
+	switch c.Kind {
+	case Added:
+		return "+ " + c.Path + ": " + encode(c.New)
+	case Removed:
+		return "- " + c.Path + ": " + encode(c.Old)
+	default:
+		return "~ " + c.Path + ": " + encode(c.Old) + " -> " + encode(c.New)
+	}
+}
+
+// Decodes a JSON document keeping numbers as written
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+
+	err := dec.Decode(&v)
+
+	return v, err
+}
+
+// DiffBytes structurally compares two encoded JSON documents
+func DiffBytes(a, b []byte) ([]Change, error) {
+	av, err := decode(a)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bv, err := decode(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Diff(av, bv), nil
+}
+
+// Diff structurally compares two decoded JSON values. Object keys are compared by name (in sorted
+// order) and array elements by index
+func Diff(a, b any) []Change {
+	return diff("$", a, b, nil)
+}
+
+func diff(path string, a, b any, changes []Change) []Change {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+
+		if !ok {
+			break
+		}
+
+		var keys []string
+
+		for k := range av {
+			keys = append(keys, k)
+		}
+
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			aval, inA := av[k]
+			bval, inB := bv[k]
+
+			switch {
+			case !inA:
+				changes = append(changes, Change{Kind: Added, Path: path + "." + k, New: bval})
+			case !inB:
+				changes = append(changes, Change{Kind: Removed, Path: path + "." + k, Old: aval})
+			default:
+				changes = diff(path+"."+k, aval, bval, changes)
+			}
+		}
+
+		return changes
+	case []any:
+		bv, ok := b.([]any)
+
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			elemPath := path + "[" + strconv.Itoa(i) + "]"
+
+			switch {
+			case i >= len(av):
+				changes = append(changes, Change{Kind: Added, Path: elemPath, New: bv[i]})
+			case i >= len(bv):
+				changes = append(changes, Change{Kind: Removed, Path: elemPath, Old: av[i]})
+			default:
+				changes = diff(elemPath, av[i], bv[i], changes)
+			}
+		}
+
+		return changes
+	}
+
+	// Scalars, or values whose type changed
+	if encode(a) != encode(b) {
+		changes = append(changes, Change{Kind: Changed, Path: path, Old: a, New: b})
+	}
+
+	return changes
+}
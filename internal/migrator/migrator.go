@@ -0,0 +1,443 @@
+// Package migrator applies versioned SQL migrations to a database
+//
+// Migrations are stored as NNNN_name.up.sql and NNNN_name.down.sql files in a directory. Applied
+// versions are tracked in the ibl_schema_migrations table along with the checksum of their up file
+//
+// Down files are not checksummed, so they can still be fixed after their up file was applied. An
+// edited down file is run as is when its migration is reverted
+package migrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Name of the bookkeeping table
+const Table = "ibl_schema_migrations"
+
+// Key of the advisory lock held while migrating
+const lockKey int64 = 0x69626c6d69677261 // "iblmigra"
+
+var fileRegex = regexp.MustCompile(`^(\d+)_([A-Za-z0-9_\-]+)\.(up|down)\.sql$`)
+
+// A migration on disk
+type Migration struct {
+	Version int64
+	Name    string
+
+	UpPath   string
+	DownPath string
+
+	// sha256 of the up file, the down file is not covered
+	Checksum string
+}
+
+// An applied migration as recorded in the bookkeeping table
+type Applied struct {
+	Version   int64
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// The status of a single migration
+type Status struct {
+	Version int64
+	Name    string
+
+	// Nil if the migration has not been applied
+	Applied *Applied
+
+	// Nil if the migration file no longer exists
+	Migration *Migration
+}
+
+// Returns whether or not the up file of the migration was edited after being applied
+func (s Status) Modified() bool {
+	return s.Applied != nil && s.Migration != nil && s.Applied.Checksum != s.Migration.Checksum
+}
+
+func checksum(path string) (string, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// Load reads all migrations in dir, sorted by version
+func Load(dir string) ([]*Migration, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		m := fileRegex.FindStringSubmatch(e.Name())
+
+		if m == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(m[1], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", e.Name(), err)
+		}
+
+		mig, ok := byVersion[version]
+
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, mig.Name, m[2])
+		}
+
+		path := filepath.Join(dir, e.Name())
+
+		if m[3] == "up" {
+			mig.UpPath = path
+		} else {
+			mig.DownPath = path
+		}
+	}
+
+	var migrations []*Migration
+
+	for _, mig := range byVersion {
+		if mig.UpPath == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+
+		mig.Checksum, err = checksum(mig.UpPath)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", mig.UpPath, err)
+		}
+
+		migrations = append(migrations, mig)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Create creates empty up and down files for a new migration, returning their paths
+func Create(dir, name string) (string, string, error) {
+	name = strings.ToLower(regexp.MustCompile(`[^A-Za-z0-9_]+`).ReplaceAllString(name, "_"))
+	name = strings.Trim(name, "_")
+
+	if name == "" {
+		return "", "", fmt.Errorf("invalid migration name")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create migrations directory: %w", err)
+	}
+
+	migrations, err := Load(dir)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	var version int64 = 1
+
+	if len(migrations) > 0 {
+		version = migrations[len(migrations)-1].Version + 1
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%04d_%s", version, name))
+	up, down := base+".up.sql", base+".down.sql"
+
+	header := fmt.Sprintf("-- Migration %04d: %s\n", version, name)
+
+	err = os.WriteFile(up, []byte(header+"\n"), 0644)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	err = os.WriteFile(down, []byte(header+"-- Reverts the up migration\n\n"), 0644)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return up, down, nil
+}
+
+// A Migrator applies migrations using a single connection
+type Migrator struct {
+	conn       *pgx.Conn
+	migrations []*Migration
+}
+
+// New takes the migration advisory lock and creates the bookkeeping table if needed
+//
+// The lock is taken first so concurrent runs do not race on creating the table. Call Close to release the lock
+func New(ctx context.Context, conn *pgx.Conn, migrations []*Migration) (*Migrator, error) {
+	var locked bool
+
+	err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", lockKey).Scan(&locked)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to take migration lock: %w", err)
+	}
+
+	if !locked {
+		fmt.Println("NOTE: Another migration is running, waiting for it to finish")
+
+		_, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", lockKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to take migration lock: %w", err)
+		}
+	}
+
+	m := &Migrator{conn: conn, migrations: migrations}
+
+	_, err = conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+Table+" (version BIGINT PRIMARY KEY, name TEXT NOT NULL, checksum TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW())")
+
+	if err != nil {
+		m.Close(ctx)
+		return nil, fmt.Errorf("failed to create %s table: %w", Table, err)
+	}
+
+	return m, nil
+}
+
+// Close releases the migration advisory lock
+func (m *Migrator) Close(ctx context.Context) error {
+	_, err := m.conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", lockKey)
+	return err
+}
+
+func (m *Migrator) applied(ctx context.Context) ([]*Applied, error) {
+	rows, err := m.conn.Query(ctx, "SELECT version, name, checksum, applied_at FROM "+Table+" ORDER BY version")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	defer rows.Close()
+
+	var applied []*Applied
+
+	for rows.Next() {
+		a := &Applied{}
+
+		err = rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.AppliedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read applied migration: %w", err)
+		}
+
+		applied = append(applied, a)
+	}
+
+	return applied, rows.Err()
+}
+
+// Status returns the status of all migrations on disk and in the database, sorted by version
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Status{}
+
+	for _, mig := range m.migrations {
+		byVersion[mig.Version] = &Status{Version: mig.Version, Name: mig.Name, Migration: mig}
+	}
+
+	for _, a := range applied {
+		s, ok := byVersion[a.Version]
+
+		if !ok {
+			s = &Status{Version: a.Version, Name: a.Name}
+			byVersion[a.Version] = s
+		}
+
+		s.Applied = a
+	}
+
+	var statuses []Status
+
+	for _, s := range byVersion {
+		statuses = append(statuses, *s)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+// Returns the statuses after checking that no applied migration was edited
+func (m *Migrator) verifiedStatus(ctx context.Context) ([]Status, error) {
+	statuses, err := m.Status(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var modified []string
+
+	for _, s := range statuses {
+		if s.Modified() {
+			modified = append(modified, filepath.Base(s.Migration.UpPath))
+		}
+	}
+
+	if len(modified) > 0 {
+		return nil, fmt.Errorf("refusing to run, these applied migrations were edited after being applied: %s. Add a new migration instead", strings.Join(modified, ", "))
+	}
+
+	return statuses, nil
+}
+
+// Runs sql and then fn in a single transaction
+func (m *Migrator) runInTx(ctx context.Context, path string, fn func(tx pgx.Tx) error) error {
+	sql, err := os.ReadFile(path)
+
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	tx, err := m.conn.Begin(ctx)
+
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, string(sql))
+
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w", filepath.Base(path), err)
+	}
+
+	err = fn(tx)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Up applies up to steps pending migrations (all if steps <= 0) in version order, returning the applied migrations
+func (m *Migrator) Up(ctx context.Context, steps int) ([]*Migration, error) {
+	statuses, err := m.verifiedStatus(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []*Migration
+
+	for _, s := range statuses {
+		if s.Applied != nil || s.Migration == nil {
+			continue
+		}
+
+		if steps > 0 && len(done) >= steps {
+			break
+		}
+
+		mig := s.Migration
+
+		fmt.Printf("Applying migration %04d_%s\n", mig.Version, mig.Name)
+
+		err = m.runInTx(ctx, mig.UpPath, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "INSERT INTO "+Table+" (version, name, checksum) VALUES ($1, $2, $3)", mig.Version, mig.Name, mig.Checksum)
+			return err
+		})
+
+		if err != nil {
+			return done, err
+		}
+
+		done = append(done, mig)
+	}
+
+	return done, nil
+}
+
+// Down reverts the latest steps applied migrations, returning the reverted migrations
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	statuses, err := m.verifiedStatus(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []*Migration
+
+	for i := len(statuses) - 1; i >= 0 && len(done) < steps; i-- {
+		s := statuses[i]
+
+		if s.Applied == nil {
+			continue
+		}
+
+		if s.Migration == nil {
+			return done, fmt.Errorf("cannot revert migration %04d_%s, its files no longer exist", s.Version, s.Name)
+		}
+
+		mig := s.Migration
+
+		if mig.DownPath == "" {
+			return done, fmt.Errorf("cannot revert migration %04d_%s, it has no down file", mig.Version, mig.Name)
+		}
+
+		fmt.Printf("Reverting migration %04d_%s\n", mig.Version, mig.Name)
+
+		err = m.runInTx(ctx, mig.DownPath, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DELETE FROM "+Table+" WHERE version = $1", mig.Version)
+			return err
+		})
+
+		if err != nil {
+			return done, err
+		}
+
+		done = append(done, mig)
+	}
+
+	return done, nil
+}
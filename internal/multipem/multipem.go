@@ -0,0 +1,163 @@
+// Package multipem is an iblfile auto encryptor that encrypts a file to several pem keys at once
+//
+// The data is encrypted with aes256 using a random key, which is then encrypted with RSA-OAEP
+// for every recipient. Any one of the private keys can decrypt the file
+package multipem
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/infinitybotlist/iblfile/encryptors/aes256"
+)
+
+// Number of random bytes in the aes256 key, hex encoded it must fit in a single RSA-OAEP block with SHA-512
+const dataKeyLength = 32
+
+type MultiPemEncryptedSource struct {
+	// Public keys of the recipients to encrypt data with
+	PublicKeys [][]byte
+
+	// Private key of any recipient to decrypt data with
+	PrivateKey []byte
+}
+
+func (p MultiPemEncryptedSource) ID() string {
+	return "multipem$$$$$$$$"
+}
+
+func (p MultiPemEncryptedSource) Encrypt(b []byte) ([]byte, error) {
+	if len(p.PublicKeys) == 0 {
+		return nil, fmt.Errorf("no public keys provided")
+	}
+
+	if len(p.PublicKeys) > 255 {
+		return nil, fmt.Errorf("too many public keys, at most 255 are supported")
+	}
+
+	keyBytes := make([]byte, dataKeyLength)
+
+	_, err := rand.Read(keyBytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	dataKey := hex.EncodeToString(keyBytes)
+
+	// Format is <recipient count, 1 byte>(<key length, 2 bytes><encrypted data key>)...<encrypted data>
+	res := []byte{uint8(len(p.PublicKeys))}
+
+	for i, pubKey := range p.PublicKeys {
+		block, _ := pem.Decode(pubKey)
+
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode public key %d", i+1)
+		}
+
+		pubInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %d: %w", i+1, err)
+		}
+
+		pub, ok := pubInterface.(*rsa.PublicKey)
+
+		if !ok {
+			return nil, fmt.Errorf("public key %d is not an RSA key", i+1)
+		}
+
+		key, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, pub, []byte(dataKey), nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt data key for public key %d: %w", i+1, err)
+		}
+
+		res = binary.BigEndian.AppendUint16(res, uint16(len(key)))
+		res = append(res, key...)
+	}
+
+	encrypted, err := aes256.AES256Source{
+		EncryptionKey: dataKey,
+	}.Encrypt(b)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data: %w", err)
+	}
+
+	return append(res, encrypted...), nil
+}
+
+func (p MultiPemEncryptedSource) Decrypt(b []byte) ([]byte, error) {
+	if len(p.PrivateKey) == 0 {
+		return nil, fmt.Errorf("no private key provided")
+	}
+
+	block, _ := pem.Decode(p.PrivateKey)
+
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key file")
+	}
+
+	privInterface, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	priv, ok := privInterface.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+
+	if len(b) < 1 {
+		return nil, fmt.Errorf("invalid data")
+	}
+
+	count := int(b[0])
+	b = b[1:]
+
+	var dataKey []byte
+
+	for i := 0; i < count; i++ {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("invalid data")
+		}
+
+		keyLength := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+
+		if len(b) < keyLength {
+			return nil, fmt.Errorf("invalid data")
+		}
+
+		key := b[:keyLength]
+		b = b[keyLength:]
+
+		if dataKey != nil {
+			continue
+		}
+
+		// Keys of other recipients fail to decrypt
+		msg, err := rsa.DecryptOAEP(sha512.New(), rand.Reader, priv, key, nil)
+
+		if err == nil {
+			dataKey = msg
+		}
+	}
+
+	if dataKey == nil {
+		return nil, fmt.Errorf("the private key is not one of the %d recipients of this file", count)
+	}
+
+	return aes256.AES256Source{
+		EncryptionKey: string(dataKey),
+	}.Decrypt(b)
+}
@@ -0,0 +1,94 @@
+package multipem
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+// Returns a PKIX public key and PKCS8 private key in pem format, like openssl genpkey makes
+func testKeyPair(t *testing.T) (pub []byte, priv []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+}
+
+func TestRoundTrip(t *testing.T) {
+	alicePub, alicePriv := testKeyPair(t)
+	bobPub, bobPriv := testKeyPair(t)
+	_, evePriv := testKeyPair(t)
+
+	data := []byte("backup data that only alice and bob may read")
+
+	encrypted, err := MultiPemEncryptedSource{PublicKeys: [][]byte{alicePub, bobPub}}.Encrypt(data)
+
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if bytes.Contains(encrypted, data) {
+		t.Fatal("encrypted output contains the plaintext")
+	}
+
+	for name, priv := range map[string][]byte{"alice": alicePriv, "bob": bobPriv} {
+		decrypted, err := MultiPemEncryptedSource{PrivateKey: priv}.Decrypt(encrypted)
+
+		if err != nil {
+			t.Errorf("Decrypt with %s's key failed: %v", name, err)
+			continue
+		}
+
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("Decrypt with %s's key = %q, want %q", name, decrypted, data)
+		}
+	}
+
+	_, err = MultiPemEncryptedSource{PrivateKey: evePriv}.Decrypt(encrypted)
+
+	if err == nil {
+		t.Error("Decrypt with a key that is not a recipient succeeded")
+	}
+}
+
+func TestDataKeyIsRandom(t *testing.T) {
+	pub, _ := testKeyPair(t)
+
+	src := MultiPemEncryptedSource{PublicKeys: [][]byte{pub}}
+
+	a, err := src.Encrypt([]byte("x"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := src.Encrypt([]byte("x"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(a, b) {
+		t.Error("two encryptions of the same data are identical")
+	}
+}
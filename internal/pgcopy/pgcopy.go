@@ -0,0 +1,217 @@
+// Package pgcopy decodes and encodes rows in the PostgreSQL COPY text format
+package pgcopy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The marker for a NULL value in the COPY text format
+const Null = `\N`
+
+// Parses a COPY statement as found in pg_dump archives, returning the
+// (schema qualified) table name and its column list
+//
+// e.g. COPY public.bots (bot_id, name) FROM stdin;
+func ParseCopyStmt(stmt string) (table string, columns []string, err error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(stmt), "COPY ")
+
+	if !ok {
+		return "", nil, fmt.Errorf("not a COPY statement: %s", stmt)
+	}
+
+	open := strings.Index(rest, "(")
+	closing := strings.LastIndex(rest, ")")
+
+	if open < 0 || closing < open {
+		return "", nil, fmt.Errorf("COPY statement has no column list: %s", stmt)
+	}
+
+	table = unquoteIdent(strings.TrimSpace(rest[:open]))
+
+	for _, col := range splitIdents(rest[open+1 : closing]) {
+		columns = append(columns, unquoteIdent(strings.TrimSpace(col)))
+	}
+
+	return table, columns, nil
+}
+
+// Splits a comma separated list of (possibly quoted) identifiers
+func splitIdents(s string) []string {
+	var idents []string
+	var inQuotes bool
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				idents = append(idents, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(idents, s[start:])
+}
+
+// Removes double quotes from each part of a (possibly qualified) identifier
+func unquoteIdent(s string) string {
+	var sb strings.Builder
+	var inQuotes bool
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == '"' && inQuotes && i+1 < len(s) && s[i+1] == '"':
+			sb.WriteByte('"')
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
+
+// Decodes a single line of COPY text data (without the trailing newline)
+//
+// NULL values are returned as nil
+func DecodeRow(line string) []*string {
+	fields := strings.Split(line, "\t")
+	row := make([]*string, len(fields))
+
+	for i, f := range fields {
+		if f == Null {
+			continue
+		}
+
+		v := Unescape(f)
+		row[i] = &v
+	}
+
+	return row
+}
+
+// Unescapes a single field of COPY text data
+func Unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if c != '\\' || i+1 >= len(s) {
+			sb.WriteByte(c)
+			continue
+		}
+
+		i++
+		c = s[i]
+
+		switch c {
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		case 'x':
+			// Up to two hex digits
+			j := i + 1
+			for j < len(s) && j < i+3 && isHex(s[j]) {
+				j++
+			}
+
+			if j == i+1 {
+				sb.WriteByte('x')
+				continue
+			}
+
+			v, _ := strconv.ParseUint(s[i+1:j], 16, 8)
+			sb.WriteByte(byte(v))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// Up to three octal digits
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+
+			v, _ := strconv.ParseUint(s[i:j], 8, 16)
+			sb.WriteByte(byte(v))
+			i = j - 1
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// Escapes a value for use as a field of COPY text data
+func Escape(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\v':
+			sb.WriteString(`\v`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
+
+// Encodes a row as a line of COPY text data (without the trailing newline)
+//
+// nil values are encoded as NULL
+func EncodeRow(row []*string) string {
+	fields := make([]string, len(row))
+
+	for i, v := range row {
+		if v == nil {
+			fields[i] = Null
+			continue
+		}
+
+		fields[i] = Escape(*v)
+	}
+
+	return strings.Join(fields, "\t")
+}
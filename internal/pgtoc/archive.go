@@ -0,0 +1,588 @@
+package pgtoc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Magic bytes at the start of every custom format archive
+var ArchiveMagic = []byte("PGDMP")
+
+// Block types in the data part of a custom format archive
+const (
+	blkData  = 1
+	blkBlobs = 3
+)
+
+// Compression algorithms, these match pg_compress_algorithm
+var compressionNames = map[int]string{
+	0: "none",
+	1: "gzip",
+	2: "lz4",
+	3: "zstd",
+}
+
+// Section numbers, these match teSection
+var sectionNames = map[int]string{
+	1: "none",
+	2: "pre-data",
+	3: "data",
+	4: "post-data",
+}
+
+func archiveVersion(major, minor, rev byte) int {
+	return int(major)<<16 | int(minor)<<8 | int(rev)
+}
+
+var (
+	vers1_12 = archiveVersion(1, 12, 0) // Oldest supported version (PostgreSQL 9.x)
+	vers1_14 = archiveVersion(1, 14, 0) // Adds table access methods
+	vers1_15 = archiveVersion(1, 15, 0) // Compression algorithm in header
+	vers1_16 = archiveVersion(1, 16, 0) // Adds relkind
+)
+
+// The header of a custom format archive
+type Header struct {
+	// Archive format version (e.g. 1.14.0)
+	Version string `json:"version"`
+
+	// Compression algorithm used for data blocks
+	Compression string `json:"compression"`
+
+	// When the archive was created
+	CreatedAt time.Time `json:"created_at"`
+
+	// Name of the dumped database
+	DatabaseName string `json:"database_name"`
+
+	// Server version the archive was dumped from
+	ServerVersion string `json:"server_version"`
+
+	// Version of pg_dump that created the archive
+	DumpVersion string `json:"dump_version"`
+}
+
+// A custom format archive's header and table of contents
+type Archive struct {
+	Header  Header  `json:"header"`
+	Entries []Entry `json:"entries"`
+}
+
+// Returns whether or not data looks like a custom format archive
+func IsArchive(data []byte) bool {
+	return bytes.HasPrefix(data, ArchiveMagic)
+}
+
+type archiveReader struct {
+	r           *bufio.Reader
+	version     int
+	intSize     int
+	offSize     int
+	compression string
+}
+
+func (a *archiveReader) readByte() (byte, error) {
+	return a.r.ReadByte()
+}
+
+func (a *archiveReader) readInt() (int, error) {
+	sign, err := a.r.ReadByte()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var res int
+	for i := 0; i < a.intSize; i++ {
+		b, err := a.r.ReadByte()
+
+		if err != nil {
+			return 0, err
+		}
+
+		res |= int(b) << (8 * i)
+	}
+
+	if sign != 0 {
+		res = -res
+	}
+
+	return res, nil
+}
+
+// Reads a string, returning ok = false for a NULL string
+func (a *archiveReader) readStr() (s string, ok bool, err error) {
+	l, err := a.readInt()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if l < 0 {
+		return "", false, nil
+	}
+
+	buf := make([]byte, l)
+
+	_, err = io.ReadFull(a.r, buf)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(buf), true, nil
+}
+
+func (a *archiveReader) skip(n int) error {
+	_, err := a.r.Discard(n)
+	return err
+}
+
+func (a *archiveReader) readHeader() (*Header, error) {
+	magic := make([]byte, len(ArchiveMagic))
+
+	_, err := io.ReadFull(a.r, magic)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read magic: %w", err)
+	}
+
+	if !bytes.Equal(magic, ArchiveMagic) {
+		return nil, fmt.Errorf("not a custom format archive")
+	}
+
+	vbuf := make([]byte, 6)
+
+	_, err = io.ReadFull(a.r, vbuf)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive version: %w", err)
+	}
+
+	a.version = archiveVersion(vbuf[0], vbuf[1], vbuf[2])
+	a.intSize = int(vbuf[3])
+	a.offSize = int(vbuf[4])
+
+	if a.version < vers1_12 {
+		return nil, fmt.Errorf("archive version %d.%d.%d is too old", vbuf[0], vbuf[1], vbuf[2])
+	}
+
+	if vbuf[5] != 1 {
+		return nil, fmt.Errorf("archive is not in custom format [format %d]", vbuf[5])
+	}
+
+	h := &Header{
+		Version: fmt.Sprintf("%d.%d.%d", vbuf[0], vbuf[1], vbuf[2]),
+	}
+
+	if a.version >= vers1_15 {
+		algo, err := a.readByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		h.Compression = compressionNames[int(algo)]
+	} else {
+		level, err := a.readInt()
+
+		if err != nil {
+			return nil, err
+		}
+
+		h.Compression = "none"
+
+		if level != 0 {
+			h.Compression = "gzip"
+		}
+	}
+
+	if h.Compression == "" {
+		h.Compression = "unknown"
+	}
+
+	a.compression = h.Compression
+
+	// sec, min, hour, mday, mon, year, isdst
+	var tm [7]int
+	for i := range tm {
+		tm[i], err = a.readInt()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read creation date: %w", err)
+		}
+	}
+
+	h.CreatedAt = time.Date(tm[5]+1900, time.Month(tm[4]+1), tm[3], tm[2], tm[1], tm[0], 0, time.Local)
+
+	for _, s := range []*string{&h.DatabaseName, &h.ServerVersion, &h.DumpVersion} {
+		*s, _, err = a.readStr()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+func (a *archiveReader) readEntry() (*Entry, error) {
+	var e Entry
+	var err error
+
+	e.DumpID, err = a.readInt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// hadDumper
+	_, err = a.readInt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var section int
+	var dropStmt, tablespace, tableam, withOids string
+
+	fields := []struct {
+		dest    any
+		minVers int
+	}{
+		{&e.TableOID, 0},
+		{&e.OID, 0},
+		{&e.Name, 0},
+		{&e.Desc, 0},
+		{&section, 0},
+		{&e.Defn, 0},
+		{&dropStmt, 0},
+		{&e.CopyStmt, 0},
+		{&e.Schema, 0},
+		{&tablespace, 0},
+		{&tableam, vers1_14},
+		{new(int), vers1_16}, // relkind
+		{&e.Owner, 0},
+		{&withOids, 0},
+	}
+
+	for _, f := range fields {
+		if a.version < f.minVers {
+			continue
+		}
+
+		switch dest := f.dest.(type) {
+		case *string:
+			*dest, _, err = a.readStr()
+		case *int:
+			*dest, err = a.readInt()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.Section = sectionNames[section]
+
+	for {
+		dep, ok, err := a.readStr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			break
+		}
+
+		id, err := strconv.Atoi(dep)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid dependency %q: %w", dep, err)
+		}
+
+		e.Deps = append(e.Deps, id)
+	}
+
+	// Data offset (flag byte + offSize bytes)
+	err = a.skip(1 + a.offSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// Reads the data chunks of a block, this is a series of length-prefixed chunks ending with an empty one
+type chunkReader struct {
+	a         *archiveReader
+	remaining int
+	done      bool
+	read      int64
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		l, err := c.a.readInt()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if l <= 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+
+		c.remaining = l
+	}
+
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.a.r.Read(p)
+	c.remaining -= n
+	c.read += int64(n)
+
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// Returns a reader of the decompressed data of a chunk reader, or nil if the compression is not supported
+func (a *archiveReader) decompress(c *chunkReader) (io.Reader, error) {
+	switch a.compression {
+	case "none":
+		return c, nil
+	case "gzip":
+		zr, err := zlib.NewReader(c)
+
+		if errors.Is(err, io.EOF) {
+			// Empty data block
+			return bytes.NewReader(nil), nil
+		}
+
+		return zr, err
+	default:
+		return nil, nil
+	}
+}
+
+// Walks the data blocks of the archive, calling fn for each data block
+func (a *archiveReader) walkData(fn func(dumpID int, c *chunkReader) error) error {
+	for {
+		blkType, err := a.readByte()
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		dumpID, err := a.readInt()
+
+		if err != nil {
+			return err
+		}
+
+		switch blkType {
+		case blkData:
+			c := &chunkReader{a: a}
+
+			err = fn(dumpID, c)
+
+			if err != nil {
+				return err
+			}
+
+			// Drain whatever fn did not read
+			_, err = io.Copy(io.Discard, c)
+
+			if err != nil {
+				return err
+			}
+		case blkBlobs:
+			for {
+				oid, err := a.readInt()
+
+				if err != nil {
+					return err
+				}
+
+				if oid == 0 {
+					break
+				}
+
+				_, err = io.Copy(io.Discard, &chunkReader{a: a})
+
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown block type %d in archive", blkType)
+		}
+	}
+}
+
+func openArchive(r io.Reader) (*archiveReader, *Archive, error) {
+	a := &archiveReader{r: bufio.NewReaderSize(r, 64*1024)}
+
+	h, err := a.readHeader()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, err := a.readInt()
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read toc count: %w", err)
+	}
+
+	archive := &Archive{Header: *h}
+
+	for i := 0; i < count; i++ {
+		e, err := a.readEntry()
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read toc entry %d: %w", i, err)
+		}
+
+		archive.Entries = append(archive.Entries, *e)
+	}
+
+	return a, archive, nil
+}
+
+// ReadArchive reads the header and table of contents of a custom format archive
+//
+// If withData is set, the data blocks are also read to find the size and row count of each entry
+func ReadArchive(r io.Reader, withData bool) (*Archive, error) {
+	a, archive, err := openArchive(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !withData {
+		return archive, nil
+	}
+
+	byID := make(map[int]*Entry, len(archive.Entries))
+
+	for i := range archive.Entries {
+		byID[archive.Entries[i].DumpID] = &archive.Entries[i]
+	}
+
+	err = a.walkData(func(dumpID int, c *chunkReader) error {
+		e, ok := byID[dumpID]
+
+		if !ok {
+			return nil
+		}
+
+		if e.Desc == "TABLE DATA" {
+			data, err := a.decompress(c)
+
+			if err != nil {
+				return fmt.Errorf("failed to decompress data of %s: %w", e.Name, err)
+			}
+
+			if data != nil {
+				rows, err := countLines(data)
+
+				if err != nil {
+					return fmt.Errorf("failed to read data of %s: %w", e.Name, err)
+				}
+
+				e.Rows = &rows
+			}
+		}
+
+		_, err := io.Copy(io.Discard, c)
+
+		if err != nil {
+			return err
+		}
+
+		e.DataSize = c.read
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive data: %w", err)
+	}
+
+	return archive, nil
+}
+
+// WalkData calls fn with the decompressed COPY data of every TABLE DATA entry of a custom format archive
+func WalkData(r io.Reader, fn func(e Entry, data io.Reader) error) error {
+	a, archive, err := openArchive(r)
+
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int]Entry, len(archive.Entries))
+
+	for _, e := range archive.Entries {
+		byID[e.DumpID] = e
+	}
+
+	return a.walkData(func(dumpID int, c *chunkReader) error {
+		e, ok := byID[dumpID]
+
+		if !ok || e.Desc != "TABLE DATA" {
+			return nil
+		}
+
+		data, err := a.decompress(c)
+
+		if err != nil {
+			return fmt.Errorf("failed to decompress data of %s: %w", e.Name, err)
+		}
+
+		if data == nil {
+			return fmt.Errorf("unsupported archive compression: %s", a.compression)
+		}
+
+		return fn(e, data)
+	})
+}
+
+func countLines(r io.Reader) (int64, error) {
+	var count int64
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(buf)
+		count += int64(bytes.Count(buf[:n], []byte{'\n'}))
+
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+
+		if err != nil {
+			return count, err
+		}
+	}
+}
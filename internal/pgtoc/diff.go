@@ -0,0 +1,189 @@
+package pgtoc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of a TOC change
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// A difference between the tables of contents of two archives
+type Change struct {
+	// One of Added, Removed or Changed
+	Kind string
+
+	// Object type and qualified name of the entry (e.g. TABLE DATA public.users)
+	Entry string
+
+	// What changed, only set for Changed
+	Detail string
+
+	// Line diff of the old and new definition, only set if the definition changed
+	DefnDiff []string
+}
+
+// Returns the change as human readable output, a single line unless the definition changed
+func (c Change) String() string {
+	line := c.Kind + ": " + c.Entry
+
+	if c.Detail != "" {
+		line += ": " + c.Detail
+	}
+
+	for _, l := range c.DefnDiff {
+		line += "\n    " + l
+	}
+
+	return line
+}
+
+// Returns a line diff of two texts, unchanged lines are prefixed with "  ", removed ones
+// with "- " and added ones with "+ "
+func lineDiff(a, b string) []string {
+	aLines := strings.Split(strings.TrimRight(a, "\n"), "\n")
+	bLines := strings.Split(strings.TrimRight(b, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of aLines[i:] and bLines[j:]
+	lcs := make([][]int, len(aLines)+1)
+
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+
+	i, j := 0, 0
+
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			diff = append(diff, "  "+aLines[i])
+			i++
+			j++
+		case i < len(aLines) && (j == len(bLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+aLines[i])
+			i++
+		default:
+			diff = append(diff, "+ "+bLines[j])
+			j++
+		}
+	}
+
+	return diff
+}
+
+// Returns the object type and qualified name of an entry
+func entryKey(e Entry) string {
+	if e.Schema == "" {
+		return e.Desc + " " + e.Name
+	}
+
+	return e.Desc + " " + e.Schema + "." + e.Name
+}
+
+// Keys entries by entryKey, numbering the rare entries with the same key (e.g. ACLs) in archive order
+func keyedEntries(entries []Entry) map[string]Entry {
+	keyed := map[string]Entry{}
+
+	for _, e := range entries {
+		key := entryKey(e)
+
+		for i := 2; ; i++ {
+			if _, ok := keyed[key]; !ok {
+				break
+			}
+
+			key = entryKey(e) + " #" + strconv.Itoa(i)
+		}
+
+		keyed[key] = e
+	}
+
+	return keyed
+}
+
+func formatRows(rows *int64) string {
+	if rows == nil {
+		return "unknown"
+	}
+
+	return strconv.FormatInt(*rows, 10)
+}
+
+// Diff compares the tables of contents of two archives by object, ignoring dump IDs and OIDs
+// which differ between any two dumps. Definitions are only compared if both archives were read directly
+//
+// Row counts and data sizes are only compared if both archives were read with data
+func Diff(a, b *Archive) []Change {
+	var changes []Change
+
+	if a.Header.ServerVersion != b.Header.ServerVersion {
+		changes = append(changes, Change{Kind: Changed, Entry: "archive", Detail: "server version " + a.Header.ServerVersion + " -> " + b.Header.ServerVersion})
+	}
+
+	if a.Header.DumpVersion != b.Header.DumpVersion {
+		changes = append(changes, Change{Kind: Changed, Entry: "archive", Detail: "pg_dump version " + a.Header.DumpVersion + " -> " + b.Header.DumpVersion})
+	}
+
+	aEntries, bEntries := keyedEntries(a.Entries), keyedEntries(b.Entries)
+
+	var keys []string
+
+	for key := range aEntries {
+		keys = append(keys, key)
+	}
+
+	for key := range bEntries {
+		if _, ok := aEntries[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ae, inA := aEntries[key]
+		be, inB := bEntries[key]
+
+		switch {
+		case !inA:
+			changes = append(changes, Change{Kind: Added, Entry: key})
+		case !inB:
+			changes = append(changes, Change{Kind: Removed, Entry: key})
+		default:
+			if ae.Defn != be.Defn {
+				changes = append(changes, Change{Kind: Changed, Entry: key, Detail: "definition", DefnDiff: lineDiff(ae.Defn, be.Defn)})
+			}
+
+			if ae.Owner != be.Owner {
+				changes = append(changes, Change{Kind: Changed, Entry: key, Detail: "owner " + ae.Owner + " -> " + be.Owner})
+			}
+
+			if ae.Rows != nil && be.Rows != nil && *ae.Rows != *be.Rows {
+				changes = append(changes, Change{Kind: Changed, Entry: key, Detail: "rows " + formatRows(ae.Rows) + " -> " + formatRows(be.Rows)})
+			}
+
+			if ae.DataSize != be.DataSize && ae.DataSize > 0 && be.DataSize > 0 {
+				changes = append(changes, Change{Kind: Changed, Entry: key, Detail: "data size " + strconv.FormatInt(ae.DataSize, 10) + " -> " + strconv.FormatInt(be.DataSize, 10)})
+			}
+		}
+	}
+
+	return changes
+}
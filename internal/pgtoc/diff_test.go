@@ -0,0 +1,58 @@
+package pgtoc
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	a := "CREATE TABLE public.bots (\n    bot_id text NOT NULL,\n    votes integer\n);\n"
+	b := "CREATE TABLE public.bots (\n    bot_id text NOT NULL,\n    votes bigint,\n    premium boolean\n);\n"
+
+	want := []string{
+		"  CREATE TABLE public.bots (",
+		"      bot_id text NOT NULL,",
+		"-     votes integer",
+		"+     votes bigint,",
+		"+     premium boolean",
+		"  );",
+	}
+
+	if got := lineDiff(a, b); !slices.Equal(got, want) {
+		t.Errorf("lineDiff =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDiffDefinitions(t *testing.T) {
+	rows := int64(3)
+
+	a := &Archive{Entries: []Entry{
+		{DumpID: 1, Desc: "TABLE", Schema: "public", Name: "bots", Owner: "postgres", Defn: "CREATE TABLE public.bots (\n    bot_id text\n);"},
+		{DumpID: 2, Desc: "TABLE DATA", Schema: "public", Name: "bots", Owner: "postgres", Rows: &rows},
+	}}
+
+	b := &Archive{Entries: []Entry{
+		{DumpID: 7, Desc: "TABLE", Schema: "public", Name: "bots", Owner: "postgres", Defn: "CREATE TABLE public.bots (\n    bot_id text,\n    votes integer\n);"},
+		{DumpID: 8, Desc: "TABLE DATA", Schema: "public", Name: "bots", Owner: "postgres", Rows: &rows},
+	}}
+
+	changes := Diff(a, b)
+
+	if len(changes) != 1 {
+		t.Fatalf("Diff returned %d changes, want 1: %v", len(changes), changes)
+	}
+
+	c := changes[0]
+
+	if c.Kind != Changed || c.Entry != "TABLE public.bots" || c.Detail != "definition" {
+		t.Errorf("Diff = %s, want changed: TABLE public.bots: definition", c)
+	}
+
+	if !slices.Contains(c.DefnDiff, "+     votes integer") {
+		t.Errorf("definition diff %q does not contain the added column", c.DefnDiff)
+	}
+
+	if len(Diff(a, a)) != 0 {
+		t.Errorf("Diff of an archive with itself = %v, want no changes", Diff(a, a))
+	}
+}
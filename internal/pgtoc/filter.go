@@ -0,0 +1,184 @@
+package pgtoc
+
+import (
+	"slices"
+	"strings"
+)
+
+// Filter selects the entries of an archive to restore
+//
+// Tables may be given as either "table" (any schema) or "schema.table"
+type Filter struct {
+	OnlyTables    []string
+	OnlySchemas   []string
+	ExcludeTables []string
+}
+
+// Returns whether or not the filter selects a subset of an archive
+func (f Filter) IsSet() bool {
+	return len(f.OnlyTables) > 0 || len(f.OnlySchemas) > 0 || len(f.ExcludeTables) > 0
+}
+
+// Object types that are tables (or behave like them)
+var tableDescs = []string{"TABLE", "FOREIGN TABLE", "MATERIALIZED VIEW"}
+
+// Object types whose tag is "<table> <name>"
+var tableTaggedDescs = []string{"CONSTRAINT", "CHECK CONSTRAINT", "FK CONSTRAINT", "DEFAULT", "TRIGGER", "POLICY", "RULE"}
+
+// Object types that only annotate other objects
+var annotationDescs = []string{"COMMENT", "ACL", "SECURITY LABEL"}
+
+func matchesTable(e Entry, spec string) bool {
+	if schema, name, ok := strings.Cut(spec, "."); ok {
+		return e.Schema == schema && e.Name == name
+	}
+
+	return e.Name == spec
+}
+
+func dependsOnAny(e Entry, ids map[int]bool) bool {
+	for _, dep := range e.Deps {
+		if ids[dep] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Adds all annotations (comments, ACLs etc.) of included entries
+func addAnnotations(entries []Entry, included map[int]bool) {
+	for _, e := range entries {
+		if slices.Contains(annotationDescs, e.Desc) && dependsOnAny(e, included) {
+			included[e.DumpID] = true
+		}
+	}
+}
+
+// TableEntries returns the dump IDs of a table, its data and everything attached
+// to it (indexes, constraints, defaults, triggers, owned sequences etc.)
+//
+// This relies on the dependencies of entries, so the entries must come from pg_restore -l -v
+func TableEntries(entries []Entry, spec string) map[int]bool {
+	roots := map[int]bool{}
+	included := map[int]bool{}
+
+	for _, e := range entries {
+		if slices.Contains(tableDescs, e.Desc) && matchesTable(e, spec) {
+			roots[e.DumpID] = true
+			included[e.DumpID] = true
+		}
+	}
+
+	for _, e := range entries {
+		if (e.Desc == "TABLE DATA" || e.Desc == "MATERIALIZED VIEW DATA") && matchesTable(e, spec) {
+			included[e.DumpID] = true
+			continue
+		}
+
+		if !dependsOnAny(e, roots) {
+			continue
+		}
+
+		switch {
+		case e.Desc == "INDEX" || e.Desc == "STATISTICS" || e.Desc == "ROW SECURITY" || e.Desc == "SEQUENCE" || e.Desc == "SEQUENCE OWNED BY":
+			included[e.DumpID] = true
+		case slices.Contains(tableTaggedDescs, e.Desc):
+			// Foreign keys of other tables depend on this table too, so check the tag
+			tableName, _, _ := strings.Cut(e.Name, " ")
+			_, specName, ok := strings.Cut(spec, ".")
+
+			if !ok {
+				specName = spec
+			}
+
+			if tableName == specName {
+				included[e.DumpID] = true
+			}
+		}
+	}
+
+	// Sequences used by defaults (serial columns) along with their current values
+	sequences := map[int]bool{}
+
+	for _, e := range entries {
+		if e.Desc == "DEFAULT" && included[e.DumpID] {
+			for _, dep := range e.Deps {
+				sequences[dep] = true
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if e.Desc == "SEQUENCE" && (sequences[e.DumpID] || included[e.DumpID]) {
+			sequences[e.DumpID] = true
+			included[e.DumpID] = true
+		} else {
+			delete(sequences, e.DumpID)
+		}
+	}
+
+	for _, e := range entries {
+		if (e.Desc == "SEQUENCE SET" || e.Desc == "SEQUENCE OWNED BY") && dependsOnAny(e, sequences) {
+			included[e.DumpID] = true
+		}
+	}
+
+	addAnnotations(entries, included)
+
+	return included
+}
+
+// SchemaEntries returns the dump IDs of a schema and everything in it
+func SchemaEntries(entries []Entry, schema string) map[int]bool {
+	included := map[int]bool{}
+
+	for _, e := range entries {
+		if e.Schema == schema || (e.Desc == "SCHEMA" && e.Name == schema) {
+			included[e.DumpID] = true
+		}
+	}
+
+	addAnnotations(entries, included)
+
+	return included
+}
+
+// Apply returns the entries selected by the filter, in archive order
+func (f Filter) Apply(entries []Entry) []Entry {
+	selected := map[int]bool{}
+
+	if len(f.OnlyTables) == 0 && len(f.OnlySchemas) == 0 {
+		for _, e := range entries {
+			selected[e.DumpID] = true
+		}
+	}
+
+	for _, table := range f.OnlyTables {
+		for id := range TableEntries(entries, table) {
+			selected[id] = true
+		}
+	}
+
+	for _, schema := range f.OnlySchemas {
+		for id := range SchemaEntries(entries, schema) {
+			selected[id] = true
+		}
+	}
+
+	for _, table := range f.ExcludeTables {
+		for id := range TableEntries(entries, table) {
+			delete(selected, id)
+		}
+	}
+
+	var result []Entry
+
+	for _, e := range entries {
+		if selected[e.DumpID] {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
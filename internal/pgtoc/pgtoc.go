@@ -0,0 +1,242 @@
+// Package pgtoc parses and filters the table of contents of pg_dump custom format archives
+package pgtoc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A single entry in the table of contents of an archive
+type Entry struct {
+	// Dump ID of the entry, this is what pg_restore -L uses to select entries
+	DumpID int `json:"dump_id"`
+
+	// Catalog table OID and OID of the object
+	TableOID string `json:"table_oid"`
+	OID      string `json:"oid"`
+
+	// Object type (e.g. TABLE, TABLE DATA, INDEX, FK CONSTRAINT)
+	Desc string `json:"desc"`
+
+	// Schema of the object, empty if the object is not in a schema
+	Schema string `json:"schema,omitempty"`
+
+	// Tag of the object. For most objects this is the name, for objects
+	// attached to a table (constraints, triggers etc.) this is "<table> <name>"
+	Name string `json:"name"`
+
+	// Owner of the object, empty if not known
+	Owner string `json:"owner,omitempty"`
+
+	// Dump IDs of the entries this entry depends on
+	Deps []int `json:"deps,omitempty"`
+
+	// Section of the dump the entry belongs to (pre-data, data, post-data)
+	//
+	// Only set when reading an archive directly
+	Section string `json:"section,omitempty"`
+
+	// SQL definition of the object (e.g. its CREATE TABLE statement)
+	//
+	// Only set when reading an archive directly
+	Defn string `json:"-"`
+
+	// COPY statement used to restore the data of the entry
+	//
+	// Only set when reading an archive directly
+	CopyStmt string `json:"-"`
+
+	// Size of the (compressed) data of the entry in the archive
+	//
+	// Only set when reading an archive directly with data
+	DataSize int64 `json:"data_size,omitempty"`
+
+	// Number of rows in the data of the entry, nil if unknown
+	//
+	// Only set when reading an archive directly with data
+	Rows *int64 `json:"rows,omitempty"`
+}
+
+// Returns the line for this entry in pg_restore -l format
+func (e Entry) String() string {
+	schema := e.Schema
+
+	if schema == "" {
+		schema = "-"
+	}
+
+	owner := e.Owner
+
+	if owner == "" {
+		owner = "-"
+	}
+
+	return fmt.Sprintf("%d; %s %s %s %s %s %s", e.DumpID, e.TableOID, e.OID, e.Desc, schema, e.Name, owner)
+}
+
+// Object types containing spaces, longest first so the longest match wins
+var multiWordDescs = []string{
+	"PUBLICATION TABLES IN SCHEMA",
+	"MATERIALIZED VIEW DATA",
+	"FOREIGN DATA WRAPPER",
+	"PROCEDURAL LANGUAGE",
+	"DATABASE PROPERTIES",
+	"SEQUENCE OWNED BY",
+	"PUBLICATION TABLE",
+	"MATERIALIZED VIEW",
+	"SUBSCRIPTION TABLE",
+	"TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY",
+	"TEXT SEARCH TEMPLATE",
+	"TEXT SEARCH PARSER",
+	"CHECK CONSTRAINT",
+	"OPERATOR FAMILY",
+	"OPERATOR CLASS",
+	"DEFAULT ACL",
+	"ACCESS METHOD",
+	"EVENT TRIGGER",
+	"FK CONSTRAINT",
+	"FOREIGN TABLE",
+	"INDEX ATTACH",
+	"LARGE OBJECT",
+	"ROW SECURITY",
+	"SECURITY LABEL",
+	"SEQUENCE SET",
+	"TABLE ATTACH",
+	"USER MAPPING",
+	"BLOB METADATA",
+	"SHELL TYPE",
+	"TABLE DATA",
+}
+
+func init() {
+	sort.SliceStable(multiWordDescs, func(i, j int) bool {
+		return len(multiWordDescs[i]) > len(multiWordDescs[j])
+	})
+}
+
+// Parses a single (non-comment) line of pg_restore -l output
+func parseLine(line string) (*Entry, error) {
+	idStr, rest, ok := strings.Cut(line, ";")
+
+	if !ok {
+		return nil, fmt.Errorf("invalid toc line: %s", line)
+	}
+
+	dumpID, err := strconv.Atoi(strings.TrimSpace(idStr))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid dump id in toc line: %s", line)
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(rest), " ", 3)
+
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid toc line: %s", line)
+	}
+
+	e := &Entry{
+		DumpID:   dumpID,
+		TableOID: fields[0],
+		OID:      fields[1],
+	}
+
+	rest = fields[2]
+
+	for _, desc := range multiWordDescs {
+		if strings.HasPrefix(rest, desc+" ") {
+			e.Desc = desc
+			rest = rest[len(desc)+1:]
+			break
+		}
+	}
+
+	if e.Desc == "" {
+		e.Desc, rest, _ = strings.Cut(rest, " ")
+	}
+
+	schema, rest, _ := strings.Cut(rest, " ")
+
+	if schema != "-" {
+		e.Schema = schema
+	}
+
+	if i := strings.LastIndex(rest, " "); i >= 0 {
+		e.Name = rest[:i]
+		e.Owner = rest[i+1:]
+	} else {
+		e.Name = rest
+	}
+
+	if e.Owner == "-" {
+		e.Owner = ""
+	}
+
+	return e, nil
+}
+
+// ParseList parses the output of pg_restore -l
+//
+// If the output came from pg_restore -l -v, the dependencies of each entry are also parsed
+func ParseList(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, ";") {
+			deps, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(line, ";")), "depends on:")
+
+			if ok && len(entries) > 0 {
+				for _, dep := range strings.Fields(deps) {
+					id, err := strconv.Atoi(dep)
+
+					if err != nil {
+						return nil, fmt.Errorf("invalid dependency in toc: %s", line)
+					}
+
+					entries[len(entries)-1].Deps = append(entries[len(entries)-1].Deps, id)
+				}
+			}
+
+			continue
+		}
+
+		e, err := parseLine(line)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, *e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// FormatList formats entries as a list file for pg_restore -L
+func FormatList(entries []Entry) string {
+	var sb strings.Builder
+
+	for _, e := range entries {
+		sb.WriteString(e.String())
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
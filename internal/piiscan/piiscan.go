@@ -0,0 +1,264 @@
+// Package piiscan scans the data of pg_dump archives for leaked PII and secrets
+package piiscan
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/pgcopy"
+	"github.com/InfinityBotList/ibldev/internal/pgtoc"
+	"github.com/InfinityBotList/ibldev/types"
+)
+
+// Name of the detector used for column name heuristics
+const ColumnDetector = "column_name"
+
+// Name of the high entropy string detector
+const EntropyDetector = "high_entropy"
+
+type detector struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+var builtinDetectors = []detector{
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)},
+	{"discord_token", regexp.MustCompile(`[A-Za-z\d_-]{24,28}\.[A-Za-z\d_-]{6}\.[A-Za-z\d_-]{27,38}`)},
+	{"jwt", regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)},
+}
+
+var defaultColumns = []string{"*token*", "*secret*", "*password*", "*api_key*"}
+
+// Candidates for the high entropy detector
+var entropyCandidate = regexp.MustCompile(`[A-Za-z0-9+/=_\-]+`)
+
+// Sanitized values (e.g. api tokens replaced with uuids) are not reported by the column name heuristic
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// A single (table, column, detector) finding
+type Finding struct {
+	Table    string
+	Column   string
+	Detector string
+
+	// Truncated sha256 of the first matching value, this can be used to allowlist a single value
+	SampleHash string
+
+	// Number of matching values
+	Count int
+}
+
+// A Scanner scans archives using a PII scan config
+type Scanner struct {
+	detectors        []detector
+	columns          []string
+	minEntropy       float64
+	minEntropyLength int
+	allowlist        []types.PIIAllow
+}
+
+// Creates a new scanner, cfg may be nil to use the defaults
+func New(cfg *types.PIIScan) (*Scanner, error) {
+	s := &Scanner{
+		detectors:        builtinDetectors,
+		columns:          defaultColumns,
+		minEntropy:       4.3,
+		minEntropyLength: 32,
+	}
+
+	if cfg == nil {
+		return s, nil
+	}
+
+	for _, d := range cfg.Detectors {
+		r, err := regexp.Compile(d.Regex)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for detector %s: %w", d.Name, err)
+		}
+
+		s.detectors = append(s.detectors, detector{d.Name, r})
+	}
+
+	if len(cfg.Columns) > 0 {
+		s.columns = cfg.Columns
+	}
+
+	if cfg.MinEntropy > 0 {
+		s.minEntropy = cfg.MinEntropy
+	}
+
+	if cfg.MinEntropyLength > 0 {
+		s.minEntropyLength = cfg.MinEntropyLength
+	}
+
+	s.allowlist = cfg.Allowlist
+
+	return s, nil
+}
+
+// Returns the truncated sha256 of a value
+func HashValue(v string) string {
+	h := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(h[:8])
+}
+
+// Returns the shannon entropy of s in bits per character
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+
+	for _, c := range s {
+		counts[c]++
+	}
+
+	var e float64
+	n := float64(len(s))
+
+	for _, c := range counts {
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
+
+func (s *Scanner) allowed(table, column, detector, hash string) bool {
+	_, tableName, _ := strings.Cut(table, ".")
+
+	for _, a := range s.allowlist {
+		if a.Table != table && a.Table != tableName {
+			continue
+		}
+
+		if a.Column != "" && a.Column != column {
+			continue
+		}
+
+		if a.Detector != "" && a.Detector != detector {
+			continue
+		}
+
+		if a.Hash != "" && a.Hash != hash {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Returns the names of the detectors matching a value of a column
+func (s *Scanner) match(column, value string) []string {
+	var matches []string
+
+	if value == "" {
+		return nil
+	}
+
+	lower := strings.ToLower(column)
+	for _, pattern := range s.columns {
+		if ok, _ := path.Match(pattern, lower); ok && !uuidRegex.MatchString(value) {
+			matches = append(matches, ColumnDetector)
+			break
+		}
+	}
+
+	for _, d := range s.detectors {
+		if d.regex.MatchString(value) {
+			matches = append(matches, d.name)
+		}
+	}
+
+	for _, candidate := range entropyCandidate.FindAllString(value, -1) {
+		if len(candidate) >= s.minEntropyLength && entropy(candidate) >= s.minEntropy {
+			matches = append(matches, EntropyDetector)
+			break
+		}
+	}
+
+	return matches
+}
+
+// Scans the data of all tables in a custom format archive, returning findings that are not allowlisted
+func (s *Scanner) ScanArchive(r io.Reader) ([]Finding, error) {
+	findings := map[[3]string]*Finding{}
+
+	err := pgtoc.WalkData(r, func(e pgtoc.Entry, data io.Reader) error {
+		table, columns, err := pgcopy.ParseCopyStmt(e.CopyStmt)
+
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(data)
+		scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+
+		for scanner.Scan() {
+			row := pgcopy.DecodeRow(scanner.Text())
+
+			for i, v := range row {
+				if v == nil || i >= len(columns) {
+					continue
+				}
+
+				for _, d := range s.match(columns[i], *v) {
+					hash := HashValue(*v)
+
+					if s.allowed(table, columns[i], d, hash) {
+						continue
+					}
+
+					key := [3]string{table, columns[i], d}
+
+					if f, ok := findings[key]; ok {
+						f.Count++
+						continue
+					}
+
+					findings[key] = &Finding{
+						Table:      table,
+						Column:     columns[i],
+						Detector:   d,
+						SampleHash: hash,
+						Count:      1,
+					}
+				}
+			}
+		}
+
+		return scanner.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Finding
+
+	for _, f := range findings {
+		result = append(result, *f)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Table != result[j].Table {
+			return result[i].Table < result[j].Table
+		}
+
+		if result[i].Column != result[j].Column {
+			return result[i].Column < result[j].Column
+		}
+
+		return result[i].Detector < result[j].Detector
+	})
+
+	return result, nil
+}
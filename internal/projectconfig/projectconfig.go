@@ -1,6 +1,7 @@
 package projectconfig
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -44,3 +45,21 @@ func LoadProjectConfig() (*types.IBLProject, error) {
 
 	return &proj, nil
 }
+
+// Like LoadProjectConfig, but returns nil (and no error) if there is no project.yaml
+func LoadOptionalProjectConfig() (*types.IBLProject, error) {
+	proj, err := LoadProjectConfig()
+
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println(" => not found, using defaults")
+		return nil, nil
+	}
+
+	fmt.Println("")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return proj, nil
+}
@@ -0,0 +1,249 @@
+package schemadiff
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+)
+
+// Severities of a CI check finding
+const (
+	// Code written against seed-ci.json will fail against the database
+	Breaking = "breaking"
+
+	// The database differs from seed-ci.json but code written against it keeps working
+	Compatible = "compatible"
+)
+
+// A single difference found by CheckCI
+type Finding struct {
+	// One of Breaking or Compatible
+	Severity string
+
+	// Object type (e.g. table, column, enum)
+	Object string
+
+	// Qualified name of the object
+	Name string
+
+	Detail string
+}
+
+// Returns the finding as a line of human readable output
+func (f Finding) String() string {
+	return f.Severity + ": " + f.Object + " " + f.Name + ": " + f.Detail
+}
+
+// Strips type modifiers and quotes from a type as returned by format_type
+func bareType(typ string) string {
+	if open := strings.Index(typ, "("); open >= 0 {
+		if closing := strings.Index(typ, ")"); closing > open {
+			typ = strings.TrimSpace(typ[:open] + typ[closing+1:])
+		}
+	}
+
+	return strings.ReplaceAll(typ, `"`, "")
+}
+
+// Returns the name of an enum type the way format_type would print it
+func enumTypeName(e *dbparser.Enum) string {
+	if e.Schema == "public" {
+		return e.Name
+	}
+
+	return e.Schema + "." + e.Name
+}
+
+// Compares a wanted and live column type, returning whether they differ and if so whether
+// the live type is a compatible widening of the wanted one
+func compareTypes(want, have string, enums map[string]bool) (differs bool, compatible bool) {
+	if want == have {
+		return false, false
+	}
+
+	// Legacy seed-ci.json files have no type modifiers and list enums as USER-DEFINED
+	if want == "USER-DEFINED" {
+		return !enums[bareType(have)], false
+	}
+
+	if !strings.Contains(want, "(") && want == bareType(have) {
+		return false, false
+	}
+
+	wantBase, haveBase := bareType(want), bareType(have)
+
+	switch {
+	case wantBase == haveBase && (wantBase == "character varying" || wantBase == "character"):
+		// Only a longer length is compatible
+		return true, !strings.Contains(have, "(") || typeLength(have) >= typeLength(want)
+	case haveBase == "text" && (wantBase == "character varying" || wantBase == "character"):
+		return true, true
+	}
+
+	return true, false
+}
+
+// Returns the length of a type such as character varying(255), 0 if it has none
+func typeLength(typ string) int {
+	open, closing := strings.Index(typ, "("), strings.Index(typ, ")")
+
+	if open < 0 || closing < open {
+		return 0
+	}
+
+	n := 0
+
+	for _, r := range typ[open+1 : closing] {
+		if r < '0' || r > '9' {
+			break
+		}
+
+		n = n*10 + int(r-'0')
+	}
+
+	return n
+}
+
+func checkColumns(object, name string, want, have []dbparser.CIColumn, enums map[string]bool) []Finding {
+	var findings []Finding
+
+	haveCols := map[string]dbparser.CIColumn{}
+
+	for _, c := range have {
+		haveCols[c.Name] = c
+	}
+
+	for _, wc := range want {
+		col := name + "." + wc.Name
+		hc, ok := haveCols[wc.Name]
+
+		if !ok {
+			findings = append(findings, Finding{Breaking, "column", col, "missing from the database"})
+			continue
+		}
+
+		if wc.Array != hc.Array {
+			findings = append(findings, Finding{Breaking, "column", col, "array mismatch (expected array=" + strconv.FormatBool(wc.Array) + ", database has array=" + strconv.FormatBool(hc.Array) + ")"})
+		} else if differs, compatible := compareTypes(wc.Type, hc.Type, enums); differs {
+			severity := Breaking
+
+			if compatible {
+				severity = Compatible
+			}
+
+			findings = append(findings, Finding{severity, "column", col, "type changed from " + wc.Type + " to " + hc.Type})
+		}
+
+		switch {
+		case !wc.Nullable && hc.Nullable:
+			findings = append(findings, Finding{Breaking, "column", col, "expected NOT NULL but the database allows NULL"})
+		case wc.Nullable && !hc.Nullable && hc.DefaultSQL == nil && object == "table":
+			findings = append(findings, Finding{Breaking, "column", col, "expected nullable but the database has NOT NULL without a default"})
+		case wc.Nullable && !hc.Nullable:
+			findings = append(findings, Finding{Compatible, "column", col, "expected nullable but the database has NOT NULL"})
+		}
+	}
+
+	for _, hc := range have {
+		if slices.ContainsFunc(want, func(c dbparser.CIColumn) bool { return c.Name == hc.Name }) {
+			continue
+		}
+
+		col := name + "." + hc.Name
+
+		if object == "table" && !hc.Nullable && hc.DefaultSQL == nil {
+			findings = append(findings, Finding{Breaking, "column", col, "extra NOT NULL column without a default, inserts that do not set it will fail"})
+			continue
+		}
+
+		findings = append(findings, Finding{Compatible, "column", col, "extra column in the database"})
+	}
+
+	return findings
+}
+
+// CheckCI checks a live database against a seed-ci.json schema, classifying every
+// difference as Breaking or Compatible for code written against seed-ci.json
+//
+// Tables in ignoreTables are skipped in both schemas
+func CheckCI(want, have *dbparser.CISchema, ignoreTables []string) []Finding {
+	var findings []Finding
+
+	enums := map[string]bool{}
+
+	for _, e := range have.Enums {
+		enums[enumTypeName(e)] = true
+	}
+
+	// Enums, legacy files have none
+	for _, we := range want.Enums {
+		i := slices.IndexFunc(have.Enums, func(e *dbparser.Enum) bool { return e.Schema == we.Schema && e.Name == we.Name })
+
+		if i < 0 {
+			findings = append(findings, Finding{Breaking, "enum", we.Schema + "." + we.Name, "missing from the database"})
+			continue
+		}
+
+		he := have.Enums[i]
+
+		for _, v := range we.Values {
+			if !slices.Contains(he.Values, v) {
+				findings = append(findings, Finding{Breaking, "enum", we.Schema + "." + we.Name, "missing value " + v})
+			}
+		}
+
+		for _, v := range he.Values {
+			if !slices.Contains(we.Values, v) {
+				findings = append(findings, Finding{Compatible, "enum", we.Schema + "." + we.Name, "extra value " + v})
+			}
+		}
+	}
+
+	for _, wt := range want.Tables {
+		if slices.Contains(ignoreTables, wt.Name) {
+			continue
+		}
+
+		name := wt.Schema + "." + wt.Name
+		ht := have.Table(wt.Schema, wt.Name)
+
+		if ht == nil {
+			// Legacy files list views as tables
+			if hv := have.View(wt.Schema, wt.Name); hv != nil && want.Version == 1 {
+				findings = append(findings, checkColumns("view", name, wt.Columns, hv.Columns, enums)...)
+				continue
+			}
+
+			findings = append(findings, Finding{Breaking, "table", name, "missing from the database"})
+			continue
+		}
+
+		findings = append(findings, checkColumns("table", name, wt.Columns, ht.Columns, enums)...)
+	}
+
+	// Only schemas seed-ci.json knows about are checked for extra tables, so that a legacy
+	// (public only) file does not flag every table of other schemas
+	for _, ht := range have.Tables {
+		if slices.Contains(ignoreTables, ht.Name) || !slices.Contains(want.Schemas, ht.Schema) || want.Table(ht.Schema, ht.Name) != nil {
+			continue
+		}
+
+		findings = append(findings, Finding{Compatible, "table", ht.Schema + "." + ht.Name, "extra table in the database"})
+	}
+
+	for _, wv := range want.Views {
+		name := wv.Schema + "." + wv.Name
+		hv := have.View(wv.Schema, wv.Name)
+
+		if hv == nil {
+			findings = append(findings, Finding{Breaking, "view", name, "missing from the database"})
+			continue
+		}
+
+		findings = append(findings, checkColumns("view", name, wv.Columns, hv.Columns, enums)...)
+	}
+
+	return findings
+}
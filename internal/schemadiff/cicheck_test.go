@@ -0,0 +1,163 @@
+package schemadiff
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+)
+
+func TestCompareTypes(t *testing.T) {
+	enums := map[string]bool{"vote_kind": true, "billing.plan": true}
+
+	tests := []struct {
+		want, have          string
+		differs, compatible bool
+	}{
+		{"text", "text", false, false},
+		{"integer", "bigint", true, false},
+		{"character varying(64)", "character varying(64)", false, false},
+		{"character varying(64)", "character varying(255)", true, true},
+		{"character varying(255)", "character varying(64)", true, false},
+		{"character varying(64)", "character varying", true, true},
+		{"character varying(64)", "text", true, true},
+		{"text", "character varying(64)", true, false},
+		{"timestamp(3) with time zone", "timestamp with time zone", true, false},
+
+		// Legacy files have no type modifiers
+		{"character varying", "character varying(64)", false, false},
+		{"timestamp with time zone", "timestamp(3) with time zone", false, false},
+
+		// Legacy files list enums as USER-DEFINED
+		{"USER-DEFINED", "vote_kind", false, false},
+		{"USER-DEFINED", `billing."plan"`, false, false},
+		{"USER-DEFINED", "text", true, false},
+	}
+
+	for _, tt := range tests {
+		differs, compatible := compareTypes(tt.want, tt.have, enums)
+
+		if differs != tt.differs || compatible != tt.compatible {
+			t.Errorf("compareTypes(%q, %q) = (%v, %v), want (%v, %v)", tt.want, tt.have, differs, compatible, tt.differs, tt.compatible)
+		}
+	}
+}
+
+// The live schema all CheckCI cases are checked against
+func testLiveSchema() *dbparser.CISchema {
+	return &dbparser.CISchema{
+		Version: dbparser.CISchemaVersion,
+		Schemas: []string{"public"},
+		Tables: []*dbparser.CITable{
+			{Schema: "public", Name: "bots", Columns: []dbparser.CIColumn{
+				{Name: "bot_id", Type: "text"},
+				{Name: "votes", Type: "bigint"},
+				{Name: "kind", Type: "vote_kind", Nullable: true},
+				{Name: "short", Type: "character varying(255)", Nullable: true},
+			}},
+		},
+		Views: []*dbparser.CIView{
+			{Schema: "public", Name: "top_bots", Columns: []dbparser.CIColumn{
+				{Name: "bot_id", Type: "text", Nullable: true},
+				{Name: "votes", Type: "bigint", Nullable: true},
+			}},
+		},
+		Enums: []*dbparser.Enum{
+			{Schema: "public", Name: "vote_kind", Values: []string{"up", "down"}},
+		},
+	}
+}
+
+func TestCheckCI(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		// Findings as returned by Finding.String, in order
+		findings []string
+	}{
+		{
+			name: "legacy file matching tables and views",
+			want: `[
+				{"table_name": "bots", "column_name": "bot_id", "type": "text", "nullable": false},
+				{"table_name": "bots", "column_name": "votes", "type": "bigint", "nullable": false},
+				{"table_name": "bots", "column_name": "kind", "type": "USER-DEFINED", "nullable": true},
+				{"table_name": "bots", "column_name": "short", "type": "character varying", "nullable": true},
+				{"table_name": "top_bots", "column_name": "bot_id", "type": "text", "nullable": true},
+				{"table_name": "top_bots", "column_name": "votes", "type": "bigint", "nullable": true}
+			]`,
+		},
+		{
+			name: "legacy file with a missing view column",
+			want: `[
+				{"table_name": "bots", "column_name": "bot_id", "type": "text", "nullable": false},
+				{"table_name": "bots", "column_name": "votes", "type": "bigint", "nullable": false},
+				{"table_name": "bots", "column_name": "kind", "type": "USER-DEFINED", "nullable": true},
+				{"table_name": "bots", "column_name": "short", "type": "character varying", "nullable": true},
+				{"table_name": "top_bots", "column_name": "bot_id", "type": "text", "nullable": true},
+				{"table_name": "top_bots", "column_name": "avatar", "type": "text", "nullable": true},
+				{"table_name": "gone", "column_name": "id", "type": "text", "nullable": false}
+			]`,
+			findings: []string{
+				"breaking: column public.top_bots.avatar: missing from the database",
+				"compatible: column public.top_bots.votes: extra column in the database",
+				"breaking: table public.gone: missing from the database",
+			},
+		},
+		{
+			name: "v2 file",
+			want: `{"version": 2, "schemas": ["public"], "tables": [
+				{"schema": "public", "name": "bots", "columns": [
+					{"name": "bot_id", "type": "text"},
+					{"name": "votes", "type": "integer"},
+					{"name": "kind", "type": "vote_kind", "nullable": true},
+					{"name": "short", "type": "character varying(64)", "nullable": true}
+				]}
+			], "views": [
+				{"schema": "public", "name": "top_bots", "columns": [{"name": "bot_id", "type": "text", "nullable": true}]}
+			], "enums": [
+				{"schema": "public", "name": "vote_kind", "values": ["up", "down", "meh"]}
+			]}`,
+			findings: []string{
+				"breaking: enum public.vote_kind: missing value meh",
+				"breaking: column public.bots.votes: type changed from integer to bigint",
+				"compatible: column public.bots.short: type changed from character varying(64) to character varying(255)",
+				"compatible: column public.top_bots.votes: extra column in the database",
+			},
+		},
+		{
+			name: "v2 file does not match tables against views",
+			want: `{"version": 2, "schemas": ["public"], "tables": [
+				{"schema": "public", "name": "bots", "columns": [
+					{"name": "bot_id", "type": "text"},
+					{"name": "votes", "type": "bigint"},
+					{"name": "kind", "type": "vote_kind", "nullable": true},
+					{"name": "short", "type": "character varying(255)", "nullable": true}
+				]},
+				{"schema": "public", "name": "top_bots", "columns": [{"name": "bot_id", "type": "text", "nullable": true}]}
+			]}`,
+			findings: []string{
+				"breaking: table public.top_bots: missing from the database",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := dbparser.ParseCISchema([]byte(tt.want))
+
+			if err != nil {
+				t.Fatalf("ParseCISchema failed: %v", err)
+			}
+
+			var got []string
+
+			for _, f := range CheckCI(want, testLiveSchema(), nil) {
+				got = append(got, f.String())
+			}
+
+			if !slices.Equal(got, tt.findings) {
+				t.Errorf("CheckCI findings =\n%q\nwant\n%q", got, tt.findings)
+			}
+		})
+	}
+}
@@ -0,0 +1,724 @@
+// Package schemadiff compares two database catalogs and generates the SQL to migrate one to the other
+package schemadiff
+
+import (
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/jackc/pgx/v4"
+)
+
+// The order statements are emitted in, so that e.g. constraints are dropped before the
+// types of their columns change and enums exist before columns using them are added
+const (
+	phaseDrop = iota
+	phaseEnum
+	phaseFunction
+	phaseSequence
+	phaseTable
+	phaseColumn
+	phaseConstraint
+	phaseForeignKey
+	phaseIndex
+	phaseManual
+)
+
+// Kinds of changes
+const (
+	Added   = "+"
+	Removed = "-"
+	Changed = "~"
+)
+
+// A single difference between the wanted and live catalogs
+type Change struct {
+	// One of Added, Removed or Changed (relative to the live database)
+	Kind string
+
+	// Object type (e.g. table, column, index)
+	Object string
+
+	// Qualified name of the object
+	Name string
+
+	// Human readable details, may be empty
+	Detail string
+
+	// Statements to apply the change. Statements that would drop data or need manual
+	// work are emitted as comments
+	SQL []string
+
+	phase int
+
+	// Whether this drops a foreign key, these are dropped before the keys they reference
+	dropsForeignKey bool
+}
+
+// Returns the change as a line of a human readable diff
+func (c Change) String() string {
+	s := c.Kind + " " + c.Object + " " + c.Name
+
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+
+	return s
+}
+
+// Returns a quoted SQL string literal
+func literal(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func ident(parts ...string) string {
+	return pgx.Identifier(parts).Sanitize()
+}
+
+func comment(stmt string) string {
+	return "-- " + strings.ReplaceAll(stmt, "\n", "\n-- ")
+}
+
+var nextvalRegex = regexp.MustCompile(`nextval\('([^']+)'::regclass\)`)
+
+// Returns statements creating the sequences used by a default expression
+func sequencesFor(def *string) []string {
+	if def == nil {
+		return nil
+	}
+
+	var stmts []string
+	for _, m := range nextvalRegex.FindAllStringSubmatch(*def, -1) {
+		stmts = append(stmts, "CREATE SEQUENCE IF NOT EXISTS "+m[1]+";")
+	}
+
+	return stmts
+}
+
+// Returns the type modifiers of a type (e.g. 10 and 2 for "numeric(10,2)"), nil if it has none
+func typeMods(typ string) []int {
+	open, closing := strings.Index(typ, "("), strings.Index(typ, ")")
+
+	if open < 0 || closing < open {
+		return nil
+	}
+
+	var mods []int
+	for _, part := range strings.Split(typ[open+1:closing], ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+
+		if err != nil {
+			return nil
+		}
+
+		mods = append(mods, n)
+	}
+
+	return mods
+}
+
+// Integer and floating point types mapped to the types they can be widened to without loss
+var widerTypes = map[string][]string{
+	"smallint":          {"integer", "bigint", "numeric"},
+	"integer":           {"bigint", "numeric"},
+	"bigint":            {"numeric"},
+	"real":              {"double precision"},
+	"character varying": {"text"},
+}
+
+// Returns whether every value of type from can be cast to type to without being truncated,
+// rounded or rejected
+func widensType(from, to string) bool {
+	fromArray, toArray := strings.HasSuffix(from, "[]"), strings.HasSuffix(to, "[]")
+
+	if fromArray != toArray {
+		return false
+	}
+
+	from, to = strings.TrimSuffix(from, "[]"), strings.TrimSuffix(to, "[]")
+	fromBase, toBase := bareType(from), bareType(to)
+	fromMods, toMods := typeMods(from), typeMods(to)
+
+	if fromBase != toBase {
+		// Casting to an unconstrained type keeps every value
+		return toMods == nil && slices.Contains(widerTypes[fromBase], toBase)
+	}
+
+	if toMods == nil {
+		// Dropping the modifier of e.g. character varying(n) or numeric(p,s)
+		return fromBase != "character" && fromBase != "bit"
+	}
+
+	if fromMods == nil || len(fromMods) != len(toMods) {
+		return false
+	}
+
+	switch fromBase {
+	case "numeric":
+		// Both the scale and the digits before the decimal point must not shrink
+		if len(toMods) == 1 {
+			return toMods[0] >= fromMods[0]
+		}
+
+		return toMods[1] >= fromMods[1] && toMods[0]-toMods[1] >= fromMods[0]-fromMods[1]
+	case "character varying", "bit varying", "timestamp without time zone", "timestamp with time zone",
+		"time without time zone", "time with time zone", "interval":
+		return toMods[0] >= fromMods[0]
+	}
+
+	// Fixed length types like character(n) are padded or truncated to the new length
+	return false
+}
+
+func columnDef(col dbparser.Column) string {
+	def := ident(col.Name) + " " + col.Type
+
+	if col.Default != nil {
+		def += " DEFAULT " + *col.Default
+	}
+
+	if col.NotNull {
+		def += " NOT NULL"
+	}
+
+	return def
+}
+
+// Diff returns the changes needed to bring have (the live database) in line with want
+//
+// Tables in ignoreTables (e.g. bookkeeping tables like seed_info) are never reported
+func Diff(want, have *dbparser.Catalog, ignoreTables []string) []Change {
+	var changes []Change
+
+	ignored := func(t *dbparser.Table) bool {
+		for _, name := range ignoreTables {
+			if name == t.Name || name == t.Schema+"."+t.Name {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	changes = append(changes, diffEnums(want, have)...)
+	changes = append(changes, diffFunctions(want, have)...)
+
+	for _, wt := range want.Tables {
+		if ignored(wt) {
+			continue
+		}
+
+		ht := have.Table(wt.Schema, wt.Name)
+
+		if ht == nil {
+			changes = append(changes, createTable(wt)...)
+			continue
+		}
+
+		changes = append(changes, diffTable(wt, ht)...)
+	}
+
+	for _, ht := range have.Tables {
+		if ignored(ht) || want.Table(ht.Schema, ht.Name) != nil {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Kind:   Removed,
+			Object: "table",
+			Name:   ht.Schema + "." + ht.Name,
+			Detail: "not in the seed, left in place",
+			SQL:    []string{comment("DROP TABLE " + ht.Ident() + ";")},
+			phase:  phaseManual,
+		})
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].phase != changes[j].phase {
+			return changes[i].phase < changes[j].phase
+		}
+
+		return changes[i].dropsForeignKey && !changes[j].dropsForeignKey
+	})
+
+	return changes
+}
+
+// SQL returns the statements of all changes in the order they need to be applied
+func SQL(changes []Change) string {
+	var sb strings.Builder
+
+	for _, c := range changes {
+		for _, stmt := range c.SQL {
+			sb.WriteString(stmt)
+			sb.WriteString("\n")
+		}
+	}
+
+	return sb.String()
+}
+
+func diffEnums(want, have *dbparser.Catalog) []Change {
+	var changes []Change
+
+	for _, we := range want.Enums {
+		name := we.Schema + "." + we.Name
+		he := have.Enum(we.Schema, we.Name)
+
+		if he == nil {
+			var values []string
+			for _, v := range we.Values {
+				values = append(values, literal(v))
+			}
+
+			changes = append(changes, Change{
+				Kind:   Added,
+				Object: "enum",
+				Name:   name,
+				Detail: strings.Join(we.Values, ", "),
+				SQL:    []string{"CREATE TYPE " + we.Ident() + " AS ENUM (" + strings.Join(values, ", ") + ");"},
+				phase:  phaseEnum,
+			})
+
+			continue
+		}
+
+		existing := map[string]bool{}
+		for _, v := range he.Values {
+			existing[v] = true
+		}
+
+		for i, v := range we.Values {
+			if existing[v] {
+				continue
+			}
+
+			stmt := "ALTER TYPE " + we.Ident() + " ADD VALUE IF NOT EXISTS " + literal(v)
+
+			if i > 0 {
+				stmt += " AFTER " + literal(we.Values[i-1])
+			} else if len(he.Values) > 0 {
+				stmt += " BEFORE " + literal(he.Values[0])
+			}
+
+			changes = append(changes, Change{
+				Kind:   Added,
+				Object: "enum value",
+				Name:   name + "." + v,
+				SQL:    []string{stmt + ";"},
+				phase:  phaseEnum,
+			})
+		}
+
+		wanted := map[string]bool{}
+		for _, v := range we.Values {
+			wanted[v] = true
+		}
+
+		for _, v := range he.Values {
+			if wanted[v] {
+				continue
+			}
+
+			changes = append(changes, Change{
+				Kind:   Removed,
+				Object: "enum value",
+				Name:   name + "." + v,
+				Detail: "not in the seed, enum values cannot be dropped without recreating the type",
+				SQL:    []string{"-- enum value " + literal(v) + " of " + we.Ident() + " is not in the seed"},
+				phase:  phaseManual,
+			})
+		}
+	}
+
+	for _, he := range have.Enums {
+		if want.Enum(he.Schema, he.Name) != nil {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Kind:   Removed,
+			Object: "enum",
+			Name:   he.Schema + "." + he.Name,
+			Detail: "not in the seed, left in place",
+			SQL:    []string{comment("DROP TYPE " + he.Ident() + ";")},
+			phase:  phaseManual,
+		})
+	}
+
+	return changes
+}
+
+func diffFunctions(want, have *dbparser.Catalog) []Change {
+	var changes []Change
+
+	for _, wf := range want.Functions {
+		hf := have.Function(wf.Signature())
+
+		switch {
+		case hf == nil:
+			changes = append(changes, Change{
+				Kind:   Added,
+				Object: "function",
+				Name:   wf.Signature(),
+				SQL:    []string{strings.TrimSpace(wf.Def) + ";"},
+				phase:  phaseFunction,
+			})
+		case strings.TrimSpace(hf.Def) != strings.TrimSpace(wf.Def):
+			changes = append(changes, Change{
+				Kind:   Changed,
+				Object: "function",
+				Name:   wf.Signature(),
+				Detail: "definition differs",
+				SQL:    []string{strings.TrimSpace(wf.Def) + ";"},
+				phase:  phaseFunction,
+			})
+		}
+	}
+
+	for _, hf := range have.Functions {
+		if want.Function(hf.Signature()) != nil {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Kind:   Removed,
+			Object: "function",
+			Name:   hf.Signature(),
+			Detail: "not in the seed, left in place",
+			SQL:    []string{comment("DROP FUNCTION " + hf.Signature() + ";")},
+			phase:  phaseManual,
+		})
+	}
+
+	return changes
+}
+
+func constraintPhase(con dbparser.Constraint) int {
+	if con.Type == "f" {
+		return phaseForeignKey
+	}
+
+	return phaseConstraint
+}
+
+func addConstraint(t *dbparser.Table, con dbparser.Constraint) string {
+	return "ALTER TABLE " + t.Ident() + " ADD CONSTRAINT " + ident(con.Name) + " " + con.Def + ";"
+}
+
+func createTable(t *dbparser.Table) []Change {
+	var seqs []string
+	var cols []string
+
+	for _, col := range t.Columns {
+		seqs = append(seqs, sequencesFor(col.Default)...)
+		cols = append(cols, "    "+columnDef(col))
+	}
+
+	name := t.Schema + "." + t.Name
+
+	var changes []Change
+
+	if len(seqs) > 0 {
+		changes = append(changes, Change{
+			Kind:   Added,
+			Object: "sequences of table",
+			Name:   name,
+			SQL:    seqs,
+			phase:  phaseSequence,
+		})
+	}
+
+	changes = append(changes, Change{
+		Kind:   Added,
+		Object: "table",
+		Name:   name,
+		SQL:    []string{"CREATE TABLE " + t.Ident() + " (\n" + strings.Join(cols, ",\n") + "\n);"},
+		phase:  phaseTable,
+	})
+
+	for _, con := range t.Constraints {
+		changes = append(changes, Change{
+			Kind:   Added,
+			Object: "constraint",
+			Name:   name + "." + con.Name,
+			Detail: con.Def,
+			SQL:    []string{addConstraint(t, con)},
+			phase:  constraintPhase(con),
+		})
+	}
+
+	for _, idx := range t.Indexes {
+		changes = append(changes, Change{
+			Kind:   Added,
+			Object: "index",
+			Name:   t.Schema + "." + idx.Name,
+			SQL:    []string{idx.Def + ";"},
+			phase:  phaseIndex,
+		})
+	}
+
+	return changes
+}
+
+func diffTable(wt, ht *dbparser.Table) []Change {
+	var changes []Change
+	name := wt.Schema + "." + wt.Name
+
+	for _, wc := range wt.Columns {
+		colName := name + "." + wc.Name
+		hc := ht.Column(wc.Name)
+
+		if hc == nil {
+			stmts := sequencesFor(wc.Default)
+
+			if wc.NotNull && wc.Default == nil {
+				// Adding a NOT NULL column without a default fails on non-empty tables
+				nullable := wc
+				nullable.NotNull = false
+
+				stmts = append(stmts,
+					"ALTER TABLE "+wt.Ident()+" ADD COLUMN "+columnDef(nullable)+";",
+					"-- Backfill "+ident(wc.Name)+" and then run:",
+					comment("ALTER TABLE "+wt.Ident()+" ALTER COLUMN "+ident(wc.Name)+" SET NOT NULL;"),
+				)
+			} else {
+				stmts = append(stmts, "ALTER TABLE "+wt.Ident()+" ADD COLUMN "+columnDef(wc)+";")
+			}
+
+			changes = append(changes, Change{
+				Kind:   Added,
+				Object: "column",
+				Name:   colName,
+				Detail: wc.Type,
+				SQL:    stmts,
+				phase:  phaseColumn,
+			})
+
+			continue
+		}
+
+		alter := "ALTER TABLE " + wt.Ident() + " ALTER COLUMN " + ident(wc.Name)
+
+		if hc.Type != wc.Type {
+			stmt := alter + " TYPE " + wc.Type + " USING " + ident(wc.Name) + "::" + wc.Type + ";"
+
+			if widensType(hc.Type, wc.Type) {
+				changes = append(changes, Change{
+					Kind:   Changed,
+					Object: "column",
+					Name:   colName,
+					Detail: "type " + hc.Type + " -> " + wc.Type,
+					SQL:    []string{stmt},
+					phase:  phaseColumn,
+				})
+			} else {
+				// The cast can truncate, round or reject existing values
+				changes = append(changes, Change{
+					Kind:   Changed,
+					Object: "column",
+					Name:   colName,
+					Detail: "type " + hc.Type + " -> " + wc.Type + ", may lose data, left in place",
+					SQL:    []string{"-- Check that the values of " + ident(wc.Name) + " fit and then run:", comment(stmt)},
+					phase:  phaseManual,
+				})
+			}
+		}
+
+		switch {
+		case wc.Default == nil && hc.Default != nil:
+			changes = append(changes, Change{
+				Kind:   Changed,
+				Object: "column",
+				Name:   colName,
+				Detail: "default " + *hc.Default + " -> none",
+				SQL:    []string{alter + " DROP DEFAULT;"},
+				phase:  phaseColumn,
+			})
+		case wc.Default != nil && (hc.Default == nil || *hc.Default != *wc.Default):
+			from := "none"
+
+			if hc.Default != nil {
+				from = *hc.Default
+			}
+
+			changes = append(changes, Change{
+				Kind:   Changed,
+				Object: "column",
+				Name:   colName,
+				Detail: "default " + from + " -> " + *wc.Default,
+				SQL:    append(sequencesFor(wc.Default), alter+" SET DEFAULT "+*wc.Default+";"),
+				phase:  phaseColumn,
+			})
+		}
+
+		if hc.NotNull != wc.NotNull {
+			stmt := alter + " DROP NOT NULL;"
+			detail := "not null -> nullable"
+
+			if wc.NotNull {
+				stmt = alter + " SET NOT NULL;"
+				detail = "nullable -> not null"
+			}
+
+			changes = append(changes, Change{
+				Kind:   Changed,
+				Object: "column",
+				Name:   colName,
+				Detail: detail,
+				SQL:    []string{stmt},
+				phase:  phaseColumn,
+			})
+		}
+	}
+
+	for _, hc := range ht.Columns {
+		if wt.Column(hc.Name) != nil {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Kind:   Removed,
+			Object: "column",
+			Name:   name + "." + hc.Name,
+			Detail: "not in the seed, left in place",
+			SQL:    []string{comment("ALTER TABLE " + wt.Ident() + " DROP COLUMN " + ident(hc.Name) + ";")},
+			phase:  phaseManual,
+		})
+	}
+
+	changes = append(changes, diffConstraints(wt, ht)...)
+	changes = append(changes, diffIndexes(wt, ht)...)
+
+	return changes
+}
+
+func diffConstraints(wt, ht *dbparser.Table) []Change {
+	var changes []Change
+	name := wt.Schema + "." + wt.Name
+
+	haveCons := map[string]dbparser.Constraint{}
+	for _, con := range ht.Constraints {
+		haveCons[con.Name] = con
+	}
+
+	wantCons := map[string]dbparser.Constraint{}
+	for _, con := range wt.Constraints {
+		wantCons[con.Name] = con
+	}
+
+	dropConstraint := func(con dbparser.Constraint) string {
+		return "ALTER TABLE " + wt.Ident() + " DROP CONSTRAINT " + ident(con.Name) + ";"
+	}
+
+	for _, con := range wt.Constraints {
+		hcon, ok := haveCons[con.Name]
+
+		switch {
+		case !ok:
+			changes = append(changes, Change{
+				Kind:   Added,
+				Object: "constraint",
+				Name:   name + "." + con.Name,
+				Detail: con.Def,
+				SQL:    []string{addConstraint(wt, con)},
+				phase:  constraintPhase(con),
+			})
+		case hcon.Def != con.Def:
+			changes = append(changes,
+				Change{
+					Kind:            Changed,
+					Object:          "constraint",
+					Name:            name + "." + con.Name,
+					Detail:          hcon.Def + " -> " + con.Def,
+					SQL:             []string{dropConstraint(hcon)},
+					phase:           phaseDrop,
+					dropsForeignKey: hcon.Type == "f",
+				},
+				Change{
+					Kind:   Changed,
+					Object: "constraint",
+					Name:   name + "." + con.Name,
+					Detail: "recreate",
+					SQL:    []string{addConstraint(wt, con)},
+					phase:  constraintPhase(con),
+				},
+			)
+		}
+	}
+
+	for _, con := range ht.Constraints {
+		if _, ok := wantCons[con.Name]; ok {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Kind:            Removed,
+			Object:          "constraint",
+			Name:            name + "." + con.Name,
+			Detail:          con.Def,
+			SQL:             []string{dropConstraint(con)},
+			phase:           phaseDrop,
+			dropsForeignKey: con.Type == "f",
+		})
+	}
+
+	return changes
+}
+
+func diffIndexes(wt, ht *dbparser.Table) []Change {
+	var changes []Change
+
+	haveIdx := map[string]dbparser.Index{}
+	for _, idx := range ht.Indexes {
+		haveIdx[idx.Name] = idx
+	}
+
+	wantIdx := map[string]dbparser.Index{}
+	for _, idx := range wt.Indexes {
+		wantIdx[idx.Name] = idx
+	}
+
+	for _, idx := range wt.Indexes {
+		hidx, ok := haveIdx[idx.Name]
+
+		switch {
+		case !ok:
+			changes = append(changes, Change{
+				Kind:   Added,
+				Object: "index",
+				Name:   wt.Schema + "." + idx.Name,
+				SQL:    []string{idx.Def + ";"},
+				phase:  phaseIndex,
+			})
+		case hidx.Def != idx.Def:
+			changes = append(changes, Change{
+				Kind:   Changed,
+				Object: "index",
+				Name:   wt.Schema + "." + idx.Name,
+				Detail: "definition differs",
+				SQL:    []string{"DROP INDEX " + ident(wt.Schema, idx.Name) + ";", idx.Def + ";"},
+				phase:  phaseIndex,
+			})
+		}
+	}
+
+	for _, idx := range ht.Indexes {
+		if _, ok := wantIdx[idx.Name]; ok {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Kind:   Removed,
+			Object: "index",
+			Name:   ht.Schema + "." + idx.Name,
+			SQL:    []string{"DROP INDEX " + ident(ht.Schema, idx.Name) + ";"},
+			phase:  phaseDrop,
+		})
+	}
+
+	return changes
+}
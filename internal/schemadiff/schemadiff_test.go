@@ -0,0 +1,304 @@
+package schemadiff
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+)
+
+func TestWidensType(t *testing.T) {
+	tests := []struct {
+		from, to string
+		widens   bool
+	}{
+		{"character varying(64)", "character varying(255)", true},
+		{"character varying(255)", "character varying(64)", false},
+		{"character varying(64)", "character varying", true},
+		{"character varying(64)", "text", true},
+		{"text", "character varying(64)", false},
+		{"character(4)", "character(8)", false},
+		{"character(4)", "text", false},
+		{"smallint", "integer", true},
+		{"integer", "bigint", true},
+		{"bigint", "integer", false},
+		{"integer", "numeric", true},
+		{"integer", "numeric(5,2)", false},
+		{"numeric(10,2)", "numeric(12,2)", true},
+		{"numeric(10,2)", "numeric(12,4)", true},
+		{"numeric(10,2)", "numeric(10,4)", false},
+		{"numeric(10,2)", "numeric(10,0)", false},
+		{"numeric(10,2)", "numeric", true},
+		{"numeric", "numeric(10,2)", false},
+		{"real", "double precision", true},
+		{"double precision", "real", false},
+		{"double precision", "numeric", false},
+		{"timestamp(3) with time zone", "timestamp(6) with time zone", true},
+		{"timestamp with time zone", "timestamp(3) with time zone", false},
+		{"timestamp without time zone", "timestamp with time zone", false},
+		{"text", "integer", false},
+		{"character varying(64)[]", "text[]", true},
+		{"text[]", "text", false},
+	}
+
+	for _, tt := range tests {
+		if got := widensType(tt.from, tt.to); got != tt.widens {
+			t.Errorf("widensType(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.widens)
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+// The live table all Diff cases are compared against
+func testLiveTable() *dbparser.Table {
+	return &dbparser.Table{
+		Schema: "public",
+		Name:   "bots",
+		Columns: []dbparser.Column{
+			{Name: "bot_id", Type: "text", NotNull: true},
+			{Name: "short", Type: "character varying(64)"},
+			{Name: "votes", Type: "integer", NotNull: true},
+			{Name: "legacy", Type: "text"},
+		},
+		Constraints: []dbparser.Constraint{
+			{Name: "bots_pkey", Type: "p", Def: "PRIMARY KEY (bot_id)"},
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		// Edits the wanted table, which starts out as a copy of the live one
+		edit func(t *dbparser.Table)
+		// Changes as returned by Change.String, in order
+		changes []string
+		sql     []string
+	}{
+		{
+			name: "no changes",
+			edit: func(t *dbparser.Table) {},
+		},
+		{
+			name: "added columns",
+			edit: func(t *dbparser.Table) {
+				t.Columns = append(t.Columns,
+					dbparser.Column{Name: "rank", Type: "integer", NotNull: true, Default: ptr("0")},
+					dbparser.Column{Name: "owner", Type: "text", NotNull: true},
+				)
+			},
+			changes: []string{
+				"+ column public.bots.rank: integer",
+				"+ column public.bots.owner: text",
+			},
+			sql: []string{
+				`ALTER TABLE "public"."bots" ADD COLUMN "rank" integer DEFAULT 0 NOT NULL;`,
+				`ALTER TABLE "public"."bots" ADD COLUMN "owner" text;`,
+				`-- Backfill "owner" and then run:`,
+				`-- ALTER TABLE "public"."bots" ALTER COLUMN "owner" SET NOT NULL;`,
+			},
+		},
+		{
+			name: "removed column is left in place",
+			edit: func(t *dbparser.Table) {
+				t.Columns = t.Columns[:3]
+			},
+			changes: []string{
+				"- column public.bots.legacy: not in the seed, left in place",
+			},
+			sql: []string{
+				`-- ALTER TABLE "public"."bots" DROP COLUMN "legacy";`,
+			},
+		},
+		{
+			name: "widening type changes are applied",
+			edit: func(t *dbparser.Table) {
+				t.Columns[1].Type = "character varying(255)"
+				t.Columns[2].Type = "bigint"
+			},
+			changes: []string{
+				"~ column public.bots.short: type character varying(64) -> character varying(255)",
+				"~ column public.bots.votes: type integer -> bigint",
+			},
+			sql: []string{
+				`ALTER TABLE "public"."bots" ALTER COLUMN "short" TYPE character varying(255) USING "short"::character varying(255);`,
+				`ALTER TABLE "public"."bots" ALTER COLUMN "votes" TYPE bigint USING "votes"::bigint;`,
+			},
+		},
+		{
+			name: "narrowing type changes are left in place",
+			edit: func(t *dbparser.Table) {
+				t.Columns[1].Type = "character varying(32)"
+				t.Columns[2].Type = "smallint"
+				t.Columns[3].Type = "character varying(16)"
+			},
+			changes: []string{
+				"~ column public.bots.short: type character varying(64) -> character varying(32), may lose data, left in place",
+				"~ column public.bots.votes: type integer -> smallint, may lose data, left in place",
+				"~ column public.bots.legacy: type text -> character varying(16), may lose data, left in place",
+			},
+			sql: []string{
+				`-- Check that the values of "short" fit and then run:`,
+				`-- ALTER TABLE "public"."bots" ALTER COLUMN "short" TYPE character varying(32) USING "short"::character varying(32);`,
+				`-- Check that the values of "votes" fit and then run:`,
+				`-- ALTER TABLE "public"."bots" ALTER COLUMN "votes" TYPE smallint USING "votes"::smallint;`,
+				`-- Check that the values of "legacy" fit and then run:`,
+				`-- ALTER TABLE "public"."bots" ALTER COLUMN "legacy" TYPE character varying(16) USING "legacy"::character varying(16);`,
+			},
+		},
+		{
+			name: "changed constraint is dropped and recreated",
+			edit: func(t *dbparser.Table) {
+				t.Constraints[0].Def = "PRIMARY KEY (bot_id, votes)"
+			},
+			changes: []string{
+				"~ constraint public.bots.bots_pkey: PRIMARY KEY (bot_id) -> PRIMARY KEY (bot_id, votes)",
+				"~ constraint public.bots.bots_pkey: recreate",
+			},
+			sql: []string{
+				`ALTER TABLE "public"."bots" DROP CONSTRAINT "bots_pkey";`,
+				`ALTER TABLE "public"."bots" ADD CONSTRAINT "bots_pkey" PRIMARY KEY (bot_id, votes);`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wt := testLiveTable()
+			tt.edit(wt)
+
+			changes := Diff(&dbparser.Catalog{Tables: []*dbparser.Table{wt}}, &dbparser.Catalog{Tables: []*dbparser.Table{testLiveTable()}}, nil)
+
+			var got []string
+
+			for _, c := range changes {
+				got = append(got, c.String())
+			}
+
+			if !slices.Equal(got, tt.changes) {
+				t.Errorf("Diff changes =\n%q\nwant\n%q", got, tt.changes)
+			}
+
+			if gotSQL := strings.Split(strings.TrimSuffix(SQL(changes), "\n"), "\n"); len(tt.sql) > 0 && !slices.Equal(gotSQL, tt.sql) {
+				t.Errorf("SQL =\n%q\nwant\n%q", gotSQL, tt.sql)
+			}
+		})
+	}
+}
+
+func TestDiffIgnoreTables(t *testing.T) {
+	have := &dbparser.Catalog{Tables: []*dbparser.Table{{Schema: "public", Name: "seed_info"}}}
+
+	if changes := Diff(&dbparser.Catalog{}, have, []string{"seed_info"}); len(changes) != 0 {
+		t.Errorf("Diff reported ignored tables: %v", changes)
+	}
+}
+
+func TestSQLOrder(t *testing.T) {
+	want := &dbparser.Catalog{
+		Enums: []*dbparser.Enum{
+			{Schema: "public", Name: "vote_kind", Values: []string{"up", "down"}},
+		},
+		Functions: []*dbparser.Function{
+			{Schema: "public", Name: "now_utc", Def: "CREATE FUNCTION public.now_utc() RETURNS timestamp LANGUAGE sql AS $$ SELECT now() $$"},
+		},
+		Tables: []*dbparser.Table{
+			{
+				Schema: "public",
+				Name:   "bots",
+				Columns: []dbparser.Column{
+					{Name: "bot_id", Type: "text", NotNull: true},
+					{Name: "short", Type: "character varying(32)"},
+				},
+				Constraints: []dbparser.Constraint{
+					{Name: "bots_pkey", Type: "p", Def: "PRIMARY KEY (bot_id)"},
+				},
+				Indexes: []dbparser.Index{
+					{Name: "bots_short_idx", Def: "CREATE INDEX bots_short_idx ON public.bots USING btree (short)"},
+				},
+			},
+			{
+				Schema: "public",
+				Name:   "votes",
+				Columns: []dbparser.Column{
+					{Name: "id", Type: "integer", NotNull: true, Default: ptr("nextval('votes_id_seq'::regclass)")},
+					{Name: "bot_id", Type: "text", NotNull: true},
+					{Name: "kind", Type: "vote_kind", NotNull: true},
+				},
+				Constraints: []dbparser.Constraint{
+					{Name: "votes_bot_id_fkey", Type: "f", Def: "FOREIGN KEY (bot_id) REFERENCES bots(bot_id)"},
+					{Name: "votes_pkey", Type: "p", Def: "PRIMARY KEY (id)"},
+				},
+			},
+		},
+	}
+
+	have := &dbparser.Catalog{
+		Tables: []*dbparser.Table{
+			{
+				Schema: "public",
+				Name:   "bots",
+				Columns: []dbparser.Column{
+					{Name: "bot_id", Type: "text", NotNull: true},
+					{Name: "short", Type: "character varying(64)"},
+				},
+				Constraints: []dbparser.Constraint{
+					{Name: "bots_pkey", Type: "p", Def: "PRIMARY KEY (owner_id)"},
+					{Name: "bots_owner_id_fkey", Type: "f", Def: "FOREIGN KEY (owner_id) REFERENCES users(user_id)"},
+				},
+				Indexes: []dbparser.Index{
+					{Name: "bots_old_idx", Def: "CREATE INDEX bots_old_idx ON public.bots USING btree (bot_id)"},
+				},
+			},
+			{
+				Schema: "public",
+				Name:   "reviews",
+				Constraints: []dbparser.Constraint{
+					{Name: "reviews_bot_id_fkey", Type: "f", Def: "FOREIGN KEY (bot_id) REFERENCES bots(owner_id)"},
+				},
+			},
+		},
+	}
+
+	// Prefixes of the statements in the order they must be emitted
+	order := []string{
+		`ALTER TABLE "public"."bots" DROP CONSTRAINT "bots_owner_id_fkey";`,
+		`ALTER TABLE "public"."bots" DROP CONSTRAINT "bots_pkey";`,
+		`DROP INDEX "public"."bots_old_idx";`,
+		`CREATE TYPE "public"."vote_kind"`,
+		`CREATE FUNCTION public.now_utc()`,
+		`CREATE SEQUENCE IF NOT EXISTS votes_id_seq;`,
+		`CREATE TABLE "public"."votes"`,
+		`ALTER TABLE "public"."bots" ADD CONSTRAINT "bots_pkey"`,
+		`ALTER TABLE "public"."votes" ADD CONSTRAINT "votes_pkey"`,
+		`ALTER TABLE "public"."votes" ADD CONSTRAINT "votes_bot_id_fkey"`,
+		`CREATE INDEX bots_short_idx`,
+		`-- ALTER TABLE "public"."bots" ALTER COLUMN "short" TYPE character varying(32)`,
+		`-- DROP TABLE "public"."reviews";`,
+	}
+
+	sql := SQL(Diff(want, have, nil))
+	last := -1
+
+	for _, prefix := range order {
+		i := strings.Index(sql, "\n"+prefix)
+
+		if i < 0 && strings.HasPrefix(sql, prefix) {
+			i = 0
+		}
+
+		if i < 0 {
+			t.Fatalf("SQL is missing %q:\n%s", prefix, sql)
+		}
+
+		if i < last {
+			t.Errorf("%q is emitted too early:\n%s", prefix, sql)
+		}
+
+		last = i
+	}
+}
@@ -0,0 +1,255 @@
+// Package schemaexport renders a database schema as JSON Schema or OpenAPI 3 components
+package schemaexport
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+	"github.com/InfinityBotList/ibldev/internal/dbtypegen"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// Output formats
+const (
+	FormatJSONSchema = "jsonschema"
+	FormatOpenAPI    = "openapi"
+)
+
+// The JSON Schema dialect of FormatJSONSchema documents
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// A JSON Schema document with one definition per table, view and enum
+type JSONSchemaDocument struct {
+	Schema string           `json:"$schema"`
+	Defs   openapi3.Schemas `json:"$defs"`
+}
+
+type exporter struct {
+	format string
+	enums  map[string]string // postgres enum name => definition name
+	defs   openapi3.Schemas
+}
+
+// Returns a reference to a definition
+func (e *exporter) ref(name string) string {
+	if e.format == FormatOpenAPI {
+		return "#/components/schemas/" + name
+	}
+
+	return "#/$defs/" + name
+}
+
+func types(typ ...string) *openapi3.Types {
+	t := openapi3.Types(typ)
+	return &t
+}
+
+// Returns the schema of a single (non array) value of a postgres type
+func (e *exporter) valueSchema(typ string) *openapi3.SchemaRef {
+	if name, ok := e.enums[strings.ReplaceAll(typ, `"`, "")]; ok {
+		// The value is only used to validate the document, refs are encoded as just $ref
+		return openapi3.NewSchemaRef(e.ref(name), e.defs[name].Value)
+	}
+
+	s := &openapi3.Schema{}
+
+	base, mods := typ, ""
+
+	if open := strings.Index(typ, "("); open >= 0 {
+		if closing := strings.Index(typ, ")"); closing > open {
+			base, mods = strings.TrimSpace(typ[:open]+typ[closing+1:]), typ[open+1:closing]
+		}
+	}
+
+	switch base {
+	case "smallint", "integer":
+		s.Type, s.Format = types(openapi3.TypeInteger), "int32"
+	case "bigint":
+		s.Type, s.Format = types(openapi3.TypeInteger), "int64"
+	case "real":
+		s.Type, s.Format = types(openapi3.TypeNumber), "float"
+	case "double precision":
+		s.Type, s.Format = types(openapi3.TypeNumber), "double"
+	case "numeric":
+		s.Type = types(openapi3.TypeNumber)
+	case "boolean":
+		s.Type = types(openapi3.TypeBoolean)
+	case "uuid":
+		s.Type, s.Format = types(openapi3.TypeString), "uuid"
+	case "timestamp with time zone", "timestamp without time zone":
+		s.Type, s.Format = types(openapi3.TypeString), "date-time"
+	case "date":
+		s.Type, s.Format = types(openapi3.TypeString), "date"
+	case "bytea":
+		s.Type, s.Format = types(openapi3.TypeString), "byte"
+	case "inet", "cidr":
+		s.Type = types(openapi3.TypeString)
+	case "json", "jsonb":
+		// Any JSON value
+	case "character varying", "character":
+		s.Type = types(openapi3.TypeString)
+
+		if n, err := strconv.ParseUint(mods, 10, 64); err == nil {
+			s.MaxLength = &n
+		}
+	default:
+		// Postgres can send any other type as text
+		s.Type = types(openapi3.TypeString)
+	}
+
+	return openapi3.NewSchemaRef("", s)
+}
+
+// Makes a schema nullable, JSON Schema uses a null type while OpenAPI 3.0 has a nullable keyword
+func (e *exporter) nullable(s *openapi3.SchemaRef) *openapi3.SchemaRef {
+	if s.Ref != "" {
+		if e.format == FormatOpenAPI {
+			return openapi3.NewSchemaRef("", &openapi3.Schema{Nullable: true, AllOf: openapi3.SchemaRefs{s}})
+		}
+
+		return openapi3.NewSchemaRef("", &openapi3.Schema{AnyOf: openapi3.SchemaRefs{s, openapi3.NewSchemaRef("", &openapi3.Schema{Type: types(openapi3.TypeNull)})}})
+	}
+
+	// A schema without a type (JSON) already allows null
+	if s.Value.Type == nil {
+		return s
+	}
+
+	if e.format == FormatOpenAPI {
+		s.Value.Nullable = true
+	} else {
+		s.Value.Type = types(append(s.Value.Type.Slice(), openapi3.TypeNull)...)
+	}
+
+	return s
+}
+
+// Returns the schema of a column
+func (e *exporter) columnSchema(c dbparser.CIColumn) *openapi3.SchemaRef {
+	s := e.valueSchema(c.Type)
+
+	if c.Array {
+		// Elements of postgres arrays can always be NULL
+		s = openapi3.NewSchemaRef("", &openapi3.Schema{Type: types(openapi3.TypeArray), Items: e.nullable(s)})
+	}
+
+	if c.Nullable {
+		s = e.nullable(s)
+	}
+
+	if c.Comment != "" {
+		if s.Ref != "" {
+			// Siblings of $ref are ignored in OpenAPI 3.0
+			s = openapi3.NewSchemaRef("", &openapi3.Schema{AllOf: openapi3.SchemaRefs{s}})
+		}
+
+		s.Value.Description = c.Comment
+	}
+
+	return s
+}
+
+// Export renders the enums and relations of a schema as definitions keyed by their type name
+func Export(s *dbparser.CISchema, rels []dbtypegen.Relation, format string) (openapi3.Schemas, error) {
+	if format != FormatJSONSchema && format != FormatOpenAPI {
+		return nil, fmt.Errorf("unknown format %s, must be one of %s, %s", format, FormatJSONSchema, FormatOpenAPI)
+	}
+
+	defs := openapi3.Schemas{}
+	e := &exporter{format: format, enums: map[string]string{}, defs: defs}
+
+	add := func(name, what string, schema *openapi3.Schema) error {
+		if _, ok := defs[name]; ok {
+			return fmt.Errorf("%s maps to %s which is already defined", what, name)
+		}
+
+		defs[name] = openapi3.NewSchemaRef("", schema)
+		return nil
+	}
+
+	for _, en := range s.Enums {
+		name := dbtypegen.TypeName(en.Schema, en.Name)
+
+		e.enums[en.Schema+"."+en.Name] = name
+
+		if en.Schema == "public" {
+			e.enums[en.Name] = name
+		}
+
+		values := make([]any, len(en.Values))
+
+		for i, v := range en.Values {
+			values[i] = v
+		}
+
+		err := add(name, "enum "+en.Schema+"."+en.Name, &openapi3.Schema{
+			Type:        types(openapi3.TypeString),
+			Title:       en.Schema + "." + en.Name,
+			Description: "The " + en.Schema + "." + en.Name + " enum",
+			Enum:        values,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range rels {
+		schema := &openapi3.Schema{
+			Type:        types(openapi3.TypeObject),
+			Title:       r.Schema + "." + r.Name,
+			Description: r.Comment,
+			Properties:  openapi3.Schemas{},
+			Required:    []string{},
+		}
+
+		for _, c := range r.Columns {
+			schema.Properties[c.Name] = e.columnSchema(c)
+
+			// Every column is always present in a row
+			schema.Required = append(schema.Required, c.Name)
+		}
+
+		err := add(dbtypegen.TypeName(r.Schema, r.Name), r.Schema+"."+r.Name, schema)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return defs, nil
+}
+
+// OpenAPI wraps definitions in an OpenAPI 3 document and validates it
+func OpenAPI(defs openapi3.Schemas, title string) (*openapi3.T, error) {
+	doc := &openapi3.T{
+		OpenAPI: "3.0.3",
+		Info: &openapi3.Info{
+			Title:   title,
+			Version: "1.0.0",
+		},
+		Paths: openapi3.NewPaths(),
+		Components: &openapi3.Components{
+			Schemas: defs,
+		},
+	}
+
+	err := doc.Validate(context.Background())
+
+	if err != nil {
+		return nil, fmt.Errorf("generated document is invalid: %w", err)
+	}
+
+	return doc, nil
+}
+
+// JSONSchema wraps definitions in a JSON Schema document
+func JSONSchema(defs openapi3.Schemas) *JSONSchemaDocument {
+	return &JSONSchemaDocument{
+		Schema: JSONSchemaDialect,
+		Defs:   defs,
+	}
+}
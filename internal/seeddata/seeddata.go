@@ -0,0 +1,439 @@
+// Package seeddata stores seed table data in plain, diffable formats (JSONL and CSV)
+//
+// Values are kept in their PostgreSQL text representation so they can be loaded back
+// with COPY without any type conversion. Rows are sorted by the primary key of the
+// table so that dumping unchanged data twice produces identical output
+package seeddata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/pgcopy"
+	"github.com/InfinityBotList/ibldev/internal/pgtoc"
+)
+
+const (
+	// pg_dump custom format archives, the default
+	FormatPg = "pg"
+
+	// A header line followed by one JSON array per row
+	FormatJSONL = "jsonl"
+
+	// A header row of name::type columns followed by one record per row
+	FormatCSV = "csv"
+)
+
+// Formats lists all supported data formats
+var Formats = []string{FormatPg, FormatJSONL, FormatCSV}
+
+// Returns whether or not format is a plain (non pg_dump) format
+func IsPlain(format string) bool {
+	return format == FormatJSONL || format == FormatCSV
+}
+
+// Returns the file extension used for a plain format
+func Ext(format string) string {
+	return "." + format
+}
+
+// A column of a table
+type Column struct {
+	Name string `json:"name"`
+
+	// Type as returned by format_type
+	Type string `json:"type"`
+}
+
+// The data of a single table
+type Table struct {
+	// Schema qualified table name, CSV does not store this
+	Name    string   `json:"table,omitempty"`
+	Columns []Column `json:"columns"`
+
+	// Values in their text representation, NULL values are nil
+	Rows [][]*string `json:"-"`
+}
+
+// FromArchive reads the data of a single table from a custom format archive
+//
+// types maps column names to their types, columns without a type are stored as text
+func FromArchive(r io.Reader, types map[string]string) (*Table, error) {
+	var t *Table
+
+	err := pgtoc.WalkData(r, func(e pgtoc.Entry, data io.Reader) error {
+		if t != nil {
+			return fmt.Errorf("archive contains data for more than one table")
+		}
+
+		name, columns, err := pgcopy.ParseCopyStmt(e.CopyStmt)
+
+		if err != nil {
+			return err
+		}
+
+		t = &Table{Name: name}
+
+		for _, c := range columns {
+			typ, ok := types[c]
+
+			if !ok {
+				typ = "text"
+			}
+
+			t.Columns = append(t.Columns, Column{Name: c, Type: typ})
+		}
+
+		scanner := bufio.NewScanner(data)
+		scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			// End of data marker
+			if line == `\.` {
+				break
+			}
+
+			t.Rows = append(t.Rows, pgcopy.DecodeRow(line))
+		}
+
+		return scanner.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return nil, fmt.Errorf("archive contains no table data")
+	}
+
+	return t, nil
+}
+
+// Types whose values are compared numerically
+var numericTypes = []string{"smallint", "integer", "bigint", "oid", "numeric", "real", "double precision"}
+
+// Returns whether or not values of a type as returned by format_type are compared numerically
+func isNumericType(typ string) bool {
+	if open := strings.Index(typ, "("); open >= 0 {
+		typ = strings.TrimSpace(typ[:open])
+	}
+
+	return slices.Contains(numericTypes, typ)
+}
+
+// Ranks a numeric value the way postgres orders them: -Infinity, numbers, Infinity and then NaN.
+// Values that cannot be parsed rank last
+func numericRank(s string) (int, *big.Rat) {
+	switch s {
+	case "-Infinity":
+		return 0, nil
+	case "Infinity":
+		return 2, nil
+	case "NaN":
+		return 3, nil
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+
+	if !ok {
+		return 4, nil
+	}
+
+	return 1, r
+}
+
+// Compares two values of a column, NULLs sort first. Values of numeric columns are compared
+// exactly as numbers and all other values as strings, so the order is always transitive
+func compareValues(a, b *string, numeric bool) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	if numeric {
+		arank, ar := numericRank(*a)
+		brank, br := numericRank(*b)
+
+		if arank != brank {
+			return arank - brank
+		}
+
+		if ar != nil {
+			if c := ar.Cmp(br); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return strings.Compare(*a, *b)
+}
+
+// Sort sorts the rows by the given key columns, ties (or all rows if keys is empty) are
+// sorted by the full row so the order is always deterministic
+func (t *Table) Sort(keys []string) {
+	var idx []int
+
+	for _, k := range keys {
+		for i, c := range t.Columns {
+			if c.Name == k {
+				idx = append(idx, i)
+			}
+		}
+	}
+
+	numeric := make([]bool, len(t.Columns))
+
+	for i, c := range t.Columns {
+		numeric[i] = isNumericType(c.Type)
+	}
+
+	sort.SliceStable(t.Rows, func(i, j int) bool {
+		for _, k := range idx {
+			if c := compareValues(t.Rows[i][k], t.Rows[j][k], numeric[k]); c != 0 {
+				return c < 0
+			}
+		}
+
+		for k := range t.Columns {
+			if c := compareValues(t.Rows[i][k], t.Rows[j][k], numeric[k]); c != 0 {
+				return c < 0
+			}
+		}
+
+		return false
+	})
+}
+
+// Returns the quoted column list of the table for use in a COPY statement
+func (t *Table) ColumnList() string {
+	names := make([]string, len(t.Columns))
+
+	for i, c := range t.Columns {
+		names[i] = `"` + strings.ReplaceAll(c.Name, `"`, `""`) + `"`
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// CopyData returns the rows in the COPY text format
+func (t *Table) CopyData() *bytes.Buffer {
+	var buf bytes.Buffer
+
+	for _, row := range t.Rows {
+		buf.WriteString(pgcopy.EncodeRow(row))
+		buf.WriteByte('\n')
+	}
+
+	return &buf
+}
+
+// Encode writes the table in the given plain format
+func (t *Table) Encode(w io.Writer, format string) error {
+	switch format {
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+
+		err := enc.Encode(t)
+
+		if err != nil {
+			return err
+		}
+
+		for _, row := range t.Rows {
+			err = enc.Encode(row)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+
+		header := make([]string, len(t.Columns))
+
+		for i, c := range t.Columns {
+			header[i] = c.Name + "::" + c.Type
+		}
+
+		err := cw.Write(header)
+
+		if err != nil {
+			return err
+		}
+
+		for _, row := range t.Rows {
+			record := make([]string, len(row))
+
+			for i, v := range row {
+				record[i] = encodeCSVValue(v)
+			}
+
+			err = cw.Write(record)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unsupported data format: %s", format)
+	}
+}
+
+// Prefix of CSV values with escaped carriage returns
+const csvEscaped = `\E`
+
+// Escapes backslashes and carriage returns, encoding/csv turns \r\n in quoted fields into \n
+var csvEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`)
+
+// CSV cannot tell NULL and empty strings apart, so NULL is written as \N and values
+// starting with a backslash get an extra one. Values with carriage returns are written
+// as \E followed by the value with backslashes and carriage returns escaped
+func encodeCSVValue(v *string) string {
+	if v == nil {
+		return pgcopy.Null
+	}
+
+	if strings.Contains(*v, "\r") {
+		return csvEscaped + csvEscaper.Replace(*v)
+	}
+
+	if strings.HasPrefix(*v, `\`) {
+		return `\` + *v
+	}
+
+	return *v
+}
+
+func decodeCSVValue(s string) *string {
+	if s == pgcopy.Null {
+		return nil
+	}
+
+	if escaped, ok := strings.CutPrefix(s, csvEscaped); ok {
+		var b strings.Builder
+
+		for i := 0; i < len(escaped); i++ {
+			if escaped[i] == '\\' && i+1 < len(escaped) {
+				i++
+
+				if escaped[i] == 'r' {
+					b.WriteByte('\r')
+					continue
+				}
+			}
+
+			b.WriteByte(escaped[i])
+		}
+
+		s = b.String()
+		return &s
+	}
+
+	s = strings.TrimPrefix(s, `\`)
+	return &s
+}
+
+// Decode reads a table written by Encode
+//
+// The table name is only set for JSONL
+func Decode(r io.Reader, format string) (*Table, error) {
+	switch format {
+	case FormatJSONL:
+		dec := json.NewDecoder(r)
+
+		var t Table
+
+		err := dec.Decode(&t)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid header: %w", err)
+		}
+
+		for {
+			var row []*string
+
+			err = dec.Decode(&row)
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid row %d: %w", len(t.Rows)+1, err)
+			}
+
+			if len(row) != len(t.Columns) {
+				return nil, fmt.Errorf("row %d has %d values, expected %d", len(t.Rows)+1, len(row), len(t.Columns))
+			}
+
+			t.Rows = append(t.Rows, row)
+		}
+
+		return &t, nil
+	case FormatCSV:
+		cr := csv.NewReader(r)
+
+		header, err := cr.Read()
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid header: %w", err)
+		}
+
+		var t Table
+
+		for _, h := range header {
+			name, typ, ok := strings.Cut(h, "::")
+
+			if !ok {
+				return nil, fmt.Errorf("header column %s has no type", h)
+			}
+
+			t.Columns = append(t.Columns, Column{Name: name, Type: typ})
+		}
+
+		for {
+			record, err := cr.Read()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid row %d: %w", len(t.Rows)+1, err)
+			}
+
+			row := make([]*string, len(record))
+
+			for i, v := range record {
+				row[i] = decodeCSVValue(v)
+			}
+
+			t.Rows = append(t.Rows, row)
+		}
+
+		return &t, nil
+	default:
+		return nil, fmt.Errorf("unsupported data format: %s", format)
+	}
+}
@@ -0,0 +1,144 @@
+package seeddata
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestRoundTrip(t *testing.T) {
+	table := &Table{
+		Name: "public.bots",
+		Columns: []Column{
+			{Name: "bot_id", Type: "text"},
+			{Name: "description", Type: "text"},
+			{Name: "banner", Type: "bytea"},
+		},
+		Rows: [][]*string{
+			{ptr("1"), ptr("windows\r\nline endings\r\n"), nil},
+			{ptr("2"), ptr(""), ptr(`\x0102`)},
+			{ptr("3"), ptr("lone \r and a \\r"), ptr(`\N`)},
+			{ptr("4"), ptr(`\E not escaped`), ptr(`\`)},
+			{ptr("5"), ptr("quotes \", commas, and\nnewlines"), ptr("")},
+		},
+	}
+
+	for _, format := range []string{FormatJSONL, FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			err := table.Encode(&buf, format)
+
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+
+			got, err := Decode(&buf, format)
+
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+
+			if len(got.Columns) != len(table.Columns) {
+				t.Fatalf("decoded %d columns, want %d", len(got.Columns), len(table.Columns))
+			}
+
+			for i, c := range table.Columns {
+				if got.Columns[i] != c {
+					t.Errorf("column %d = %v, want %v", i, got.Columns[i], c)
+				}
+			}
+
+			if len(got.Rows) != len(table.Rows) {
+				t.Fatalf("decoded %d rows, want %d", len(got.Rows), len(table.Rows))
+			}
+
+			for i, row := range table.Rows {
+				for j, want := range row {
+					v := got.Rows[i][j]
+
+					switch {
+					case want == nil && v != nil:
+						t.Errorf("row %d column %d = %q, want NULL", i, j, *v)
+					case want != nil && v == nil:
+						t.Errorf("row %d column %d = NULL, want %q", i, j, *want)
+					case want != nil && *v != *want:
+						t.Errorf("row %d column %d = %q, want %q", i, j, *v, *want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSort(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  string
+		// Key values in input order, nil for NULL
+		values []*string
+		want   []string
+	}{
+		{
+			name:   "text keys are compared as strings even if they look numeric",
+			typ:    "text",
+			values: []*string{ptr("10"), ptr("9"), ptr("1e1"), ptr("abc"), nil},
+			want:   []string{"NULL", "10", "1e1", "9", "abc"},
+		},
+		{
+			name:   "integer keys are compared numerically",
+			typ:    "bigint",
+			values: []*string{ptr("10"), ptr("9"), ptr("-3"), nil},
+			want:   []string{"NULL", "-3", "9", "10"},
+		},
+		{
+			name:   "snowflakes beyond float precision are compared exactly",
+			typ:    "bigint",
+			values: []*string{ptr("1149856203745542147"), ptr("1149856203745542145"), ptr("1149856203745542146")},
+			want:   []string{"1149856203745542145", "1149856203745542146", "1149856203745542147"},
+		},
+		{
+			name:   "numeric keys with special values",
+			typ:    "numeric(10,2)",
+			values: []*string{ptr("NaN"), ptr("2.50"), ptr("Infinity"), ptr("-Infinity"), ptr("10.00"), ptr("2.5")},
+			want:   []string{"-Infinity", "2.5", "2.50", "10.00", "Infinity", "NaN"},
+		},
+		{
+			name:   "double precision keys in exponent notation",
+			typ:    "double precision",
+			values: []*string{ptr("1e+20"), ptr("5"), ptr("1.5e-05")},
+			want:   []string{"1.5e-05", "5", "1e+20"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &Table{Name: "public.t", Columns: []Column{{Name: "k", Type: tt.typ}}}
+
+			for _, v := range tt.values {
+				table.Rows = append(table.Rows, []*string{v})
+			}
+
+			table.Sort([]string{"k"})
+
+			var got []string
+
+			for _, row := range table.Rows {
+				if row[0] == nil {
+					got = append(got, "NULL")
+					continue
+				}
+
+				got = append(got, *row[0])
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
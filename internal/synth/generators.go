@@ -0,0 +1,481 @@
+// Package synth generates type correct synthetic data for a database schema
+package synth
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InfinityBotList/ibldev/types"
+)
+
+// A Generator returns the text representation of the value for row n (0 based), nil for NULL
+type Generator func(r *rand.Rand, n int) *string
+
+func str(s string) *string {
+	return &s
+}
+
+var words = []string{
+	"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel", "india", "juliet",
+	"kilo", "lima", "mike", "november", "oscar", "papa", "quebec", "romeo", "sierra", "tango",
+	"uniform", "victor", "whiskey", "xray", "yankee", "zulu",
+}
+
+var firstNames = []string{"Alice", "Bob", "Carol", "Dave", "Erin", "Frank", "Grace", "Heidi", "Ivan", "Judy", "Mallory", "Niaj", "Olivia", "Peggy", "Rupert", "Sybil", "Trent", "Victor", "Walter"}
+var lastNames = []string{"Smith", "Jones", "Taylor", "Brown", "Williams", "Wilson", "Johnson", "Davies", "Robinson", "Wright", "Thompson", "Evans", "Walker", "White", "Roberts"}
+
+func pick(r *rand.Rand, list []string) string {
+	return list[r.Intn(len(list))]
+}
+
+func randString(r *rand.Rand, n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+
+	for i := range b {
+		b[i] = chars[r.Intn(len(chars))]
+	}
+
+	return string(b)
+}
+
+// Discord epoch in milliseconds
+const discordEpoch = 1420070400000
+
+// Time all generated timestamps are relative to, fixed so that a given --seed always produces the same data
+var baseTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Builtin generators, all of them produce unique values where that makes sense
+var builtins = map[string]Generator{
+	"int": func(r *rand.Rand, n int) *string {
+		return str(strconv.Itoa(n + 1))
+	},
+	"random_int": func(r *rand.Rand, n int) *string {
+		return str(strconv.Itoa(r.Intn(1000000)))
+	},
+	"float": func(r *rand.Rand, n int) *string {
+		return str(strconv.FormatFloat(r.Float64()*1000, 'f', 4, 64))
+	},
+	"bool": func(r *rand.Rand, n int) *string {
+		return str(strconv.FormatBool(r.Intn(2) == 0))
+	},
+	"word": func(r *rand.Rand, n int) *string {
+		return str(pick(r, words))
+	},
+	"text": func(r *rand.Rand, n int) *string {
+		sentence := make([]string, 3+r.Intn(8))
+
+		for i := range sentence {
+			sentence[i] = pick(r, words)
+		}
+
+		return str(strconv.Itoa(n) + " " + strings.Join(sentence, " "))
+	},
+	"name": func(r *rand.Rand, n int) *string {
+		return str(pick(r, firstNames) + " " + pick(r, lastNames))
+	},
+	"username": func(r *rand.Rand, n int) *string {
+		return str(strings.ToLower(pick(r, firstNames)) + strconv.Itoa(n))
+	},
+	"email": func(r *rand.Rand, n int) *string {
+		return str(strings.ToLower(pick(r, firstNames)) + "." + strconv.Itoa(n) + "@example.com")
+	},
+	"url": func(r *rand.Rand, n int) *string {
+		return str("https://example.com/" + pick(r, words) + "/" + strconv.Itoa(n))
+	},
+	"uuid": func(r *rand.Rand, n int) *string {
+		b := make([]byte, 16)
+		r.Read(b)
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return str(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+	},
+	"snowflake": func(r *rand.Rand, n int) *string {
+		// One millisecond per row keeps snowflakes unique and increasing
+		ms := baseTime.UnixMilli() - discordEpoch + int64(n)
+		return str(strconv.FormatInt(ms<<22|int64(r.Intn(1<<22)), 10))
+	},
+	"timestamp": func(r *rand.Rand, n int) *string {
+		t := baseTime.Add(-time.Duration(r.Int63n(int64(365 * 24 * time.Hour))))
+		return str(t.Format("2006-01-02 15:04:05.000000Z07:00"))
+	},
+	"date": func(r *rand.Rand, n int) *string {
+		return str(baseTime.AddDate(0, 0, -r.Intn(365)).Format("2006-01-02"))
+	},
+	"time": func(r *rand.Rand, n int) *string {
+		return str(fmt.Sprintf("%02d:%02d:%02d", r.Intn(24), r.Intn(60), r.Intn(60)))
+	},
+	"interval": func(r *rand.Rand, n int) *string {
+		return str(strconv.Itoa(r.Intn(10000)) + " seconds")
+	},
+	"json": func(r *rand.Rand, n int) *string {
+		return str(fmt.Sprintf(`{"n": %d, "word": "%s"}`, n, pick(r, words)))
+	},
+	"ip": func(r *rand.Rand, n int) *string {
+		return str(fmt.Sprintf("10.%d.%d.%d", (n>>16)&0xff, (n>>8)&0xff, n&0xff))
+	},
+	"bytes": func(r *rand.Rand, n int) *string {
+		b := make([]byte, 16)
+		r.Read(b)
+		return str(fmt.Sprintf(`\x%x`, b))
+	},
+	"null": func(r *rand.Rand, n int) *string {
+		return nil
+	},
+}
+
+// Builtin generators that return a different value for every row
+var uniqueBuiltins = []string{"bytes", "email", "int", "ip", "json", "snowflake", "text", "url", "username", "uuid"}
+
+// One second per row, going back from baseTime
+func uniqueTimestamp(r *rand.Rand, n int) *string {
+	return str(baseTime.Add(-time.Duration(n) * time.Second).Format("2006-01-02 15:04:05.000000Z07:00"))
+}
+
+// Types whose default generator never repeats a value
+var uniqueDefaultTypes = []string{"smallint", "integer", "bigint", "oid", "text", "character varying", "character", "citext", "name", "uuid", "json", "jsonb", "inet", "cidr", "bytea"}
+
+// Generators for unique columns of types whose default generator repeats values, based on the row number
+//
+// numeric columns with a precision use uniqueNumeric instead
+var uniqueByType = map[string]Generator{
+	"numeric":                     builtins["int"],
+	"real":                        builtins["int"],
+	"double precision":            builtins["int"],
+	"money":                       builtins["int"],
+	"timestamp without time zone": uniqueTimestamp,
+	"timestamp with time zone":    uniqueTimestamp,
+	"date": func(r *rand.Rand, n int) *string {
+		return str(baseTime.AddDate(0, 0, -n).Format("2006-01-02"))
+	},
+	"interval": func(r *rand.Rand, n int) *string {
+		return str(strconv.Itoa(n) + " seconds")
+	},
+}
+
+// Builtins returns the names of the builtin generators
+func Builtins() []string {
+	var names []string
+
+	for name := range builtins {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// UniqueBuiltins returns the names of the builtin generators that never repeat a value
+func UniqueBuiltins() []string {
+	return slices.Clone(uniqueBuiltins)
+}
+
+// Splits a type as returned by format_type into its base type, type modifiers and whether or not it is an array
+//
+// e.g. "numeric(10,2)[]" is split into numeric, [10 2] and true
+func parseType(typ string) (base string, mods []int, array bool) {
+	base, array = strings.CutSuffix(typ, "[]")
+
+	open, closing := strings.Index(base, "("), strings.Index(base, ")")
+
+	if open >= 0 && closing > open {
+		for _, m := range strings.Split(base[open+1:closing], ",") {
+			v, _ := strconv.Atoi(strings.TrimSpace(m))
+			mods = append(mods, v)
+		}
+
+		base = strings.TrimSpace(base[:open] + base[closing+1:])
+	}
+
+	return base, mods, array
+}
+
+// Truncates the values of g to length characters
+func truncate(g Generator, length int) Generator {
+	return func(r *rand.Rand, n int) *string {
+		v := g(r, n)
+
+		if v != nil && len([]rune(*v)) > length {
+			return str(string([]rune(*v)[:length]))
+		}
+
+		return v
+	}
+}
+
+// Generates numbers that fit in numeric(precision, scale)
+func numeric(precision, scale int) Generator {
+	return func(r *rand.Rand, n int) *string {
+		digits := precision - scale
+		max := 1.0
+
+		for i := 0; i < digits && i < 15; i++ {
+			max *= 10
+		}
+
+		return str(strconv.FormatFloat(r.Float64()*(max-1), 'f', scale, 64))
+	}
+}
+
+// Generates n+1 for row n, wrapping around after max so the values fit in a smaller integer type
+func boundedInt(max int) Generator {
+	return func(r *rand.Rand, n int) *string {
+		return str(strconv.Itoa(n%max + 1))
+	}
+}
+
+// Largest values of the integer types
+var intMax = map[string]int{
+	"smallint": 32767,
+	"integer":  2147483647,
+}
+
+// Generates (n+1) / 10^scale for row n, which is unique until it no longer fits in numeric(precision, scale)
+func uniqueNumeric(scale int) Generator {
+	return func(r *rand.Rand, n int) *string {
+		v := strconv.Itoa(n + 1)
+
+		if scale == 0 {
+			return str(v)
+		}
+
+		if len(v) <= scale {
+			v = strings.Repeat("0", scale-len(v)+1) + v
+		}
+
+		return str(v[:len(v)-scale] + "." + v[len(v)-scale:])
+	}
+}
+
+// Returns 10^exp, or 0 if it does not fit in an int64
+func pow10(exp int) int64 {
+	if exp > 18 {
+		return 0
+	}
+
+	v := int64(1)
+
+	for i := 0; i < exp; i++ {
+		v *= 10
+	}
+
+	return v
+}
+
+// UniqueLimit returns how many rows the generator returned by UniqueForType can fill before its values
+// no longer fit the type, 0 if there is no practical limit
+func UniqueLimit(typ string) int64 {
+	base, mods, _ := parseType(typ)
+
+	switch base {
+	case "smallint", "integer":
+		return int64(intMax[base])
+	case "real":
+		// Integers above 2^24 are rounded
+		return 1 << 24
+	case "numeric":
+		if len(mods) > 0 {
+			return pow10(mods[0]) - 1
+		}
+	case "character varying", "character":
+		// Values start with the row number, which is cut off once it has more digits than fit
+		if len(mods) > 0 {
+			return pow10(mods[0])
+		}
+	}
+
+	return 0
+}
+
+// Wraps the values of g in an array literal of 0-3 elements
+func arrayOf(g Generator) Generator {
+	return func(r *rand.Rand, n int) *string {
+		elems := make([]string, r.Intn(4))
+
+		for i := range elems {
+			v := g(r, n)
+
+			if v == nil {
+				elems[i] = "NULL"
+				continue
+			}
+
+			elems[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(*v) + `"`
+		}
+
+		return str("{" + strings.Join(elems, ",") + "}")
+	}
+}
+
+// ForType returns the default generator for a column type as returned by format_type
+//
+// enums maps the names of enum types to their values
+func ForType(typ string, enums map[string][]string) (Generator, error) {
+	return forType(typ, enums, false)
+}
+
+// UniqueForType is like ForType but returns a generator that never repeats a value, for columns
+// that are unique on their own or the only generated column of a unique index
+func UniqueForType(typ string, enums map[string][]string) (Generator, error) {
+	return forType(typ, enums, true)
+}
+
+func forType(typ string, enums map[string][]string, unique bool) (Generator, error) {
+	base, mods, array := parseType(typ)
+
+	var g Generator
+
+	switch base {
+	case "smallint", "integer":
+		g = boundedInt(intMax[base])
+	case "bigint", "oid":
+		g = builtins["int"]
+	case "numeric":
+		g = builtins["float"]
+
+		// Stay within the precision of the column
+		if len(mods) > 0 {
+			scale := 0
+
+			if len(mods) > 1 {
+				scale = mods[1]
+			}
+
+			g = numeric(mods[0], scale)
+		}
+	case "real", "double precision", "money":
+		g = builtins["float"]
+	case "boolean":
+		g = builtins["bool"]
+	case "text", "character varying", "character", "citext", "name":
+		g = builtins["text"]
+	case "uuid":
+		g = builtins["uuid"]
+	case "timestamp without time zone", "timestamp with time zone":
+		g = builtins["timestamp"]
+	case "date":
+		g = builtins["date"]
+	case "time without time zone", "time with time zone":
+		g = builtins["time"]
+	case "interval":
+		g = builtins["interval"]
+	case "json", "jsonb":
+		g = builtins["json"]
+	case "inet", "cidr":
+		g = builtins["ip"]
+	case "bytea":
+		g = builtins["bytes"]
+	default:
+		values, ok := enums[base]
+
+		if !ok {
+			return nil, fmt.Errorf("no generator for type %s, set one in the synth.columns section of project.yaml", typ)
+		}
+
+		g = func(r *rand.Rand, n int) *string {
+			return str(pick(r, values))
+		}
+	}
+
+	if unique && !slices.Contains(uniqueDefaultTypes, base) {
+		ug, ok := uniqueByType[base]
+
+		if !ok {
+			return nil, fmt.Errorf("no generator for unique values of type %s, set one (e.g. a pattern with {n}) in the synth.columns section of project.yaml", typ)
+		}
+
+		g = ug
+
+		if base == "numeric" && len(mods) > 0 {
+			scale := 0
+
+			if len(mods) > 1 {
+				scale = mods[1]
+			}
+
+			g = uniqueNumeric(scale)
+		}
+	}
+
+	if len(mods) > 0 && (base == "character varying" || base == "character") {
+		g = truncate(g, mods[0])
+	}
+
+	if array && unique {
+		g = singletonArrayOf(g)
+	} else if array {
+		g = arrayOf(g)
+	}
+
+	return g, nil
+}
+
+// Wraps the values of g in an array literal of 1 element, so that arrays are as unique as the values of g
+func singletonArrayOf(g Generator) Generator {
+	return func(r *rand.Rand, n int) *string {
+		v := g(r, n)
+
+		if v == nil {
+			return str("{NULL}")
+		}
+
+		return str(`{"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(*v) + `"}`)
+	}
+}
+
+// FromConfig returns the generator for a column override
+func FromConfig(cfg types.SynthColumn) (Generator, error) {
+	switch {
+	case cfg.Generator != "":
+		g, ok := builtins[cfg.Generator]
+
+		if !ok {
+			return nil, fmt.Errorf("unknown generator %s, must be one of %s", cfg.Generator, strings.Join(Builtins(), ", "))
+		}
+
+		return g, nil
+	case len(cfg.Values) > 0:
+		return func(r *rand.Rand, n int) *string {
+			return str(pick(r, cfg.Values))
+		}, nil
+	case cfg.Pattern != "":
+		return func(r *rand.Rand, n int) *string {
+			v := strings.ReplaceAll(cfg.Pattern, "{n}", strconv.Itoa(n))
+			return str(strings.ReplaceAll(v, "{rand}", randString(r, 8)))
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// UniqueConfig returns whether or not the generator of a column override never repeats a value
+func UniqueConfig(cfg types.SynthColumn) bool {
+	switch {
+	case cfg.Generator != "":
+		return slices.Contains(uniqueBuiltins, cfg.Generator)
+	case len(cfg.Values) > 0:
+		return false
+	default:
+		return strings.Contains(cfg.Pattern, "{n}")
+	}
+}
+
+// WithNulls returns NULL for a fraction of the rows and the value of g otherwise
+func WithNulls(g Generator, fraction float64) Generator {
+	if fraction <= 0 {
+		return g
+	}
+
+	return func(r *rand.Rand, n int) *string {
+		if r.Float64() < fraction {
+			return nil
+		}
+
+		return g(r, n)
+	}
+}
@@ -0,0 +1,127 @@
+package synth
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUniqueForType(t *testing.T) {
+	enums := map[string][]string{"vote_kind": {"up", "down"}}
+
+	for _, typ := range []string{"integer", "numeric(10,2)", "text", "character varying(32)", "uuid", "timestamp with time zone", "date", "interval", "inet", "bytea", "jsonb", "text[]"} {
+		g, err := UniqueForType(typ, enums)
+
+		if err != nil {
+			t.Errorf("UniqueForType(%q) failed: %v", typ, err)
+			continue
+		}
+
+		r := rand.New(rand.NewSource(1))
+		seen := map[string]int{}
+
+		for n := 0; n < 2000; n++ {
+			v := g(r, n)
+
+			if v == nil {
+				t.Fatalf("UniqueForType(%q) returned NULL for row %d", typ, n)
+			}
+
+			if prev, ok := seen[*v]; ok {
+				t.Errorf("UniqueForType(%q) returned %q for rows %d and %d", typ, *v, prev, n)
+				break
+			}
+
+			seen[*v] = n
+		}
+	}
+
+	for _, typ := range []string{"boolean", "vote_kind", "time without time zone"} {
+		if _, err := UniqueForType(typ, enums); err == nil {
+			t.Errorf("UniqueForType(%q) succeeded, want an error as the type cannot hold unique values", typ)
+		}
+	}
+}
+
+func TestUniqueForTypeBounds(t *testing.T) {
+	tests := []struct {
+		typ   string
+		limit int64
+		// Checks that a value fits in the type
+		fits func(v string) bool
+	}{
+		{"smallint", 32767, func(v string) bool {
+			n, err := strconv.Atoi(v)
+			return err == nil && n >= 1 && n <= 32767
+		}},
+		{"numeric(4,2)", 9999, func(v string) bool {
+			whole, frac, ok := strings.Cut(v, ".")
+			return ok && len(whole) <= 2 && len(frac) == 2
+		}},
+		{"numeric(3)", 999, func(v string) bool {
+			return len(v) <= 3 && !strings.Contains(v, ".")
+		}},
+		{"numeric(5,5)", 99999, func(v string) bool {
+			return strings.HasPrefix(v, "0.") && len(v) == 7
+		}},
+		{"character varying(2)", 100, func(v string) bool {
+			return len(v) <= 2
+		}},
+	}
+
+	for _, tt := range tests {
+		if got := UniqueLimit(tt.typ); got != tt.limit {
+			t.Errorf("UniqueLimit(%q) = %d, want %d", tt.typ, got, tt.limit)
+		}
+
+		g, err := UniqueForType(tt.typ, nil)
+
+		if err != nil {
+			t.Fatalf("UniqueForType(%q) failed: %v", tt.typ, err)
+		}
+
+		r := rand.New(rand.NewSource(1))
+		seen := map[string]bool{}
+
+		for n := 0; n < int(tt.limit); n++ {
+			v := *g(r, n)
+
+			if !tt.fits(v) {
+				t.Errorf("UniqueForType(%q) returned %q for row %d, which does not fit the type", tt.typ, v, n)
+				break
+			}
+
+			if seen[v] {
+				t.Errorf("UniqueForType(%q) returned %q twice within its limit of %d rows", tt.typ, v, tt.limit)
+				break
+			}
+
+			seen[v] = true
+		}
+	}
+
+	for _, typ := range []string{"bigint", "text", "numeric", "uuid", "timestamp with time zone"} {
+		if got := UniqueLimit(typ); got != 0 {
+			t.Errorf("UniqueLimit(%q) = %d, want 0 (no limit)", typ, got)
+		}
+	}
+}
+
+func TestForTypeSmallint(t *testing.T) {
+	g, err := ForType("smallint", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+
+	for _, n := range []int{0, 32766, 32767, 100000} {
+		v, err := strconv.Atoi(*g(r, n))
+
+		if err != nil || v < 1 || v > 32767 {
+			t.Errorf("ForType(smallint) returned %d for row %d, want a value in 1..32767", v, n)
+		}
+	}
+}
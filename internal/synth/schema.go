@@ -0,0 +1,273 @@
+package synth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+)
+
+// A foreign key of a table
+type ForeignKey struct {
+	Columns    []string
+	RefSchema  string
+	RefTable   string
+	RefColumns []string
+}
+
+// A table to fill along with the information needed to generate its rows
+type Table struct {
+	*dbparser.Table
+
+	// Columns filled by the database (generated, identity and serial columns)
+	Omit map[string]bool
+
+	// Columns of the primary key and unique indexes, a composite key is only unique as a whole
+	UniqueKeys [][]string
+
+	ForeignKeys []ForeignKey
+}
+
+// Returns schema.table
+func (t *Table) QualifiedName() string {
+	return t.Schema + "." + t.Name
+}
+
+// Returns whether or not name matches the table, name is either "table" or "schema.table"
+func (t *Table) Matches(name string) bool {
+	return name == t.QualifiedName() || (t.Schema == "public" && name == t.Name)
+}
+
+// Returns the foreign key a column is part of or nil
+func (t *Table) ForeignKey(column string) *ForeignKey {
+	for i := range t.ForeignKeys {
+		for _, c := range t.ForeignKeys[i].Columns {
+			if c == column {
+				return &t.ForeignKeys[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Inspect reads the tables of a database along with the column, unique index and foreign key
+// information needed to generate data. Partitions are left out as rows are inserted into their parents
+func Inspect(ctx context.Context, q dbparser.Querier, cat *dbparser.Catalog) ([]*Table, error) {
+	partitions := map[string]bool{}
+
+	rows, err := q.Query(ctx, `SELECT n.nspname || '.' || c.relname FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relispartition`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read partition: %w", err)
+		}
+
+		partitions[name] = true
+	}
+
+	rows.Close()
+
+	var tables []*Table
+	byName := map[string]*Table{}
+
+	for _, ct := range cat.Tables {
+		t := &Table{Table: ct, Omit: map[string]bool{}}
+
+		if partitions[t.QualifiedName()] {
+			continue
+		}
+
+		for _, c := range ct.Columns {
+			if c.Default != nil && strings.HasPrefix(*c.Default, "nextval(") {
+				t.Omit[c.Name] = true
+			}
+		}
+
+		tables = append(tables, t)
+		byName[t.QualifiedName()] = t
+	}
+
+	// Generated and identity columns
+	rows, err = q.Query(ctx, `SELECT n.nspname || '.' || c.relname, a.attname FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE a.attnum > 0 AND NOT a.attisdropped AND (a.attidentity <> '' OR a.attgenerated <> '')`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list generated columns: %w", err)
+	}
+
+	for rows.Next() {
+		var table, column string
+
+		err = rows.Scan(&table, &column)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read generated column: %w", err)
+		}
+
+		if t, ok := byName[table]; ok {
+			t.Omit[column] = true
+		}
+	}
+
+	rows.Close()
+
+	// Key columns of unique indexes, expression indexes are ignored and INCLUDE columns are not part of the key
+	rows, err = q.Query(ctx, `SELECT n.nspname || '.' || c.relname,
+ARRAY(SELECT a.attname::text FROM unnest(i.indkey::int2[]) WITH ORDINALITY k(num, ord) JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.num WHERE k.ord <= i.indnkeyatts ORDER BY k.ord)
+FROM pg_index i
+JOIN pg_class c ON c.oid = i.indrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE i.indisunique AND i.indexprs IS NULL
+ORDER BY 1, i.indexrelid`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unique indexes: %w", err)
+	}
+
+	for rows.Next() {
+		var table string
+		var columns []string
+
+		err = rows.Scan(&table, &columns)
+
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read unique index: %w", err)
+		}
+
+		if t, ok := byName[table]; ok {
+			t.UniqueKeys = append(t.UniqueKeys, columns)
+		}
+	}
+
+	rows.Close()
+
+	// Foreign keys
+	rows, err = q.Query(ctx, `SELECT tn.nspname || '.' || t.relname, rn.nspname, r.relname,
+ARRAY(SELECT a.attname::text FROM unnest(con.conkey) WITH ORDINALITY k(num, ord) JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.num ORDER BY k.ord),
+ARRAY(SELECT a.attname::text FROM unnest(con.confkey) WITH ORDINALITY k(num, ord) JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.num ORDER BY k.ord)
+FROM pg_constraint con
+JOIN pg_class t ON t.oid = con.conrelid
+JOIN pg_namespace tn ON tn.oid = t.relnamespace
+JOIN pg_class r ON r.oid = con.confrelid
+JOIN pg_namespace rn ON rn.oid = r.relnamespace
+WHERE con.contype = 'f'
+ORDER BY con.conname`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+		var fk ForeignKey
+
+		err = rows.Scan(&table, &fk.RefSchema, &fk.RefTable, &fk.Columns, &fk.RefColumns)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read foreign key: %w", err)
+		}
+
+		if t, ok := byName[table]; ok {
+			t.ForeignKeys = append(t.ForeignKeys, fk)
+		}
+	}
+
+	return tables, rows.Err()
+}
+
+// Returns whether or not the foreign key can be left NULL
+func (t *Table) nullable(fk ForeignKey) bool {
+	for _, c := range fk.Columns {
+		if col := t.Column(c); col != nil && col.NotNull {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Order sorts tables so that every table comes after the tables its NOT NULL foreign keys reference
+//
+// Nullable foreign keys to tables that come later (including the table itself) are left NULL
+func Order(tables []*Table) ([]*Table, error) {
+	byName := map[string]*Table{}
+
+	for _, t := range tables {
+		byName[t.QualifiedName()] = t
+	}
+
+	const (
+		visiting = iota + 1
+		done
+	)
+
+	state := map[string]int{}
+	var order []*Table
+
+	var visit func(t *Table, path []string) error
+	visit = func(t *Table, path []string) error {
+		name := t.QualifiedName()
+
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("foreign key cycle through NOT NULL columns: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+
+		for _, fk := range t.ForeignKeys {
+			ref, ok := byName[fk.RefSchema+"."+fk.RefTable]
+
+			if !ok || ref == t || t.nullable(fk) {
+				continue
+			}
+
+			err := visit(ref, append(path, name))
+
+			if err != nil {
+				return err
+			}
+		}
+
+		state[name] = done
+		order = append(order, t)
+		return nil
+	}
+
+	sorted := append([]*Table{}, tables...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].QualifiedName() < sorted[j].QualifiedName()
+	})
+
+	for _, t := range sorted {
+		err := visit(t, nil)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
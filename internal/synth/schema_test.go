@@ -0,0 +1,106 @@
+package synth
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/InfinityBotList/ibldev/internal/agents/dbparser"
+)
+
+// Returns a table with a NOT NULL id column and a column per foreign key, nullable when the key is listed in nullable
+func testTable(name string, refs []string, nullable []string) *Table {
+	t := &Table{Table: &dbparser.Table{Schema: "public", Name: name, Columns: []dbparser.Column{{Name: "id", Type: "bigint", NotNull: true}}}}
+
+	for _, ref := range refs {
+		col := ref + "_id"
+
+		t.Columns = append(t.Columns, dbparser.Column{Name: col, Type: "bigint", NotNull: !slices.Contains(nullable, ref)})
+		t.ForeignKeys = append(t.ForeignKeys, ForeignKey{Columns: []string{col}, RefSchema: "public", RefTable: ref, RefColumns: []string{"id"}})
+	}
+
+	return t
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		tables []*Table
+		// Qualified names in order, nil if Order must fail
+		order []string
+	}{
+		{
+			name: "referenced tables come first",
+			tables: []*Table{
+				testTable("votes", []string{"bots", "users"}, nil),
+				testTable("bots", []string{"users"}, nil),
+				testTable("users", nil, nil),
+			},
+			order: []string{"public.users", "public.bots", "public.votes"},
+		},
+		{
+			name: "tables without dependencies are sorted by name",
+			tables: []*Table{
+				testTable("zebras", nil, nil),
+				testTable("apples", nil, nil),
+			},
+			order: []string{"public.apples", "public.zebras"},
+		},
+		{
+			name: "nullable foreign keys do not order tables",
+			tables: []*Table{
+				testTable("users", []string{"teams"}, []string{"teams"}),
+				testTable("teams", []string{"users"}, nil),
+			},
+			order: []string{"public.users", "public.teams"},
+		},
+		{
+			name: "self references are ignored",
+			tables: []*Table{
+				testTable("comments", []string{"comments"}, nil),
+			},
+			order: []string{"public.comments"},
+		},
+		{
+			name: "foreign keys to other tables are ignored",
+			tables: []*Table{
+				testTable("votes", []string{"skipped"}, nil),
+			},
+			order: []string{"public.votes"},
+		},
+		{
+			name: "NOT NULL cycles fail",
+			tables: []*Table{
+				testTable("users", []string{"teams"}, nil),
+				testTable("teams", []string{"users"}, nil),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables, err := Order(tt.tables)
+
+			if tt.order == nil {
+				if err == nil {
+					t.Fatal("Order succeeded, want a cycle error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Order failed: %v", err)
+			}
+
+			var got []string
+
+			for _, table := range tables {
+				got = append(got, table.QualifiedName())
+			}
+
+			if !slices.Equal(got, tt.order) {
+				t.Errorf("Order = %v, want %v", got, tt.order)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package types
+
+// Drill represents the format of the `ibl db drill` config
+type Drill struct {
+	Checks []DrillCheck `yaml:"checks" validate:"dive"` // Queries to run against the restored database
+}
+
+// DrillCheck represents a check query run against a restored database
+//
+// The check passes if the query succeeds and, if Expect is set, the first column of the first row equals Expect
+type DrillCheck struct {
+	Name   string `yaml:"name" validate:"required"`
+	Query  string `yaml:"query" validate:"required"`
+	Expect string `yaml:"expect"`
+}
@@ -2,5 +2,10 @@ package types
 
 // IBLProject represents the format of a ibl project.yaml file
 type IBLProject struct {
-	TypeGen *TypeGen `yaml:"typegen"` // `ibl typegen` config
+	TypeGen    *TypeGen    `yaml:"typegen"`    // `ibl typegen` config
+	PIIScan    *PIIScan    `yaml:"pii_scan"`   // `ibl db new staging/seed` PII scan config
+	Drill      *Drill      `yaml:"drill"`      // `ibl db drill` config
+	Migrations *Migrations `yaml:"migrations"` // `ibl db migrate` config
+	Synth      *Synth      `yaml:"synth"`      // `ibl db synth` config
+	DbTypeGen  *DbTypeGen  `yaml:"db_typegen"` // `ibl db typegen` config
 }
@@ -0,0 +1,7 @@
+package types
+
+// Migrations represents the format of the `ibl db migrate` config
+type Migrations struct {
+	Dir      string `yaml:"dir" validate:"required"` // Directory containing NNNN_name.up.sql/NNNN_name.down.sql files
+	Database string `yaml:"database"`                // Database to migrate, defaults to infinity
+}
@@ -0,0 +1,37 @@
+package types
+
+// PIIScan represents the format of the PII scan config used by `ibl db new staging/seed`
+type PIIScan struct {
+	// Extra detectors to run on top of the builtin ones
+	Detectors []PIIDetector `yaml:"detectors" validate:"dive"`
+
+	// Column name patterns (e.g. *token*) whose values are always reported.
+	// Defaults to *token*, *secret*, *password* and *api_key* if unset
+	Columns []string `yaml:"columns"`
+
+	// Minimum shannon entropy (bits per char) for the high entropy detector, defaults to 4.3
+	MinEntropy float64 `yaml:"min_entropy"`
+
+	// Minimum length of a string for the high entropy detector, defaults to 32
+	MinEntropyLength int `yaml:"min_entropy_length"`
+
+	// Findings that are known to be safe
+	Allowlist []PIIAllow `yaml:"allowlist" validate:"dive"`
+}
+
+// PIIDetector represents a custom regex detector
+type PIIDetector struct {
+	Name  string `yaml:"name" validate:"required"`
+	Regex string `yaml:"regex" validate:"required"`
+}
+
+// PIIAllow represents an allowlisted finding
+//
+// Table may be either "table" or "schema.table". Empty Column/Detector/Hash match anything
+type PIIAllow struct {
+	Table    string `yaml:"table" validate:"required"`
+	Column   string `yaml:"column"`
+	Detector string `yaml:"detector"`
+	Hash     string `yaml:"hash"`
+	Reason   string `yaml:"reason"`
+}
@@ -0,0 +1,30 @@
+package types
+
+// Synth represents the format of the `ibl db synth` config
+type Synth struct {
+	// Row counts of specific tables, overriding --rows. Keys are "table" or "schema.table"
+	Rows map[string]int `yaml:"rows"`
+
+	// Tables to leave empty. Entries are "table" or "schema.table"
+	Skip []string `yaml:"skip"`
+
+	// Generator overrides, keyed by "table.column" or "schema.table.column"
+	Columns map[string]SynthColumn `yaml:"columns" validate:"dive"`
+}
+
+// SynthColumn represents the generator override of a single column
+//
+// Exactly one of Generator, Values or Pattern should be set
+type SynthColumn struct {
+	// A builtin generator, see `ibl db synth --help` for the list
+	Generator string `yaml:"generator"`
+
+	// Pick one of these values at random
+	Values []string `yaml:"values"`
+
+	// A pattern where {n} is replaced with the row number and {rand} with a random string
+	Pattern string `yaml:"pattern"`
+
+	// Fraction (0-1) of rows that get NULL, only used for nullable columns
+	NullFraction float64 `yaml:"null_fraction" validate:"gte=0,lte=1"`
+}
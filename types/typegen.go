@@ -5,3 +5,18 @@ type TypeGen struct {
 	Path     string   `yaml:"path" validate:"required"`     // Path to copy types from
 	Projects []string `yaml:"projects" validate:"required"` // List of projects to copy types to
 }
+
+// DbTypeGen represents the format of the `ibl db typegen` config
+type DbTypeGen struct {
+	Database string           `yaml:"database"` // Database to read the schema of, defaults to infinity
+	Skip     []string         `yaml:"skip"`     // Tables and views to leave out, entries are "table" or "schema.table"
+	Go       *DbTypeGenTarget `yaml:"go"`       // Output of --lang go
+	TS       *DbTypeGenTarget `yaml:"ts"`       // Output of --lang ts
+}
+
+// DbTypeGenTarget represents the output of a single `ibl db typegen` language
+type DbTypeGenTarget struct {
+	Path    string `yaml:"path" validate:"required"` // File to write the types to
+	Package string `yaml:"package"`                  // Go package name, defaults to the name of the directory of path
+	PgType  bool   `yaml:"pgtype"`                   // Use pgtype types for nullable columns instead of pointers (go only)
+}